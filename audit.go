@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditRestore = "restore"
+	auditPurge   = "purge"
+)
+
+const anonymousActor = "anonymous"
+
+// systemActor is recorded for changes made by the server itself, such as
+// the purge job.
+const systemActor = "system"
+
+// AuditEntry records one change made to a patient. The repository writes
+// it together with the change, so neither is saved without the other.
+// Entries are only ever appended, and they outlive the patient they
+// describe.
+type AuditEntry struct {
+	bun.BaseModel `bun:"table:patient_audit"`
+
+	Id        int           `json:"id" bun:"id,pk,autoincrement"`
+	PatientId int           `json:"patientId" bun:"patient_id"`
+	Actor     string        `json:"actor" bun:"actor"`
+	Action    string        `json:"action" bun:"action"`
+	At        time.Time     `json:"at" bun:"at"`
+	Changes   []FieldChange `json:"changes" bun:"changes,type:jsonb"`
+}
+
+// FieldChange is the value of one field before and after a change. Before
+// is left out for a create and After for a delete.
+type FieldChange struct {
+	Field  string `json:"field"`
+	Before any    `json:"before,omitempty"`
+	After  any    `json:"after,omitempty"`
+}
+
+// newAuditEntry describes a change to a patient made on behalf of the
+// actor in ctx.
+func newAuditEntry(ctx context.Context, patientId int, action string, at time.Time, changes []FieldChange) AuditEntry {
+	return AuditEntry{
+		PatientId: patientId,
+		Actor:     actorFromContext(ctx),
+		Action:    action,
+		At:        at,
+		Changes:   changes,
+	}
+}
+
+// auditChanges lists the client-editable fields that differ between before
+// and after. A nil side stands for a patient that does not exist, so every
+// field of the other side is listed.
+func auditChanges(before, after *Patient) []FieldChange {
+	changes := make([]FieldChange, 0)
+	for _, c := range patientColumns {
+		var change FieldChange
+		change.Field = c.name
+		if before != nil {
+			change.Before = c.get(before)
+		}
+		if after != nil {
+			change.After = c.get(after)
+		}
+		if before != nil && after != nil && change.Before == change.After {
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+type actorKey struct{}
+
+// withActor returns a copy of ctx that attributes changes to actor.
+func withActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return anonymousActor
+}
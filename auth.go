@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	authMethodJWT    = "jwt"
+	authMethodAPIKey = "api-key"
+)
+
+const (
+	msgAuthRequired       = "authentication required, send an Authorization: Bearer <token> or X-API-Key header"
+	msgInvalidCredentials = "invalid or expired credentials"
+)
+
+var errNoCredentials = errors.New("no credentials")
+
+const apiKeyHeader = "X-API-Key"
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	// Subject is the JWT sub claim or the name of the API key.
+	Subject string
+	Method  string
+	Roles   []string
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+func principalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// authenticator checks the credentials of a request: a JWT signed with
+// HS256 using a shared secret or RS256 using a key from a JWKS, or a
+// static API key.
+type authenticator struct {
+	hmacSecret []byte
+	jwks       *jwks
+	issuer     string
+	audience   string
+	rolesClaim string
+	apiKeys    []apiKey
+}
+
+type apiKey struct {
+	name  string
+	hash  [sha256.Size]byte
+	roles []string
+}
+
+// jwtLeeway allows for clock skew between the token issuer and this server.
+const jwtLeeway = 30 * time.Second
+
+func newAuthenticator(ctx context.Context, cfg AuthConfig) (*authenticator, error) {
+	a := &authenticator{
+		hmacSecret: []byte(cfg.JWTSecret),
+		issuer:     cfg.JWTIssuer,
+		audience:   cfg.JWTAudience,
+		rolesClaim: cfg.JWTRolesClaim,
+	}
+	if cfg.JWKS != "" {
+		keys, err := loadJWKS(ctx, cfg.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		a.jwks = keys
+	}
+	for _, k := range cfg.APIKeys {
+		a.apiKeys = append(a.apiKeys, apiKey{name: k.Name, hash: sha256.Sum256([]byte(k.Key)), roles: k.Roles})
+	}
+	return a, nil
+}
+
+// authenticate returns the caller of req, or errNoCredentials when it
+// carries none. allowQueryToken also accepts a bearer token in the
+// access_token query parameter, for browsers opening a WebSocket, which
+// cannot set headers.
+func (a *authenticator) authenticate(req *http.Request, allowQueryToken bool) (Principal, error) {
+	if key := req.Header.Get(apiKeyHeader); key != "" {
+		return a.authenticateAPIKey(key)
+	}
+
+	token := ""
+	if scheme, credentials, ok := strings.Cut(req.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		token = strings.TrimSpace(credentials)
+	} else if allowQueryToken {
+		token = req.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		return Principal{}, errNoCredentials
+	}
+	return a.authenticateJWT(req.Context(), token)
+}
+
+func (a *authenticator) authenticateAPIKey(key string) (Principal, error) {
+	hash := sha256.Sum256([]byte(key))
+	for _, k := range a.apiKeys {
+		if subtle.ConstantTimeCompare(hash[:], k.hash[:]) == 1 {
+			return Principal{Subject: k.name, Method: authMethodAPIKey, Roles: k.roles}, nil
+		}
+	}
+	return Principal{}, errors.New("unknown API key")
+}
+
+func (a *authenticator) authenticateJWT(ctx context.Context, token string) (Principal, error) {
+	var methods []string
+	if len(a.hmacSecret) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if a.jwks != nil {
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+	if len(methods) == 0 {
+		return Principal{}, errors.New("bearer tokens are not accepted")
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(jwtLeeway),
+	}
+	if a.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.issuer))
+	}
+	if a.audience != "" {
+		opts = append(opts, jwt.WithAudience(a.audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (any, error) {
+		if t.Method == jwt.SigningMethodHS256 {
+			return a.hmacSecret, nil
+		}
+		kid, _ := t.Header["kid"].(string)
+		return a.jwks.key(ctx, kid)
+	}, opts...)
+	if err != nil {
+		return Principal{}, err
+	}
+	subject, err := claims.GetSubject()
+	if err != nil {
+		return Principal{}, err
+	}
+	if subject == "" {
+		return Principal{}, errors.New("token has no subject")
+	}
+	return Principal{Subject: subject, Method: authMethodJWT, Roles: claimRoles(claims, a.rolesClaim)}, nil
+}
+
+// claimRoles reads the roles from the claim at path, where dots lead into
+// nested objects as in Keycloak's realm_access.roles. The claim may be a
+// list of strings or a single space separated string. A token without the
+// claim has no roles.
+func claimRoles(claims jwt.MapClaims, path string) []string {
+	var value any = map[string]any(claims)
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = obj[name]
+	}
+
+	switch v := value.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		var names []string
+		for _, item := range v {
+			if name, ok := item.(string); ok {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+// writeUnauthorized answers a request that could not be authenticated.
+func writeUnauthorized(w http.ResponseWriter, err error) {
+	if errors.Is(err, errNoCredentials) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="patients"`)
+		writeErrResponse(w, http.StatusUnauthorized, errResponse{Messages: []string{msgAuthRequired}})
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="patients", error="invalid_token"`)
+	writeErrResponse(w, http.StatusUnauthorized, errResponse{Messages: []string{msgInvalidCredentials}})
+}
+
+// middleware rejects requests without valid credentials and attaches the
+// principal, which is also the actor recorded in the audit log.
+func (a *authenticator) middleware(allowQueryToken bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			principal, err := a.authenticate(req, allowQueryToken)
+			if err != nil {
+				writeUnauthorized(w, err)
+				return
+			}
+
+			ctx := withPrincipal(req.Context(), principal)
+			ctx = withActor(ctx, principal.Subject)
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
+
+// jwksRefreshInterval is how often keys from a JWKS URL are fetched again,
+// and jwksMinRefreshInterval how soon a token with an unknown key id may
+// cause an early fetch, so that rotated keys are picked up without letting
+// made-up key ids hammer the identity provider.
+const (
+	jwksRefreshInterval    = time.Hour
+	jwksMinRefreshInterval = time.Minute
+)
+
+// jwks holds the RSA public keys of a JSON Web Key Set read from a file or
+// an http(s) URL.
+type jwks struct {
+	source string
+	client *http.Client
+
+	// mu guards the fields below. It is never held while the set is
+	// fetched, so requests with known keys are not held up by a refresh.
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+
+	// refreshing, while a fetch is in flight, is closed when it is done,
+	// so that concurrent refreshes wait for it instead of fetching again.
+	refreshing chan struct{}
+}
+
+func loadJWKS(ctx context.Context, source string) (*jwks, error) {
+	k := &jwks{source: source, client: &http.Client{Timeout: 10 * time.Second}}
+	if err := k.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *jwks) remote() bool {
+	return strings.HasPrefix(k.source, "http://") || strings.HasPrefix(k.source, "https://")
+}
+
+// key returns the key with id kid. A token without a kid can only be
+// checked against a set with a single key.
+func (k *jwks) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	if k.remote() {
+		k.mu.Lock()
+		age := time.Since(k.fetchedAt)
+		_, known := k.keys[kid]
+		inFlight := k.refreshing != nil
+		k.mu.Unlock()
+		// an unknown key id also waits for a fetch already in flight,
+		// which may bring the key
+		if age > jwksRefreshInterval || (!known && (inFlight || age > jwksMinRefreshInterval)) {
+			// a failed refresh keeps the keys already loaded
+			_ = k.refresh(ctx)
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, nil
+		}
+	}
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+// refresh fetches the set again, or waits for the fetch already in
+// flight. The fetch outlives the ctx of the request that started it, as
+// other requests may be waiting for it.
+func (k *jwks) refresh(ctx context.Context) error {
+	k.mu.Lock()
+	if done := k.refreshing; done != nil {
+		k.mu.Unlock()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	done := make(chan struct{})
+	k.refreshing = done
+	k.fetchedAt = time.Now()
+	k.mu.Unlock()
+
+	keys, err := k.fetch(context.WithoutCancel(ctx))
+
+	k.mu.Lock()
+	if err == nil {
+		k.keys = keys
+	}
+	k.refreshing = nil
+	k.mu.Unlock()
+	close(done)
+	return err
+}
+
+func (k *jwks) fetch(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	data, err := k.read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("jwks %s: %w", k.source, err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, fmt.Errorf("jwks %s: %w", k.source, err)
+	}
+	return keys, nil
+}
+
+func (k *jwks) read(ctx context.Context) ([]byte, error) {
+	if !k.remote() {
+		return os.ReadFile(k.source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, 1<<20))
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// parseJWKS reads the RSA signing keys from a JWKS document and skips any
+// other keys it contains.
+func parseJWKS(data []byte) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") || (jwk.Alg != "" && jwk.Alg != "RS256") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: modulus: %w", jwk.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: exponent: %w", jwk.Kid, err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("key %q: unsupported exponent", jwk.Kid)
+		}
+		modulus := new(big.Int).SetBytes(n)
+		if modulus.BitLen() < 2048 {
+			return nil, fmt.Errorf("key %q: RSA keys should be at least 2048 bits", jwk.Kid)
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: modulus, E: int(exponent.Int64())}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no RS256 signing keys")
+	}
+	return keys, nil
+}
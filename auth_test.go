@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testJWTSecret = "0123456789abcdef0123456789abcdef"
+	testAPIKey    = "ci-0123456789abcdef0123456789abcdef"
+)
+
+func testJWKS(t *testing.T, keys map[string]*rsa.PrivateKey) []byte {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	for kid, key := range keys {
+		set.Keys = append(set.Keys, jsonWebKey{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatalf("failed to encode jwks: %v", err)
+	}
+	return data
+}
+
+// testClaims are the registered claims plus the default roles claim.
+type testClaims struct {
+	jwt.RegisteredClaims
+	Roles []string `json:"roles,omitempty"`
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, key any, kid string, claims jwt.Claims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func TestAuth_authenticate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, testJWKS(t, map[string]*rsa.PrivateKey{"key-1": rsaKey}), 0o600); err != nil {
+		t.Fatalf("failed to write jwks: %v", err)
+	}
+
+	auth, err := newAuthenticator(context.Background(), AuthConfig{
+		JWTSecret:     testJWTSecret,
+		JWKS:          jwksFile,
+		JWTIssuer:     "https://id.example.com",
+		JWTAudience:   "patients",
+		JWTRolesClaim: "roles",
+		APIKeys:       []APIKeyConfig{{Name: "ci", Key: testAPIKey, Roles: []string{roleAdmin}}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+
+	valid := jwt.RegisteredClaims{
+		Subject:   "dr-who",
+		Issuer:    "https://id.example.com",
+		Audience:  jwt.ClaimStrings{"patients"},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+	expired := valid
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	wrongAudience := valid
+	wrongAudience.Audience = jwt.ClaimStrings{"billing"}
+	noExpiry := valid
+	noExpiry.ExpiresAt = nil
+	withRoles := testClaims{RegisteredClaims: valid, Roles: []string{roleClinician, roleAuditor}}
+
+	tests := []struct {
+		name          string
+		header        string
+		value         string
+		wantPrincipal Principal
+		wantStatus    int
+		wantMessage   string
+	}{
+		{
+			name:          "hs256 token :POS",
+			header:        "Authorization",
+			value:         "Bearer " + signToken(t, jwt.SigningMethodHS256, []byte(testJWTSecret), "", valid),
+			wantPrincipal: Principal{Subject: "dr-who", Method: authMethodJWT},
+		},
+		{
+			name:          "rs256 token from jwks :POS",
+			header:        "Authorization",
+			value:         "Bearer " + signToken(t, jwt.SigningMethodRS256, rsaKey, "key-1", valid),
+			wantPrincipal: Principal{Subject: "dr-who", Method: authMethodJWT},
+		},
+		{
+			name:          "token with roles :POS",
+			header:        "Authorization",
+			value:         "Bearer " + signToken(t, jwt.SigningMethodHS256, []byte(testJWTSecret), "", withRoles),
+			wantPrincipal: Principal{Subject: "dr-who", Method: authMethodJWT, Roles: []string{roleClinician, roleAuditor}},
+		},
+		{
+			name:          "api key :POS",
+			header:        apiKeyHeader,
+			value:         testAPIKey,
+			wantPrincipal: Principal{Subject: "ci", Method: authMethodAPIKey, Roles: []string{roleAdmin}},
+		},
+		{
+			name:        "no credentials :NEG",
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: msgAuthRequired,
+		},
+		{
+			name:        "expired token :NEG",
+			header:      "Authorization",
+			value:       "Bearer " + signToken(t, jwt.SigningMethodHS256, []byte(testJWTSecret), "", expired),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: msgInvalidCredentials,
+		},
+		{
+			name:        "token without expiry :NEG",
+			header:      "Authorization",
+			value:       "Bearer " + signToken(t, jwt.SigningMethodHS256, []byte(testJWTSecret), "", noExpiry),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: msgInvalidCredentials,
+		},
+		{
+			name:        "wrong audience :NEG",
+			header:      "Authorization",
+			value:       "Bearer " + signToken(t, jwt.SigningMethodHS256, []byte(testJWTSecret), "", wrongAudience),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: msgInvalidCredentials,
+		},
+		{
+			name:        "token signed with unknown key :NEG",
+			header:      "Authorization",
+			value:       "Bearer " + signToken(t, jwt.SigningMethodRS256, otherKey, "key-1", valid),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: msgInvalidCredentials,
+		},
+		{
+			name:        "unsigned token :NEG",
+			header:      "Authorization",
+			value:       "Bearer " + signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", valid),
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: msgInvalidCredentials,
+		},
+		{
+			name:        "unknown api key :NEG",
+			header:      apiKeyHeader,
+			value:       "ci-guessed",
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: msgInvalidCredentials,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPrincipal Principal
+			var gotActor string
+			handler := auth.middleware(false)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				gotPrincipal, _ = principalFromContext(req.Context())
+				gotActor = actorFromContext(req.Context())
+			}))
+
+			req := httptest.NewRequest("GET", "/api/patients", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+
+			if tt.wantStatus == 0 {
+				assert.Equal(t, http.StatusOK, res.Code, "expect request to be let through")
+				assert.Equal(t, tt.wantPrincipal, gotPrincipal, "expect principal to match")
+				assert.Equal(t, tt.wantPrincipal.Subject, gotActor, "expect principal to be the audit actor")
+				return
+			}
+			assert.Equal(t, tt.wantStatus, res.Code, "expect status code to match")
+			assert.Contains(t, res.Header().Get("WWW-Authenticate"), "Bearer", "expect challenge")
+			assert.JSONEq(t, `{"messages": ["`+tt.wantMessage+`"]}`, res.Body.String(), "expect response to match")
+		})
+	}
+}
+
+func TestAuth_jwksRotation(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	keys := map[string]*rsa.PrivateKey{"old": oldKey}
+	fetches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fetches++
+		w.Write(testJWKS(t, keys))
+	}))
+	defer ts.Close()
+
+	auth, err := newAuthenticator(context.Background(), AuthConfig{JWKS: ts.URL})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+	claims := jwt.RegisteredClaims{Subject: "dr-who", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+	authenticate := func(token string) error {
+		req := httptest.NewRequest("GET", "/api/patients", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		_, err := auth.authenticate(req, false)
+		return err
+	}
+
+	assert.NoError(t, authenticate(signToken(t, jwt.SigningMethodRS256, oldKey, "old", claims)), "expect current key to be accepted")
+
+	keys = map[string]*rsa.PrivateKey{"old": oldKey, "new": newKey}
+	rotated := signToken(t, jwt.SigningMethodRS256, newKey, "new", claims)
+	assert.Error(t, authenticate(rotated), "expect new key to wait for the minimum refresh interval")
+	assert.Equal(t, 1, fetches, "expect no refetch straight after loading")
+
+	auth.jwks.fetchedAt = time.Now().Add(-jwksMinRefreshInterval - time.Second)
+	assert.NoError(t, authenticate(rotated), "expect unknown key id to refetch the set")
+	assert.Equal(t, 2, fetches, "expect one refetch")
+}
+
+// TestAuth_jwksRefreshUnlocked checks that a slow JWKS fetch holds up
+// neither tokens signed with known keys nor causes a second fetch.
+func TestAuth_jwksRefreshUnlocked(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	var fetches atomic.Int32
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if fetches.Add(1) == 1 {
+			w.Write(testJWKS(t, map[string]*rsa.PrivateKey{"old": oldKey}))
+			return
+		}
+		close(fetching)
+		<-release
+		w.Write(testJWKS(t, map[string]*rsa.PrivateKey{"old": oldKey, "new": newKey}))
+	}))
+	defer ts.Close()
+
+	auth, err := newAuthenticator(context.Background(), AuthConfig{JWKS: ts.URL})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+	claims := jwt.RegisteredClaims{Subject: "dr-who", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+	authenticate := func(token string) error {
+		req := httptest.NewRequest("GET", "/api/patients", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		_, err := auth.authenticate(req, false)
+		return err
+	}
+	rotated := signToken(t, jwt.SigningMethodRS256, newKey, "new", claims)
+
+	auth.jwks.fetchedAt = time.Now().Add(-jwksMinRefreshInterval - time.Second)
+	rotatedErrs := make(chan error, 2)
+	go func() { rotatedErrs <- authenticate(rotated) }()
+	<-fetching
+	go func() { rotatedErrs <- authenticate(rotated) }()
+
+	known := make(chan error, 1)
+	go func() { known <- authenticate(signToken(t, jwt.SigningMethodRS256, oldKey, "old", claims)) }()
+	select {
+	case err := <-known:
+		assert.NoError(t, err, "expect known key to be accepted")
+	case <-time.After(5 * time.Second):
+		t.Error("expect known key not to wait for the fetch")
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, <-rotatedErrs, "expect new key once fetched")
+	}
+	assert.Equal(t, int32(2), fetches.Load(), "expect a single refetch")
+}
+
+func TestAuth_routes(t *testing.T) {
+	auth, err := newAuthenticator(context.Background(), AuthConfig{
+		JWTSecret:     testJWTSecret,
+		JWTRolesClaim: "roles",
+		APIKeys:       []APIKeyConfig{{Name: "ci", Key: testAPIKey, Roles: []string{roleAdmin}}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+	repo := newInMemoryRepository()
+	service := newPatientsService(repo)
+	httpTransport := newHttpTransport(service)
+	httpTransport.auth = auth
+	ts := httptest.NewServer(buildRoutes(httpTransport))
+	defer ts.Close()
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", path, err)
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode, "expect %s to be open", path)
+	}
+
+	res, err := http.Get(ts.URL + "/api/patients")
+	if err != nil {
+		t.Fatalf("failed to list patients: %v", err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "expect patients to need credentials")
+
+	// X-Actor is ignored once callers are authenticated
+	body := `{"name": "priya", "address": "surat", "disease": "cold", "phone": "+919876543210", "dateOfBirth": "2024-02-12"}`
+	req, _ := http.NewRequest("POST", ts.URL+"/api/patients", strings.NewReader(body))
+	req.Header.Set(apiKeyHeader, testAPIKey)
+	req.Header.Set("X-Actor", "someone else")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to create patient: %v", err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode, "expect api key to be accepted")
+	if assert.Len(t, repo.audit, 1, "expect create to be audited") {
+		assert.Equal(t, "ci", repo.audit[0].Actor, "expect actor to be the api key name")
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/websocket"
+	_, res, err = websocket.DefaultDialer.Dial(wsURL, nil)
+	assert.Error(t, err, "expect upgrade without credentials to fail")
+	if assert.NotNil(t, res, "expect a response") {
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "expect upgrade to be rejected")
+	}
+
+	token := signToken(t, jwt.SigningMethodHS256, []byte(testJWTSecret), "", testClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "dr-who", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		Roles:            []string{roleClinician},
+	})
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?access_token="+token, nil)
+	if assert.NoError(t, err, "expect token in query to be accepted for websocket") {
+		conn.Close()
+	}
+}
+
+func TestAuth_claimRoles(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims string
+		path   string
+		want   []string
+	}{
+		{name: "list :POS", claims: `{"roles": ["admin", "auditor"]}`, path: "roles", want: []string{"admin", "auditor"}},
+		{name: "space separated string :POS", claims: `{"scope": "clinician auditor"}`, path: "scope", want: []string{"clinician", "auditor"}},
+		{name: "nested claim :POS", claims: `{"realm_access": {"roles": ["receptionist"]}}`, path: "realm_access.roles", want: []string{"receptionist"}},
+		{name: "missing claim :NEG", claims: `{"sub": "dr-who"}`, path: "roles"},
+		{name: "path through a string :NEG", claims: `{"realm_access": "admin"}`, path: "realm_access.roles"},
+		{name: "not strings :NEG", claims: `{"roles": [1, {"name": "admin"}]}`, path: "roles"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := jwt.MapClaims{}
+			if err := json.Unmarshal([]byte(tt.claims), &claims); err != nil {
+				t.Fatalf("failed to decode claims: %v", err)
+			}
+			assert.Equal(t, tt.want, claimRoles(claims, tt.path), "expect roles to match")
+		})
+	}
+}
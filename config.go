@@ -0,0 +1,523 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds everything that differs between deployments. Each setting
+// is read from, in increasing order of precedence, the defaults below, a
+// YAML config file, a PATIENTS_* environment variable and a command-line
+// flag.
+type Config struct {
+	ListenAddr      string         `yaml:"listenAddr"`
+	ShutdownTimeout time.Duration  `yaml:"shutdownTimeout"`
+	Database        DatabaseConfig `yaml:"database"`
+	AllowClientIds  bool           `yaml:"allowClientIds"`
+	TrashRetention  time.Duration  `yaml:"trashRetention"`
+	PurgeInterval   time.Duration  `yaml:"purgeInterval"`
+	LegacyDates     bool           `yaml:"legacyDates"`
+	PhoneRegion     string         `yaml:"phoneRegion"`
+	AutoMigrate     bool           `yaml:"autoMigrate"`
+	LogLevel        string         `yaml:"logLevel"`
+	LogFormat       string         `yaml:"logFormat"`
+
+	// TracingEndpoint is the OTLP/HTTP collector spans are sent to, such as
+	// http://localhost:4318. Tracing is off when it is empty.
+	TracingEndpoint    string  `yaml:"tracingEndpoint"`
+	TracingSampleRatio float64 `yaml:"tracingSampleRatio"`
+
+	Auth AuthConfig `yaml:"auth"`
+
+	Subscribers SubscriberConfig `yaml:"subscribers"`
+
+	// EncryptionKeyFile holds the keys that encrypt disease, address and
+	// phone at rest. They are stored in plaintext when it is empty.
+	EncryptionKeyFile string `yaml:"encryptionKeyFile"`
+}
+
+// SubscriberConfig limits what a WebSocket client that reads too slowly can
+// cost. Each client has its own queue of notifications waiting to be sent,
+// so it never holds up the requests that cause them.
+type SubscriberConfig struct {
+	QueueSize int `yaml:"queueSize"`
+
+	// Overflow is what happens to a client whose queue is full: the oldest
+	// notification is dropped, or the client is disconnected.
+	Overflow string `yaml:"overflow"`
+
+	// WriteTimeout is how long sending one notification may take before
+	// the client is disconnected.
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+
+	// PingInterval is how often the client is pinged. A client that sends
+	// nothing, not even a pong, for IdleTimeout is taken to be gone and is
+	// disconnected.
+	PingInterval time.Duration `yaml:"pingInterval"`
+	IdleTimeout  time.Duration `yaml:"idleTimeout"`
+
+	// MaxMessageSize is the largest message in bytes a client may send.
+	MaxMessageSize int `yaml:"maxMessageSize"`
+
+	// ReplaySize is how many of the latest changes are kept for clients
+	// that reconnect. It is at most QueueSize, since a longer replay would
+	// overflow the queue.
+	ReplaySize int `yaml:"replaySize"`
+}
+
+// AuthConfig lists the credentials callers of the API may present. At
+// least one kind has to be configured unless auth is disabled, which is
+// only meant for local development.
+type AuthConfig struct {
+	Disabled bool `yaml:"disabled"`
+
+	// JWTSecret verifies HS256 tokens and JWKS, a file or an http(s) URL,
+	// holds the keys for RS256 tokens. Issuer and audience are checked
+	// when set.
+	JWTSecret   string `yaml:"jwtSecret"`
+	JWKS        string `yaml:"jwks"`
+	JWTIssuer   string `yaml:"jwtIssuer"`
+	JWTAudience string `yaml:"jwtAudience"`
+
+	// JWTRolesClaim is the claim holding the roles of a token's subject.
+	// Dots lead into nested objects.
+	JWTRolesClaim string `yaml:"jwtRolesClaim"`
+
+	APIKeys []APIKeyConfig `yaml:"apiKeys"`
+}
+
+// APIKeyConfig is a static key sent in the X-API-Key header. Name is
+// recorded as the actor of the changes made with it.
+type APIKeyConfig struct {
+	Name  string   `yaml:"name"`
+	Key   string   `yaml:"key"`
+	Roles []string `yaml:"roles"`
+}
+
+// minJWTSecretLength is the HS256 key size recommended by RFC 7518, and
+// API keys are held to the same length.
+const (
+	minJWTSecretLength = 32
+	minAPIKeyLength    = 32
+)
+
+type DatabaseConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+
+	// SSLMode takes the libpq sslmode values. With verify-ca and
+	// verify-full the server certificate is checked against SSLRootCert,
+	// or the system roots when it is empty.
+	SSLMode     string `yaml:"sslMode"`
+	SSLRootCert string `yaml:"sslRootCert"`
+}
+
+const configFileEnv = "PATIENTS_CONFIG"
+
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// defaultConfig matches the local development setup described in the
+// README.
+func defaultConfig() Config {
+	return Config{
+		ListenAddr:      ":8000",
+		ShutdownTimeout: 15 * time.Second,
+		Database: DatabaseConfig{
+			Host:     "localhost",
+			Port:     5432,
+			User:     "postgres",
+			Password: "password",
+			Name:     "postgres",
+			SSLMode:  "disable",
+		},
+		TrashRetention: defaultTrashRetention,
+		PurgeInterval:  time.Hour,
+		LegacyDates:    true,
+		PhoneRegion:    defaultPhoneRegion,
+		LogLevel:       "info",
+		LogFormat:      "json",
+
+		TracingSampleRatio: 1,
+
+		Auth: AuthConfig{JWTRolesClaim: "roles"},
+
+		Subscribers: defaultSubscriberConfig(),
+	}
+}
+
+// configOption is a setting that can be given as a flag and as an
+// environment variable.
+type configOption struct {
+	flag   string
+	env    string
+	usage  string
+	isBool bool
+	set    func(c *Config, value string) error
+}
+
+var configOptions = []configOption{
+	{flag: "listen-addr", env: "PATIENTS_LISTEN_ADDR", usage: "address to serve HTTP on", set: stringOption(func(c *Config) *string { return &c.ListenAddr })},
+	{flag: "shutdown-timeout", env: "PATIENTS_SHUTDOWN_TIMEOUT", usage: "how long to wait for in-flight requests and WebSocket clients on shutdown", set: durationOption(func(c *Config) *time.Duration { return &c.ShutdownTimeout })},
+	{flag: "db-host", env: "PATIENTS_DB_HOST", usage: "Postgres host", set: stringOption(func(c *Config) *string { return &c.Database.Host })},
+	{flag: "db-port", env: "PATIENTS_DB_PORT", usage: "Postgres port", set: intOption(func(c *Config) *int { return &c.Database.Port })},
+	{flag: "db-user", env: "PATIENTS_DB_USER", usage: "Postgres user", set: stringOption(func(c *Config) *string { return &c.Database.User })},
+	{flag: "db-password", env: "PATIENTS_DB_PASSWORD", usage: "Postgres password, prefer the environment variable over the flag", set: stringOption(func(c *Config) *string { return &c.Database.Password })},
+	{flag: "db-name", env: "PATIENTS_DB_NAME", usage: "Postgres database", set: stringOption(func(c *Config) *string { return &c.Database.Name })},
+	{flag: "db-sslmode", env: "PATIENTS_DB_SSLMODE", usage: "Postgres sslmode: " + strings.Join(sslModes, ", "), set: stringOption(func(c *Config) *string { return &c.Database.SSLMode })},
+	{flag: "db-sslrootcert", env: "PATIENTS_DB_SSLROOTCERT", usage: "PEM file with the CA certificates to verify Postgres against", set: stringOption(func(c *Config) *string { return &c.Database.SSLRootCert })},
+	{flag: "allow-client-ids", env: "PATIENTS_ALLOW_CLIENT_IDS", usage: "import mode: keep patient ids supplied by clients on create", isBool: true, set: boolOption(func(c *Config) *bool { return &c.AllowClientIds })},
+	{flag: "trash-retention", env: "PATIENTS_TRASH_RETENTION", usage: "how long deleted patients can be restored before they are purged", set: durationOption(func(c *Config) *time.Duration { return &c.TrashRetention })},
+	{flag: "purge-interval", env: "PATIENTS_PURGE_INTERVAL", usage: "how often to purge patients past the trash retention, 0 to disable", set: durationOption(func(c *Config) *time.Duration { return &c.PurgeInterval })},
+	{flag: "legacy-dates", env: "PATIENTS_LEGACY_DATES", usage: "accept a date of birth sent as separate year, month and date fields", isBool: true, set: boolOption(func(c *Config) *bool { return &c.LegacyDates })},
+	{flag: "phone-region", env: "PATIENTS_PHONE_REGION", usage: "region (ISO 3166 code) for phone numbers given without a country code", set: stringOption(func(c *Config) *string { return &c.PhoneRegion })},
+	{flag: "auto-migrate", env: "PATIENTS_AUTO_MIGRATE", usage: "apply pending migrations before serving", isBool: true, set: boolOption(func(c *Config) *bool { return &c.AutoMigrate })},
+	{flag: "log-level", env: "PATIENTS_LOG_LEVEL", usage: "least severe log level written: " + strings.Join(logLevels, ", "), set: stringOption(func(c *Config) *string { return &c.LogLevel })},
+	{flag: "log-format", env: "PATIENTS_LOG_FORMAT", usage: "log line format: " + strings.Join(logFormats, ", "), set: stringOption(func(c *Config) *string { return &c.LogFormat })},
+	{flag: "tracing-endpoint", env: "PATIENTS_TRACING_ENDPOINT", usage: "OTLP/HTTP collector URL to send traces to, empty to disable tracing", set: stringOption(func(c *Config) *string { return &c.TracingEndpoint })},
+	{flag: "tracing-sample-ratio", env: "PATIENTS_TRACING_SAMPLE_RATIO", usage: "fraction of new traces to keep, between 0 and 1", set: floatOption(func(c *Config) *float64 { return &c.TracingSampleRatio })},
+	{flag: "subscriber-queue-size", env: "PATIENTS_SUBSCRIBER_QUEUE_SIZE", usage: "notifications that may wait to be sent to one WebSocket client", set: intOption(func(c *Config) *int { return &c.Subscribers.QueueSize })},
+	{flag: "subscriber-overflow", env: "PATIENTS_SUBSCRIBER_OVERFLOW", usage: "what to do when a WebSocket client's queue is full: " + strings.Join(overflowPolicies, ", "), set: stringOption(func(c *Config) *string { return &c.Subscribers.Overflow })},
+	{flag: "subscriber-write-timeout", env: "PATIENTS_SUBSCRIBER_WRITE_TIMEOUT", usage: "how long sending a notification may take before the WebSocket client is disconnected", set: durationOption(func(c *Config) *time.Duration { return &c.Subscribers.WriteTimeout })},
+	{flag: "subscriber-ping-interval", env: "PATIENTS_SUBSCRIBER_PING_INTERVAL", usage: "how often WebSocket clients are pinged", set: durationOption(func(c *Config) *time.Duration { return &c.Subscribers.PingInterval })},
+	{flag: "subscriber-idle-timeout", env: "PATIENTS_SUBSCRIBER_IDLE_TIMEOUT", usage: "how long a WebSocket client may send nothing, not even a pong, before it is disconnected", set: durationOption(func(c *Config) *time.Duration { return &c.Subscribers.IdleTimeout })},
+	{flag: "subscriber-replay-size", env: "PATIENTS_SUBSCRIBER_REPLAY_SIZE", usage: "latest changes kept for WebSocket clients that reconnect", set: intOption(func(c *Config) *int { return &c.Subscribers.ReplaySize })},
+	{flag: "subscriber-max-message-size", env: "PATIENTS_SUBSCRIBER_MAX_MESSAGE_SIZE", usage: "largest message in bytes a WebSocket client may send", set: intOption(func(c *Config) *int { return &c.Subscribers.MaxMessageSize })},
+	{flag: "encryption-keyfile", env: "PATIENTS_ENCRYPTION_KEYFILE", usage: "JSON file with the keys that encrypt disease, address and phone at rest", set: stringOption(func(c *Config) *string { return &c.EncryptionKeyFile })},
+	{flag: "auth-disabled", env: "PATIENTS_AUTH_DISABLED", usage: "serve the API without authentication, for local development only", isBool: true, set: boolOption(func(c *Config) *bool { return &c.Auth.Disabled })},
+	{flag: "jwt-secret", env: "PATIENTS_JWT_SECRET", usage: "shared secret for HS256 bearer tokens, at least 32 bytes", set: stringOption(func(c *Config) *string { return &c.Auth.JWTSecret })},
+	{flag: "jwks", env: "PATIENTS_JWKS", usage: "file or http(s) URL of the JSON Web Key Set for RS256 bearer tokens", set: stringOption(func(c *Config) *string { return &c.Auth.JWKS })},
+	{flag: "jwt-issuer", env: "PATIENTS_JWT_ISSUER", usage: "required iss claim of bearer tokens", set: stringOption(func(c *Config) *string { return &c.Auth.JWTIssuer })},
+	{flag: "jwt-audience", env: "PATIENTS_JWT_AUDIENCE", usage: "required aud claim of bearer tokens", set: stringOption(func(c *Config) *string { return &c.Auth.JWTAudience })},
+	{flag: "jwt-roles-claim", env: "PATIENTS_JWT_ROLES_CLAIM", usage: "claim of bearer tokens listing the caller's roles, dots lead into nested objects", set: stringOption(func(c *Config) *string { return &c.Auth.JWTRolesClaim })},
+	{flag: "api-keys", env: "PATIENTS_API_KEYS", usage: "comma separated name:role+role:key entries accepted in the X-API-Key header", set: apiKeysOption},
+}
+
+func stringOption(field func(c *Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func intOption(field func(c *Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func boolOption(field func(c *Config) *bool) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func floatOption(field func(c *Config) *float64) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		*field(c) = f
+		return nil
+	}
+}
+
+// apiKeysOption reads API keys written as name:role+role:key, separated by
+// commas. The key is last so that it may contain colons.
+func apiKeysOption(c *Config, value string) error {
+	var keys []APIKeyConfig
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			return errors.New("API keys should be written as name:role+role:key,name:role:key")
+		}
+		keys = append(keys, APIKeyConfig{
+			Name:  strings.TrimSpace(parts[0]),
+			Roles: parseRoles(parts[1]),
+			Key:   strings.TrimSpace(parts[2]),
+		})
+	}
+	c.Auth.APIKeys = keys
+	return nil
+}
+
+func durationOption(field func(c *Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration such as 90m or 720h", value)
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+// loadConfig builds the configuration from args, the command-line
+// arguments without the program name, and the environment as seen through
+// lookupEnv, then validates it. The arguments left after the flags are
+// returned as they are.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, []string, error) {
+	fs := flag.NewFlagSet("patients", flag.ContinueOnError)
+	configPath, _ := lookupEnv(configFileEnv)
+	fs.StringVar(&configPath, "config", configPath, "YAML config file (env "+configFileEnv+")")
+
+	// flags win over everything else, so they are applied last
+	var flagValues []func(c *Config) error
+	for _, opt := range configOptions {
+		opt := opt
+		usage := fmt.Sprintf("%s (env %s)", opt.usage, opt.env)
+		setFlag := func(value string) error {
+			if err := opt.set(&Config{}, value); err != nil {
+				return err
+			}
+			flagValues = append(flagValues, func(c *Config) error { return opt.set(c, value) })
+			return nil
+		}
+		if opt.isBool {
+			fs.BoolFunc(opt.flag, usage, setFlag)
+		} else {
+			fs.Func(opt.flag, usage, setFlag)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+
+	cfg := defaultConfig()
+	if configPath != "" {
+		if err := loadConfigFile(configPath, &cfg); err != nil {
+			return Config{}, nil, err
+		}
+	}
+
+	for _, opt := range configOptions {
+		if value, ok := lookupEnv(opt.env); ok {
+			if err := opt.set(&cfg, value); err != nil {
+				return Config{}, nil, fmt.Errorf("%s: %w", opt.env, err)
+			}
+		}
+	}
+
+	for _, apply := range flagValues {
+		if err := apply(&cfg); err != nil {
+			return Config{}, nil, err
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return Config{}, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// loadConfigFile overlays the settings in a YAML file on cfg. Unknown keys
+// are rejected so that a misspelt setting is not silently ignored.
+func loadConfigFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// validate reports every problem with cfg at once.
+func (cfg Config) validate() error {
+	var problems []string
+	if _, _, err := net.SplitHostPort(cfg.ListenAddr); err != nil {
+		problems = append(problems, fmt.Sprintf("listen address %q should be host:port or :port", cfg.ListenAddr))
+	}
+
+	if cfg.ShutdownTimeout <= 0 {
+		problems = append(problems, "shutdown timeout should be positive")
+	}
+
+	db := cfg.Database
+	if db.Host == "" {
+		problems = append(problems, "database host is required")
+	}
+	if db.Port < 1 || db.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("database port %d should be between 1 and 65535", db.Port))
+	}
+	if db.User == "" {
+		problems = append(problems, "database user is required")
+	}
+	if db.Name == "" {
+		problems = append(problems, "database name is required")
+	}
+
+	validMode := false
+	for _, mode := range sslModes {
+		validMode = validMode || db.SSLMode == mode
+	}
+	if !validMode {
+		problems = append(problems, fmt.Sprintf("database sslmode %q should be one of %s", db.SSLMode, strings.Join(sslModes, ", ")))
+	}
+	if db.SSLRootCert != "" {
+		if db.SSLMode == "disable" {
+			problems = append(problems, "database sslrootcert is set but sslmode is disable")
+		}
+		if _, err := os.Stat(db.SSLRootCert); err != nil {
+			problems = append(problems, fmt.Sprintf("database sslrootcert: %v", err))
+		}
+	}
+
+	if cfg.TrashRetention <= 0 {
+		problems = append(problems, "trash retention should be positive")
+	}
+	if cfg.PurgeInterval < 0 {
+		problems = append(problems, "purge interval should not be negative")
+	}
+	if !validPhoneRegion(cfg.PhoneRegion) {
+		problems = append(problems, fmt.Sprintf("unknown phone region %q", cfg.PhoneRegion))
+	}
+	if _, err := newLogger(io.Discard, cfg.LogLevel, cfg.LogFormat); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if cfg.TracingEndpoint != "" {
+		if u, err := url.Parse(cfg.TracingEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("tracing endpoint %q should be an http or https URL", cfg.TracingEndpoint))
+		}
+	}
+	if cfg.TracingSampleRatio < 0 || cfg.TracingSampleRatio > 1 {
+		problems = append(problems, fmt.Sprintf("tracing sample ratio %v should be between 0 and 1", cfg.TracingSampleRatio))
+	}
+	problems = append(problems, cfg.Subscribers.problems()...)
+	if cfg.EncryptionKeyFile != "" {
+		if _, err := os.Stat(cfg.EncryptionKeyFile); err != nil {
+			problems = append(problems, fmt.Sprintf("encryption keyfile: %v", err))
+		}
+	}
+	problems = append(problems, cfg.Auth.problems()...)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (subs SubscriberConfig) problems() []string {
+	var problems []string
+	if subs.QueueSize < 1 {
+		problems = append(problems, "subscriber queue size should be at least 1")
+	}
+	if !slices.Contains(overflowPolicies, subs.Overflow) {
+		problems = append(problems, fmt.Sprintf("subscriber overflow %q should be one of %s", subs.Overflow, strings.Join(overflowPolicies, ", ")))
+	}
+	if subs.WriteTimeout <= 0 {
+		problems = append(problems, "subscriber write timeout should be positive")
+	}
+	if subs.PingInterval <= 0 {
+		problems = append(problems, "subscriber ping interval should be positive")
+	} else if subs.IdleTimeout <= subs.PingInterval {
+		problems = append(problems, "subscriber idle timeout should be longer than the ping interval")
+	}
+	if subs.MaxMessageSize < 1 {
+		problems = append(problems, "subscriber max message size should be at least 1")
+	}
+	if subs.ReplaySize < 0 || subs.ReplaySize > subs.QueueSize {
+		problems = append(problems, fmt.Sprintf("subscriber replay size %d should be between 0 and the queue size", subs.ReplaySize))
+	}
+	return problems
+}
+
+var errNoAuthConfigured = errors.New("auth needs a JWT secret, a JWKS or API keys, or has to be disabled with -auth-disabled for local development")
+
+// checkServing fails when the API would be served without any way for
+// callers to authenticate. It is separate from validate because the
+// migrate subcommand needs no auth settings.
+func (auth AuthConfig) checkServing() error {
+	if !auth.Disabled && auth.JWTSecret == "" && auth.JWKS == "" && len(auth.APIKeys) == 0 {
+		return errNoAuthConfigured
+	}
+	return nil
+}
+
+func (auth AuthConfig) problems() []string {
+	var problems []string
+	if auth.JWTSecret != "" && len(auth.JWTSecret) < minJWTSecretLength {
+		problems = append(problems, fmt.Sprintf("JWT secret should be at least %d bytes", minJWTSecretLength))
+	}
+	if (auth.JWTSecret != "" || auth.JWKS != "") && auth.JWTRolesClaim == "" {
+		problems = append(problems, "JWT roles claim cannot be empty")
+	}
+
+	names := map[string]bool{}
+	for _, k := range auth.APIKeys {
+		switch {
+		case k.Name == "":
+			problems = append(problems, "every API key needs a name")
+		case names[k.Name]:
+			problems = append(problems, fmt.Sprintf("API key name %q is used twice", k.Name))
+		}
+		names[k.Name] = true
+		if len(k.Key) < minAPIKeyLength {
+			problems = append(problems, fmt.Sprintf("API key %q should be at least %d characters", k.Name, minAPIKeyLength))
+		}
+		if len(k.Roles) == 0 {
+			problems = append(problems, fmt.Sprintf("API key %q needs at least one role", k.Name))
+		}
+		if unknown := unknownRoles(k.Roles); len(unknown) > 0 {
+			problems = append(problems, fmt.Sprintf("API key %q has unknown roles %s, roles are %s", k.Name, strings.Join(unknown, ", "), strings.Join(roleNames(), ", ")))
+		}
+	}
+	return problems
+}
+
+func (db DatabaseConfig) url() *url.URL {
+	query := url.Values{}
+	query.Set("sslmode", db.SSLMode)
+	if db.SSLRootCert != "" {
+		query.Set("sslrootcert", db.SSLRootCert)
+	}
+	return &url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(db.User, db.Password),
+		Host:     net.JoinHostPort(db.Host, strconv.Itoa(db.Port)),
+		Path:     "/" + db.Name,
+		RawQuery: query.Encode(),
+	}
+}
+
+// dsn is the connection string for pgdriver, with the password escaped.
+func (db DatabaseConfig) dsn() string {
+	return db.url().String()
+}
+
+// String is the DSN with the password masked, for logging.
+func (db DatabaseConfig) String() string {
+	return db.url().Redacted()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Date is a calendar date with no time of day or time zone. It is stored in
+// a Postgres date column and written in JSON as an ISO 8601 date,
+// YYYY-MM-DD, or null when it is not set.
+type Date struct {
+	Year  int
+	Month time.Month
+	Day   int
+}
+
+func newDate(year int, month time.Month, day int) Date {
+	return Date{Year: year, Month: month, Day: day}
+}
+
+func dateOf(t time.Time) Date {
+	year, month, day := t.Date()
+	return newDate(year, month, day)
+}
+
+func today() Date {
+	return dateOf(time.Now())
+}
+
+func parseDate(s string) (Date, error) {
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return Date{}, err
+	}
+	return dateOf(t), nil
+}
+
+func (d Date) IsZero() bool {
+	return d == Date{}
+}
+
+// valid reports whether d is a day that exists in the calendar, so that
+// February 31 or year -5 are rejected rather than normalised.
+func (d Date) valid() bool {
+	if d.Year < 1 || d.Year > 9999 {
+		return false
+	}
+	return dateOf(time.Date(d.Year, d.Month, d.Day, 0, 0, 0, 0, time.UTC)) == d
+}
+
+func (d Date) After(other Date) bool {
+	if d.Year != other.Year {
+		return d.Year > other.Year
+	}
+	if d.Month != other.Month {
+		return d.Month > other.Month
+	}
+	return d.Day > other.Day
+}
+
+func (d Date) String() string {
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year, int(d.Month), d.Day)
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	if d.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(d.String())
+}
+
+func (d *Date) UnmarshalJSON(data []byte) error {
+	var s *string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == nil {
+		*d = Date{}
+		return nil
+	}
+
+	parsed, err := parseDate(*s)
+	if err != nil {
+		return fmt.Errorf("date should be YYYY-MM-DD: %w", err)
+	}
+	*d = parsed
+	return nil
+}
+
+func (d Date) Value() (driver.Value, error) {
+	if d.IsZero() {
+		return nil, nil
+	}
+	return d.String(), nil
+}
+
+func (d *Date) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*d = Date{}
+		return nil
+	case time.Time:
+		*d = dateOf(v)
+		return nil
+	case string:
+		return d.scanString(v)
+	case []byte:
+		return d.scanString(string(v))
+	default:
+		return fmt.Errorf("cannot scan %T into Date", src)
+	}
+}
+
+func (d *Date) scanString(s string) error {
+	// timestamps come back as "YYYY-MM-DD HH:MM:SS..." so only the date
+	// part is read
+	if len(s) > len(time.DateOnly) {
+		s = s[:len(time.DateOnly)]
+	}
+	parsed, err := parseDate(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
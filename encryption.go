@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// encryptedPrefix starts every encrypted column value, which is written as
+// enc:v1:<key id>:<wrapped data key>:<ciphertext>. The search_vector
+// column leaves values with this prefix out.
+const encryptedPrefix = "enc:v1:"
+
+// encryptionKeySize is the size of key encryption keys, data keys and the
+// blind index key: 32 bytes, for AES-256 and HMAC-SHA256.
+const encryptionKeySize = 32
+
+var errUnknownEncryptionKey = errors.New("unknown encryption key")
+
+// keyring holds the keys from an encryption keyfile. Every value is
+// encrypted with AES-GCM under a data key of its own, and that data key is
+// stored next to it wrapped by the primary key. The other keys are only
+// used to read values written before the primary key was rotated.
+type keyring struct {
+	primary  string
+	keys     map[string][]byte
+	indexKey []byte
+}
+
+// keyfile is the JSON layout of an encryption keyfile. Keys are base64
+// encoded 32 byte values.
+type keyfile struct {
+	PrimaryKeyId  string            `json:"primaryKeyId"`
+	Keys          map[string]string `json:"keys"`
+	BlindIndexKey string            `json:"blindIndexKey"`
+}
+
+func loadKeyring(path string) (*keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := parseKeyring(data)
+	if err != nil {
+		return nil, fmt.Errorf("encryption keyfile %s: %w", path, err)
+	}
+	return k, nil
+}
+
+func parseKeyring(data []byte) (*keyring, error) {
+	var file keyfile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	k := &keyring{primary: file.PrimaryKeyId, keys: map[string][]byte{}}
+	for id, encoded := range file.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("key id %q should be non-empty and not contain a colon", id)
+		}
+		key, err := decodeEncryptionKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		k.keys[id] = key
+	}
+	if _, ok := k.keys[k.primary]; !ok {
+		return nil, fmt.Errorf("primary key %q is not one of the keys", k.primary)
+	}
+
+	indexKey, err := decodeEncryptionKey(file.BlindIndexKey)
+	if err != nil {
+		return nil, fmt.Errorf("blind index key: %w", err)
+	}
+	for id, key := range k.keys {
+		if bytes.Equal(key, indexKey) {
+			return nil, fmt.Errorf("blind index key should differ from key %q", id)
+		}
+	}
+	k.indexKey = indexKey
+	return k, nil
+}
+
+func decodeEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("should be base64: %w", err)
+	}
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("should be %d bytes, not %d", encryptionKeySize, len(key))
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealGCM encrypts plaintext with key, bound to additionalData, and returns
+// the nonce followed by the ciphertext.
+func sealGCM(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openGCM(key, sealed, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// encrypt returns value encrypted for column under the primary key. The
+// column is authenticated with the value, so that a value cannot be moved
+// to another column. Empty values are left empty.
+func (k *keyring) encrypt(column, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	dataKey := make([]byte, encryptionKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	wrapped, err := sealGCM(k.keys[k.primary], dataKey, []byte(k.primary))
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := sealGCM(dataKey, []byte(value), []byte(column))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + k.primary + ":" +
+		base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(ciphertext), nil
+}
+
+// decrypt returns the plaintext of a value encrypted for column. Values
+// that are not encrypted were written before encryption was turned on and
+// are returned as they are.
+func (k *keyring) decrypt(column, value string) (string, error) {
+	keyId, wrapped, ciphertext, encrypted := parseEncrypted(value)
+	if !encrypted {
+		return value, nil
+	}
+	key, ok := k.keys[keyId]
+	if !ok {
+		return "", fmt.Errorf("%w %q", errUnknownEncryptionKey, keyId)
+	}
+
+	dataKey, err := openGCM(key, wrapped, []byte(keyId))
+	if err != nil {
+		return "", fmt.Errorf("unwrapping data key of %s: %w", column, err)
+	}
+	plaintext, err := openGCM(dataKey, ciphertext, []byte(column))
+	if err != nil {
+		return "", fmt.Errorf("decrypting %s: %w", column, err)
+	}
+	return string(plaintext), nil
+}
+
+// blindIndex is a keyed hash of value for column, stored next to the
+// encrypted value so that rows can still be looked up by an exact value.
+// Case and runs of whitespace are ignored. Empty values have no index.
+func (k *keyring) blindIndex(column, value string) []byte {
+	normalized := strings.ToLower(strings.Join(strings.Fields(value), " "))
+	if normalized == "" {
+		return nil
+	}
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(column))
+	mac.Write([]byte{0})
+	mac.Write([]byte(normalized))
+	return mac.Sum(nil)
+}
+
+// encryptionKeyId returns the id of the key value was encrypted under, or
+// false when value is not encrypted.
+func encryptionKeyId(value string) (string, bool) {
+	keyId, _, _, encrypted := parseEncrypted(value)
+	return keyId, encrypted
+}
+
+// parseEncrypted splits an encrypted value into its key id, wrapped data
+// key and ciphertext. Values that do not have this shape, such as
+// plaintext stored before encryption that happens to start with the
+// encrypted prefix, are not encrypted.
+func parseEncrypted(value string) (keyId string, wrapped, ciphertext []byte, encrypted bool) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return "", nil, nil, false
+	}
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 || parts[0] == "" {
+		return "", nil, nil, false
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, false
+	}
+	ciphertext, err = base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, false
+	}
+	return parts[0], wrapped, ciphertext, true
+}
+
+// encryptedColumns are the patient columns encrypted at rest, with their
+// blind index.
+var encryptedColumns = []struct {
+	name  string
+	value func(p *Patient) *string
+	index func(p *Patient) *[]byte
+}{
+	{"disease", func(p *Patient) *string { return &p.Disease }, func(p *Patient) *[]byte { return &p.DiseaseIndex }},
+	{"address", func(p *Patient) *string { return &p.Address }, func(p *Patient) *[]byte { return &p.AddressIndex }},
+	{"phone", func(p *Patient) *string { return &p.Phone }, func(p *Patient) *[]byte { return &p.PhoneIndex }},
+}
+
+func isEncryptedColumn(column string) bool {
+	for _, c := range encryptedColumns {
+		if c.name == column {
+			return true
+		}
+	}
+	return false
+}
+
+// sealPatient returns p as it is stored, with the encrypted columns
+// encrypted and their blind indexes set. Without keys p is stored as it
+// is.
+func (dbrepo *postgresRepo) sealPatient(p Patient) (Patient, error) {
+	if dbrepo.keys == nil {
+		return p, nil
+	}
+	for _, c := range encryptedColumns {
+		value := c.value(&p)
+		*c.index(&p) = dbrepo.keys.blindIndex(c.name, *value)
+		encrypted, err := dbrepo.keys.encrypt(c.name, *value)
+		if err != nil {
+			return Patient{}, err
+		}
+		*value = encrypted
+	}
+	return p, nil
+}
+
+// openPatient decrypts the encrypted columns of a stored patient. Without
+// a keyfile the values are returned as stored. Blind indexes are only
+// needed inside the repository, so they are cleared.
+func (dbrepo *postgresRepo) openPatient(p *Patient) error {
+	for _, c := range encryptedColumns {
+		value := c.value(p)
+		*c.index(p) = nil
+		if dbrepo.keys == nil {
+			continue
+		}
+		decrypted, err := dbrepo.keys.decrypt(c.name, *value)
+		if err != nil {
+			return fmt.Errorf("patient %d: %w", p.Id, err)
+		}
+		*value = decrypted
+	}
+	return nil
+}
+
+func (dbrepo *postgresRepo) openPatients(patients []Patient) error {
+	for i := range patients {
+		if err := dbrepo.openPatient(&patients[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealAuditEntry encrypts the values recorded for encrypted columns. The
+// audit log is append-only, so these entries keep the key they were
+// written with; retired keys have to stay in the keyfile to read them.
+func (dbrepo *postgresRepo) sealAuditEntry(e AuditEntry) (AuditEntry, error) {
+	if dbrepo.keys == nil {
+		return e, nil
+	}
+	changes := make([]FieldChange, len(e.Changes))
+	for i, c := range e.Changes {
+		if isEncryptedColumn(c.Field) {
+			var err error
+			if c.Before, err = dbrepo.sealAuditValue(c.Field, c.Before); err != nil {
+				return AuditEntry{}, err
+			}
+			if c.After, err = dbrepo.sealAuditValue(c.Field, c.After); err != nil {
+				return AuditEntry{}, err
+			}
+		}
+		changes[i] = c
+	}
+	e.Changes = changes
+	return e, nil
+}
+
+func (dbrepo *postgresRepo) sealAuditValue(column string, value any) (any, error) {
+	s, ok := value.(string)
+	if !ok || s == "" {
+		return value, nil
+	}
+	return dbrepo.keys.encrypt(column, s)
+}
+
+func (dbrepo *postgresRepo) openAuditEntries(entries []AuditEntry) error {
+	for _, e := range entries {
+		for i, c := range e.Changes {
+			if !isEncryptedColumn(c.Field) {
+				continue
+			}
+			var err error
+			if c.Before, err = dbrepo.openAuditValue(c.Field, c.Before); err != nil {
+				return fmt.Errorf("audit entry %d: %w", e.Id, err)
+			}
+			if c.After, err = dbrepo.openAuditValue(c.Field, c.After); err != nil {
+				return fmt.Errorf("audit entry %d: %w", e.Id, err)
+			}
+			e.Changes[i] = c
+		}
+	}
+	return nil
+}
+
+func (dbrepo *postgresRepo) openAuditValue(column string, value any) (any, error) {
+	s, ok := value.(string)
+	if !ok {
+		return value, nil
+	}
+	if dbrepo.keys == nil {
+		return value, nil
+	}
+	return dbrepo.keys.decrypt(column, s)
+}
+
+// reencryptBatchSize is how many patients reencryptPatients reads at a time.
+const reencryptBatchSize = 500
+
+type reencryptResult struct {
+	Rewritten int
+	Current   int
+	Skipped   int
+}
+
+// reencryptPatients rewrites every stored patient, deleted ones included,
+// whose encrypted columns are not under the primary key or whose blind
+// indexes are stale, such as rows written before encryption was turned on
+// or before a key was rotated. Patients are rewritten without a new version
+// and skipped if a client changed them in the meantime, since that change
+// was written with the current keys.
+func (dbrepo *postgresRepo) reencryptPatients(ctx context.Context) (reencryptResult, error) {
+	var result reencryptResult
+	if dbrepo.keys == nil {
+		return result, errors.New("no encryption keyfile is configured")
+	}
+
+	lastId := 0
+	for {
+		batch := make([]Patient, 0, reencryptBatchSize)
+		err := dbrepo.db.NewSelect().Model(&batch).
+			WhereAllWithDeleted().
+			Where("id > ?", lastId).
+			OrderExpr("id ASC").
+			Limit(reencryptBatchSize).
+			Scan(ctx)
+		if err != nil {
+			return result, err
+		}
+		if len(batch) == 0 {
+			return result, nil
+		}
+		lastId = batch[len(batch)-1].Id
+
+		for _, stored := range batch {
+			if dbrepo.currentlySealed(stored) {
+				result.Current++
+				continue
+			}
+			rewritten, err := dbrepo.reencryptPatient(ctx, stored)
+			if err != nil {
+				return result, err
+			}
+			if rewritten {
+				result.Rewritten++
+			} else {
+				result.Skipped++
+			}
+		}
+		dbrepo.logger.InfoContext(ctx, "patients re-encrypted", "up_to_id", lastId, "rewritten", result.Rewritten, "current", result.Current, "skipped", result.Skipped)
+	}
+}
+
+// currentlySealed reports whether every encrypted column of a stored
+// patient is under the primary key with an up to date blind index.
+func (dbrepo *postgresRepo) currentlySealed(stored Patient) bool {
+	opened := stored
+	if err := dbrepo.openPatient(&opened); err != nil {
+		return false
+	}
+	for _, c := range encryptedColumns {
+		keyId, encrypted := encryptionKeyId(*c.value(&stored))
+		if *c.value(&opened) != "" && (!encrypted || keyId != dbrepo.keys.primary) {
+			return false
+		}
+		if !bytes.Equal(*c.index(&stored), dbrepo.keys.blindIndex(c.name, *c.value(&opened))) {
+			return false
+		}
+	}
+	return true
+}
+
+func (dbrepo *postgresRepo) reencryptPatient(ctx context.Context, stored Patient) (bool, error) {
+	if err := dbrepo.openPatient(&stored); err != nil {
+		return false, err
+	}
+	row, err := dbrepo.sealPatient(stored)
+	if err != nil {
+		return false, err
+	}
+
+	var columns []string
+	for _, c := range encryptedColumns {
+		columns = append(columns, c.name, c.name+"_bidx")
+	}
+	res, err := dbrepo.db.NewUpdate().
+		Model(&row).
+		Column(columns...).
+		WhereAllWithDeleted().
+		Where("id = ?", row.Id).
+		Where("version = ?", row.Version).
+		Exec(ctx)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	return rowsAffected == 1, err
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testEncryptionKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune(b)), encryptionKeySize)))
+}
+
+func testKeyring(t *testing.T, primary string, keyIds ...string) *keyring {
+	keys := []string{}
+	for i, id := range keyIds {
+		keys = append(keys, fmt.Sprintf("%q: %q", id, testEncryptionKey(byte('a'+i))))
+	}
+	data := fmt.Sprintf(`{"primaryKeyId": %q, "keys": {%s}, "blindIndexKey": %q}`, primary, strings.Join(keys, ", "), testEncryptionKey('z'))
+	k, err := parseKeyring([]byte(data))
+	if err != nil {
+		t.Fatalf("failed to parse keyring: %v", err)
+	}
+	return k
+}
+
+func TestEncryption_parseKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{
+			name: "primary and retired key :POS",
+			data: `{"primaryKeyId": "2026-10", "keys": {"2026-01": "` + testEncryptionKey('a') + `", "2026-10": "` + testEncryptionKey('b') + `"}, "blindIndexKey": "` + testEncryptionKey('z') + `"}`,
+		},
+		{
+			name:    "unknown primary key :NEG",
+			data:    `{"primaryKeyId": "2026-10", "keys": {"2026-01": "` + testEncryptionKey('a') + `"}, "blindIndexKey": "` + testEncryptionKey('z') + `"}`,
+			wantErr: `primary key "2026-10" is not one of the keys`,
+		},
+		{
+			name:    "short key :NEG",
+			data:    `{"primaryKeyId": "k1", "keys": {"k1": "c2hvcnQ="}, "blindIndexKey": "` + testEncryptionKey('z') + `"}`,
+			wantErr: `key "k1": should be 32 bytes, not 5`,
+		},
+		{
+			name:    "key id with colon :NEG",
+			data:    `{"primaryKeyId": "k:1", "keys": {"k:1": "` + testEncryptionKey('a') + `"}, "blindIndexKey": "` + testEncryptionKey('z') + `"}`,
+			wantErr: `key id "k:1" should be non-empty and not contain a colon`,
+		},
+		{
+			name:    "missing blind index key :NEG",
+			data:    `{"primaryKeyId": "k1", "keys": {"k1": "` + testEncryptionKey('a') + `"}}`,
+			wantErr: "blind index key: should be 32 bytes, not 0",
+		},
+		{
+			name:    "blind index key reused :NEG",
+			data:    `{"primaryKeyId": "k1", "keys": {"k1": "` + testEncryptionKey('a') + `"}, "blindIndexKey": "` + testEncryptionKey('a') + `"}`,
+			wantErr: `blind index key should differ from key "k1"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseKeyring([]byte(tt.data))
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr, "expect error to match")
+				return
+			}
+			assert.NoError(t, err, "expect keyring to parse")
+		})
+	}
+}
+
+func TestEncryption_encrypt(t *testing.T) {
+	k := testKeyring(t, "k1", "k1")
+
+	encrypted, err := k.encrypt("disease", "diabetes")
+	if !assert.NoError(t, err, "expect value to encrypt") {
+		return
+	}
+	assert.True(t, strings.HasPrefix(encrypted, encryptedPrefix+"k1:"), "expect key id to be stored with the ciphertext")
+	assert.NotContains(t, encrypted, "diabetes", "expect no plaintext")
+
+	again, _ := k.encrypt("disease", "diabetes")
+	assert.NotEqual(t, encrypted, again, "expect every value to get its own data key and nonce")
+
+	decrypted, err := k.decrypt("disease", encrypted)
+	assert.NoError(t, err, "expect value to decrypt")
+	assert.Equal(t, "diabetes", decrypted, "expect plaintext back")
+
+	_, err = k.decrypt("address", encrypted)
+	assert.ErrorContains(t, err, "decrypting address", "expect value moved to another column to be rejected")
+
+	parts := strings.Split(encrypted, ":")
+	ciphertext, _ := base64.RawStdEncoding.DecodeString(parts[4])
+	ciphertext[len(ciphertext)-1] ^= 1
+	parts[4] = base64.RawStdEncoding.EncodeToString(ciphertext)
+	_, err = k.decrypt("disease", strings.Join(parts, ":"))
+	assert.Error(t, err, "expect tampered value to be rejected")
+
+	plaintext, err := k.decrypt("disease", "cold")
+	assert.NoError(t, err, "expect value written before encryption to be read")
+	assert.Equal(t, "cold", plaintext, "expect plaintext as stored")
+
+	empty, err := k.encrypt("phone", "")
+	assert.NoError(t, err, "expect empty value to be accepted")
+	assert.Empty(t, empty, "expect empty value to stay empty")
+}
+
+func TestEncryption_rotation(t *testing.T) {
+	old := testKeyring(t, "k1", "k1")
+	encrypted, err := old.encrypt("address", "surat")
+	if !assert.NoError(t, err, "expect value to encrypt") {
+		return
+	}
+
+	rotated := testKeyring(t, "k2", "k1", "k2")
+	decrypted, err := rotated.decrypt("address", encrypted)
+	assert.NoError(t, err, "expect retired key to still decrypt")
+	assert.Equal(t, "surat", decrypted, "expect plaintext back")
+
+	reencrypted, _ := rotated.encrypt("address", decrypted)
+	keyId, _ := encryptionKeyId(reencrypted)
+	assert.Equal(t, "k2", keyId, "expect new values under the primary key")
+
+	withoutOld := testKeyring(t, "k2", "k2")
+	_, err = withoutOld.decrypt("address", encrypted)
+	assert.ErrorIs(t, err, errUnknownEncryptionKey, "expect removed key to be reported")
+}
+
+func TestEncryption_blindIndex(t *testing.T) {
+	k := testKeyring(t, "k1", "k1")
+
+	assert.Equal(t, k.blindIndex("disease", "Type 2  Diabetes"), k.blindIndex("disease", "type 2 diabetes "), "expect case and spacing to be ignored")
+	assert.NotEqual(t, k.blindIndex("disease", "diabetes"), k.blindIndex("disease", "cold"), "expect values to differ")
+	assert.NotEqual(t, k.blindIndex("disease", "surat"), k.blindIndex("address", "surat"), "expect columns to differ")
+	assert.Nil(t, k.blindIndex("phone", " "), "expect no index for an empty value")
+
+	other := testKeyring(t, "k1", "k1", "k2")
+	assert.Equal(t, k.blindIndex("disease", "cold"), other.blindIndex("disease", "cold"), "expect index not to depend on the encryption keys")
+}
+
+func TestEncryption_sealPatient(t *testing.T) {
+	repo := &postgresRepo{logger: discardLogger(), keys: testKeyring(t, "k1", "k1")}
+	p := Patient{Id: 1, Name: "priya", Address: "surat", Disease: "diabetes", Phone: "+919876543210", DateOfBirth: newDate(1990, 2, 12), Version: 3}
+
+	row, err := repo.sealPatient(p)
+	if !assert.NoError(t, err, "expect patient to be sealed") {
+		return
+	}
+	assert.Equal(t, "priya", row.Name, "expect name to stay searchable")
+	for _, c := range encryptedColumns {
+		_, encrypted := encryptionKeyId(*c.value(&row))
+		assert.True(t, encrypted, "expect %s to be encrypted", c.name)
+		assert.Equal(t, repo.keys.blindIndex(c.name, *c.value(&p)), *c.index(&row), "expect %s to be indexed", c.name)
+	}
+	assert.True(t, repo.currentlySealed(row), "expect sealed row to need no re-encryption")
+
+	opened := row
+	assert.NoError(t, repo.openPatient(&opened), "expect patient to be opened")
+	assert.Equal(t, p, opened, "expect the patient back without indexes")
+
+	assert.False(t, repo.currentlySealed(p), "expect plaintext row to need encrypting")
+	rotated := &postgresRepo{logger: discardLogger(), keys: testKeyring(t, "k2", "k1", "k2")}
+	assert.False(t, rotated.currentlySealed(row), "expect row under retired key to need re-encrypting")
+
+	plain := &postgresRepo{logger: discardLogger()}
+	unchanged, err := plain.sealPatient(p)
+	assert.NoError(t, err, "expect patient to be stored as is without keys")
+	assert.Equal(t, p, unchanged, "expect no encryption without keys")
+	stored := row
+	assert.NoError(t, plain.openPatient(&stored), "expect row to be opened without keys")
+	assert.Equal(t, row.Disease, stored.Disease, "expect values as stored without keys")
+
+	legacy := Patient{Id: 1, Disease: encryptedPrefix + "flu", Address: encryptedPrefix + "a:b:c"}
+	assert.NoError(t, repo.openPatient(&legacy), "expect plaintext with the encrypted prefix to be opened")
+	assert.Equal(t, encryptedPrefix+"flu", legacy.Disease, "expect plaintext to be returned as is")
+	assert.Equal(t, encryptedPrefix+"a:b:c", legacy.Address, "expect plaintext to be returned as is")
+}
+
+func TestEncryption_sealAuditEntry(t *testing.T) {
+	repo := &postgresRepo{logger: discardLogger(), keys: testKeyring(t, "k1", "k1")}
+	e := AuditEntry{Id: 1, PatientId: 1, Changes: []FieldChange{
+		{Field: "name", Before: "priya", After: "priya d"},
+		{Field: "disease", Before: "flu", After: "diabetes"},
+		{Field: "phone", After: "+919876543210"},
+	}}
+
+	row, err := repo.sealAuditEntry(e)
+	if !assert.NoError(t, err, "expect entry to be sealed") {
+		return
+	}
+	assert.Equal(t, "priya", row.Changes[0].Before, "expect name to be kept")
+	assert.NotEqual(t, "flu", row.Changes[1].Before, "expect disease to be encrypted")
+	assert.Nil(t, row.Changes[2].Before, "expect missing value to stay missing")
+	assert.Equal(t, "flu", e.Changes[1].Before, "expect the entry passed in to be left alone")
+
+	entries := []AuditEntry{row}
+	assert.NoError(t, repo.openAuditEntries(entries), "expect entry to be opened")
+	assert.Equal(t, e, entries[0], "expect the entry back")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pressly/goose/v3"
+)
+
+// readinessTimeout bounds how long /readyz waits on any one check, so that
+// a hung database shows up as not ready rather than as a probe timeout.
+const readinessTimeout = 2 * time.Second
+
+// maxFanOutDuration is how long sending one notification to every
+// subscriber may take before the service is reported as not ready.
+const maxFanOutDuration = 30 * time.Second
+
+const (
+	healthOK          = "ok"
+	healthUnavailable = "unavailable"
+)
+
+// readinessCheck is a dependency that has to be working before the service
+// can take traffic.
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+type checkResult struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// databaseCheck pings Postgres through the connection pool.
+func databaseCheck(db *sql.DB) readinessCheck {
+	return readinessCheck{name: "database", check: db.PingContext}
+}
+
+// migrationsCheck fails while the database is behind, or ahead of, the
+// migrations built into this binary. It does not take the migration lock,
+// so it keeps answering while another replica is migrating.
+func migrationsCheck(migrator *goose.Provider) readinessCheck {
+	return readinessCheck{name: "migrations", check: func(ctx context.Context) error {
+		current, target, err := migrator.GetVersions(ctx)
+		if err != nil {
+			return err
+		}
+		if current != target {
+			return fmt.Errorf("database is at migration %d, expected %d", current, target)
+		}
+		return nil
+	}}
+}
+
+// subscribersCheck fails when a notification has been stuck fanning out to
+// subscribers for longer than maxFanOut.
+func subscribersCheck(service *patientsService, maxFanOut time.Duration) readinessCheck {
+	return readinessCheck{name: "subscribers", check: func(ctx context.Context) error {
+		if stuck := service.fanOutDuration(); stuck > maxFanOut {
+			return fmt.Errorf("notification fan-out has been running for %s", stuck.Round(time.Second))
+		}
+		return nil
+	}}
+}
+
+// runReadinessChecks runs every check at once and reports each one.
+func runReadinessChecks(ctx context.Context, checks []readinessCheck) healthResponse {
+	res := healthResponse{Status: healthOK, Checks: map[string]checkResult{}}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c readinessCheck) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, readinessTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := c.check(checkCtx)
+			result := checkResult{
+				Status:    healthOK,
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status = healthUnavailable
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			res.Checks[c.name] = result
+			if err != nil {
+				res.Status = healthUnavailable
+			}
+		}(c)
+	}
+	wg.Wait()
+	return res
+}
+
+func writeHealthResponse(w http.ResponseWriter, res healthResponse) {
+	statusCode := http.StatusOK
+	if res.Status != healthOK {
+		statusCode = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		slog.Error("error writing response", "error", err)
+	}
+}
+
+// healthzHandler answers as long as the process can serve HTTP at all. It
+// checks no dependencies, so a database outage does not get the process
+// restarted.
+func (t *httpTransport) healthzHandler(w http.ResponseWriter, req *http.Request) {
+	writeHealthResponse(w, healthResponse{Status: healthOK})
+}
+
+// readyzHandler reports whether the service can take traffic.
+func (t *httpTransport) readyzHandler(w http.ResponseWriter, req *http.Request) {
+	writeHealthResponse(w, runReadinessChecks(req.Context(), t.readinessChecks))
+}
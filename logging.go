@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var logLevels = []string{"debug", "info", "warn", "error"}
+var logFormats = []string{"json", "text"}
+
+// newLogger returns a logger writing to w at level in format, json or
+// text. Attributes attached to a context with withLogAttrs are added to
+// every line logged with that context.
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("log level %q should be one of %s", level, strings.Join(logLevels, ", "))
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+	var handler slog.Handler
+	switch format {
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("log format %q should be one of %s", format, strings.Join(logFormats, ", "))
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+type logAttrsKey struct{}
+
+// withLogAttrs returns a context whose log lines carry attrs, on top of any
+// the parent context already carries.
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	parent, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	merged := append(append([]slog.Attr(nil), parent...), attrs...)
+	return context.WithValue(ctx, logAttrsKey{}, merged)
+}
+
+// logAttrs returns the attributes stored in ctx by withLogAttrs.
+func logAttrs(ctx context.Context) []any {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	args := make([]any, len(attrs))
+	for i, a := range attrs {
+		args[i] = a
+	}
+	return args
+}
+
+// contextHandler adds the attributes stored by withLogAttrs to each
+// record, so that everything logged while handling a request can be found
+// by its request id.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// discardLogger drops everything, for tests that are not about logging.
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+const requestIdHeader = "X-Request-ID"
+
+// maxRequestIdLength keeps a caller from filling the logs through the
+// X-Request-ID header.
+const maxRequestIdLength = 128
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestId accepts the printable ASCII ids that proxies and other
+// services generate.
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// routeTemplate is the route a request matched, such as
+// /api/patients/{id}, so that ids do not each become their own label.
+func routeTemplate(req *http.Request) string {
+	if current := mux.CurrentRoute(req); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unknown"
+}
+
+// loggingMiddleware keeps the caller's X-Request-ID, or assigns one, echoes
+// it in the response and tags every line logged for the request with it.
+// Each request ends with one line giving its status and duration.
+func loggingMiddleware(logger *slog.Logger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			requestId := req.Header.Get(requestIdHeader)
+			if !validRequestId(requestId) {
+				requestId = newRequestId()
+			}
+			w.Header().Set(requestIdHeader, requestId)
+
+			ctx := withLogAttrs(req.Context(),
+				slog.String("request_id", requestId),
+				slog.String("route", routeTemplate(req)),
+				slog.String("method", req.Method),
+			)
+
+			start := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, req.WithContext(ctx))
+
+			level := slog.LevelInfo
+			if recorder.status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+			logger.LogAttrs(ctx, level, "request handled",
+				slog.Int("status", recorder.status),
+				slog.Duration("duration", time.Since(start)),
+			)
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogging_requestId(t *testing.T) {
+	tests := []struct {
+		name          string
+		requestId     string
+		wantRequestId string
+	}{
+		{
+			name:          "caller's request id is kept :POS",
+			requestId:     "req-7f3a",
+			wantRequestId: "req-7f3a",
+		},
+		{
+			name: "missing request id is assigned :POS",
+		},
+		{
+			name:      "request id with spaces is replaced :NEG",
+			requestId: "req 7f3a",
+		},
+		{
+			name:      "overlong request id is replaced :NEG",
+			requestId: strings.Repeat("a", maxRequestIdLength+1),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger, err := newLogger(&logs, "debug", "json")
+			if err != nil {
+				t.Fatalf("failed to create logger: %v", err)
+			}
+			service := newPatientsService(newInMemoryRepository())
+			service.logger = logger
+			httpTransport := newHttpTransport(service)
+			httpTransport.logger = logger
+			router := buildRoutes(httpTransport)
+
+			body := `{"name": "priya", "address": "surat", "disease": "cold", "phone": "+919876543210", "dateOfBirth": "2024-02-12"}`
+			req := httptest.NewRequest("POST", "/api/patients", strings.NewReader(body))
+			if tt.requestId != "" {
+				req.Header.Set(requestIdHeader, tt.requestId)
+			}
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			assert.Equal(t, http.StatusCreated, res.Code, "expect status code to match")
+
+			requestId := res.Header().Get(requestIdHeader)
+			if tt.wantRequestId != "" {
+				assert.Equal(t, tt.wantRequestId, requestId, "expect request id to be echoed")
+			} else {
+				assert.Len(t, requestId, 32, "expect a generated request id")
+				assert.NotEqual(t, tt.requestId, requestId, "expect invalid request id to be replaced")
+			}
+
+			lines := map[string]map[string]any{}
+			scanner := bufio.NewScanner(&logs)
+			for scanner.Scan() {
+				var line map[string]any
+				if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+					t.Fatalf("failed to decode log line %q: %v", scanner.Text(), err)
+				}
+				assert.Equal(t, requestId, line["request_id"], "expect every line to carry the request id")
+				lines[line["msg"].(string)] = line
+			}
+
+			if assert.Contains(t, lines, "patient created", "expect service to log the change") {
+				assert.Equal(t, 1.0, lines["patient created"]["patient_id"], "expect patient id to be logged")
+				assert.Equal(t, "/api/patients", lines["patient created"]["route"], "expect route to be logged")
+			}
+			if assert.Contains(t, lines, "request handled", "expect request to be logged") {
+				assert.Equal(t, "INFO", lines["request handled"]["level"], "expect level to match")
+				assert.Equal(t, 201.0, lines["request handled"]["status"], "expect status to be logged")
+				assert.Equal(t, "POST", lines["request handled"]["method"], "expect method to be logged")
+				assert.Contains(t, lines["request handled"], "duration", "expect duration to be logged")
+			}
+		})
+	}
+}
+
+func TestLogging_newLogger(t *testing.T) {
+	tests := []struct {
+		name      string
+		level     string
+		format    string
+		wantLines int
+		wantErr   string
+	}{
+		{name: "text at info :POS", level: "info", format: "text", wantLines: 2},
+		{name: "json at warn :POS", level: "warn", format: "json", wantLines: 1},
+		{name: "unknown level :NEG", level: "verbose", format: "json", wantErr: `log level "verbose" should be one of debug, info, warn, error`},
+		{name: "unknown format :NEG", level: "info", format: "xml", wantErr: `log format "xml" should be one of json, text`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger, err := newLogger(&logs, tt.level, tt.format)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr, "expect error to match")
+				return
+			}
+			if !assert.NoError(t, err, "expect logger to be created") {
+				return
+			}
+
+			logger.Debug("debug")
+			logger.Info("info")
+			logger.Warn("warn")
+			assert.Equal(t, tt.wantLines, strings.Count(logs.String(), "\n"), "expect lines below the level to be dropped")
+		})
+	}
+}
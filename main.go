@@ -1,31 +1,237 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/uptrace/bun"
 	"github.com/uptrace/bun/dialect/pgdialect"
 	"github.com/uptrace/bun/driver/pgdriver"
+	"go.opentelemetry.io/otel"
 )
 
-func connectDB(username, password, host, database string, port int) *bun.DB {
-	dsn := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=disable", username, password, host, port, database)
-	sqldb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(dsn)))
+func connectDB(cfg DatabaseConfig) *bun.DB {
+	sqldb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(cfg.dsn())))
 	db := bun.NewDB(sqldb, pgdialect.New())
 	return db
 }
 
+// purgeDeletedPatients purges the trash every interval until ctx is done.
+func purgeDeletedPatients(ctx context.Context, service *patientsService, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := service.purgeDeletedPatients(withActor(ctx, systemActor)); err != nil && ctx.Err() == nil {
+				logger.Error("error purging deleted patients", "error", err)
+			}
+		}
+	}
+}
+
 func main() {
-	db := connectDB("postgres", "password", "localhost", "postgres", 5432)
-	repo := newPostgresRepo(db)
+	// "patients migrate [flags] up" manages the schema and "patients
+	// reencrypt [flags]" rewrites patients under the current encryption
+	// keys, anything else serves
+	args := os.Args[1:]
+	subcommand := ""
+	if len(args) > 0 && (args[0] == "migrate" || args[0] == "reencrypt") {
+		subcommand, args = args[0], args[1:]
+	}
+
+	cfg, args, err := loadConfig(args, os.LookupEnv)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatalln("error loading configuration:", err)
+	}
+
+	switch {
+	case subcommand == "migrate":
+		if _, _, err := migrateCommand(args); err != nil {
+			log.Fatalln(err)
+		}
+	case len(args) > 0:
+		log.Fatalf("unexpected arguments %q, the subcommands are migrate and reencrypt", args)
+	case subcommand == "reencrypt":
+		if cfg.EncryptionKeyFile == "" {
+			log.Fatalln("reencrypt needs -encryption-keyfile")
+		}
+	default:
+		if err := cfg.Auth.checkServing(); err != nil {
+			log.Fatalln("error loading configuration:", err)
+		}
+	}
+
+	// validate has already checked the level and format
+	logger, _ := newLogger(os.Stderr, cfg.LogLevel, cfg.LogFormat)
+	slog.SetDefault(logger)
+	fatal := func(msg string, args ...any) {
+		logger.Error(msg, args...)
+		os.Exit(1)
+	}
+
+	// ctx is cancelled on the first SIGINT or SIGTERM; a second one kills
+	// the process straight away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Info("connecting to database", "database", cfg.Database.String())
+	db := connectDB(cfg.Database)
+
+	migrator, err := newMigrator(db.DB)
+	if err != nil {
+		fatal("error loading migrations", "error", err)
+	}
+	if subcommand == "migrate" {
+		err := runMigrate(ctx, migrator, args, os.Stdout)
+		db.Close()
+		if err != nil {
+			fatal("error migrating database", "error", err)
+		}
+		return
+	}
+	if cfg.AutoMigrate {
+		if err := autoMigrate(ctx, migrator, logger); err != nil {
+			fatal("error migrating database", "error", err)
+		}
+	}
+
+	pgRepo := newPostgresRepo(db, logger)
+	if cfg.EncryptionKeyFile != "" {
+		pgRepo.keys, err = loadKeyring(cfg.EncryptionKeyFile)
+		if err != nil {
+			fatal("error loading encryption keys", "error", err)
+		}
+	}
+	if subcommand == "reencrypt" {
+		result, err := pgRepo.reencryptPatients(ctx)
+		db.Close()
+		if err != nil {
+			fatal("error re-encrypting patients", "error", err)
+		}
+		fmt.Printf("%d patients rewritten, %d already current, %d changed while running\n", result.Rewritten, result.Current, result.Skipped)
+		return
+	}
+
+	tracerProvider, shutdownTracing, err := newTracerProvider(ctx, cfg.TracingEndpoint, cfg.TracingSampleRatio)
+	if err != nil {
+		fatal("error setting up tracing", "error", err)
+	}
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(tracePropagator)
+	tracer := tracerProvider.Tracer(tracerName)
+	db.AddQueryHook(queryTraceHook{tracer: tracer})
+
+	metrics := newMetrics()
+	repo := newTracedRepository(newInstrumentedRepository(pgRepo, metrics), tracer)
 	service := newPatientsService(repo)
-	httpTransport := newHttpTransport(service)
+	metrics.instrumentService(service)
+	service.logger = logger
+	service.tracer = tracer
+	service.allowClientIds = cfg.AllowClientIds
+	service.trashRetention = cfg.TrashRetention
+	service.acceptLegacyDates = cfg.LegacyDates
+	service.phoneRegion = cfg.PhoneRegion
+	service.replay = newReplayBuffer(cfg.Subscribers.ReplaySize)
+
+	var background sync.WaitGroup
+	if cfg.PurgeInterval > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			purgeDeletedPatients(ctx, service, cfg.PurgeInterval, logger)
+		}()
+	}
+	// the purge job above calls the service directly, requests go through
+	// role checks unless auth is disabled
+	var handled Service = service
+	if !cfg.Auth.Disabled {
+		handled = newAuthorizedService(service, logger)
+	}
+	httpTransport := newHttpTransport(newTracedService(handled, tracer))
+	httpTransport.logger = logger
+	httpTransport.tracer = tracer
+	if cfg.Auth.Disabled {
+		logger.Warn("authentication is disabled, anyone who can reach the server can read and change patients")
+	} else {
+		httpTransport.auth, err = newAuthenticator(ctx, cfg.Auth)
+		if err != nil {
+			fatal("error setting up authentication", "error", err)
+		}
+	}
+	httpTransport.metrics = metrics
+	httpTransport.subscriberConfig = cfg.Subscribers
+	httpTransport.readinessChecks = []readinessCheck{
+		databaseCheck(db.DB),
+		migrationsCheck(migrator),
+		subscribersCheck(service, maxFanOutDuration),
+	}
 
 	routes := buildRoutes(httpTransport)
 
-	err := http.ListenAndServe(":8000", routes)
-	log.Println("Some error occured while listening to port 8000:", err)
+	server := &http.Server{
+		Addr:     cfg.ListenAddr,
+		Handler:  routes,
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	server.RegisterOnShutdown(service.closeSubscribers)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		logger.Info("listening", "addr", cfg.ListenAddr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	exitCode := 0
+	select {
+	case err := <-serverErr:
+		logger.Error("error listening", "addr", cfg.ListenAddr, "error", err)
+		exitCode = 1
+	case <-ctx.Done():
+		stop()
+		logger.Info("shutting down", "timeout", cfg.ShutdownTimeout)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Shutdown stops accepting, waits for in-flight requests and runs
+	// closeSubscribers; upgraded WebSocket connections are waited for
+	// separately
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("error draining HTTP requests", "error", err)
+		server.Close()
+	}
+	if err := httpTransport.waitForWebSockets(shutdownCtx); err != nil {
+		logger.Error("error waiting for websocket clients to disconnect", "error", err)
+	}
+
+	stop()
+	background.Wait()
+	if err := db.Close(); err != nil {
+		logger.Error("error closing database", "error", err)
+	}
+	// flush the spans still waiting to be exported
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("error exporting remaining spans", "error", err)
+	}
+	logger.Info("shut down")
+	os.Exit(exitCode)
 }
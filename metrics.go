@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics are the Prometheus collectors for the service. Each instance has
+// its own registry so that tests can build as many as they like.
+type metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests         *prometheus.CounterVec
+	httpRequestDuration  *prometheus.HistogramVec
+	repoCallDuration     *prometheus.HistogramVec
+	repoErrors           *prometheus.CounterVec
+	fanOutDuration       prometheus.Histogram
+	notificationsDropped *prometheus.CounterVec
+	slowSubscribers      *prometheus.CounterVec
+	idleSubscribers      prometheus.Counter
+	subscribers          prometheus.GaugeFunc
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "patients_http_requests_total",
+			Help: "HTTP requests handled, by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		httpRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "patients_http_request_duration_seconds",
+			Help:    "Time taken to handle HTTP requests, by route, method and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		repoCallDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "patients_repository_call_duration_seconds",
+			Help:    "Time taken by repository calls, by method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method"}),
+		repoErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "patients_repository_errors_total",
+			Help: "Repository calls that returned an error, by method.",
+		}, []string{"method"}),
+		fanOutDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "patients_notification_fanout_duration_seconds",
+			Help:    "Time taken to send one notification to every subscriber.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		notificationsDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "patients_notifications_dropped_total",
+			Help: "Notifications not sent to a WebSocket client, because its queue was full or it was disconnected for being too slow.",
+		}, []string{"reason"}),
+		slowSubscribers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "patients_slow_subscribers_disconnected_total",
+			Help: "WebSocket clients disconnected for not keeping up with notifications, by whether their queue filled up or a write timed out.",
+		}, []string{"reason"}),
+		idleSubscribers: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "patients_idle_subscribers_disconnected_total",
+			Help: "WebSocket clients disconnected for sending nothing, not even a pong, within the idle timeout.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.httpRequests,
+		m.httpRequestDuration,
+		m.repoCallDuration,
+		m.repoErrors,
+		m.fanOutDuration,
+		m.notificationsDropped,
+		m.slowSubscribers,
+		m.idleSubscribers,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// instrumentService reports the subscribers and notification fan-outs of
+// service.
+func (m *metrics) instrumentService(service *patientsService) {
+	m.subscribers = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "patients_subscribers",
+		Help: "WebSocket clients currently subscribed to patient changes.",
+	}, func() float64 {
+		return float64(service.subscriberCount())
+	})
+	m.registry.MustRegister(m.subscribers)
+	service.observeFanOut = func(d time.Duration) {
+		m.fanOutDuration.Observe(d.Seconds())
+	}
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// middleware counts and times requests by their route template.
+func (m *metrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := routeTemplate(req)
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+
+		labels := prometheus.Labels{"route": route, "method": req.Method, "code": strconv.Itoa(recorder.status)}
+		m.httpRequests.With(labels).Inc()
+		m.httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusRecorder remembers the status code written through it. A hijacked
+// WebSocket connection is recorded as 101 Switching Protocols.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && !r.wroteHeader {
+		r.status = http.StatusSwitchingProtocols
+		r.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrumentedRepository decorates a Repository with call timings and
+// error counts.
+type instrumentedRepository struct {
+	next    Repository
+	metrics *metrics
+}
+
+func newInstrumentedRepository(next Repository, m *metrics) *instrumentedRepository {
+	return &instrumentedRepository{next: next, metrics: m}
+}
+
+// observe records a call to method that started at start and returned err.
+// Patients that do not exist are an answer rather than a failure, so they
+// are not counted as errors.
+func (r *instrumentedRepository) observe(method string, start time.Time, err error) {
+	r.metrics.repoCallDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, errPatientNotFound) {
+		r.metrics.repoErrors.WithLabelValues(method).Inc()
+	}
+}
+
+func (r *instrumentedRepository) createPatient(ctx context.Context, p Patient) (created Patient, err error) {
+	defer func(start time.Time) { r.observe("createPatient", start, err) }(time.Now())
+	return r.next.createPatient(ctx, p)
+}
+
+func (r *instrumentedRepository) getPatients(ctx context.Context) (patients []Patient, err error) {
+	defer func(start time.Time) { r.observe("getPatients", start, err) }(time.Now())
+	return r.next.getPatients(ctx)
+}
+
+func (r *instrumentedRepository) findPatients(ctx context.Context, q PatientQuery) (page PatientPage, err error) {
+	defer func(start time.Time) { r.observe("findPatients", start, err) }(time.Now())
+	return r.next.findPatients(ctx, q)
+}
+
+func (r *instrumentedRepository) searchPatients(ctx context.Context, terms []string, fields []string, limit int) (results []SearchResult, err error) {
+	defer func(start time.Time) { r.observe("searchPatients", start, err) }(time.Now())
+	return r.next.searchPatients(ctx, terms, fields, limit)
+}
+
+func (r *instrumentedRepository) getPatient(ctx context.Context, id int) (patient Patient, err error) {
+	defer func(start time.Time) { r.observe("getPatient", start, err) }(time.Now())
+	return r.next.getPatient(ctx, id)
+}
+
+func (r *instrumentedRepository) deletePatient(ctx context.Context, id int) (deleted Patient, err error) {
+	defer func(start time.Time) { r.observe("deletePatient", start, err) }(time.Now())
+	return r.next.deletePatient(ctx, id)
+}
+
+func (r *instrumentedRepository) updatePatient(ctx context.Context, p Patient) (updated Patient, err error) {
+	defer func(start time.Time) { r.observe("updatePatient", start, err) }(time.Now())
+	return r.next.updatePatient(ctx, p)
+}
+
+func (r *instrumentedRepository) patchPatient(ctx context.Context, p Patient, columns []string) (patched Patient, err error) {
+	defer func(start time.Time) { r.observe("patchPatient", start, err) }(time.Now())
+	return r.next.patchPatient(ctx, p, columns)
+}
+
+func (r *instrumentedRepository) getDeletedPatients(ctx context.Context) (patients []Patient, err error) {
+	defer func(start time.Time) { r.observe("getDeletedPatients", start, err) }(time.Now())
+	return r.next.getDeletedPatients(ctx)
+}
+
+func (r *instrumentedRepository) restorePatient(ctx context.Context, id int, restoredAt time.Time) (restored Patient, err error) {
+	defer func(start time.Time) { r.observe("restorePatient", start, err) }(time.Now())
+	return r.next.restorePatient(ctx, id, restoredAt)
+}
+
+func (r *instrumentedRepository) purgePatients(ctx context.Context, deletedBefore time.Time) (purged []int, err error) {
+	defer func(start time.Time) { r.observe("purgePatients", start, err) }(time.Now())
+	return r.next.purgePatients(ctx, deletedBefore)
+}
+
+func (r *instrumentedRepository) getAuditEntries(ctx context.Context, patientId int) (entries []AuditEntry, err error) {
+	defer func(start time.Time) { r.observe("getAuditEntries", start, err) }(time.Now())
+	return r.next.getAuditEntries(ctx, patientId)
+}
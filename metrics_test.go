@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics_httpRequests(t *testing.T) {
+	m := newMetrics()
+	repo := newInMemoryRepository()
+	repo.patients = []Patient{{Id: 1, Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12), Version: 1}}
+	httpTransport := newHttpTransport(newPatientsService(repo))
+	httpTransport.metrics = m
+	router := buildRoutes(httpTransport)
+
+	for _, url := range []string{"/api/patients/1", "/api/patients/1", "/api/patients/2", "/api/patients"} {
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, httptest.NewRequest("GET", url, nil))
+	}
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.httpRequests.WithLabelValues("/api/patients/{id}", "GET", "200")), "expect requests to be counted by route template")
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.httpRequests.WithLabelValues("/api/patients/{id}", "GET", "404")), "expect requests to be counted by status")
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.httpRequests.WithLabelValues("/api/patients", "GET", "200")), "expect listing to be counted")
+	assert.Equal(t, 3, testutil.CollectAndCount(m.httpRequestDuration), "expect one latency histogram per route and status")
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, res.Code, "expect metrics to be served")
+	assert.Contains(t, res.Body.String(), `patients_http_requests_total{code="404",method="GET",route="/api/patients/{id}"} 1`, "expect exposition to include request counts")
+}
+
+func TestMetrics_repository(t *testing.T) {
+	m := newMetrics()
+	repo := newInstrumentedRepository(newInMemoryRepository(), m)
+	ctx := context.Background()
+
+	_, err := repo.createPatient(ctx, Patient{Id: 1, Name: "priya"})
+	assert.NoError(t, err, "expect patient to be created")
+	_, err = repo.createPatient(ctx, Patient{Id: 1, Name: "priya"})
+	assert.ErrorIs(t, err, errDuplicateId, "expect decorator to pass errors through")
+	_, err = repo.getPatient(ctx, 2)
+	assert.ErrorIs(t, err, errPatientNotFound, "expect decorator to pass errors through")
+
+	assert.Equal(t, 2, testutil.CollectAndCount(m.repoCallDuration), "expect one timing histogram per method")
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.repoErrors.WithLabelValues("createPatient")), "expect failed call to be counted")
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.repoErrors.WithLabelValues("getPatient")), "expect missing patient not to count as an error")
+}
+
+func TestMetrics_subscribers(t *testing.T) {
+	m := newMetrics()
+	service := newPatientsService(newInMemoryRepository())
+	m.instrumentService(service)
+	httpTransport := newHttpTransport(service)
+	httpTransport.metrics = m
+	ts := httptest.NewServer(buildRoutes(httpTransport))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket", nil)
+	if err != nil {
+		t.Fatalf("failed to connect websocket: %v", err)
+	}
+	defer conn.Close()
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(m.subscribers) == 1
+	}, time.Second, 10*time.Millisecond, "expect subscriber to be reported")
+
+	_, err = service.createPatient(context.Background(), Patient{Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)})
+	assert.NoError(t, err, "expect patient to be created")
+	assert.Equal(t, 1, testutil.CollectAndCount(m.fanOutDuration), "expect fan-out to be timed")
+
+	// the request is only counted once the connection ends
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(m.subscribers) == 0
+	}, time.Second, 10*time.Millisecond, "expect subscriber to be removed")
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(m.httpRequests.WithLabelValues("/websocket", "GET", "101")) == 1
+	}, time.Second, 10*time.Millisecond, "expect upgrade to be counted as switching protocols")
+}
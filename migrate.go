@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/pressly/goose/v3"
+	"github.com/pressly/goose/v3/lock"
+)
+
+//go:embed migrations/*.sql
+var embeddedMigrations embed.FS
+
+const migrateUsage = "usage: migrate [flags] up | down | status | to <version>"
+
+var errMigrateUsage = errors.New(migrateUsage)
+
+// newMigrator returns a goose provider for the migrations built into the
+// binary. Every run holds a Postgres advisory lock, so replicas that start
+// at the same time apply migrations one after another instead of racing.
+// Versions are tracked in goose's usual table, so databases migrated with
+// the goose CLI carry on where they left off.
+func newMigrator(db *sql.DB) (*goose.Provider, error) {
+	migrations, err := fs.Sub(embeddedMigrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	locker, err := lock.NewPostgresSessionLocker()
+	if err != nil {
+		return nil, err
+	}
+	return goose.NewProvider(goose.DialectPostgres, db, migrations, goose.WithSessionLocker(locker))
+}
+
+// migrateCommand checks the arguments of the migrate subcommand before
+// anything connects to the database, and returns the target version for
+// "to".
+func migrateCommand(args []string) (string, int64, error) {
+	if len(args) == 0 {
+		return "", 0, errMigrateUsage
+	}
+
+	switch command := args[0]; command {
+	case "up", "down", "status":
+		if len(args) != 1 {
+			return "", 0, errMigrateUsage
+		}
+		return command, 0, nil
+	case "to":
+		if len(args) != 2 {
+			return "", 0, errMigrateUsage
+		}
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || version < 0 {
+			return "", 0, fmt.Errorf("version %q should be a migration number such as 20240816075507", args[1])
+		}
+		return command, version, nil
+	default:
+		return "", 0, fmt.Errorf("unknown migrate command %q\n%s", command, migrateUsage)
+	}
+}
+
+// runMigrate runs one migrate subcommand and writes what it did to out.
+func runMigrate(ctx context.Context, migrator *goose.Provider, args []string, out io.Writer) error {
+	command, version, err := migrateCommand(args)
+	if err != nil {
+		return err
+	}
+
+	var results []*goose.MigrationResult
+	switch command {
+	case "up":
+		results, err = migrator.Up(ctx)
+	case "down":
+		var result *goose.MigrationResult
+		result, err = migrator.Down(ctx)
+		if result != nil {
+			results = append(results, result)
+		}
+	case "to":
+		var current int64
+		current, err = migrator.GetDBVersion(ctx)
+		if err != nil {
+			return err
+		}
+		if version >= current {
+			results, err = migrator.UpTo(ctx, version)
+		} else {
+			results, err = migrator.DownTo(ctx, version)
+		}
+	case "status":
+		return writeMigrationStatus(ctx, migrator, out)
+	}
+
+	var partial *goose.PartialError
+	if errors.As(err, &partial) {
+		results = partial.Applied
+	}
+	for _, r := range results {
+		fmt.Fprintf(out, "%-4s %s (%s)\n", r.Direction, r.Source.Path, r.Duration.Round(time.Millisecond))
+	}
+	if err == nil && len(results) == 0 {
+		fmt.Fprintln(out, "nothing to migrate")
+	}
+	return err
+}
+
+func writeMigrationStatus(ctx context.Context, migrator *goose.Provider, out io.Writer) error {
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range statuses {
+		appliedAt := "pending"
+		if s.State == goose.StateApplied {
+			appliedAt = s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(out, "%-25s %s\n", appliedAt, s.Source.Path)
+	}
+	return nil
+}
+
+// autoMigrate applies pending migrations when the server starts.
+func autoMigrate(ctx context.Context, migrator *goose.Provider, logger *slog.Logger) error {
+	results, err := migrator.Up(ctx)
+	for _, r := range results {
+		logger.InfoContext(ctx, "migration applied", "migration", r.Source.Path, "duration", r.Duration)
+	}
+	return err
+}
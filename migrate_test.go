@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrate_embeddedMigrations(t *testing.T) {
+	files, err := filepath.Glob("migrations/*.sql")
+	if err != nil {
+		t.Fatalf("failed to list migrations: %v", err)
+	}
+
+	// the database is only connected to when a migration runs
+	db := connectDB(defaultConfig().Database)
+	defer db.Close()
+	migrator, err := newMigrator(db.DB)
+	if !assert.NoError(t, err, "expect migrations to load") {
+		return
+	}
+
+	var embedded []string
+	for _, source := range migrator.ListSources() {
+		embedded = append(embedded, filepath.Join("migrations", source.Path))
+	}
+	assert.Equal(t, files, embedded, "expect every migration to be embedded in order")
+}
+
+func TestMigrate_migrateCommand(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		wantCommand string
+		wantVersion int64
+		wantErr     string
+	}{
+		{name: "up :POS", args: []string{"up"}, wantCommand: "up"},
+		{name: "down :POS", args: []string{"down"}, wantCommand: "down"},
+		{name: "status :POS", args: []string{"status"}, wantCommand: "status"},
+		{name: "to version :POS", args: []string{"to", "20240822090714"}, wantCommand: "to", wantVersion: 20240822090714},
+		{name: "to zero reverts everything :POS", args: []string{"to", "0"}, wantCommand: "to"},
+		{name: "no command :NEG", wantErr: migrateUsage},
+		{name: "unknown command :NEG", args: []string{"redo"}, wantErr: `unknown migrate command "redo"`},
+		{name: "extra argument :NEG", args: []string{"up", "20240822090714"}, wantErr: migrateUsage},
+		{name: "to without version :NEG", args: []string{"to"}, wantErr: migrateUsage},
+		{name: "to non-numeric version :NEG", args: []string{"to", "latest"}, wantErr: `version "latest" should be a migration number`},
+		{name: "to negative version :NEG", args: []string{"to", "-1"}, wantErr: `version "-1" should be a migration number`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, version, err := migrateCommand(tt.args)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr, "expect error to match")
+				return
+			}
+			assert.NoError(t, err, "expect command to be accepted")
+			assert.Equal(t, tt.wantCommand, command, "expect command to match")
+			assert.Equal(t, tt.wantVersion, version, "expect version to match")
+		})
+	}
+}
@@ -0,0 +1,15 @@
+-- +goose Up
+ALTER TABLE patients
+ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('simple', coalesce(name, '')), 'A') ||
+    setweight(to_tsvector('simple', coalesce(disease, '')), 'B') ||
+    setweight(to_tsvector('simple', coalesce(address, '')), 'C')
+) STORED;
+
+CREATE INDEX patients_search_vector_idx ON patients USING GIN (search_vector);
+
+-- +goose Down
+DROP INDEX patients_search_vector_idx;
+
+ALTER TABLE patients
+DROP COLUMN search_vector;
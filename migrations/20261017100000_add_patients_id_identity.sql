@@ -0,0 +1,9 @@
+-- +goose Up
+ALTER TABLE patients
+ALTER COLUMN id ADD GENERATED BY DEFAULT AS IDENTITY (SEQUENCE NAME patients_id_seq);
+
+SELECT setval('patients_id_seq', coalesce(max(id), 0) + 1, false) FROM patients;
+
+-- +goose Down
+ALTER TABLE patients
+ALTER COLUMN id DROP IDENTITY;
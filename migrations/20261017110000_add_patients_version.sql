@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE patients
+ADD COLUMN version int NOT NULL DEFAULT 1;
+
+-- +goose Down
+ALTER TABLE patients
+DROP COLUMN version;
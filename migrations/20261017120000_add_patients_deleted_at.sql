@@ -0,0 +1,11 @@
+-- +goose Up
+ALTER TABLE patients
+ADD COLUMN deleted_at timestamptz;
+
+CREATE INDEX patients_deleted_at_idx ON patients (deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- +goose Down
+DROP INDEX patients_deleted_at_idx;
+
+ALTER TABLE patients
+DROP COLUMN deleted_at;
@@ -0,0 +1,33 @@
+-- +goose Up
+CREATE TABLE patient_audit (
+    id integer GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    patient_id integer NOT NULL,
+    actor text NOT NULL,
+    action text NOT NULL,
+    at timestamptz NOT NULL,
+    changes jsonb NOT NULL DEFAULT '[]'
+);
+
+CREATE INDEX patient_audit_patient_id_idx ON patient_audit (patient_id, at);
+
+-- the audit log is append-only: refuse to change or remove entries
+-- +goose StatementBegin
+CREATE FUNCTION patient_audit_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'patient_audit is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER patient_audit_no_update
+BEFORE UPDATE OR DELETE ON patient_audit
+FOR EACH ROW EXECUTE FUNCTION patient_audit_append_only();
+
+CREATE TRIGGER patient_audit_no_truncate
+BEFORE TRUNCATE ON patient_audit
+FOR EACH STATEMENT EXECUTE FUNCTION patient_audit_append_only();
+
+-- +goose Down
+DROP TABLE patient_audit;
+
+DROP FUNCTION patient_audit_append_only();
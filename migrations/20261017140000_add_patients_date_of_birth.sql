@@ -0,0 +1,33 @@
+-- +goose Up
+ALTER TABLE patients
+ADD COLUMN date_of_birth date;
+
+-- only triples that name a real day are carried over; the nested CASE keeps
+-- make_date from seeing a month or day that is out of range
+UPDATE patients
+SET date_of_birth = CASE
+    WHEN year > 0 AND month BETWEEN 1 AND 12 THEN
+        CASE
+            WHEN date BETWEEN 1 AND extract(day FROM make_date(year, month, 1) + interval '1 month - 1 day')
+            THEN make_date(year, month, date)
+        END
+END;
+
+ALTER TABLE patients
+DROP COLUMN year,
+DROP COLUMN month,
+DROP COLUMN date;
+
+-- +goose Down
+ALTER TABLE patients
+ADD COLUMN year integer,
+ADD COLUMN month integer,
+ADD COLUMN date integer;
+
+UPDATE patients
+SET year = extract(year FROM date_of_birth),
+    month = extract(month FROM date_of_birth),
+    date = extract(day FROM date_of_birth);
+
+ALTER TABLE patients
+DROP COLUMN date_of_birth;
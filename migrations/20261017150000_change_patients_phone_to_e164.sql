@@ -0,0 +1,21 @@
+-- +goose Up
+-- existing numbers were stored as integers, so any leading zero or + is
+-- already gone. Ten digit numbers are national numbers in the default
+-- region (India, +91); longer ones already start with their country code.
+-- Numbers that are still invalid are reported when the patient is next
+-- saved.
+ALTER TABLE patients
+ALTER COLUMN phone TYPE varchar(16) USING CASE
+    WHEN phone IS NULL OR phone <= 0 THEN NULL
+    WHEN length(phone::text) = 10 THEN '+91' || phone::text
+    ELSE '+' || phone::text
+END;
+
+-- +goose Down
+-- only numbers that still fit in an int survive, without their country code
+-- for the default region
+ALTER TABLE patients
+ALTER COLUMN phone TYPE int USING CASE
+    WHEN phone ~ '^\+91\d{1,9}$' THEN substr(phone, 4)::int
+    WHEN phone ~ '^\+\d{1,9}$' THEN substr(phone, 2)::int
+END;
@@ -0,0 +1,57 @@
+-- +goose Up
+-- disease, address and phone may now hold encrypted values, which are
+-- longer than the plaintext and meaningless to search. search_vector has to
+-- go while the column types change, and comes back without encrypted
+-- values in it.
+DROP INDEX patients_search_vector_idx;
+
+ALTER TABLE patients
+DROP COLUMN search_vector;
+
+ALTER TABLE patients
+ALTER COLUMN disease TYPE text,
+ALTER COLUMN address TYPE text,
+ALTER COLUMN phone TYPE text,
+ADD COLUMN disease_bidx bytea,
+ADD COLUMN address_bidx bytea,
+ADD COLUMN phone_bidx bytea;
+
+ALTER TABLE patients
+ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('simple', coalesce(name, '')), 'A') ||
+    setweight(to_tsvector('simple', CASE WHEN disease LIKE 'enc:v1:%' THEN '' ELSE coalesce(disease, '') END), 'B') ||
+    setweight(to_tsvector('simple', CASE WHEN address LIKE 'enc:v1:%' THEN '' ELSE coalesce(address, '') END), 'C')
+) STORED;
+
+CREATE INDEX patients_search_vector_idx ON patients USING GIN (search_vector);
+CREATE INDEX patients_disease_bidx_idx ON patients (disease_bidx);
+CREATE INDEX patients_address_bidx_idx ON patients (address_bidx);
+CREATE INDEX patients_phone_bidx_idx ON patients (phone_bidx);
+
+-- +goose Down
+-- fails while encrypted values are stored, as they do not fit the old
+-- column types
+DROP INDEX patients_phone_bidx_idx;
+DROP INDEX patients_address_bidx_idx;
+DROP INDEX patients_disease_bidx_idx;
+DROP INDEX patients_search_vector_idx;
+
+ALTER TABLE patients
+DROP COLUMN search_vector;
+
+ALTER TABLE patients
+DROP COLUMN phone_bidx,
+DROP COLUMN address_bidx,
+DROP COLUMN disease_bidx,
+ALTER COLUMN disease TYPE varchar(255),
+ALTER COLUMN address TYPE varchar(255),
+ALTER COLUMN phone TYPE varchar(16);
+
+ALTER TABLE patients
+ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('simple', coalesce(name, '')), 'A') ||
+    setweight(to_tsvector('simple', coalesce(disease, '')), 'B') ||
+    setweight(to_tsvector('simple', coalesce(address, '')), 'C')
+) STORED;
+
+CREATE INDEX patients_search_vector_idx ON patients USING GIN (search_vector);
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+var errInvalidPatch = errors.New("invalid patch")
+var errPatchTestFailed = errors.New("patch test operation failed")
+
+// PatientPatch is a change document for a stored patient: an RFC 7396 merge
+// patch or an RFC 6902 JSON Patch, depending on ContentType.
+type PatientPatch struct {
+	ContentType string
+	Document    json.RawMessage
+}
+
+// apply returns doc, a JSON encoded patient, with the patch applied.
+func (p PatientPatch) apply(doc []byte) ([]byte, error) {
+	var target map[string]any
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+
+	var patched any
+	var err error
+	switch p.ContentType {
+	case mergePatchContentType:
+		patched, err = applyMergePatch(target, p.Document)
+	case jsonPatchContentType:
+		patched, err = applyJSONPatch(target, p.Document)
+	default:
+		return nil, fmt.Errorf("%w: unsupported content type %q", errInvalidPatch, p.ContentType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(patched)
+}
+
+func applyMergePatch(target map[string]any, document []byte) (any, error) {
+	var patch any
+	if err := json.Unmarshal(document, &patch); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidPatch, err)
+	}
+	if _, ok := patch.(map[string]any); !ok {
+		return nil, fmt.Errorf("%w: merge patch should be a JSON object", errInvalidPatch)
+	}
+	return mergePatch(target, patch), nil
+}
+
+// mergePatch implements the MergePatch function from RFC 7396: objects are
+// merged recursively, null removes a member and anything else replaces it.
+func mergePatch(target, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = make(map[string]any)
+	}
+	for name, value := range patchObj {
+		if value == nil {
+			delete(targetObj, name)
+			continue
+		}
+		targetObj[name] = mergePatch(targetObj[name], value)
+	}
+	return targetObj
+}
+
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies an RFC 6902 JSON Patch. A patient is a flat object,
+// so only pointers to its top-level members are supported.
+func applyJSONPatch(target map[string]any, document []byte) (any, error) {
+	var ops []jsonPatchOperation
+	if err := json.Unmarshal(document, &ops); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidPatch, err)
+	}
+
+	for i, op := range ops {
+		if err := applyJSONPatchOperation(target, op); err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return target, nil
+}
+
+func applyJSONPatchOperation(target map[string]any, op jsonPatchOperation) error {
+	name, err := patchPointerMember(op.Path)
+	if err != nil {
+		return err
+	}
+
+	switch op.Op {
+	case "add", "replace":
+		if _, ok := target[name]; !ok && op.Op == "replace" {
+			return fmt.Errorf("%w: %s does not exist", errInvalidPatch, op.Path)
+		}
+		value, err := patchValue(op)
+		if err != nil {
+			return err
+		}
+		target[name] = value
+	case "remove":
+		if _, ok := target[name]; !ok {
+			return fmt.Errorf("%w: %s does not exist", errInvalidPatch, op.Path)
+		}
+		delete(target, name)
+	case "move", "copy":
+		from, err := patchPointerMember(op.From)
+		if err != nil {
+			return err
+		}
+		value, ok := target[from]
+		if !ok {
+			return fmt.Errorf("%w: %s does not exist", errInvalidPatch, op.From)
+		}
+		if op.Op == "move" {
+			delete(target, from)
+		}
+		target[name] = value
+	case "test":
+		value, err := patchValue(op)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(target[name], value) {
+			return fmt.Errorf("%w: %s", errPatchTestFailed, op.Path)
+		}
+	default:
+		return fmt.Errorf("%w: unknown op %q", errInvalidPatch, op.Op)
+	}
+	return nil
+}
+
+func patchValue(op jsonPatchOperation) (any, error) {
+	if op.Value == nil {
+		return nil, fmt.Errorf("%w: %s needs a value", errInvalidPatch, op.Op)
+	}
+	var value any
+	if err := json.Unmarshal(op.Value, &value); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidPatch, err)
+	}
+	return value, nil
+}
+
+// patchPointerMember resolves a JSON pointer such as "/name" to the member
+// name it refers to.
+func patchPointerMember(pointer string) (string, error) {
+	if !strings.HasPrefix(pointer, "/") || strings.Count(pointer, "/") != 1 {
+		return "", fmt.Errorf("%w: path %q should point to a patient field", errInvalidPatch, pointer)
+	}
+	name := strings.TrimPrefix(pointer, "/")
+	return strings.NewReplacer("~1", "/", "~0", "~").Replace(name), nil
+}
+
+// members returns the names of the top-level patient members the patch
+// reads or changes.
+func (p PatientPatch) members() ([]string, error) {
+	var members []string
+	switch p.ContentType {
+	case mergePatchContentType:
+		var patch map[string]json.RawMessage
+		if err := json.Unmarshal(p.Document, &patch); err != nil {
+			return nil, fmt.Errorf("%w: merge patch should be a JSON object", errInvalidPatch)
+		}
+		for name := range patch {
+			members = append(members, name)
+		}
+	case jsonPatchContentType:
+		var ops []jsonPatchOperation
+		if err := json.Unmarshal(p.Document, &ops); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidPatch, err)
+		}
+		for _, op := range ops {
+			pointers := []string{op.Path}
+			if op.Op == "move" || op.Op == "copy" {
+				pointers = append(pointers, op.From)
+			}
+			for _, pointer := range pointers {
+				name, err := patchPointerMember(pointer)
+				if err != nil {
+					return nil, err
+				}
+				members = append(members, name)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported content type %q", errInvalidPatch, p.ContentType)
+	}
+	return members, nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"strings"
 	"time"
 
@@ -10,27 +12,149 @@ import (
 type Patient struct {
 	bun.BaseModel `bun:"table:patients"`
 
-	Id        int       `json:"id" bun:"id"`
+	Id        int       `json:"id" bun:"id,pk,autoincrement"`
 	Name      string    `json:"name" bun:"name"`
 	Address   string    `json:"address" bun:"address"`
 	Disease   string    `json:"disease" bun:"disease"`
-	Phone     int       `json:"phone" bun:"phone"`
-	Year      int       `json:"year" bun:"year"`
-	Month     int       `json:"month" bun:"month"`
-	Date      int       `json:"date" bun:"date"`
+	Phone     string    `json:"phone" bun:"phone"`
 	CreatedAt time.Time `json:"createdAt" bun:"created_at"`
 	UpdatedAt time.Time `json:"updatedAt" bun:"updated_at"`
+
+	DateOfBirth Date `json:"dateOfBirth" bun:"date_of_birth,type:date"`
+
+	// Version is bumped on every update and served as the ETag. It is in
+	// the JSON too, so WebSocket clients can tell stale changes apart, but
+	// the version a client sends is ignored.
+	Version int `json:"version" bun:"version"`
+
+	// DeletedAt is set while the patient is in the trash. bun leaves such
+	// rows out of every query unless it is asked for deleted rows.
+	DeletedAt *time.Time `json:"deletedAt,omitempty" bun:"deleted_at,soft_delete,nullzero"`
+
+	// DiseaseIndex, AddressIndex and PhoneIndex are the blind indexes of
+	// the columns encrypted at rest. They only exist inside postgresRepo.
+	DiseaseIndex []byte `json:"-" bun:"disease_bidx,nullzero"`
+	AddressIndex []byte `json:"-" bun:"address_bidx,nullzero"`
+	PhoneIndex   []byte `json:"-" bun:"phone_bidx,nullzero"`
+
+	// legacyDateOfBirth holds the year, month and date fields that clients
+	// sent before dateOfBirth existed, until applyLegacyDateOfBirth turns
+	// them into DateOfBirth.
+	legacyDateOfBirth *legacyDate
+
+	// redacted lists, by JSON name, the fields the caller is not allowed to
+	// see. They are zeroed and left out of the JSON.
+	redacted []string
+}
+
+type legacyDate struct {
+	Year  *int `json:"year"`
+	Month *int `json:"month"`
+	Date  *int `json:"date"`
+}
+
+func (p *Patient) UnmarshalJSON(data []byte) error {
+	type patientJSON Patient
+	var in struct {
+		patientJSON
+		legacyDate
+
+		// older clients send the phone as a JSON number
+		Phone json.RawMessage `json:"phone"`
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	*p = Patient(in.patientJSON)
+	if len(in.Phone) > 0 {
+		phone, err := decodePhone(in.Phone)
+		if err != nil {
+			return err
+		}
+		p.Phone = phone
+	}
+	if in.Year != nil || in.Month != nil || in.Date != nil {
+		legacy := in.legacyDate
+		p.legacyDateOfBirth = &legacy
+	}
+	return nil
+}
+
+// MarshalJSON leaves out the redacted fields.
+func (p Patient) MarshalJSON() ([]byte, error) {
+	type patientJSON Patient
+	data, err := json.Marshal(patientJSON(p))
+	if err != nil || len(p.redacted) == 0 {
+		return data, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for _, name := range p.redacted {
+		delete(fields, name)
+	}
+	return json.Marshal(fields)
+}
+
+func decodePhone(data json.RawMessage) (string, error) {
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err == nil {
+		return number.String(), nil
+	}
+	var phone *string
+	if err := json.Unmarshal(data, &phone); err != nil {
+		return "", fmt.Errorf("phone should be a string: %w", err)
+	}
+	if phone == nil {
+		return "", nil
+	}
+	return *phone, nil
+}
+
+// applyLegacyDateOfBirth sets DateOfBirth from the legacy fields p was
+// decoded with. Parts that were left out keep their current value, so a
+// patch can change just the year.
+func applyLegacyDateOfBirth(p *Patient) []string {
+	legacy := p.legacyDateOfBirth
+	p.legacyDateOfBirth = nil
+	if legacy == nil {
+		return nil
+	}
+
+	d := p.DateOfBirth
+	if legacy.Year != nil {
+		d.Year = *legacy.Year
+	}
+	if legacy.Month != nil {
+		d.Month = time.Month(*legacy.Month)
+	}
+	if legacy.Date != nil {
+		d.Day = *legacy.Date
+	}
+	if !d.valid() {
+		return []string{mistakeInvalidDateOfBirth}
+	}
+	p.DateOfBirth = d
+	return nil
 }
 
 const (
 	mistakeNegativeId   = "id should be positive"
-	mistakeInvalidMonth = "month should be positive or less than 13"
-	mistakeInvalidDate  = "date should be positive or less than 32"
-	mistakeInvalidyear  = "year should be positive or negative"
+	mistakeClientId     = "id is assigned by the server"
+	mistakeIdChanged    = "id cannot be changed"
 	mistakeEmptyName    = "name cannot be empty"
 	mistakeEmptyAddress = "address cannot be empty"
 	mistakeEmptyDisease = "disease cannot be empty"
-	mistakeInvalidPhone = "contact Number should be postive"
+
+	mistakeEmptyDateOfBirth   = "dateOfBirth cannot be empty"
+	mistakeInvalidDateOfBirth = "dateOfBirth should be a real calendar date"
+	mistakeFutureDateOfBirth  = "dateOfBirth cannot be in the future"
+	mistakeLegacyDateOfBirth  = "year, month and date are no longer accepted, send dateOfBirth as YYYY-MM-DD"
+
+	mistakeEncryptedPrefix = "values cannot start with " + encryptedPrefix
 )
 
 type ValidationError struct {
@@ -41,12 +165,24 @@ func (e ValidationError) Error() string {
 	return strings.Join(e.Mistakes, ", ")
 }
 
-func patientValidation(p Patient) error {
+func patientValidation(p Patient, phoneRegion string) error {
 	var mistakes []string
 	if p.Id <= 0 {
 		mistakes = append(mistakes, mistakeNegativeId)
 	}
 
+	mistakes = append(mistakes, patientFieldMistakes(p, phoneRegion)...)
+	if len(mistakes) > 0 {
+		return &ValidationError{Mistakes: mistakes}
+	}
+	return nil
+}
+
+// patientFieldMistakes checks everything about p except its id, which is
+// validated differently on create and on update. A phone without a country
+// code is read as a number in phoneRegion.
+func patientFieldMistakes(p Patient, phoneRegion string) []string {
+	var mistakes []string
 	if p.Name == "" {
 		mistakes = append(mistakes, mistakeEmptyName)
 	}
@@ -55,27 +191,68 @@ func patientValidation(p Patient) error {
 		mistakes = append(mistakes, mistakeEmptyDisease)
 	}
 
-	if p.Phone == 0 {
-		mistakes = append(mistakes, mistakeInvalidPhone)
+	if _, mistake := parsePhone(p.Phone, phoneRegion); mistake != "" {
+		mistakes = append(mistakes, mistake)
 	}
 
-	if p.Year == 0 {
-		mistakes = append(mistakes, mistakeInvalidyear)
+	if p.DateOfBirth.IsZero() {
+		mistakes = append(mistakes, mistakeEmptyDateOfBirth)
+	} else if !p.DateOfBirth.valid() {
+		mistakes = append(mistakes, mistakeInvalidDateOfBirth)
+	} else if p.DateOfBirth.After(today()) {
+		mistakes = append(mistakes, mistakeFutureDateOfBirth)
 	}
 
-	if p.Month <= 0 || p.Month > 12 {
-		mistakes = append(mistakes, mistakeInvalidMonth)
+	if p.Address == "" {
+		mistakes = append(mistakes, mistakeEmptyAddress)
 	}
 
-	if p.Date <= 0 || p.Date > 31 {
-		mistakes = append(mistakes, mistakeInvalidDate)
+	// Encrypted columns are stored with this prefix, so a value that
+	// starts with it would be read back as ciphertext.
+	for _, value := range []string{p.Name, p.Disease, p.Address, p.Phone} {
+		if strings.HasPrefix(value, encryptedPrefix) {
+			mistakes = append(mistakes, mistakeEncryptedPrefix)
+			break
+		}
 	}
+	return mistakes
+}
 
-	if p.Address == "" {
-		mistakes = append(mistakes, mistakeEmptyAddress)
+// patientColumns lists the columns a client may change, with the JSON name
+// and accessors of the matching Patient field.
+var patientColumns = []struct {
+	name string
+	json string
+	get  func(p *Patient) any
+	set  func(dst *Patient, src Patient)
+}{
+	{"name", "name", func(p *Patient) any { return p.Name }, func(dst *Patient, src Patient) { dst.Name = src.Name }},
+	{"address", "address", func(p *Patient) any { return p.Address }, func(dst *Patient, src Patient) { dst.Address = src.Address }},
+	{"disease", "disease", func(p *Patient) any { return p.Disease }, func(dst *Patient, src Patient) { dst.Disease = src.Disease }},
+	{"phone", "phone", func(p *Patient) any { return p.Phone }, func(dst *Patient, src Patient) { dst.Phone = src.Phone }},
+	{"date_of_birth", "dateOfBirth", func(p *Patient) any { return p.DateOfBirth }, func(dst *Patient, src Patient) { dst.DateOfBirth = src.DateOfBirth }},
+}
+
+// changedPatientColumns returns the client-editable columns that differ
+// between before and after.
+func changedPatientColumns(before, after Patient) []string {
+	var columns []string
+	for _, c := range patientColumns {
+		if c.get(&before) != c.get(&after) {
+			columns = append(columns, c.name)
+		}
 	}
-	if len(mistakes) > 0 {
-		return &ValidationError{Mistakes: mistakes}
+	return columns
+}
+
+// copyPatientColumns copies the given client-editable columns from src to
+// dst, leaving every other field of dst alone.
+func copyPatientColumns(dst *Patient, src Patient, columns []string) {
+	for _, c := range patientColumns {
+		for _, name := range columns {
+			if c.name == name {
+				c.set(dst, src)
+			}
+		}
 	}
-	return nil
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+const (
+	sortById        = "id"
+	sortByName      = "name"
+	sortByAddress   = "address"
+	sortByDisease   = "disease"
+	sortByCreatedAt = "createdAt"
+	sortByUpdatedAt = "updatedAt"
+)
+
+// sortColumns maps the sort fields accepted by the API to their column in
+// the patients table.
+var sortColumns = map[string]string{
+	sortById:        "id",
+	sortByName:      "name",
+	sortByAddress:   "address",
+	sortByDisease:   "disease",
+	sortByCreatedAt: "created_at",
+	sortByUpdatedAt: "updated_at",
+}
+
+const (
+	mistakeInvalidLimit     = "limit should be between 1 and 500"
+	mistakeInvalidOffset    = "offset should not be negative"
+	mistakeInvalidSort      = "sort should be one of id, name, address, disease, createdAt, updatedAt"
+	mistakeInvalidOrder     = "order should be asc or desc"
+	mistakeInvalidDateRange = "admittedFrom should not be after admittedTo"
+)
+
+// PatientQuery describes one page of a filtered, sorted patient listing.
+// Text filters are case-insensitive substring matches, except that Disease
+// and Address match whole values, ignoring case and spacing, when those
+// columns are encrypted. The admission range is applied to CreatedAt, both
+// ends inclusive.
+type PatientQuery struct {
+	Limit        int
+	Offset       int
+	SortBy       string
+	SortDesc     bool
+	Name         string
+	Disease      string
+	Address      string
+	AdmittedFrom time.Time
+	AdmittedTo   time.Time
+}
+
+type PatientPage struct {
+	Patients []Patient
+	Total    int
+}
+
+func newPatientQuery() PatientQuery {
+	return PatientQuery{Limit: defaultPageSize, SortBy: sortById}
+}
+
+func patientQueryValidation(q PatientQuery) error {
+	var mistakes []string
+	if q.Limit <= 0 || q.Limit > maxPageSize {
+		mistakes = append(mistakes, mistakeInvalidLimit)
+	}
+
+	if q.Offset < 0 {
+		mistakes = append(mistakes, mistakeInvalidOffset)
+	}
+
+	if _, ok := sortColumns[q.SortBy]; !ok {
+		mistakes = append(mistakes, mistakeInvalidSort)
+	}
+
+	if !q.AdmittedFrom.IsZero() && !q.AdmittedTo.IsZero() && q.AdmittedFrom.After(q.AdmittedTo) {
+		mistakes = append(mistakes, mistakeInvalidDateRange)
+	}
+	if len(mistakes) > 0 {
+		return &ValidationError{Mistakes: mistakes}
+	}
+	return nil
+}
+
+func (q PatientQuery) matches(p Patient) bool {
+	if !containsFold(p.Name, q.Name) || !containsFold(p.Disease, q.Disease) || !containsFold(p.Address, q.Address) {
+		return false
+	}
+
+	if !q.AdmittedFrom.IsZero() && p.CreatedAt.Before(q.AdmittedFrom) {
+		return false
+	}
+
+	if !q.AdmittedTo.IsZero() && p.CreatedAt.After(q.AdmittedTo) {
+		return false
+	}
+	return true
+}
+
+func (q PatientQuery) less(a, b Patient) bool {
+	switch q.SortBy {
+	case sortByName:
+		return lessFold(a.Name, b.Name)
+	case sortByAddress:
+		return lessFold(a.Address, b.Address)
+	case sortByDisease:
+		return lessFold(a.Disease, b.Disease)
+	case sortByCreatedAt:
+		return a.CreatedAt.Before(b.CreatedAt)
+	case sortByUpdatedAt:
+		return a.UpdatedAt.Before(b.UpdatedAt)
+	default:
+		return a.Id < b.Id
+	}
+}
+
+// apply filters, sorts and pages patients in memory. Ties on the sort field
+// are broken by id so that pages are stable.
+func (q PatientQuery) apply(patients []Patient) PatientPage {
+	filtered := make([]Patient, 0, len(patients))
+	for _, p := range patients {
+		if q.matches(p) {
+			filtered = append(filtered, p)
+		}
+	}
+
+	sort.SliceStable(filtered, func(i, j int) bool {
+		a, b := filtered[i], filtered[j]
+		if q.SortDesc {
+			a, b = b, a
+		}
+		if q.less(a, b) {
+			return true
+		}
+		if q.less(b, a) {
+			return false
+		}
+		return a.Id < b.Id
+	})
+
+	total := len(filtered)
+	start := min(q.Offset, total)
+	end := min(start+q.Limit, total)
+
+	return PatientPage{Patients: filtered[start:end], Total: total}
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// lessFold orders text case-insensitively, which is closer to how Postgres
+// collates the same columns than a plain byte comparison.
+func lessFold(a, b string) bool {
+	return strings.ToLower(a) < strings.ToLower(b)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// defaultPhoneRegion is the region assumed for numbers written without a
+// +<country code> prefix.
+const defaultPhoneRegion = "IN"
+
+const (
+	mistakeEmptyPhone       = "phone cannot be empty"
+	mistakePhoneNotANumber  = "phone should only contain digits, spaces, dashes, brackets and a leading +"
+	mistakePhoneCountryCode = "phone has an unknown country code, write it as +<country code> <number>"
+	mistakePhoneTooShort    = "phone has too few digits"
+	mistakePhoneTooLong     = "phone has too many digits"
+	mistakePhoneLength      = "phone has the wrong number of digits for its region"
+	mistakePhoneInvalid     = "phone is not a number that can be dialled in its region"
+)
+
+// parsePhone normalizes phone to E.164, such as +919876543210, reading it
+// as a number in region unless it starts with a country code. When phone
+// cannot be normalized the returned mistake says why.
+func parsePhone(phone, region string) (string, string) {
+	if strings.TrimSpace(phone) == "" {
+		return "", mistakeEmptyPhone
+	}
+
+	number, err := phonenumbers.Parse(phone, region)
+	switch {
+	case errors.Is(err, phonenumbers.ErrInvalidCountryCode):
+		return "", mistakePhoneCountryCode
+	case errors.Is(err, phonenumbers.ErrTooShortNSN), errors.Is(err, phonenumbers.ErrTooShortAfterIDD):
+		return "", mistakePhoneTooShort
+	case errors.Is(err, phonenumbers.ErrNumTooLong):
+		return "", mistakePhoneTooLong
+	case err != nil:
+		return "", mistakePhoneNotANumber
+	}
+
+	switch phonenumbers.IsPossibleNumberWithReason(number) {
+	case phonenumbers.IS_POSSIBLE:
+	case phonenumbers.INVALID_COUNTRY_CODE:
+		return "", mistakePhoneCountryCode
+	case phonenumbers.TOO_SHORT:
+		return "", mistakePhoneTooShort
+	case phonenumbers.TOO_LONG:
+		return "", mistakePhoneTooLong
+	default:
+		return "", mistakePhoneLength
+	}
+
+	if !phonenumbers.IsValidNumber(number) {
+		return "", mistakePhoneInvalid
+	}
+	return phonenumbers.Format(number, phonenumbers.E164), ""
+}
+
+func validPhoneRegion(region string) bool {
+	return phonenumbers.GetSupportedRegions()[region]
+}
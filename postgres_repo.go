@@ -5,104 +5,420 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/uptrace/bun"
 	"github.com/uptrace/bun/driver/pgdriver"
 )
 
 type postgresRepo struct {
-	db *bun.DB
+	db     *bun.DB
+	logger *slog.Logger
+
+	// keys, when set, encrypts the encryptedColumns of every patient
+	// written, see sealPatient.
+	keys *keyring
+}
+
+// newPostgresRepo also logs the queries run through db, see queryLogHook.
+func newPostgresRepo(db *bun.DB, logger *slog.Logger) *postgresRepo {
+	db.AddQueryHook(queryLogHook{logger: logger})
+	return &postgresRepo{db: db, logger: logger}
+}
+
+// queryLogHook logs every query at debug level and failed queries as
+// errors. Bun inlines the arguments into the query text, so only the
+// operation and table are logged to keep patient data out of the logs.
+type queryLogHook struct {
+	logger *slog.Logger
 }
 
-func newPostgresRepo(db *bun.DB) *postgresRepo {
-	return &postgresRepo{db: db}
+func (h queryLogHook) BeforeQuery(ctx context.Context, _ *bun.QueryEvent) context.Context {
+	return ctx
 }
 
-func (dbrepo *postgresRepo) doesPatientExist(id int) (bool, error) {
+func (h queryLogHook) AfterQuery(ctx context.Context, event *bun.QueryEvent) {
+	level := slog.LevelDebug
+	attrs := []slog.Attr{
+		slog.String("operation", event.Operation()),
+		slog.Duration("duration", time.Since(event.StartTime)),
+	}
+	if event.IQuery != nil {
+		attrs = append(attrs, slog.String("table", event.IQuery.GetTableName()))
+	}
+	if event.Err != nil {
+		attrs = append(attrs, slog.String("error", event.Err.Error()))
+		if !expectedQueryError(event.Err) {
+			level = slog.LevelError
+		}
+	}
+	h.logger.LogAttrs(ctx, level, "query", attrs...)
+}
+
+// expectedQueryError reports whether err is one the repository turns into
+// an answer, such as errPatientNotFound or errDuplicateId.
+func expectedQueryError(err error) bool {
+	var pgErr pgdriver.Error
+	return errors.Is(err, sql.ErrNoRows) || (errors.As(err, &pgErr) && pgErr.Field('C') == "23505")
+}
+
+// lockPatient reads a patient that is not in the trash and locks its row
+// until tx ends, so that it is the row the change in tx replaces.
+func (dbrepo *postgresRepo) lockPatient(ctx context.Context, tx bun.Tx, id int) (Patient, error) {
 	var patient Patient
-	err := dbrepo.db.NewSelect().Model(&patient).Where("id = ?", id).Scan(context.Background())
-	if err != nil {
+	if err := tx.NewSelect().Model(&patient).Where("id = ?", id).For("UPDATE").Scan(ctx); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return false, nil
+			return Patient{}, errPatientNotFound
 		}
-		return false, err
+		return Patient{}, err
 	}
-	return true, nil
+	return patient, dbrepo.openPatient(&patient)
 }
 
-func (dbrepo *postgresRepo) createPatient(p Patient) error {
-	_, err := dbrepo.db.NewInsert().Model(&p).Exec(context.Background())
-	pgDriverErr, ok := err.(pgdriver.Error)
-	if ok {
-		errCode := pgDriverErr.Field('C')
-		if errCode == "23505" {
-			return errDuplicateId
-		} else {
+func (dbrepo *postgresRepo) createPatient(ctx context.Context, p Patient) (Patient, error) {
+	imported := p.Id != 0
+	row, err := dbrepo.sealPatient(p)
+	if err != nil {
+		return Patient{}, err
+	}
+	err = dbrepo.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewInsert().Model(&row).Exec(ctx)
+		pgDriverErr, ok := err.(pgdriver.Error)
+		if ok {
+			errCode := pgDriverErr.Field('C')
+			if errCode == "23505" {
+				return errDuplicateId
+			} else {
+				return err
+			}
+		}
+		if err != nil {
 			return err
 		}
+		p.Id = row.Id
+
+		if imported {
+			// keep the identity sequence ahead of imported ids so later
+			// server-assigned ids do not collide with them
+			_, err = tx.NewRaw("SELECT setval('patients_id_seq', GREATEST(?, (SELECT last_value FROM patients_id_seq)))", p.Id).Exec(ctx)
+			if err != nil {
+				return err
+			}
+			dbrepo.logger.DebugContext(ctx, "id sequence moved past imported patient", "patient_id", p.Id)
+		}
+		return dbrepo.addAuditEntry(ctx, tx, newAuditEntry(ctx, p.Id, auditCreate, p.CreatedAt, auditChanges(nil, &p)))
+	})
+	if err != nil {
+		return Patient{}, err
 	}
-	return nil
+	return p, nil
 }
-func (dbrepo *postgresRepo) getPatients() ([]Patient, error) {
+
+func (dbrepo *postgresRepo) getPatients(ctx context.Context) ([]Patient, error) {
+	patients := make([]Patient, 0)
+	if err := dbrepo.db.NewSelect().Model(&patients).Scan(ctx); err != nil {
+		return nil, err
+	}
+	return patients, dbrepo.openPatients(patients)
+}
+
+func (dbrepo *postgresRepo) findPatients(ctx context.Context, q PatientQuery) (PatientPage, error) {
 	patients := make([]Patient, 0)
-	err := dbrepo.db.NewSelect().Model(&patients).Scan(context.Background())
-	return patients, err
+	query := dbrepo.db.NewSelect().Model(&patients)
+
+	if q.Name != "" {
+		query = query.Where("name ILIKE ?", likePattern(q.Name))
+	}
+	// encrypted columns can only be matched exactly, through their blind
+	// index, and not sorted by
+	if dbrepo.keys != nil && isEncryptedColumn(sortColumns[q.SortBy]) {
+		return PatientPage{}, &ValidationError{Mistakes: []string{fmt.Sprintf("cannot sort by %s, it is encrypted", q.SortBy)}}
+	}
+	for _, f := range []struct{ column, value string }{{"disease", q.Disease}, {"address", q.Address}} {
+		switch {
+		case f.value == "":
+		case dbrepo.keys != nil:
+			query = query.Where("? = ?", bun.Ident(f.column+"_bidx"), dbrepo.keys.blindIndex(f.column, f.value))
+		default:
+			query = query.Where("? ILIKE ?", bun.Ident(f.column), likePattern(f.value))
+		}
+	}
+	if !q.AdmittedFrom.IsZero() {
+		query = query.Where("created_at >= ?", q.AdmittedFrom)
+	}
+	if !q.AdmittedTo.IsZero() {
+		query = query.Where("created_at <= ?", q.AdmittedTo)
+	}
+
+	direction := "ASC"
+	if q.SortDesc {
+		direction = "DESC"
+	}
+	query = query.
+		OrderExpr("? "+direction, bun.Ident(sortColumns[q.SortBy])).
+		OrderExpr("id " + direction).
+		Limit(q.Limit).
+		Offset(q.Offset)
+
+	total, err := query.ScanAndCount(ctx)
+	if err != nil {
+		return PatientPage{}, err
+	}
+	if err := dbrepo.openPatients(patients); err != nil {
+		return PatientPage{}, err
+	}
+	return PatientPage{Patients: patients, Total: total}, nil
+}
+
+// likePattern turns s into an ILIKE substring pattern, escaping the
+// wildcards so user input is matched literally.
+func likePattern(s string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+	return "%" + escaped + "%"
+}
+
+type searchRow struct {
+	Patient `bun:",extend"`
+
+	Rank float64 `bun:"rank"`
+}
+
+func (dbrepo *postgresRepo) searchPatients(ctx context.Context, terms []string, fields []string, limit int) ([]SearchResult, error) {
+	if len(fields) == 0 {
+		return []SearchResult{}, nil
+	}
+	tsQuery := prefixTsQuery(terms, fields)
+	rows := make([]searchRow, 0)
+
+	err := dbrepo.db.NewSelect().Model(&rows).
+		ColumnExpr("?TableColumns").
+		ColumnExpr("ts_rank(search_vector, to_tsquery('simple', ?)) AS rank", tsQuery).
+		Where("search_vector @@ to_tsquery('simple', ?)", tsQuery).
+		OrderExpr("rank DESC, id ASC").
+		Limit(limit).
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]SearchResult, len(rows))
+	for i, row := range rows {
+		// encrypted values are not in search_vector, so they did not match
+		encrypted := map[string]bool{}
+		for _, c := range encryptedColumns {
+			_, encrypted[c.name] = encryptionKeyId(*c.value(&row.Patient))
+		}
+		if err := dbrepo.openPatient(&row.Patient); err != nil {
+			return nil, err
+		}
+
+		// highlighted the same way as searchInMemory rather than with
+		// ts_headline, which does not escape the text it returns
+		highlights := make(map[string]string)
+		for _, sw := range searchWeights {
+			highlighted, matched := highlightTerms(sw.value(row.Patient), terms)
+			if len(matched) > 0 && !encrypted[sw.field] && slices.Contains(fields, sw.field) {
+				highlights[sw.field] = highlighted
+			}
+		}
+		results[i] = SearchResult{Patient: row.Patient, Rank: row.Rank, Highlights: highlights}
+	}
+	return results, nil
 }
 
-func (dbrepo *postgresRepo) getPatient(id int) (Patient, error) {
+func (dbrepo *postgresRepo) getPatient(ctx context.Context, id int) (Patient, error) {
 	var patient Patient
-	if err := dbrepo.db.NewSelect().Model(&patient).Where("id = ?", id).Scan(context.Background()); err != nil {
+	if err := dbrepo.db.NewSelect().Model(&patient).Where("id = ?", id).Scan(ctx); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Patient{}, errPatientNotFound
 		}
 		return Patient{}, err
 	}
 
-	return patient, nil
+	return patient, dbrepo.openPatient(&patient)
 }
 
-func (dbrepo *postgresRepo) deletePatient(id int) error {
-	exists, err := dbrepo.doesPatientExist(id)
+// deletePatient moves the patient to the trash and returns the row it
+// deleted.
+func (dbrepo *postgresRepo) deletePatient(ctx context.Context, id int) (Patient, error) {
+	var stored Patient
+	err := dbrepo.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var err error
+		if stored, err = dbrepo.lockPatient(ctx, tx, id); err != nil {
+			return err
+		}
+
+		// Patient has a soft_delete column, so bun turns this into an
+		// UPDATE that sets deleted_at
+		deletedAt := time.Now()
+		if _, err := tx.NewDelete().Model((*Patient)(nil)).Where("id = ?", id).Exec(ctx); err != nil {
+			return err
+		}
+		return dbrepo.addAuditEntry(ctx, tx, newAuditEntry(ctx, id, auditDelete, deletedAt, auditChanges(&stored, nil)))
+	})
 	if err != nil {
-		return err
-	}
-	if !exists {
-		return errPatientNotFound
+		return Patient{}, err
 	}
+	return stored, nil
+}
+
+// updatePatient replaces the stored patient only if it is still at
+// p.Version, and returns it with the version bumped.
+func (dbrepo *postgresRepo) updatePatient(ctx context.Context, p Patient) (Patient, error) {
+	err := dbrepo.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		stored, err := dbrepo.lockPatient(ctx, tx, p.Id)
+		if err != nil {
+			return err
+		}
+		if stored.Version != p.Version {
+			return errVersionConflict
+		}
 
-	result, err := dbrepo.db.NewDelete().Model((*Patient)(nil)).Where("id = ?", id).Exec(context.Background())
+		p.Version++
+		row, err := dbrepo.sealPatient(p)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.NewUpdate().Model(&row).Where("id = ?", p.Id).Exec(ctx); err != nil {
+			return err
+		}
+		return dbrepo.addAuditEntry(ctx, tx, newAuditEntry(ctx, p.Id, auditUpdate, p.UpdatedAt, auditChanges(&stored, &p)))
+	})
 	if err != nil {
-		return err
+		return Patient{}, err
 	}
-	rowsAffected, err := result.RowsAffected()
+	return p, nil
+}
+
+// patchPatient writes only the given columns (plus UpdatedAt) of p, if the
+// stored patient is still at p.Version.
+func (dbrepo *postgresRepo) patchPatient(ctx context.Context, p Patient, columns []string) (Patient, error) {
+	var updated Patient
+	err := dbrepo.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		stored, err := dbrepo.lockPatient(ctx, tx, p.Id)
+		if err != nil {
+			return err
+		}
+		if stored.Version != p.Version {
+			return errVersionConflict
+		}
+
+		updated = stored
+		copyPatientColumns(&updated, p, columns)
+		updated.UpdatedAt = p.UpdatedAt
+		updated.Version++
+		row, err := dbrepo.sealPatient(updated)
+		if err != nil {
+			return err
+		}
+		written := append(slices.Clone(columns), "updated_at", "version")
+		for _, c := range encryptedColumns {
+			if slices.Contains(written, c.name) {
+				written = append(written, c.name+"_bidx")
+			}
+		}
+		_, err = tx.NewUpdate().
+			Model(&row).
+			Column(written...).
+			Where("id = ?", p.Id).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		return dbrepo.addAuditEntry(ctx, tx, newAuditEntry(ctx, p.Id, auditUpdate, updated.UpdatedAt, auditChanges(&stored, &updated)))
+	})
 	if err != nil {
-		return err
+		return Patient{}, err
 	}
-	if rowsAffected == 0 {
-		return fmt.Errorf("no rows were deleted")
+	return updated, nil
+}
+
+func (dbrepo *postgresRepo) getDeletedPatients(ctx context.Context) ([]Patient, error) {
+	patients := make([]Patient, 0)
+	if err := dbrepo.db.NewSelect().Model(&patients).WhereDeleted().OrderExpr("deleted_at DESC, id ASC").Scan(ctx); err != nil {
+		return nil, err
 	}
-	return nil
+	return patients, dbrepo.openPatients(patients)
 }
 
-func (dbrepo *postgresRepo) updatePatient(p Patient) error {
-	exists, err := dbrepo.doesPatientExist(p.Id)
+func (dbrepo *postgresRepo) restorePatient(ctx context.Context, id int, restoredAt time.Time) (Patient, error) {
+	var restored Patient
+	err := dbrepo.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		result, err := tx.NewUpdate().
+			Model((*Patient)(nil)).
+			WhereDeleted().
+			Set("deleted_at = NULL").
+			Set("updated_at = ?", restoredAt).
+			Set("version = version + 1").
+			Where("id = ?", id).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return errPatientNotFound
+		}
+		if restored, err = dbrepo.lockPatient(ctx, tx, id); err != nil {
+			return err
+		}
+		return dbrepo.addAuditEntry(ctx, tx, newAuditEntry(ctx, id, auditRestore, restoredAt, []FieldChange{}))
+	})
 	if err != nil {
-		return err
-	}
-	if !exists {
-		return errPatientNotFound
+		return Patient{}, err
 	}
+	return restored, nil
+}
+
+func (dbrepo *postgresRepo) purgePatients(ctx context.Context, deletedBefore time.Time) ([]int, error) {
+	purged := make([]int, 0)
+	err := dbrepo.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewDelete().
+			Model((*Patient)(nil)).
+			WhereDeleted().
+			Where("deleted_at < ?", deletedBefore).
+			ForceDelete().
+			Returning("id").
+			Exec(ctx, &purged)
+		if err != nil {
+			return err
+		}
 
-	result, err := dbrepo.db.NewUpdate().Model(&p).Where("id = ?", p.Id).Exec(context.Background())
+		// the delete entry already holds the values the patient had
+		purgedAt := time.Now()
+		for _, id := range purged {
+			if err := dbrepo.addAuditEntry(ctx, tx, newAuditEntry(ctx, id, auditPurge, purgedAt, []FieldChange{})); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	rowsAffected, err := result.RowsAffected()
+	return purged, nil
+}
+
+// addAuditEntry writes e in tx, the transaction of the change it records.
+func (dbrepo *postgresRepo) addAuditEntry(ctx context.Context, tx bun.Tx, e AuditEntry) error {
+	row, err := dbrepo.sealAuditEntry(e)
 	if err != nil {
 		return err
 	}
-	if rowsAffected == 0 {
-		return errors.New("no rows were updated")
+	_, err = tx.NewInsert().Model(&row).Exec(ctx)
+	return err
+}
+
+func (dbrepo *postgresRepo) getAuditEntries(ctx context.Context, patientId int) ([]AuditEntry, error) {
+	entries := make([]AuditEntry, 0)
+	if err := dbrepo.db.NewSelect().Model(&entries).Where("patient_id = ?", patientId).OrderExpr("at ASC, id ASC").Scan(ctx); err != nil {
+		return nil, err
 	}
-	return nil
+	return entries, dbrepo.openAuditEntries(entries)
 }
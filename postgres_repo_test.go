@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
+	"slices"
 	"testing"
 	"time"
 
@@ -10,8 +12,18 @@ import (
 	"github.com/uptrace/bun"
 )
 
+// testDatabaseConfig points the tests at the database given by the
+// PATIENTS_* environment, which defaults to the local development one.
+func testDatabaseConfig(t *testing.T) DatabaseConfig {
+	cfg, _, err := loadConfig(nil, os.LookupEnv)
+	if err != nil {
+		t.Fatalf("failed to load database configuration: %v", err)
+	}
+	return cfg.Database
+}
+
 func setup(db *bun.DB, existingPatients []Patient) error {
-	_, err := db.NewDelete().Model((*Patient)(nil)).Where("true").Exec(context.Background())
+	_, err := db.NewDelete().Model((*Patient)(nil)).WhereAllWithDeleted().Where("true").ForceDelete().Exec(context.Background())
 	if err != nil {
 		return fmt.Errorf("failed to delete existing patients: %w", err)
 	}
@@ -38,41 +50,35 @@ func TestPostgresRepo_createPatient(t *testing.T) {
 		{
 			name: "duplicate id :NEG",
 			args: Patient{
-				Id:      1,
-				Name:    "abc",
-				Disease: "cold",
-				Phone:   12345,
-				Address: "surat",
-				Date:    12,
-				Month:   12,
-				Year:    2022,
+				Id:          1,
+				Name:        "abc",
+				Disease:     "cold",
+				Phone:       "+919876543210",
+				Address:     "surat",
+				DateOfBirth: newDate(2022, 12, 12),
 			},
 			existingPatients: []Patient{
 				{
-					Id:        1,
-					Name:      "abc",
-					Disease:   "cold",
-					Phone:     12345,
-					Address:   "surat",
-					Date:      12,
-					Month:     12,
-					Year:      2022,
-					CreatedAt: testTime,
-					UpdatedAt: testTime,
+					Id:          1,
+					Name:        "abc",
+					Disease:     "cold",
+					Phone:       "+919876543210",
+					Address:     "surat",
+					DateOfBirth: newDate(2022, 12, 12),
+					CreatedAt:   testTime,
+					UpdatedAt:   testTime,
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:        1,
-					Name:      "abc",
-					Disease:   "cold",
-					Phone:     12345,
-					Address:   "surat",
-					Date:      12,
-					Month:     12,
-					Year:      2022,
-					CreatedAt: testTime,
-					UpdatedAt: testTime,
+					Id:          1,
+					Name:        "abc",
+					Disease:     "cold",
+					Phone:       "+919876543210",
+					Address:     "surat",
+					DateOfBirth: newDate(2022, 12, 12),
+					CreatedAt:   testTime,
+					UpdatedAt:   testTime,
 				},
 			},
 			wantErr: errDuplicateId,
@@ -80,55 +86,47 @@ func TestPostgresRepo_createPatient(t *testing.T) {
 		{
 			name: "successfully add patient :POS",
 			args: Patient{
-				Id:        3,
-				Name:      "ert",
-				Address:   "amd",
-				Disease:   "fever",
-				Phone:     65432,
-				Year:      2024,
-				Month:     12,
-				Date:      2,
-				CreatedAt: testTime,
-				UpdatedAt: testTime,
+				Id:          3,
+				Name:        "ert",
+				Address:     "amd",
+				Disease:     "fever",
+				Phone:       "+919900112233",
+				DateOfBirth: newDate(2024, 12, 2),
+				CreatedAt:   testTime,
+				UpdatedAt:   testTime,
 			},
 			existingPatients: []Patient{
 				{
-					Id:        2,
-					Name:      "abc",
-					Disease:   "cold",
-					Phone:     12345,
-					Address:   "surat",
-					Date:      12,
-					Month:     12,
-					Year:      2022,
-					CreatedAt: testTime,
-					UpdatedAt: testTime,
+					Id:          2,
+					Name:        "abc",
+					Disease:     "cold",
+					Phone:       "+919876543210",
+					Address:     "surat",
+					DateOfBirth: newDate(2022, 12, 12),
+					CreatedAt:   testTime,
+					UpdatedAt:   testTime,
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:        2,
-					Name:      "abc",
-					Disease:   "cold",
-					Phone:     12345,
-					Address:   "surat",
-					Date:      12,
-					Month:     12,
-					Year:      2022,
-					CreatedAt: testTime,
-					UpdatedAt: testTime,
+					Id:          2,
+					Name:        "abc",
+					Disease:     "cold",
+					Phone:       "+919876543210",
+					Address:     "surat",
+					DateOfBirth: newDate(2022, 12, 12),
+					CreatedAt:   testTime,
+					UpdatedAt:   testTime,
 				},
 				{
-					Id:        3,
-					Name:      "ert",
-					Address:   "amd",
-					Disease:   "fever",
-					Phone:     65432,
-					Year:      2024,
-					Month:     12,
-					Date:      2,
-					CreatedAt: testTime,
-					UpdatedAt: testTime,
+					Id:          3,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
+					CreatedAt:   testTime,
+					UpdatedAt:   testTime,
 				},
 			},
 		},
@@ -136,14 +134,14 @@ func TestPostgresRepo_createPatient(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			db := connectDB("postgres", "password", "localhost", "postgres", 5432)
-			repo := newPostgresRepo(db)
+			db := connectDB(testDatabaseConfig(t))
+			repo := newPostgresRepo(db, discardLogger())
 
 			if err := setup(repo.db, tt.existingPatients); err != nil {
 				t.Fatalf("failed to setup test: %v", err)
 			}
 
-			gotErr := repo.createPatient(tt.args)
+			_, gotErr := repo.createPatient(context.Background(), tt.args)
 			assert.ErrorIs(t, gotErr, tt.wantErr, "expect error to match")
 
 			var patients []Patient
@@ -170,46 +168,38 @@ func TestPostgresRepo_getPatients(t *testing.T) {
 			name: "get all patients :POS",
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "abc",
-					Disease: "cold",
-					Phone:   12345,
-					Address: "surat",
-					Date:    12,
-					Month:   12,
-					Year:    2022,
+					Id:          1,
+					Name:        "abc",
+					Disease:     "cold",
+					Phone:       "+919876543210",
+					Address:     "surat",
+					DateOfBirth: newDate(2022, 12, 12),
 				},
 				{
-					Id:      2,
-					Name:    "def",
-					Disease: "fever",
-					Phone:   54321,
-					Address: "abc",
-					Date:    10,
-					Month:   11,
-					Year:    2023,
+					Id:          2,
+					Name:        "def",
+					Disease:     "fever",
+					Phone:       "+919812345678",
+					Address:     "abc",
+					DateOfBirth: newDate(2023, 11, 10),
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "abc",
-					Disease: "cold",
-					Phone:   12345,
-					Address: "surat",
-					Date:    12,
-					Month:   12,
-					Year:    2022,
+					Id:          1,
+					Name:        "abc",
+					Disease:     "cold",
+					Phone:       "+919876543210",
+					Address:     "surat",
+					DateOfBirth: newDate(2022, 12, 12),
 				},
 				{
-					Id:      2,
-					Name:    "def",
-					Disease: "fever",
-					Phone:   54321,
-					Address: "abc",
-					Date:    10,
-					Month:   11,
-					Year:    2023,
+					Id:          2,
+					Name:        "def",
+					Disease:     "fever",
+					Phone:       "+919812345678",
+					Address:     "abc",
+					DateOfBirth: newDate(2023, 11, 10),
 				},
 			},
 		},
@@ -217,14 +207,14 @@ func TestPostgresRepo_getPatients(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			db := connectDB("postgres", "password", "localhost", "postgres", 5432)
-			repo := newPostgresRepo(db)
+			db := connectDB(testDatabaseConfig(t))
+			repo := newPostgresRepo(db, discardLogger())
 
 			if err := setup(repo.db, tt.existingPatients); err != nil {
 				t.Fatalf("failed to setup test: %v", err)
 			}
 
-			gotPatients, err := repo.getPatients()
+			gotPatients, err := repo.getPatients(context.Background())
 			if err != nil {
 				t.Fatalf("no error expected but got %v", err)
 			}
@@ -250,24 +240,20 @@ func TestPostgresRepo_getPatient(t *testing.T) {
 			name: "patient does not exist :NEG",
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 				{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			args:        args{id: 3},
@@ -278,50 +264,44 @@ func TestPostgresRepo_getPatient(t *testing.T) {
 			name: "patient exists :POS",
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 				{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			args: args{id: 2},
 			wantPatient: Patient{
-				Id:      2,
-				Name:    "wer",
-				Address: "srt",
-				Disease: "fever",
-				Phone:   12345,
-				Year:    2024,
-				Month:   12,
-				Date:    12,
+				Id:          2,
+				Name:        "wer",
+				Address:     "srt",
+				Disease:     "fever",
+				Phone:       "+919876543210",
+				DateOfBirth: newDate(2024, 12, 12),
 			},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			db := connectDB("postgres", "password", "localhost", "postgres", 5432)
-			repo := newPostgresRepo(db)
+			db := connectDB(testDatabaseConfig(t))
+			repo := newPostgresRepo(db, discardLogger())
 
 			if err := setup(repo.db, tt.existingPatients); err != nil {
 				t.Fatalf("failed to setup test: %v", err)
 			}
 
-			gotPatient, gotErr := repo.getPatient(tt.args.id)
+			gotPatient, gotErr := repo.getPatient(context.Background(), tt.args.id)
 			assert.ErrorIs(t, gotErr, tt.wantErr, "expected error and got error are not same")
 			assert.Equal(t, tt.wantPatient, gotPatient, "expect patients to match")
 		})
@@ -345,26 +325,22 @@ func TestPostgresRepo_deletePatient(t *testing.T) {
 			args: args{id: 2},
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			wantErr: errPatientNotFound,
@@ -374,36 +350,30 @@ func TestPostgresRepo_deletePatient(t *testing.T) {
 			args: args{id: 2},
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 				{
-					Id:      2,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          2,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 		},
@@ -411,15 +381,19 @@ func TestPostgresRepo_deletePatient(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			db := connectDB("postgres", "password", "localhost", "postgres", 5432)
-			repo := newPostgresRepo(db)
+			db := connectDB(testDatabaseConfig(t))
+			repo := newPostgresRepo(db, discardLogger())
 
 			if err := setup(repo.db, tt.existingPatients); err != nil {
 				t.Fatalf("failed to setup test: %v", err)
 			}
 
-			gotErr := repo.deletePatient(tt.args.id)
+			gotDeleted, gotErr := repo.deletePatient(context.Background(), tt.args.id)
 			assert.ErrorIs(t, gotErr, tt.wantErr, "expect error to match")
+			if tt.wantErr == nil {
+				assert.Equal(t, tt.args.id, gotDeleted.Id, "expect the deleted row to be returned")
+				assert.Nil(t, gotDeleted.DeletedAt, "expect the row as it was before the delete")
+			}
 
 			var patients []Patient
 			err := repo.db.NewSelect().Model(&patients).Scan(context.Background())
@@ -449,14 +423,12 @@ func TestPostgresRepo_updatePatient(t *testing.T) {
 			existingPatients: nil,
 			args: args{
 				patient: Patient{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			wantErr: errPatientNotFound,
@@ -465,38 +437,32 @@ func TestPostgresRepo_updatePatient(t *testing.T) {
 			name: "patient not found :NEG",
 			args: args{
 				patient: Patient{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "jhdfe",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   2,
-					Date:    22,
+					Id:          1,
+					Name:        "jhdfe",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 22),
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "jhdfe",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   2,
-					Date:    22,
+					Id:          1,
+					Name:        "jhdfe",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 22),
 				},
 			},
 			wantErr: errPatientNotFound,
@@ -505,83 +471,357 @@ func TestPostgresRepo_updatePatient(t *testing.T) {
 			name: "patient updated :POS",
 			args: args{
 				patient: Patient{
-					Id:        2,
-					Name:      "xyz",
-					Address:   "srt",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     12,
-					Date:      12,
-					CreatedAt: testTime,
-					UpdatedAt: testTime,
+					Id:          2,
+					Name:        "xyz",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+					CreatedAt:   testTime,
+					UpdatedAt:   testTime,
 				},
 			},
 			existingPatients: []Patient{
 				{
-					Id:        1,
-					Name:      "priya",
-					Address:   "surat",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     2,
-					Date:      22,
-					CreatedAt: testTime,
-					UpdatedAt: testTime,
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 22),
+					CreatedAt:   testTime,
+					UpdatedAt:   testTime,
 				},
 				{
-					Id:        2,
-					Name:      "abc",
-					Address:   "srt",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     2,
-					Date:      22,
-					CreatedAt: testTime,
-					UpdatedAt: testTime,
+					Id:          2,
+					Name:        "abc",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 22),
+					CreatedAt:   testTime,
+					UpdatedAt:   testTime,
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:        1,
-					Name:      "priya",
-					Address:   "surat",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     2,
-					Date:      22,
-					CreatedAt: testTime,
-					UpdatedAt: testTime,
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 22),
+					CreatedAt:   testTime,
+					UpdatedAt:   testTime,
+				},
+				{
+					Id:          2,
+					Name:        "xyz",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+					CreatedAt:   testTime,
+					UpdatedAt:   testTime,
+					Version:     1,
+				},
+			},
+		},
+		{
+			name: "stale version :NEG",
+			args: args{
+				patient: Patient{
+					Id:          1,
+					Name:        "xyz",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+					Version:     1,
+				},
+			},
+			existingPatients: []Patient{
+				{
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 22),
+					CreatedAt:   testTime,
+					UpdatedAt:   testTime,
+					Version:     2,
 				},
+			},
+			wantPatients: []Patient{
 				{
-					Id:        2,
-					Name:      "xyz",
-					Address:   "srt",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     12,
-					Date:      12,
-					CreatedAt: testTime,
-					UpdatedAt: testTime,
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 22),
+					CreatedAt:   testTime,
+					UpdatedAt:   testTime,
+					Version:     2,
 				},
 			},
+			wantErr: errVersionConflict,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			db := connectDB("postgres", "password", "localhost", "postgres", 5432)
-			repo := newPostgresRepo(db)
+			db := connectDB(testDatabaseConfig(t))
+			repo := newPostgresRepo(db, discardLogger())
 
 			if err := setup(repo.db, tt.existingPatients); err != nil {
 				t.Fatalf("failed to setup test: %v", err)
 			}
 
-			gotErr := repo.updatePatient(tt.args.patient)
+			_, gotErr := repo.updatePatient(context.Background(), tt.args.patient)
+			assert.ErrorIs(t, gotErr, tt.wantErr, "expect error to match")
+
+			var patients []Patient
+			err := repo.db.NewSelect().Model(&patients).Scan(context.Background())
+			if err != nil {
+				t.Fatalf("failed to retrieve patients: %v", err)
+			}
+			assert.Equal(t, tt.wantPatients, patients, "expect patients to match")
+		})
+	}
+}
+
+func TestPostgresRepo_findPatients(t *testing.T) {
+	day1 := time.Date(2024, time.August, 1, 10, 0, 0, 0, time.UTC)
+	day2 := time.Date(2024, time.August, 2, 10, 0, 0, 0, time.UTC)
+	day3 := time.Date(2024, time.August, 3, 10, 0, 0, 0, time.UTC)
+
+	existingPatients := []Patient{
+		{Id: 1, Name: "priya", Address: "surat", Disease: "fever", Phone: "+919876543210", DateOfBirth: newDate(2024, 12, 12), CreatedAt: day2, UpdatedAt: day2},
+		{Id: 2, Name: "abc", Address: "ahmedabad", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 12, 12), CreatedAt: day1, UpdatedAt: day1},
+		{Id: 3, Name: "priyanka", Address: "surat", Disease: "cold_flu", Phone: "+919876543210", DateOfBirth: newDate(2024, 12, 12), CreatedAt: day3, UpdatedAt: day3},
+	}
+
+	tests := []struct {
+		name    string
+		query   PatientQuery
+		wantIds []int
+		wantTot int
+	}{
+		{
+			name:    "default sort by id :POS",
+			query:   newPatientQuery(),
+			wantIds: []int{1, 2, 3},
+			wantTot: 3,
+		},
+		{
+			name:    "sort by name descending :POS",
+			query:   PatientQuery{Limit: 10, SortBy: sortByName, SortDesc: true},
+			wantIds: []int{3, 1, 2},
+			wantTot: 3,
+		},
+		{
+			name:    "limit and offset :POS",
+			query:   PatientQuery{Limit: 1, Offset: 1, SortBy: sortByCreatedAt},
+			wantIds: []int{1},
+			wantTot: 3,
+		},
+		{
+			name:    "case insensitive name filter :POS",
+			query:   PatientQuery{Limit: 10, SortBy: sortById, Name: "PRIYA"},
+			wantIds: []int{1, 3},
+			wantTot: 2,
+		},
+		{
+			name:    "wildcards are matched literally :POS",
+			query:   PatientQuery{Limit: 10, SortBy: sortById, Disease: "d_f"},
+			wantIds: []int{3},
+			wantTot: 1,
+		},
+		{
+			name:    "admission date range :POS",
+			query:   PatientQuery{Limit: 10, SortBy: sortById, AdmittedFrom: day1, AdmittedTo: day2},
+			wantIds: []int{1, 2},
+			wantTot: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := connectDB(testDatabaseConfig(t))
+			repo := newPostgresRepo(db, discardLogger())
+
+			if err := setup(repo.db, existingPatients); err != nil {
+				t.Fatalf("failed to setup test: %v", err)
+			}
+
+			gotPage, err := repo.findPatients(context.Background(), tt.query)
+			if err != nil {
+				t.Fatalf("no error expected but got %v", err)
+			}
+
+			gotIds := []int{}
+			for _, p := range gotPage.Patients {
+				gotIds = append(gotIds, p.Id)
+			}
+			assert.Equal(t, tt.wantIds, gotIds, "expect patient ids to match")
+			assert.Equal(t, tt.wantTot, gotPage.Total, "expect total to match")
+		})
+	}
+}
+
+func TestPostgresRepo_searchPatients(t *testing.T) {
+	existingPatients := []Patient{
+		{Id: 1, Name: "Priya Shah", Address: "Adajan, Surat", Disease: "fever", Phone: "+919876543210", DateOfBirth: newDate(2024, 12, 12)},
+		{Id: 2, Name: "Rahul", Address: "Priyadarshini Nagar", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 12, 12)},
+		{Id: 3, Name: "Meera", Address: "Surat", Disease: "viral fever", Phone: "+919876543210", DateOfBirth: newDate(2024, 12, 12)},
+		{Id: 4, Name: `<script>alert("x")</script> Anil`, Address: "Vesu", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 12, 12)},
+	}
+
+	tests := []struct {
+		name           string
+		terms          []string
+		fields         []string
+		wantIds        []int
+		wantHighlights []map[string]string
+	}{
+		{
+			name:           "no match :POS",
+			terms:          []string{"malaria"},
+			wantIds:        []int{},
+			wantHighlights: []map[string]string{},
+		},
+		{
+			name:    "partial name ranks name above address :POS",
+			terms:   []string{"priy"},
+			wantIds: []int{1, 2},
+			wantHighlights: []map[string]string{
+				{"name": "<mark>Priya</mark> Shah"},
+				{"address": "<mark>Priyadarshini</mark> Nagar"},
+			},
+		},
+		{
+			name:    "every term must match :POS",
+			terms:   []string{"fever", "surat"},
+			wantIds: []int{1, 3},
+			wantHighlights: []map[string]string{
+				{"disease": "<mark>fever</mark>", "address": "Adajan, <mark>Surat</mark>"},
+				{"disease": "viral <mark>fever</mark>", "address": "<mark>Surat</mark>"},
+			},
+		},
+		{
+			name:    "markup in a field is escaped :POS",
+			terms:   []string{"anil"},
+			wantIds: []int{4},
+			wantHighlights: []map[string]string{
+				{"name": "&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; <mark>Anil</mark>"},
+			},
+		},
+		{
+			name:           "only the given fields are searched :POS",
+			terms:          []string{"fever", "surat"},
+			fields:         []string{"name", "address"},
+			wantIds:        []int{},
+			wantHighlights: []map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := connectDB(testDatabaseConfig(t))
+			repo := newPostgresRepo(db, discardLogger())
+
+			if err := setup(repo.db, existingPatients); err != nil {
+				t.Fatalf("failed to setup test: %v", err)
+			}
+
+			fields := tt.fields
+			if fields == nil {
+				fields = allSearchFields()
+			}
+			gotResults, err := repo.searchPatients(context.Background(), tt.terms, fields, 10)
+			if err != nil {
+				t.Fatalf("no error expected but got %v", err)
+			}
+
+			gotIds := []int{}
+			gotHighlights := []map[string]string{}
+			for _, r := range gotResults {
+				gotIds = append(gotIds, r.Patient.Id)
+				gotHighlights = append(gotHighlights, r.Highlights)
+			}
+			assert.Equal(t, tt.wantIds, gotIds, "expect patient ids to match")
+			assert.Equal(t, tt.wantHighlights, gotHighlights, "expect highlights to match")
+		})
+	}
+}
+
+func TestPostgresRepo_patchPatient(t *testing.T) {
+	testTime := time.Date(2024, time.August, 20, 17, 0, 0, 0, time.UTC)
+	existingPatient := Patient{
+		Id:          1,
+		Name:        "priya",
+		Address:     "surat",
+		Disease:     "fever",
+		Phone:       "+919876543210",
+		DateOfBirth: newDate(2024, 2, 22),
+		CreatedAt:   testTime,
+		UpdatedAt:   testTime,
+		Version:     2,
+	}
+
+	tests := []struct {
+		name         string
+		patch        Patient
+		columns      []string
+		wantPatients []Patient
+		wantErr      error
+	}{
+		{
+			name:         "patient not found :NEG",
+			patch:        Patient{Id: 2, Name: "abc", Version: 2},
+			columns:      []string{"name"},
+			wantPatients: []Patient{existingPatient},
+			wantErr:      errPatientNotFound,
+		},
+		{
+			name:         "stale version :NEG",
+			patch:        Patient{Id: 1, Name: "abc", Version: 1},
+			columns:      []string{"name"},
+			wantPatients: []Patient{existingPatient},
+			wantErr:      errVersionConflict,
+		},
+		{
+			name:    "only listed columns are written :POS",
+			patch:   Patient{Id: 1, Name: "abc", Address: "ignored", UpdatedAt: testTime.Add(time.Hour), Version: 2},
+			columns: []string{"name"},
+			wantPatients: []Patient{
+				{
+					Id:          1,
+					Name:        "abc",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 22),
+					CreatedAt:   testTime,
+					UpdatedAt:   testTime.Add(time.Hour),
+					Version:     3,
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := connectDB(testDatabaseConfig(t))
+			repo := newPostgresRepo(db, discardLogger())
+
+			if err := setup(repo.db, []Patient{existingPatient}); err != nil {
+				t.Fatalf("failed to setup test: %v", err)
+			}
+
+			_, gotErr := repo.patchPatient(context.Background(), tt.patch, tt.columns)
 			assert.ErrorIs(t, gotErr, tt.wantErr, "expect error to match")
 
 			var patients []Patient
@@ -593,3 +833,576 @@ func TestPostgresRepo_updatePatient(t *testing.T) {
 		})
 	}
 }
+
+// TestPostgresRepo_versionedUpdate covers updates that find the stored row
+// at another version, or no longer find it.
+func TestPostgresRepo_versionedUpdate(t *testing.T) {
+	deletedAt := time.Date(2024, time.August, 20, 17, 0, 0, 0, time.UTC)
+	patient := Patient{Id: 1, Name: "priya", Address: "surat", Disease: "fever", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 22), Version: 3}
+	stale := patient
+	stale.Version = 2
+	trashed := patient
+	trashed.DeletedAt = &deletedAt
+
+	tests := []struct {
+		name             string
+		existingPatients []Patient
+		wantErr          error
+	}{
+		{
+			name:             "version moved on :NEG",
+			existingPatients: []Patient{patient},
+			wantErr:          errVersionConflict,
+		},
+		{
+			name:             "patient deleted meanwhile :NEG",
+			existingPatients: nil,
+			wantErr:          errPatientNotFound,
+		},
+		{
+			name:             "patient trashed meanwhile :NEG",
+			existingPatients: []Patient{trashed},
+			wantErr:          errPatientNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := connectDB(testDatabaseConfig(t))
+			repo := newPostgresRepo(db, discardLogger())
+			if err := setup(repo.db, tt.existingPatients); err != nil {
+				t.Fatalf("failed to setup test: %v", err)
+			}
+
+			_, err := repo.updatePatient(context.Background(), stale)
+			assert.ErrorIs(t, err, tt.wantErr, "expect update error to match")
+			_, err = repo.patchPatient(context.Background(), stale, []string{"name"})
+			assert.ErrorIs(t, err, tt.wantErr, "expect patch error to match")
+		})
+	}
+}
+
+func TestPostgresRepo_trash(t *testing.T) {
+	testTime := time.Date(2024, time.August, 20, 17, 0, 0, 0, time.UTC)
+	oldDelete := time.Date(2024, time.January, 1, 10, 0, 0, 0, time.UTC)
+	newDelete := time.Date(2024, time.August, 1, 10, 0, 0, 0, time.UTC)
+
+	existingPatients := []Patient{
+		{Id: 1, Name: "priya", Address: "surat", Disease: "fever", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 22), CreatedAt: testTime, UpdatedAt: testTime, Version: 1},
+		{Id: 2, Name: "abc", Address: "surat", Disease: "fever", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 22), CreatedAt: testTime, UpdatedAt: testTime, Version: 4, DeletedAt: &oldDelete},
+		{Id: 3, Name: "xyz", Address: "surat", Disease: "fever", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 22), CreatedAt: testTime, UpdatedAt: testTime, Version: 1, DeletedAt: &newDelete},
+	}
+
+	tests := []struct {
+		name          string
+		action        func(repo *postgresRepo) error
+		wantErr       error
+		wantActiveIds []int
+		wantTrashIds  []int
+	}{
+		{
+			name: "soft delete :POS",
+			action: func(repo *postgresRepo) error {
+				_, err := repo.deletePatient(context.Background(), 1)
+				return err
+			},
+			wantActiveIds: []int{},
+			wantTrashIds:  []int{1, 3, 2},
+		},
+		{
+			name: "delete patient already in trash :NEG",
+			action: func(repo *postgresRepo) error {
+				_, err := repo.deletePatient(context.Background(), 2)
+				return err
+			},
+			wantErr:       errPatientNotFound,
+			wantActiveIds: []int{1},
+			wantTrashIds:  []int{3, 2},
+		},
+		{
+			name: "restore patient :POS",
+			action: func(repo *postgresRepo) error {
+				_, err := repo.restorePatient(context.Background(), 2, testTime)
+				return err
+			},
+			wantActiveIds: []int{1, 2},
+			wantTrashIds:  []int{3},
+		},
+		{
+			name: "restore active patient :NEG",
+			action: func(repo *postgresRepo) error {
+				_, err := repo.restorePatient(context.Background(), 1, testTime)
+				return err
+			},
+			wantErr:       errPatientNotFound,
+			wantActiveIds: []int{1},
+			wantTrashIds:  []int{3, 2},
+		},
+		{
+			name: "purge patients past retention :POS",
+			action: func(repo *postgresRepo) error {
+				_, err := repo.purgePatients(context.Background(), time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC))
+				return err
+			},
+			wantActiveIds: []int{1},
+			wantTrashIds:  []int{3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := connectDB(testDatabaseConfig(t))
+			repo := newPostgresRepo(db, discardLogger())
+
+			if err := setup(repo.db, existingPatients); err != nil {
+				t.Fatalf("failed to setup test: %v", err)
+			}
+
+			gotErr := tt.action(repo)
+			assert.ErrorIs(t, gotErr, tt.wantErr, "expect error to match")
+
+			active, err := repo.getPatients(context.Background())
+			if err != nil {
+				t.Fatalf("failed to retrieve patients: %v", err)
+			}
+			trash, err := repo.getDeletedPatients(context.Background())
+			if err != nil {
+				t.Fatalf("failed to retrieve deleted patients: %v", err)
+			}
+
+			gotActiveIds := []int{}
+			for _, p := range active {
+				gotActiveIds = append(gotActiveIds, p.Id)
+			}
+			gotTrashIds := []int{}
+			for _, p := range trash {
+				gotTrashIds = append(gotTrashIds, p.Id)
+			}
+			assert.Equal(t, tt.wantActiveIds, gotActiveIds, "expect active patients to match")
+			assert.Equal(t, tt.wantTrashIds, gotTrashIds, "expect deleted patients to match")
+		})
+	}
+}
+
+func TestPostgresRepo_auditEntries(t *testing.T) {
+	db := connectDB(testDatabaseConfig(t))
+	repo := newPostgresRepo(db, discardLogger())
+	ctx := context.Background()
+
+	// entries cannot be removed, so use a patient id no earlier run has used
+	patientId := int(time.Now().Unix())
+	at := time.Date(2024, time.August, 20, 17, 0, 0, 0, time.UTC)
+
+	wantEntries := []AuditEntry{
+		{PatientId: patientId, Actor: "nurse", Action: auditCreate, At: at, Changes: []FieldChange{{Field: "name", After: "priya"}}},
+		{PatientId: patientId, Actor: "doctor", Action: auditUpdate, At: at.Add(time.Minute), Changes: []FieldChange{{Field: "name", Before: "priya", After: "priya d"}}},
+	}
+	for _, e := range wantEntries {
+		err := repo.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			return repo.addAuditEntry(ctx, tx, e)
+		})
+		if err != nil {
+			t.Fatalf("failed to add audit entry: %v", err)
+		}
+	}
+
+	gotEntries, err := repo.getAuditEntries(ctx, patientId)
+	if err != nil {
+		t.Fatalf("failed to retrieve audit entries: %v", err)
+	}
+	if assert.Len(t, gotEntries, len(wantEntries), "expect audit entries to match") {
+		for i := range wantEntries {
+			assert.NotZero(t, gotEntries[i].Id, "expect entry id to be assigned")
+			assert.Equal(t, wantEntries[i].Actor, gotEntries[i].Actor, "expect actor to match")
+			assert.Equal(t, wantEntries[i].Action, gotEntries[i].Action, "expect action to match")
+			assert.True(t, wantEntries[i].At.Equal(gotEntries[i].At), "expect time to match")
+			assert.Equal(t, wantEntries[i].Changes[0].Field, gotEntries[i].Changes[0].Field, "expect changes to match")
+		}
+	}
+
+	_, err = repo.db.NewDelete().Model((*AuditEntry)(nil)).Where("patient_id = ?", patientId).Exec(ctx)
+	assert.Error(t, err, "expect audit entries to be append-only")
+}
+
+// TestPostgresRepo_auditInTransaction checks that a change is rolled back
+// when its audit entry cannot be written.
+func TestPostgresRepo_auditInTransaction(t *testing.T) {
+	testTime := time.Date(2024, time.August, 20, 17, 0, 0, 0, time.UTC)
+	existing := Patient{Id: 1, Name: "priya", Address: "surat", Disease: "fever", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 22), CreatedAt: testTime, UpdatedAt: testTime, Version: 1}
+	changed := existing
+	changed.Name = "priya d"
+	changed.UpdatedAt = testTime.Add(time.Hour)
+
+	tests := []struct {
+		name   string
+		action func(repo *postgresRepo, ctx context.Context) error
+	}{
+		{
+			name: "create :NEG",
+			action: func(repo *postgresRepo, ctx context.Context) error {
+				_, err := repo.createPatient(ctx, Patient{Id: 2, Name: "rahul", Address: "pune", Disease: "cold", Phone: "+919876543211", DateOfBirth: newDate(1985, 6, 1), CreatedAt: testTime, UpdatedAt: testTime, Version: 1})
+				return err
+			},
+		},
+		{
+			name: "update :NEG",
+			action: func(repo *postgresRepo, ctx context.Context) error {
+				_, err := repo.updatePatient(ctx, changed)
+				return err
+			},
+		},
+		{
+			name: "patch :NEG",
+			action: func(repo *postgresRepo, ctx context.Context) error {
+				_, err := repo.patchPatient(ctx, changed, []string{"name"})
+				return err
+			},
+		},
+		{
+			name: "delete :NEG",
+			action: func(repo *postgresRepo, ctx context.Context) error {
+				_, err := repo.deletePatient(ctx, 1)
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := connectDB(testDatabaseConfig(t))
+			repo := newPostgresRepo(db, discardLogger())
+			ctx := context.Background()
+			if err := setup(repo.db, []Patient{existing}); err != nil {
+				t.Fatalf("failed to setup test: %v", err)
+			}
+
+			// refuse every new audit entry for the length of the test
+			_, err := repo.db.ExecContext(ctx, "CREATE TRIGGER patient_audit_no_insert BEFORE INSERT ON patient_audit FOR EACH ROW EXECUTE FUNCTION patient_audit_append_only()")
+			if err != nil {
+				t.Fatalf("failed to setup test: %v", err)
+			}
+			defer repo.db.ExecContext(ctx, "DROP TRIGGER patient_audit_no_insert ON patient_audit")
+
+			assert.ErrorContains(t, tt.action(repo, ctx), "patient_audit is append-only", "expect the audit failure to be returned")
+
+			var patients []Patient
+			if err := repo.db.NewSelect().Model(&patients).WhereAllWithDeleted().Scan(ctx); err != nil {
+				t.Fatalf("failed to retrieve patients: %v", err)
+			}
+			assert.Equal(t, []Patient{existing}, patients, "expect the change to be rolled back")
+		})
+	}
+}
+
+// storedPatient reads patient id as it is stored, without opening it.
+func storedPatient(t *testing.T, db *bun.DB, id int) Patient {
+	var p Patient
+	err := db.NewSelect().Model(&p).WhereAllWithDeleted().Where("id = ?", id).Scan(context.Background())
+	if err != nil {
+		t.Fatalf("failed to retrieve stored patient: %v", err)
+	}
+	return p
+}
+
+func TestPostgresRepo_sealing(t *testing.T) {
+	testTime := time.Date(2024, time.August, 20, 17, 0, 0, 0, time.UTC)
+	existingPatient := Patient{Id: 1, Name: "priya", Address: "surat", Disease: "fever", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 22), CreatedAt: testTime, UpdatedAt: testTime, Version: 1}
+	changed := Patient{Id: 1, Name: "priya", Address: "pune", Disease: "diabetes", Phone: "+919876543211", DateOfBirth: newDate(2024, 2, 22), CreatedAt: testTime, UpdatedAt: testTime.Add(time.Hour), Version: 1}
+
+	tests := []struct {
+		name        string
+		write       func(repo *postgresRepo) (Patient, error)
+		wantPatient Patient
+		wantSealed  []string
+	}{
+		{
+			name: "create seals every encrypted column :POS",
+			write: func(repo *postgresRepo) (Patient, error) {
+				return repo.createPatient(context.Background(), Patient{Id: 2, Name: "rahul", Address: "pune", Disease: "cold", Phone: "+919876543211", DateOfBirth: newDate(1985, 6, 1), CreatedAt: testTime, UpdatedAt: testTime, Version: 1})
+			},
+			wantPatient: Patient{Id: 2, Name: "rahul", Address: "pune", Disease: "cold", Phone: "+919876543211", DateOfBirth: newDate(1985, 6, 1), CreatedAt: testTime, UpdatedAt: testTime, Version: 1},
+			wantSealed:  []string{"disease", "address", "phone"},
+		},
+		{
+			name: "update seals every encrypted column :POS",
+			write: func(repo *postgresRepo) (Patient, error) {
+				return repo.updatePatient(context.Background(), changed)
+			},
+			wantPatient: Patient{Id: 1, Name: "priya", Address: "pune", Disease: "diabetes", Phone: "+919876543211", DateOfBirth: newDate(2024, 2, 22), CreatedAt: testTime, UpdatedAt: testTime.Add(time.Hour), Version: 2},
+			wantSealed:  []string{"disease", "address", "phone"},
+		},
+		{
+			name: "patch seals only the written columns :POS",
+			write: func(repo *postgresRepo) (Patient, error) {
+				return repo.patchPatient(context.Background(), changed, []string{"disease"})
+			},
+			wantPatient: Patient{Id: 1, Name: "priya", Address: "surat", Disease: "diabetes", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 22), CreatedAt: testTime, UpdatedAt: testTime.Add(time.Hour), Version: 2},
+			wantSealed:  []string{"disease"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := connectDB(testDatabaseConfig(t))
+			repo := newPostgresRepo(db, discardLogger())
+
+			// the existing patient was stored before encryption was turned on
+			if err := setup(repo.db, []Patient{existingPatient}); err != nil {
+				t.Fatalf("failed to setup test: %v", err)
+			}
+			repo.keys = testKeyring(t, "k1", "k1")
+
+			written, err := tt.write(repo)
+			if err != nil {
+				t.Fatalf("no error expected but got %v", err)
+			}
+
+			stored := storedPatient(t, repo.db, written.Id)
+			assert.Equal(t, tt.wantPatient.Name, stored.Name, "expect name to be stored as is")
+			for _, c := range encryptedColumns {
+				keyId, encrypted := encryptionKeyId(*c.value(&stored))
+				if slices.Contains(tt.wantSealed, c.name) {
+					assert.True(t, encrypted, "expect %s to be encrypted", c.name)
+					assert.Equal(t, "k1", keyId, "expect %s to be under the primary key", c.name)
+					assert.Equal(t, repo.keys.blindIndex(c.name, *c.value(&tt.wantPatient)), *c.index(&stored), "expect %s to be indexed", c.name)
+				} else {
+					assert.Equal(t, *c.value(&tt.wantPatient), *c.value(&stored), "expect %s to be left alone", c.name)
+					assert.Nil(t, *c.index(&stored), "expect %s not to be indexed", c.name)
+				}
+			}
+
+			got, err := repo.getPatient(context.Background(), written.Id)
+			if err != nil {
+				t.Fatalf("failed to retrieve patient: %v", err)
+			}
+			assert.Equal(t, tt.wantPatient, got, "expect the patient back in plaintext")
+		})
+	}
+}
+
+func TestPostgresRepo_encryptedPrefixPlaintext(t *testing.T) {
+	testTime := time.Date(2024, time.August, 20, 17, 0, 0, 0, time.UTC)
+	// stored before the prefix was rejected, or before encryption was on
+	legacy := Patient{Id: 1, Name: "priya", Address: encryptedPrefix + "surat", Disease: encryptedPrefix + "flu", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 22), CreatedAt: testTime, UpdatedAt: testTime, Version: 1}
+
+	tests := []struct {
+		name string
+		keys bool
+	}{
+		{name: "without a keyfile :POS"},
+		{name: "with a keyfile :POS", keys: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := connectDB(testDatabaseConfig(t))
+			repo := newPostgresRepo(db, discardLogger())
+			if err := setup(repo.db, []Patient{legacy}); err != nil {
+				t.Fatalf("failed to setup test: %v", err)
+			}
+			if tt.keys {
+				repo.keys = testKeyring(t, "k1", "k1")
+			}
+
+			patients, err := repo.getPatients(context.Background())
+			assert.NoError(t, err, "expect patients to be listed")
+			assert.Equal(t, []Patient{legacy}, patients, "expect values to be returned as stored")
+		})
+	}
+}
+
+func TestPostgresRepo_findEncryptedPatients(t *testing.T) {
+	patients := []Patient{
+		{Id: 1, Name: "priya", Address: "Surat", Disease: "Type 2 Diabetes", Phone: "+919876543210", DateOfBirth: newDate(2024, 12, 12)},
+		{Id: 2, Name: "abc", Address: "ahmedabad", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 12, 12)},
+		{Id: 3, Name: "priyanka", Address: "surat", Disease: "type 2  diabetes", Phone: "+919876543210", DateOfBirth: newDate(2024, 12, 12)},
+	}
+
+	tests := []struct {
+		name    string
+		query   PatientQuery
+		wantIds []int
+		wantErr bool
+	}{
+		{
+			name:    "disease matches the whole value ignoring case and spacing :POS",
+			query:   PatientQuery{Limit: 10, SortBy: sortById, Disease: "TYPE 2 DIABETES "},
+			wantIds: []int{1, 3},
+		},
+		{
+			name:    "address matches the whole value :POS",
+			query:   PatientQuery{Limit: 10, SortBy: sortById, Address: "surat"},
+			wantIds: []int{1, 3},
+		},
+		{
+			name:    "part of a value does not match :POS",
+			query:   PatientQuery{Limit: 10, SortBy: sortById, Disease: "diabetes"},
+			wantIds: []int{},
+		},
+		{
+			name:    "filters combine :POS",
+			query:   PatientQuery{Limit: 10, SortBy: sortById, Name: "priyanka", Address: "surat"},
+			wantIds: []int{3},
+		},
+		{
+			name:    "sort by an encrypted column :NEG",
+			query:   PatientQuery{Limit: 10, SortBy: sortByDisease},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := connectDB(testDatabaseConfig(t))
+			repo := newPostgresRepo(db, discardLogger())
+			repo.keys = testKeyring(t, "k1", "k1")
+
+			if err := setup(repo.db, nil); err != nil {
+				t.Fatalf("failed to setup test: %v", err)
+			}
+			for _, p := range patients {
+				if _, err := repo.createPatient(context.Background(), p); err != nil {
+					t.Fatalf("failed to create patient: %v", err)
+				}
+			}
+
+			gotPage, err := repo.findPatients(context.Background(), tt.query)
+			if tt.wantErr {
+				var validationErr *ValidationError
+				assert.ErrorAs(t, err, &validationErr, "expect a validation error")
+				return
+			}
+			if err != nil {
+				t.Fatalf("no error expected but got %v", err)
+			}
+
+			gotIds := []int{}
+			for _, p := range gotPage.Patients {
+				gotIds = append(gotIds, p.Id)
+			}
+			assert.Equal(t, tt.wantIds, gotIds, "expect patient ids to match")
+		})
+	}
+}
+
+func TestPostgresRepo_reencryptPatients(t *testing.T) {
+	ctx := context.Background()
+	deletedAt := time.Date(2024, time.August, 20, 17, 0, 0, 0, time.UTC)
+	db := connectDB(testDatabaseConfig(t))
+	repo := newPostgresRepo(db, discardLogger())
+
+	// patient 1 was stored before encryption was turned on
+	plaintext := Patient{Id: 1, Name: "priya", Address: "surat", Disease: "fever", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 22), Version: 1}
+	if err := setup(repo.db, []Patient{plaintext}); err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+
+	// patients 2 and 3 were stored under k1, and 3 is in the trash
+	repo.keys = testKeyring(t, "k1", "k1")
+	underK1 := []Patient{
+		{Id: 2, Name: "rahul", Address: "pune", Disease: "cold", Phone: "+919876543211", DateOfBirth: newDate(1985, 6, 1), Version: 1},
+		{Id: 3, Name: "meera", Address: "vesu", Disease: "flu", Phone: "+919876543212", DateOfBirth: newDate(1992, 3, 4), Version: 1, DeletedAt: &deletedAt},
+	}
+	for _, p := range underK1 {
+		if _, err := repo.createPatient(ctx, p); err != nil {
+			t.Fatalf("failed to create patient: %v", err)
+		}
+	}
+
+	// k2 becomes the primary key
+	repo.keys = testKeyring(t, "k2", "k1", "k2")
+	result, err := repo.reencryptPatients(ctx)
+	if assert.NoError(t, err, "expect patients to be re-encrypted") {
+		assert.Equal(t, reencryptResult{Rewritten: 3}, result, "expect every patient to be rewritten")
+	}
+
+	for _, want := range append([]Patient{plaintext}, underK1...) {
+		stored := storedPatient(t, repo.db, want.Id)
+		assert.True(t, repo.currentlySealed(stored), "expect patient %d to be under the primary key", want.Id)
+		assert.Equal(t, want.Version, stored.Version, "expect version of patient %d to be kept", want.Id)
+		opened := stored
+		if assert.NoError(t, repo.openPatient(&opened), "expect patient %d to be opened", want.Id) {
+			assert.Equal(t, want.Disease, opened.Disease, "expect disease of patient %d to be kept", want.Id)
+			assert.Equal(t, want.Address, opened.Address, "expect address of patient %d to be kept", want.Id)
+			assert.Equal(t, want.Phone, opened.Phone, "expect phone of patient %d to be kept", want.Id)
+		}
+	}
+
+	result, err = repo.reencryptPatients(ctx)
+	if assert.NoError(t, err, "expect a second run to succeed") {
+		assert.Equal(t, reencryptResult{Current: 3}, result, "expect nothing left to rewrite")
+	}
+
+	page, err := repo.findPatients(ctx, PatientQuery{Limit: 10, SortBy: sortById, Disease: "fever"})
+	if assert.NoError(t, err, "expect filtering by disease to work") {
+		assert.Len(t, page.Patients, 1, "expect the blind index of the plaintext patient to be set")
+	}
+}
+
+// TestPostgresRepo_searchEncrypted covers search_vector leaving encrypted
+// values out, while values stored before encryption stay searchable.
+func TestPostgresRepo_searchEncrypted(t *testing.T) {
+	ctx := context.Background()
+	db := connectDB(testDatabaseConfig(t))
+	repo := newPostgresRepo(db, discardLogger())
+
+	plaintext := Patient{Id: 1, Name: "priya", Address: "surat", Disease: "fever", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 22)}
+	if err := setup(repo.db, []Patient{plaintext}); err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	repo.keys = testKeyring(t, "k1", "k1")
+	encrypted := Patient{Id: 2, Name: "rahul", Address: "surat", Disease: "fever", Phone: "+919876543211", DateOfBirth: newDate(1985, 6, 1)}
+	if _, err := repo.createPatient(ctx, encrypted); err != nil {
+		t.Fatalf("failed to create patient: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		terms          []string
+		wantIds        []int
+		wantHighlights []map[string]string
+	}{
+		{
+			name:           "encrypted values are not searched :POS",
+			terms:          []string{"surat"},
+			wantIds:        []int{1},
+			wantHighlights: []map[string]string{{"address": "<mark>surat</mark>"}},
+		},
+		{
+			name:           "ciphertext is not searched :POS",
+			terms:          []string{"enc"},
+			wantIds:        []int{},
+			wantHighlights: []map[string]string{},
+		},
+		{
+			name:           "an encrypted value cannot complete a match :POS",
+			terms:          []string{"rahul", "fever"},
+			wantIds:        []int{},
+			wantHighlights: []map[string]string{},
+		},
+		{
+			name:           "name of an encrypted patient :POS",
+			terms:          []string{"rahul"},
+			wantIds:        []int{2},
+			wantHighlights: []map[string]string{{"name": "<mark>rahul</mark>"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotResults, err := repo.searchPatients(ctx, tt.terms, allSearchFields(), 10)
+			if err != nil {
+				t.Fatalf("no error expected but got %v", err)
+			}
+
+			gotIds := []int{}
+			gotHighlights := []map[string]string{}
+			for _, r := range gotResults {
+				gotIds = append(gotIds, r.Patient.Id)
+				gotHighlights = append(gotHighlights, r.Highlights)
+			}
+			assert.Equal(t, tt.wantIds, gotIds, "expect patient ids to match")
+			assert.Equal(t, tt.wantHighlights, gotHighlights, "expect highlights to match")
+		})
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// permission is an operation on patients that a role may be granted.
+type permission string
+
+const (
+	permReadPatients   permission = "patients:read"
+	permCreatePatients permission = "patients:create"
+	permUpdatePatients permission = "patients:update"
+	permDeletePatients permission = "patients:delete"
+	permPurgePatients  permission = "patients:purge"
+	permReadHistory    permission = "patients:history"
+)
+
+const (
+	roleAdmin        = "admin"
+	roleClinician    = "clinician"
+	roleReceptionist = "receptionist"
+	roleAuditor      = "auditor"
+)
+
+var errForbidden = errors.New("forbidden")
+
+// role is what the holders of a role may do. hiddenColumns lists the
+// patient fields, by column name, they are not allowed to see.
+type role struct {
+	permissions   []permission
+	hiddenColumns []string
+}
+
+// roles are the roles callers can be given through the roles claim of
+// their token or the roles of their API key. The trash, deleting patients
+// and restoring them go together under permDeletePatients.
+var roles = map[string]role{
+	roleAdmin: {
+		permissions: []permission{permReadPatients, permCreatePatients, permUpdatePatients, permDeletePatients, permPurgePatients, permReadHistory},
+	},
+	roleClinician: {
+		permissions: []permission{permReadPatients, permCreatePatients, permUpdatePatients, permReadHistory},
+	},
+	roleReceptionist: {
+		permissions:   []permission{permReadPatients, permCreatePatients, permUpdatePatients},
+		hiddenColumns: []string{"disease"},
+	},
+	roleAuditor: {
+		permissions: []permission{permReadPatients, permReadHistory},
+	},
+}
+
+func roleNames() []string {
+	names := make([]string, 0, len(roles))
+	for name := range roles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// access is the combined grant of a caller's roles. A field is hidden only
+// when every one of the roles hides it. Unknown roles grant nothing.
+type access struct {
+	permissions map[permission]bool
+	hidden      map[string]bool
+}
+
+func accessFor(roleNames []string) access {
+	a := access{permissions: map[permission]bool{}, hidden: map[string]bool{}}
+	var held []role
+	for _, name := range roleNames {
+		if r, ok := roles[name]; ok {
+			held = append(held, r)
+		}
+	}
+	for _, r := range held {
+		for _, p := range r.permissions {
+			a.permissions[p] = true
+		}
+	}
+	for _, c := range patientColumns {
+		hidden := len(held) > 0
+		for _, r := range held {
+			hidden = hidden && slices.Contains(r.hiddenColumns, c.name)
+		}
+		if hidden {
+			a.hidden[c.name] = true
+		}
+	}
+	return a
+}
+
+func (a access) can(p permission) bool {
+	return a.permissions[p]
+}
+
+// hiddenColumns returns the hidden fields in the order of patientColumns.
+func (a access) hiddenColumns() []string {
+	var columns []string
+	for _, c := range patientColumns {
+		if a.hidden[c.name] {
+			columns = append(columns, c.name)
+		}
+	}
+	return columns
+}
+
+// hiddenMember reports whether name, a member of the patient JSON, is a
+// hidden field. The legacy year, month and date members are part of the
+// date of birth.
+func (a access) hiddenMember(name string) bool {
+	switch name {
+	case "year", "month", "date":
+		name = "dateOfBirth"
+	}
+	for _, c := range patientColumns {
+		if c.json == name {
+			return a.hidden[c.name]
+		}
+	}
+	return false
+}
+
+// redactPatient zeroes the fields p's reader may not see and marks them to
+// be left out of the JSON.
+func (a access) redactPatient(p Patient) Patient {
+	if len(a.hidden) == 0 {
+		return p
+	}
+	var zero Patient
+	p.redacted = nil
+	for _, c := range patientColumns {
+		if a.hidden[c.name] {
+			c.set(&p, zero)
+			p.redacted = append(p.redacted, c.json)
+		}
+	}
+	return p
+}
+
+func (a access) redactPatients(patients []Patient) []Patient {
+	if len(a.hidden) == 0 || patients == nil {
+		return patients
+	}
+	redacted := make([]Patient, len(patients))
+	for i, p := range patients {
+		redacted[i] = a.redactPatient(p)
+	}
+	return redacted
+}
+
+// redactSearchResults drops the highlights of hidden fields, and the
+// results that only matched on them, so that a search cannot tell which
+// patients have a hidden value.
+func (a access) redactSearchResults(results []SearchResult) []SearchResult {
+	if len(a.hidden) == 0 {
+		return results
+	}
+	redacted := make([]SearchResult, 0, len(results))
+	for _, r := range results {
+		highlights := map[string]string{}
+		for field, highlight := range r.Highlights {
+			if !a.hiddenMember(field) {
+				highlights[field] = highlight
+			}
+		}
+		if len(highlights) == 0 {
+			continue
+		}
+		r.Patient = a.redactPatient(r.Patient)
+		r.Highlights = highlights
+		redacted = append(redacted, r)
+	}
+	return redacted
+}
+
+// redactAuditEntries drops the changes made to hidden fields.
+func (a access) redactAuditEntries(entries []AuditEntry) []AuditEntry {
+	if len(a.hidden) == 0 {
+		return entries
+	}
+	redacted := make([]AuditEntry, len(entries))
+	for i, e := range entries {
+		changes := make([]FieldChange, 0, len(e.Changes))
+		for _, c := range e.Changes {
+			if !a.hidden[c.Field] {
+				changes = append(changes, c)
+			}
+		}
+		e.Changes = changes
+		redacted[i] = e
+	}
+	return redacted
+}
+
+func (a access) redactNotification(n Notification) Notification {
+	if n.Patient != nil {
+		p := a.redactPatient(*n.Patient)
+		n.Patient = &p
+	}
+	if n.Before != nil {
+		before := a.redactPatient(*n.Before)
+		n.Before = &before
+	}
+	n.Patients = a.redactPatients(n.Patients)
+	return n
+}
+
+// authorizedService decorates a Service with role-based access control.
+// Every call needs the principal attached by the auth middleware and a
+// role granting the operation, and patients are returned with the fields
+// the caller may not see redacted, notifications to subscribers included.
+type authorizedService struct {
+	next   Service
+	logger *slog.Logger
+}
+
+func newAuthorizedService(next Service, logger *slog.Logger) *authorizedService {
+	return &authorizedService{next: next, logger: logger}
+}
+
+// authorize returns the access of the caller of ctx, or errForbidden when
+// it lacks perm.
+func (s *authorizedService) authorize(ctx context.Context, method string, perm permission) (access, error) {
+	principal, ok := principalFromContext(ctx)
+	if !ok {
+		s.logger.WarnContext(ctx, "permission denied", "operation", method, "reason", "no principal")
+		return access{}, fmt.Errorf("%w: %s needs an authenticated caller", errForbidden, method)
+	}
+	a := accessFor(principal.Roles)
+	if !a.can(perm) {
+		s.logger.WarnContext(ctx, "permission denied", "operation", method, "subject", principal.Subject, "roles", principal.Roles, "permission", perm)
+		return access{}, fmt.Errorf("%w: %s needs the %s permission", errForbidden, method, perm)
+	}
+	return a, nil
+}
+
+func (s *authorizedService) createPatient(ctx context.Context, p Patient) (Patient, error) {
+	// hidden fields can still be filled in when a patient is registered,
+	// they just cannot be read back
+	a, err := s.authorize(ctx, "createPatient", permCreatePatients)
+	if err != nil {
+		return Patient{}, err
+	}
+	created, err := s.next.createPatient(ctx, p)
+	return a.redactPatient(created), err
+}
+
+func (s *authorizedService) getPatients(ctx context.Context) ([]Patient, error) {
+	a, err := s.authorize(ctx, "getPatients", permReadPatients)
+	if err != nil {
+		return nil, err
+	}
+	patients, err := s.next.getPatients(ctx)
+	return a.redactPatients(patients), err
+}
+
+// findPatients refuses to filter or sort by a hidden field, as the
+// listing would give its values away.
+func (s *authorizedService) findPatients(ctx context.Context, q PatientQuery) (PatientPage, error) {
+	a, err := s.authorize(ctx, "findPatients", permReadPatients)
+	if err != nil {
+		return PatientPage{}, err
+	}
+	filters := map[string]bool{
+		"name":    q.Name != "",
+		"disease": q.Disease != "",
+		"address": q.Address != "",
+	}
+	for column, filtered := range filters {
+		if a.hidden[column] && (filtered || sortColumns[q.SortBy] == column) {
+			return PatientPage{}, fmt.Errorf("%w: cannot filter or sort by %s", errForbidden, column)
+		}
+	}
+
+	page, err := s.next.findPatients(ctx, q)
+	page.Patients = a.redactPatients(page.Patients)
+	return page, err
+}
+
+// searchPatients only searches the fields the caller can see, so that a
+// term cannot match a hidden one and the limit applies to visible results.
+func (s *authorizedService) searchPatients(ctx context.Context, query string, fields []string, limit int) ([]SearchResult, error) {
+	a, err := s.authorize(ctx, "searchPatients", permReadPatients)
+	if err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		fields = allSearchFields()
+	}
+	visible := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if !a.hiddenMember(field) {
+			visible = append(visible, field)
+		}
+	}
+	results, err := s.next.searchPatients(ctx, query, visible, limit)
+	return a.redactSearchResults(results), err
+}
+
+func (s *authorizedService) getPatient(ctx context.Context, id int) (Patient, error) {
+	a, err := s.authorize(ctx, "getPatient", permReadPatients)
+	if err != nil {
+		return Patient{}, err
+	}
+	patient, err := s.next.getPatient(ctx, id)
+	return a.redactPatient(patient), err
+}
+
+func (s *authorizedService) deletePatient(ctx context.Context, id int) error {
+	if _, err := s.authorize(ctx, "deletePatient", permDeletePatients); err != nil {
+		return err
+	}
+	return s.next.deletePatient(ctx, id)
+}
+
+// updatePatient keeps the stored value of the fields the caller cannot
+// see, since a client that was sent a redacted patient sends it back
+// without them.
+func (s *authorizedService) updatePatient(ctx context.Context, p Patient) (Patient, error) {
+	a, err := s.authorize(ctx, "updatePatient", permUpdatePatients)
+	if err != nil {
+		return Patient{}, err
+	}
+	if hidden := a.hiddenColumns(); len(hidden) > 0 {
+		stored, err := s.next.getPatient(ctx, p.Id)
+		if err != nil {
+			return Patient{}, err
+		}
+		copyPatientColumns(&p, stored, hidden)
+		if a.hidden["date_of_birth"] {
+			p.legacyDateOfBirth = nil
+		}
+	}
+	updated, err := s.next.updatePatient(ctx, p)
+	return a.redactPatient(updated), err
+}
+
+// patchPatient refuses patches that touch a hidden field, including test
+// operations, which could otherwise be used to guess its value.
+func (s *authorizedService) patchPatient(ctx context.Context, id int, version int, patch PatientPatch) (Patient, error) {
+	a, err := s.authorize(ctx, "patchPatient", permUpdatePatients)
+	if err != nil {
+		return Patient{}, err
+	}
+	if len(a.hidden) > 0 {
+		members, err := patch.members()
+		if err != nil {
+			return Patient{}, err
+		}
+		for _, member := range members {
+			if a.hiddenMember(member) {
+				return Patient{}, fmt.Errorf("%w: cannot patch %s", errForbidden, member)
+			}
+		}
+	}
+	patched, err := s.next.patchPatient(ctx, id, version, patch)
+	return a.redactPatient(patched), err
+}
+
+func (s *authorizedService) getDeletedPatients(ctx context.Context) ([]Patient, error) {
+	a, err := s.authorize(ctx, "getDeletedPatients", permDeletePatients)
+	if err != nil {
+		return nil, err
+	}
+	patients, err := s.next.getDeletedPatients(ctx)
+	return a.redactPatients(patients), err
+}
+
+func (s *authorizedService) restorePatient(ctx context.Context, id int) (Patient, error) {
+	a, err := s.authorize(ctx, "restorePatient", permDeletePatients)
+	if err != nil {
+		return Patient{}, err
+	}
+	restored, err := s.next.restorePatient(ctx, id)
+	return a.redactPatient(restored), err
+}
+
+func (s *authorizedService) purgeDeletedPatients(ctx context.Context) (int, error) {
+	if _, err := s.authorize(ctx, "purgeDeletedPatients", permPurgePatients); err != nil {
+		return 0, err
+	}
+	return s.next.purgeDeletedPatients(ctx)
+}
+
+func (s *authorizedService) getPatientHistory(ctx context.Context, id int) ([]AuditEntry, error) {
+	a, err := s.authorize(ctx, "getPatientHistory", permReadHistory)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.next.getPatientHistory(ctx, id)
+	return a.redactAuditEntries(entries), err
+}
+
+func (s *authorizedService) addSubscriber(ctx context.Context, sub Subscriber) error {
+	a, err := s.authorize(ctx, "addSubscriber", permReadPatients)
+	if err != nil {
+		return err
+	}
+	return s.next.addSubscriber(ctx, &redactingSubscriber{Subscriber: sub, access: a})
+}
+
+func (s *authorizedService) resumeSubscriber(ctx context.Context, sub Subscriber, stream string, since int64) error {
+	a, err := s.authorize(ctx, "resumeSubscriber", permReadPatients)
+	if err != nil {
+		return err
+	}
+	return s.next.resumeSubscriber(ctx, &redactingSubscriber{Subscriber: sub, access: a}, stream, since)
+}
+
+func (s *authorizedService) resyncSubscriber(ctx context.Context, sub Subscriber) error {
+	a, err := s.authorize(ctx, "resyncSubscriber", permReadPatients)
+	if err != nil {
+		return err
+	}
+	return s.next.resyncSubscriber(ctx, &redactingSubscriber{Subscriber: sub, access: a})
+}
+
+func (s *authorizedService) removeSubscriber(sub Subscriber) error {
+	return s.next.removeSubscriber(sub)
+}
+
+func (s *authorizedService) closeSubscribers() {
+	s.next.closeSubscribers()
+}
+
+// redactingSubscriber sends a subscriber its notifications with the fields
+// its caller may not see redacted. Subscribers are told apart by name, so
+// it stands for the subscriber it wraps.
+type redactingSubscriber struct {
+	Subscriber
+	access access
+}
+
+func (s *redactingSubscriber) update(notification Notification) {
+	s.Subscriber.update(s.access.redactNotification(notification))
+}
+
+// unknownRoles returns the names in names that are not roles.
+func unknownRoles(names []string) []string {
+	var unknown []string
+	for _, name := range names {
+		if _, ok := roles[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	return unknown
+}
+
+// parseRoles reads roles written as role+role.
+func parseRoles(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, "+") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
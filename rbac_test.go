@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func rbacTestService() (*authorizedService, *InMemoryRepository) {
+	repo := newInMemoryRepository()
+	repo.patients = []Patient{
+		{Id: 1, Name: "priya", Address: "surat", Disease: "diabetes", Phone: "+919876543210", DateOfBirth: newDate(1990, 2, 12), Version: 1},
+		{Id: 2, Name: "rahul", Address: "pune", Disease: "cold", Phone: "+919876543211", DateOfBirth: newDate(1985, 6, 1), Version: 1},
+	}
+	repo.lastId.Store(2)
+	repo.audit = []AuditEntry{
+		{Id: 1, PatientId: 1, Actor: "nurse", Action: auditUpdate, Changes: []FieldChange{
+			{Field: "address", Before: "ahmedabad", After: "surat"},
+			{Field: "disease", Before: "flu", After: "diabetes"},
+		}},
+	}
+	service := newPatientsService(repo)
+	service.logger = discardLogger()
+	return newAuthorizedService(service, discardLogger()), repo
+}
+
+func asRoles(roles ...string) context.Context {
+	return withPrincipal(context.Background(), Principal{Subject: "tester", Method: authMethodJWT, Roles: roles})
+}
+
+func TestRBAC_permissions(t *testing.T) {
+	operations := map[string]func(ctx context.Context, s Service) error{
+		"read": func(ctx context.Context, s Service) error {
+			_, err := s.getPatient(ctx, 1)
+			return err
+		},
+		"create": func(ctx context.Context, s Service) error {
+			_, err := s.createPatient(ctx, Patient{Name: "new", Address: "surat", Disease: "cold", Phone: "+919876543212", DateOfBirth: newDate(2000, 1, 1)})
+			return err
+		},
+		"update": func(ctx context.Context, s Service) error {
+			_, err := s.updatePatient(ctx, Patient{Id: 2, Name: "rahul k", Address: "pune", Disease: "cold", Phone: "+919876543211", DateOfBirth: newDate(1985, 6, 1), Version: 1})
+			return err
+		},
+		"delete": func(ctx context.Context, s Service) error {
+			return s.deletePatient(ctx, 2)
+		},
+		"trash": func(ctx context.Context, s Service) error {
+			_, err := s.getDeletedPatients(ctx)
+			return err
+		},
+		"purge": func(ctx context.Context, s Service) error {
+			_, err := s.purgeDeletedPatients(ctx)
+			return err
+		},
+		"history": func(ctx context.Context, s Service) error {
+			_, err := s.getPatientHistory(ctx, 1)
+			return err
+		},
+		"subscribe": func(ctx context.Context, s Service) error {
+			return s.addSubscriber(ctx, &testSubscriber{name: "a"})
+		},
+	}
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		allowed []string
+	}{
+		{name: "admin :POS", ctx: asRoles(roleAdmin), allowed: []string{"read", "subscribe", "create", "update", "delete", "trash", "purge", "history"}},
+		{name: "clinician :POS", ctx: asRoles(roleClinician), allowed: []string{"read", "subscribe", "create", "update", "history"}},
+		{name: "receptionist :POS", ctx: asRoles(roleReceptionist), allowed: []string{"read", "subscribe", "create", "update"}},
+		{name: "auditor :POS", ctx: asRoles(roleAuditor), allowed: []string{"read", "subscribe", "history"}},
+		{name: "roles are combined :POS", ctx: asRoles(roleReceptionist, roleAuditor), allowed: []string{"read", "subscribe", "create", "update", "history"}},
+		{name: "unknown role :NEG", ctx: asRoles("nurse")},
+		{name: "no roles :NEG", ctx: asRoles()},
+		{name: "no principal :NEG", ctx: context.Background()},
+	}
+
+	for _, tt := range tests {
+		for op, call := range operations {
+			t.Run(tt.name+"/"+op, func(t *testing.T) {
+				service, _ := rbacTestService()
+				err := call(tt.ctx, service)
+
+				allowed := false
+				for _, a := range tt.allowed {
+					allowed = allowed || a == op
+				}
+				if allowed {
+					assert.NoError(t, err, "expect %s to be allowed", op)
+				} else {
+					assert.ErrorIs(t, err, errForbidden, "expect %s to be forbidden", op)
+				}
+			})
+		}
+	}
+}
+
+func TestRBAC_redaction(t *testing.T) {
+	service, repo := rbacTestService()
+	receptionist := asRoles(roleReceptionist)
+
+	patient, err := service.getPatient(receptionist, 1)
+	if assert.NoError(t, err, "expect patient to be read") {
+		assert.Empty(t, patient.Disease, "expect disease to be redacted")
+		assert.Equal(t, "surat", patient.Address, "expect address to be kept")
+		data, err := json.Marshal(patient)
+		assert.NoError(t, err, "expect patient to encode")
+		assert.NotContains(t, string(data), `"disease"`, "expect disease to be left out of the JSON")
+		assert.Contains(t, string(data), `"address":"surat"`, "expect address in the JSON")
+	}
+
+	patients, err := service.getPatients(receptionist)
+	if assert.NoError(t, err, "expect patients to be listed") {
+		for _, p := range patients {
+			assert.Empty(t, p.Disease, "expect disease of patient %d to be redacted", p.Id)
+		}
+	}
+
+	page, err := service.findPatients(receptionist, newPatientQuery())
+	if assert.NoError(t, err, "expect listing to be allowed") {
+		assert.Len(t, page.Patients, 2, "expect every patient")
+		assert.Empty(t, page.Patients[0].Disease, "expect disease to be redacted")
+	}
+
+	query := newPatientQuery()
+	query.Disease = "diab"
+	_, err = service.findPatients(receptionist, query)
+	assert.ErrorIs(t, err, errForbidden, "expect filtering by disease to be forbidden")
+
+	query = newPatientQuery()
+	query.SortBy = sortByDisease
+	_, err = service.findPatients(receptionist, query)
+	assert.ErrorIs(t, err, errForbidden, "expect sorting by disease to be forbidden")
+
+	results, err := service.searchPatients(receptionist, "diabetes", nil, 10)
+	if assert.NoError(t, err, "expect search to be allowed") {
+		assert.Empty(t, results, "expect matches on disease alone to be dropped")
+	}
+	results, err = service.searchPatients(receptionist, "priya diabetes", nil, 10)
+	if assert.NoError(t, err, "expect search to be allowed") {
+		assert.Empty(t, results, "expect a term matching only the disease not to match")
+	}
+	results, err = service.searchPatients(receptionist, "priya", nil, 10)
+	if assert.NoError(t, err, "expect search to be allowed") && assert.Len(t, results, 1, "expect the name match") {
+		assert.Empty(t, results[0].Patient.Disease, "expect disease to be redacted")
+		assert.NotContains(t, results[0].Highlights, "disease", "expect disease highlight to be dropped")
+	}
+
+	// the limit applies to what the receptionist can see: the disease match
+	// on sugar would otherwise rank above the address match on surat
+	repo.patients = append(repo.patients, Patient{Id: 3, Name: "meera", Address: "vesu", Disease: "sugar", Phone: "+919876543212", DateOfBirth: newDate(1992, 3, 4), Version: 1})
+	results, err = service.searchPatients(receptionist, "su", nil, 1)
+	if assert.NoError(t, err, "expect search to be allowed") && assert.Len(t, results, 1, "expect the limit to be filled") {
+		assert.Equal(t, 1, results[0].Patient.Id, "expect the address match")
+	}
+	repo.patients = repo.patients[:2]
+
+	// a receptionist who is also a clinician sees the disease
+	patient, err = service.getPatient(asRoles(roleReceptionist, roleClinician), 1)
+	if assert.NoError(t, err, "expect patient to be read") {
+		assert.Equal(t, "diabetes", patient.Disease, "expect disease to be visible")
+	}
+
+	entries, err := service.getPatientHistory(asRoles(roleAuditor), 1)
+	if assert.NoError(t, err, "expect history to be read") {
+		assert.Len(t, entries[0].Changes, 2, "expect auditors to see every change")
+	}
+	entries = accessFor([]string{roleReceptionist}).redactAuditEntries(entries)
+	assert.Equal(t, []FieldChange{{Field: "address", Before: "ahmedabad", After: "surat"}}, entries[0].Changes, "expect disease change to be dropped")
+
+	subscriber := &testSubscriber{name: "a"}
+	if assert.NoError(t, service.addSubscriber(receptionist, subscriber), "expect receptionist to subscribe") {
+		_, err := service.updatePatient(asRoles(roleClinician), Patient{Id: 2, Name: "rahul k", Address: "pune", Disease: "cold", Phone: "+919876543211", DateOfBirth: newDate(1985, 6, 1), Version: 1})
+		assert.NoError(t, err, "expect patient to be updated")
+		assert.NoError(t, service.resyncSubscriber(receptionist, subscriber), "expect receptionist to resync")
+		if assert.Len(t, subscriber.notification, 3, "expect snapshot, update and snapshot") {
+			for _, n := range subscriber.notification {
+				for _, p := range n.Patients {
+					assert.Empty(t, p.Disease, "expect disease to be redacted from snapshots")
+				}
+			}
+			assert.Empty(t, subscriber.notification[1].Patient.Disease, "expect disease to be redacted from changes")
+			assert.Empty(t, subscriber.notification[1].Before.Disease, "expect disease to be redacted from the previous version")
+		}
+		assert.NoError(t, service.removeSubscriber(subscriber), "expect the wrapped subscriber to be removed by name")
+	}
+}
+
+func TestRBAC_writeHiddenFields(t *testing.T) {
+	service, repo := rbacTestService()
+	receptionist := asRoles(roleReceptionist)
+
+	// the client only ever saw the redacted patient, so it sends no disease
+	updated, err := service.updatePatient(receptionist, Patient{Id: 1, Name: "priya", Address: "vadodara", Phone: "+919876543210", DateOfBirth: newDate(1990, 2, 12), Version: 1})
+	if assert.NoError(t, err, "expect update to be allowed") {
+		assert.Empty(t, updated.Disease, "expect disease to be redacted")
+	}
+	stored, _ := repo.getPatient(context.Background(), 1)
+	assert.Equal(t, "vadodara", stored.Address, "expect address to be updated")
+	assert.Equal(t, "diabetes", stored.Disease, "expect disease to be kept")
+
+	tests := []struct {
+		name    string
+		patch   PatientPatch
+		wantErr error
+	}{
+		{
+			name:  "merge patch of visible field :POS",
+			patch: PatientPatch{ContentType: mergePatchContentType, Document: json.RawMessage(`{"address": "surat"}`)},
+		},
+		{
+			name:    "merge patch of disease :NEG",
+			patch:   PatientPatch{ContentType: mergePatchContentType, Document: json.RawMessage(`{"disease": "cold"}`)},
+			wantErr: errForbidden,
+		},
+		{
+			name:    "test of disease :NEG",
+			patch:   PatientPatch{ContentType: jsonPatchContentType, Document: json.RawMessage(`[{"op": "test", "path": "/disease", "value": "diabetes"}]`)},
+			wantErr: errForbidden,
+		},
+		{
+			name:    "copy from disease :NEG",
+			patch:   PatientPatch{ContentType: jsonPatchContentType, Document: json.RawMessage(`[{"op": "copy", "from": "/disease", "path": "/address"}]`)},
+			wantErr: errForbidden,
+		},
+		{
+			name:    "malformed patch :NEG",
+			patch:   PatientPatch{ContentType: mergePatchContentType, Document: json.RawMessage(`[]`)},
+			wantErr: errInvalidPatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored, _ := repo.getPatient(context.Background(), 1)
+			patched, err := service.patchPatient(receptionist, 1, stored.Version, tt.patch)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr, "expect error to match")
+				return
+			}
+			if assert.NoError(t, err, "expect patch to be applied") {
+				assert.Empty(t, patched.Disease, "expect disease to be redacted")
+			}
+		})
+	}
+}
+
+func TestRBAC_routes(t *testing.T) {
+	const receptionistKey = "rc-0123456789abcdef0123456789abcdef"
+	const auditorKey = "au-0123456789abcdef0123456789abcdef"
+	auth, err := newAuthenticator(context.Background(), AuthConfig{
+		APIKeys: []APIKeyConfig{
+			{Name: "front-desk", Key: receptionistKey, Roles: []string{roleReceptionist}},
+			{Name: "audit", Key: auditorKey, Roles: []string{roleAuditor}},
+			{Name: "ci", Key: testAPIKey},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+	authorized, _ := rbacTestService()
+	transport := newHttpTransport(authorized)
+	transport.logger = discardLogger()
+	transport.auth = auth
+	ts := httptest.NewServer(buildRoutes(transport))
+	defer ts.Close()
+
+	do := func(method, path, key, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set(apiKeyHeader, key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to %s %s: %v", method, path, err)
+		}
+		defer res.Body.Close()
+		data, _ := io.ReadAll(res.Body)
+		return res, string(data)
+	}
+
+	res, body := do("GET", "/api/patients/1", receptionistKey, "")
+	assert.Equal(t, http.StatusOK, res.StatusCode, "expect patient to be read")
+	assert.NotContains(t, body, "disease", "expect disease to be left out")
+
+	res, body = do("DELETE", "/api/patients/1", receptionistKey, "")
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "expect delete to be forbidden")
+	assert.JSONEq(t, `{"messages": ["forbidden: deletePatient needs the patients:delete permission"]}`, body, "expect reason")
+
+	res, _ = do("GET", "/api/patients?disease=diab", receptionistKey, "")
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "expect filtering by disease to be forbidden")
+
+	res, _ = do("POST", "/api/patients", auditorKey, `{"name": "new", "address": "surat", "disease": "cold", "phone": "+919876543212", "dateOfBirth": "2000-01-01"}`)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "expect auditors not to create patients")
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/websocket"
+	forbidden, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{apiKeyHeader: {testAPIKey}})
+	if assert.NoError(t, err, "expect the connection to be upgraded") {
+		forbidden.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err = forbidden.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "expect a caller without roles not to subscribe, got %v", err)
+		assert.ErrorContains(t, err, "forbidden: addSubscriber needs the patients:read permission", "expect reason")
+		forbidden.Close()
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{apiKeyHeader: {receptionistKey}})
+	if !assert.NoError(t, err, "expect receptionist to subscribe") {
+		return
+	}
+	defer conn.Close()
+
+	res, _ = do("POST", "/api/patients", receptionistKey, `{"name": "new", "address": "surat", "disease": "cold", "phone": "+919876543212", "dateOfBirth": "2000-01-01"}`)
+	assert.Equal(t, http.StatusCreated, res.StatusCode, "expect receptionist to register a patient")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	assert.NoError(t, err, "expect the snapshot")
+	_, message, err := conn.ReadMessage()
+	if assert.NoError(t, err, "expect a notification") {
+		assert.Contains(t, string(message), `"name":"new"`, "expect the new patient")
+		assert.NotContains(t, string(message), "disease", "expect disease to be left out of notifications")
+	}
+}
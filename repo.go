@@ -1,83 +1,321 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var errPatientNotFound = errors.New("patient not found")
 var errDuplicateId = errors.New("duplicate id")
+var errVersionConflict = errors.New("patient was modified since it was read")
 
+// Repository stores patients. Every change is recorded in the audit log,
+// attributed to the actor in ctx, and fails if its entry cannot be written.
 type Repository interface {
-	createPatient(p Patient) error
-	getPatients() ([]Patient, error)
-	getPatient(id int) (Patient, error)
-	deletePatient(id int) error
-	updatePatient(p Patient) error
+	createPatient(ctx context.Context, p Patient) (Patient, error)
+	getPatients(ctx context.Context) ([]Patient, error)
+	findPatients(ctx context.Context, q PatientQuery) (PatientPage, error)
+	searchPatients(ctx context.Context, terms []string, fields []string, limit int) ([]SearchResult, error)
+	getPatient(ctx context.Context, id int) (Patient, error)
+	deletePatient(ctx context.Context, id int) (Patient, error)
+	updatePatient(ctx context.Context, p Patient) (Patient, error)
+	patchPatient(ctx context.Context, p Patient, columns []string) (Patient, error)
+	getDeletedPatients(ctx context.Context) ([]Patient, error)
+	restorePatient(ctx context.Context, id int, restoredAt time.Time) (Patient, error)
+	purgePatients(ctx context.Context, deletedBefore time.Time) ([]int, error)
+	getAuditEntries(ctx context.Context, patientId int) ([]AuditEntry, error)
 }
 
+// InMemoryRepository is safe for concurrent use: mu guards the patients and
+// the audit log, and callers only ever get copies of them.
 type InMemoryRepository struct {
+	mu       sync.RWMutex
 	patients []Patient
+	lastId   atomic.Int64
+
+	audit       []AuditEntry
+	lastAuditId int
 }
 
 func newInMemoryRepository() *InMemoryRepository {
 	return &InMemoryRepository{patients: []Patient{}}
 }
 
-func (repo *InMemoryRepository) createPatient(p Patient) error {
+// createPatient stores p under a newly allocated id, or under p.Id when the
+// caller supplied one.
+func (repo *InMemoryRepository) createPatient(ctx context.Context, p Patient) (Patient, error) {
+	if err := ctx.Err(); err != nil {
+		return Patient{}, err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if p.Id == 0 {
+		p.Id = repo.nextId()
+	}
+
 	for _, patient := range repo.patients {
 		if patient.Id == p.Id {
-			return errDuplicateId
+			return Patient{}, errDuplicateId
 		}
 	}
 	repo.patients = append(repo.patients, p)
-	return nil
+	repo.addAuditEntry(newAuditEntry(ctx, p.Id, auditCreate, p.CreatedAt, auditChanges(nil, &p)))
+	return p, nil
 }
 
-func (repo *InMemoryRepository) getPatients() ([]Patient, error) {
-	patientsCopy := make([]Patient, len(repo.patients))
-	copy(patientsCopy, repo.patients)
-	return patientsCopy, nil
+// nextId hands out ids from an increasing counter, skipping any that are
+// already taken by imported patients, deleted ones included. The caller
+// holds mu.
+func (repo *InMemoryRepository) nextId() int {
+	for {
+		id := int(repo.lastId.Add(1))
+		taken := false
+		for _, patient := range repo.patients {
+			if patient.Id == id {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			return id
+		}
+	}
 }
 
-func (repo *InMemoryRepository) getPatient(id int) (Patient, error) {
+func (repo *InMemoryRepository) getPatients(ctx context.Context) ([]Patient, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	return repo.activePatients(), nil
+}
+
+// activePatients returns a copy of the patients that are not in the trash.
+// The caller holds mu.
+func (repo *InMemoryRepository) activePatients() []Patient {
+	patients := make([]Patient, 0, len(repo.patients))
 	for _, p := range repo.patients {
-		if p.Id == id {
-			return p, nil
+		if p.DeletedAt == nil {
+			patients = append(patients, p)
 		}
 	}
-	return Patient{}, errPatientNotFound
+	return patients
 }
 
-func (repo *InMemoryRepository) deletePatient(id int) error {
+func (repo *InMemoryRepository) findPatients(ctx context.Context, q PatientQuery) (PatientPage, error) {
+	if err := ctx.Err(); err != nil {
+		return PatientPage{}, err
+	}
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	return q.apply(repo.activePatients()), nil
+}
+
+func (repo *InMemoryRepository) searchPatients(ctx context.Context, terms []string, fields []string, limit int) ([]SearchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	return searchInMemory(repo.activePatients(), terms, fields, limit), nil
+}
+
+func (repo *InMemoryRepository) getPatient(ctx context.Context, id int) (Patient, error) {
+	if err := ctx.Err(); err != nil {
+		return Patient{}, err
+	}
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
 	idx, err := repo.findPatientIdx(id)
 	if err != nil {
-		return err
+		return Patient{}, err
 	}
+	return repo.patients[idx], nil
+}
 
-	sliceLen := len(repo.patients)
-	lastIndex := sliceLen - 1
+// deletePatient moves the patient to the trash and returns it as it was;
+// it stays stored until purgePatients removes it.
+func (repo *InMemoryRepository) deletePatient(ctx context.Context, id int) (Patient, error) {
+	if err := ctx.Err(); err != nil {
+		return Patient{}, err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
 
-	if idx != lastIndex {
-		repo.patients[idx] = repo.patients[lastIndex]
+	idx, err := repo.findPatientIdx(id)
+	if err != nil {
+		return Patient{}, err
 	}
 
-	repo.patients = repo.patients[:lastIndex]
-	return nil
+	stored := repo.patients[idx]
+	deletedAt := time.Now()
+	repo.patients[idx].DeletedAt = &deletedAt
+	repo.addAuditEntry(newAuditEntry(ctx, id, auditDelete, deletedAt, auditChanges(&stored, nil)))
+	return stored, nil
 }
 
-func (repo *InMemoryRepository) updatePatient(p Patient) error {
+// updatePatient replaces the stored patient only if it is still at
+// p.Version, and returns it with the version bumped.
+func (repo *InMemoryRepository) updatePatient(ctx context.Context, p Patient) (Patient, error) {
+	if err := ctx.Err(); err != nil {
+		return Patient{}, err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
 	idx, err := repo.findPatientIdx(p.Id)
 	if err != nil {
-		return err
+		return Patient{}, err
 	}
 
+	stored := repo.patients[idx]
+	if stored.Version != p.Version {
+		return Patient{}, errVersionConflict
+	}
+
+	p.Version++
 	repo.patients[idx] = p
-	return nil
+	repo.addAuditEntry(newAuditEntry(ctx, p.Id, auditUpdate, p.UpdatedAt, auditChanges(&stored, &p)))
+	return p, nil
+}
+
+// patchPatient copies only the given columns (plus UpdatedAt) from p onto
+// the stored patient, if it is still at p.Version.
+func (repo *InMemoryRepository) patchPatient(ctx context.Context, p Patient, columns []string) (Patient, error) {
+	if err := ctx.Err(); err != nil {
+		return Patient{}, err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	idx, err := repo.findPatientIdx(p.Id)
+	if err != nil {
+		return Patient{}, err
+	}
+
+	stored := repo.patients[idx]
+	if stored.Version != p.Version {
+		return Patient{}, errVersionConflict
+	}
+
+	updated := stored
+	copyPatientColumns(&updated, p, columns)
+	updated.UpdatedAt = p.UpdatedAt
+	updated.Version++
+	repo.patients[idx] = updated
+	repo.addAuditEntry(newAuditEntry(ctx, p.Id, auditUpdate, updated.UpdatedAt, auditChanges(&stored, &updated)))
+	return updated, nil
+}
+
+func (repo *InMemoryRepository) getDeletedPatients(ctx context.Context) ([]Patient, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	patients := make([]Patient, 0)
+	for _, p := range repo.patients {
+		if p.DeletedAt != nil {
+			patients = append(patients, p)
+		}
+	}
+
+	sort.SliceStable(patients, func(i, j int) bool {
+		return patients[i].DeletedAt.After(*patients[j].DeletedAt)
+	})
+	return patients, nil
+}
+
+// restorePatient takes a patient out of the trash, which counts as an
+// update and so bumps its version.
+func (repo *InMemoryRepository) restorePatient(ctx context.Context, id int, restoredAt time.Time) (Patient, error) {
+	if err := ctx.Err(); err != nil {
+		return Patient{}, err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	for idx, p := range repo.patients {
+		if p.Id == id && p.DeletedAt != nil {
+			p.DeletedAt = nil
+			p.UpdatedAt = restoredAt
+			p.Version++
+			repo.patients[idx] = p
+			repo.addAuditEntry(newAuditEntry(ctx, id, auditRestore, restoredAt, []FieldChange{}))
+			return p, nil
+		}
+	}
+	return Patient{}, errPatientNotFound
+}
+
+// purgePatients permanently removes patients that went to the trash before
+// deletedBefore and returns their ids.
+func (repo *InMemoryRepository) purgePatients(ctx context.Context, deletedBefore time.Time) ([]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	purgedAt := time.Now()
+	kept := make([]Patient, 0, len(repo.patients))
+	purged := make([]int, 0)
+	for _, p := range repo.patients {
+		if p.DeletedAt == nil || !p.DeletedAt.Before(deletedBefore) {
+			kept = append(kept, p)
+		} else {
+			purged = append(purged, p.Id)
+			// the delete entry already holds the values the patient had
+			repo.addAuditEntry(newAuditEntry(ctx, p.Id, auditPurge, purgedAt, []FieldChange{}))
+		}
+	}
+
+	repo.patients = kept
+	return purged, nil
+}
+
+// addAuditEntry appends e to the audit log. Stored entries are never
+// changed or removed, not even when their patient is purged. The caller
+// holds mu.
+func (repo *InMemoryRepository) addAuditEntry(e AuditEntry) {
+	repo.lastAuditId++
+	e.Id = repo.lastAuditId
+	repo.audit = append(repo.audit, e)
+}
+
+// getAuditEntries returns the audit entries of a patient, oldest first.
+func (repo *InMemoryRepository) getAuditEntries(ctx context.Context, patientId int) ([]AuditEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	entries := make([]AuditEntry, 0)
+	for _, e := range repo.audit {
+		if e.PatientId == patientId {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
 }
 
+// findPatientIdx finds a patient that is not in the trash. The caller holds
+// mu.
 func (repo *InMemoryRepository) findPatientIdx(id int) (int, error) {
 	for idx, patient := range repo.patients {
-		if patient.Id == id {
+		if patient.Id == id && patient.DeletedAt == nil {
 			return idx, nil
 		}
 	}
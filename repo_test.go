@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -22,38 +25,32 @@ func TestRepo_createPatient(t *testing.T) {
 			name: "duplicate patient id :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			wantErr: errDuplicateId,
@@ -62,48 +59,81 @@ func TestRepo_createPatient(t *testing.T) {
 			name: "succesfully add patient :POS",
 			args: args{
 				patient: Patient{
-					Id:      2,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          2,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 				{
-					Id:      2,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          2,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
+				},
+			},
+			wantErr: nil,
+		},
+		{
+			name: "server assigns id skipping imported ids :POS",
+			args: args{
+				patient: Patient{
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
+				},
+			},
+			existingPatients: []Patient{
+				{
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
+				},
+			},
+			wantPatients: []Patient{
+				{
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
+				},
+				{
+					Id:          2,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			wantErr: nil,
@@ -115,10 +145,13 @@ func TestRepo_createPatient(t *testing.T) {
 			repo := newInMemoryRepository()
 			repo.patients = tt.existingPatients
 
-			gotErr := repo.createPatient(tt.args.patient)
+			gotPatient, gotErr := repo.createPatient(context.Background(), tt.args.patient)
 
 			assert.ErrorIs(t, gotErr, tt.wantErr, "expect errors to match")
 			assert.Equal(t, repo.patients, tt.wantPatients)
+			if tt.wantErr == nil {
+				assert.Equal(t, tt.wantPatients[len(tt.wantPatients)-1], gotPatient, "expect created patient to be returned")
+			}
 		})
 	}
 }
@@ -140,46 +173,38 @@ func TestRepo_getPatients(t *testing.T) {
 			name: "multiple patient list :POS",
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 				{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 				{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			wantErr: false,
@@ -191,7 +216,7 @@ func TestRepo_getPatients(t *testing.T) {
 			repo := newInMemoryRepository()
 			repo.patients = tt.existingPatients
 
-			gotPatients, gotErr := repo.getPatients()
+			gotPatients, gotErr := repo.getPatients(context.Background())
 
 			assert.NoError(t, gotErr, "no error expected")
 			assert.Equal(t, tt.wantPatients, gotPatients, "expect patients to match")
@@ -215,24 +240,20 @@ func TestRepo_getPatient(t *testing.T) {
 			name: "patient does not exist :NEG",
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 				{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			args:        args{id: 3},
@@ -243,36 +264,30 @@ func TestRepo_getPatient(t *testing.T) {
 			name: "patient exists :POS",
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 				{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			args: args{id: 2},
 			wantPatient: Patient{
-				Id:      2,
-				Name:    "wer",
-				Address: "srt",
-				Disease: "fever",
-				Phone:   12345,
-				Year:    2024,
-				Month:   12,
-				Date:    12,
+				Id:          2,
+				Name:        "wer",
+				Address:     "srt",
+				Disease:     "fever",
+				Phone:       "+919876543210",
+				DateOfBirth: newDate(2024, 12, 12),
 			},
 			wantErr: nil,
 		},
@@ -282,7 +297,7 @@ func TestRepo_getPatient(t *testing.T) {
 			repo := newInMemoryRepository()
 			repo.patients = tt.existingPatients
 
-			gotPatient, gotErr := repo.getPatient(tt.args.id)
+			gotPatient, gotErr := repo.getPatient(context.Background(), tt.args.id)
 
 			assert.ErrorIs(t, gotErr, tt.wantErr, "expected error and got error are not same")
 			assert.Equal(t, tt.wantPatient, gotPatient, "expected patient and got patient are not same")
@@ -307,14 +322,12 @@ func TestRepo_updatePatient(t *testing.T) {
 			existingPatients: []Patient{},
 			args: args{
 				patient: Patient{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			wantErr:      errPatientNotFound,
@@ -324,38 +337,32 @@ func TestRepo_updatePatient(t *testing.T) {
 			name: "patient not found :NEG",
 			args: args{
 				patient: Patient{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "jhdfe",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   2,
-					Date:    22,
+					Id:          1,
+					Name:        "jhdfe",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 22),
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "jhdfe",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   2,
-					Date:    22,
+					Id:          1,
+					Name:        "jhdfe",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 22),
 				},
 			},
 			wantErr: errPatientNotFound,
@@ -364,69 +371,99 @@ func TestRepo_updatePatient(t *testing.T) {
 			name: "patient updated :POS",
 			args: args{
 				patient: Patient{
-					Id:      2,
-					Name:    "xyz",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "xyz",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+					Version:     3,
 				},
 			},
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "priya",
-					Address: "surat",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   2,
-					Date:    22,
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 22),
 				},
 				{
-					Id:      2,
-					Name:    "abc",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   2,
-					Date:    22,
+					Id:          2,
+					Name:        "abc",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 22),
+					Version:     3,
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "priya",
-					Address: "surat",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   2,
-					Date:    22,
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 22),
 				},
 				{
-					Id:      2,
-					Name:    "xyz",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "xyz",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+					Version:     4,
 				},
 			},
 			wantErr: nil,
 		},
+		{
+			name: "stale version :NEG",
+			args: args{
+				patient: Patient{
+					Id:          1,
+					Name:        "xyz",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+					Version:     1,
+				},
+			},
+			existingPatients: []Patient{
+				{
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 22),
+					Version:     2,
+				},
+			},
+			wantPatients: []Patient{
+				{
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 22),
+					Version:     2,
+				},
+			},
+			wantErr: errVersionConflict,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			repo := newInMemoryRepository()
 			repo.patients = tt.existingPatients
 
-			gotErr := repo.updatePatient(tt.args.patient)
+			_, gotErr := repo.updatePatient(context.Background(), tt.args.patient)
 
 			assert.ErrorIs(t, gotErr, tt.wantErr, "expected error and got error are not same")
 			assert.Equal(t, tt.wantPatients, repo.patients, "expected patient and got patient are not same")
@@ -451,26 +488,22 @@ func TestRepo_deletePatient(t *testing.T) {
 			args: args{id: 2},
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			wantErr: errPatientNotFound,
@@ -480,36 +513,30 @@ func TestRepo_deletePatient(t *testing.T) {
 			args: args{id: 2},
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 				{
-					Id:      2,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          2,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			wantErr: nil,
@@ -521,10 +548,474 @@ func TestRepo_deletePatient(t *testing.T) {
 			repo := newInMemoryRepository()
 			repo.patients = tt.existingPatients
 
-			gotErr := repo.deletePatient(tt.args.id)
+			_, gotErr := repo.deletePatient(context.Background(), tt.args.id)
+
+			assert.ErrorIs(t, gotErr, tt.wantErr, "expected error and got error are not same")
+			assert.Equal(t, tt.wantPatients, repo.activePatients(), "expected and got patient are not same")
+		})
+	}
+}
+
+func TestRepo_cancelledContext(t *testing.T) {
+	existingPatients := []Patient{
+		{
+			Id:          1,
+			Name:        "ert",
+			Address:     "amd",
+			Disease:     "fever",
+			Phone:       "+919900112233",
+			DateOfBirth: newDate(2024, 12, 2),
+		},
+	}
+
+	tests := []struct {
+		name string
+		call func(ctx context.Context, repo *InMemoryRepository) error
+	}{
+		{
+			name: "create patient :NEG",
+			call: func(ctx context.Context, repo *InMemoryRepository) error {
+				_, err := repo.createPatient(ctx, Patient{Id: 2})
+				return err
+			},
+		},
+		{
+			name: "get patients :NEG",
+			call: func(ctx context.Context, repo *InMemoryRepository) error {
+				_, err := repo.getPatients(ctx)
+				return err
+			},
+		},
+		{
+			name: "get patient :NEG",
+			call: func(ctx context.Context, repo *InMemoryRepository) error {
+				_, err := repo.getPatient(ctx, 1)
+				return err
+			},
+		},
+		{
+			name: "update patient :NEG",
+			call: func(ctx context.Context, repo *InMemoryRepository) error {
+				_, err := repo.updatePatient(ctx, Patient{Id: 1, Name: "abc"})
+				return err
+			},
+		},
+		{
+			name: "delete patient :NEG",
+			call: func(ctx context.Context, repo *InMemoryRepository) error {
+				_, err := repo.deletePatient(ctx, 1)
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newInMemoryRepository()
+			repo.patients = append([]Patient{}, existingPatients...)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			gotErr := tt.call(ctx, repo)
+
+			assert.ErrorIs(t, gotErr, context.Canceled, "expect cancelled context error")
+			assert.Equal(t, existingPatients, repo.patients, "expect patients to be untouched")
+		})
+	}
+}
+
+func TestRepo_findPatients(t *testing.T) {
+	day1 := time.Date(2024, time.August, 1, 10, 0, 0, 0, time.UTC)
+	day2 := time.Date(2024, time.August, 2, 10, 0, 0, 0, time.UTC)
+	day3 := time.Date(2024, time.August, 3, 10, 0, 0, 0, time.UTC)
+
+	existingPatients := []Patient{
+		{Id: 1, Name: "priya", Address: "surat", Disease: "fever", CreatedAt: day2},
+		{Id: 2, Name: "abc", Address: "ahmedabad", Disease: "cold", CreatedAt: day1},
+		{Id: 3, Name: "Priyanka", Address: "surat", Disease: "cold", CreatedAt: day3},
+	}
+
+	tests := []struct {
+		name    string
+		query   PatientQuery
+		wantIds []int
+		wantTot int
+	}{
+		{
+			name:    "default sort by id :POS",
+			query:   newPatientQuery(),
+			wantIds: []int{1, 2, 3},
+			wantTot: 3,
+		},
+		{
+			name:    "sort by name descending :POS",
+			query:   PatientQuery{Limit: 10, SortBy: sortByName, SortDesc: true},
+			wantIds: []int{3, 1, 2},
+			wantTot: 3,
+		},
+		{
+			name:    "limit and offset :POS",
+			query:   PatientQuery{Limit: 1, Offset: 1, SortBy: sortByCreatedAt},
+			wantIds: []int{1},
+			wantTot: 3,
+		},
+		{
+			name:    "offset past the end :POS",
+			query:   PatientQuery{Limit: 10, Offset: 5, SortBy: sortById},
+			wantIds: []int{},
+			wantTot: 3,
+		},
+		{
+			name:    "case insensitive name filter :POS",
+			query:   PatientQuery{Limit: 10, SortBy: sortById, Name: "PRIYA"},
+			wantIds: []int{1, 3},
+			wantTot: 2,
+		},
+		{
+			name:    "disease and address filter :POS",
+			query:   PatientQuery{Limit: 10, SortBy: sortById, Disease: "cold", Address: "sur"},
+			wantIds: []int{3},
+			wantTot: 1,
+		},
+		{
+			name:    "admission date range :POS",
+			query:   PatientQuery{Limit: 10, SortBy: sortById, AdmittedFrom: day1, AdmittedTo: day2},
+			wantIds: []int{1, 2},
+			wantTot: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newInMemoryRepository()
+			repo.patients = existingPatients
+
+			gotPage, gotErr := repo.findPatients(context.Background(), tt.query)
+
+			assert.NoError(t, gotErr, "no error expected")
+			gotIds := []int{}
+			for _, p := range gotPage.Patients {
+				gotIds = append(gotIds, p.Id)
+			}
+			assert.Equal(t, tt.wantIds, gotIds, "expect patient ids to match")
+			assert.Equal(t, tt.wantTot, gotPage.Total, "expect total to match")
+			assert.Equal(t, existingPatients[0].Id, repo.patients[0].Id, "expect stored order to be untouched")
+		})
+	}
+}
+
+func TestRepo_searchPatients(t *testing.T) {
+	existingPatients := []Patient{
+		{Id: 1, Name: "Priya Shah", Address: "Adajan, Surat", Disease: "fever"},
+		{Id: 2, Name: "Rahul", Address: "Priyadarshini Nagar", Disease: "cold"},
+		{Id: 3, Name: "Meera", Address: "Surat", Disease: "viral fever"},
+		{Id: 4, Name: `<script>alert("x")</script> Anil`, Address: "Vesu", Disease: "cold"},
+	}
+
+	tests := []struct {
+		name        string
+		terms       []string
+		fields      []string
+		limit       int
+		wantResults []SearchResult
+	}{
+		{
+			name:        "no match :POS",
+			terms:       []string{"malaria"},
+			limit:       10,
+			wantResults: []SearchResult{},
+		},
+		{
+			name:  "partial name ranks name above address :POS",
+			terms: []string{"priy"},
+			limit: 10,
+			wantResults: []SearchResult{
+				{
+					Patient:    existingPatients[0],
+					Rank:       1.0,
+					Highlights: map[string]string{"name": "<mark>Priya</mark> Shah"},
+				},
+				{
+					Patient:    existingPatients[1],
+					Rank:       0.2,
+					Highlights: map[string]string{"address": "<mark>Priyadarshini</mark> Nagar"},
+				},
+			},
+		},
+		{
+			name:  "every term must match :POS",
+			terms: []string{"fever", "surat"},
+			limit: 10,
+			wantResults: []SearchResult{
+				{
+					Patient: existingPatients[0],
+					Rank:    0.6000000000000001,
+					Highlights: map[string]string{
+						"disease": "<mark>fever</mark>",
+						"address": "Adajan, <mark>Surat</mark>",
+					},
+				},
+				{
+					Patient: existingPatients[2],
+					Rank:    0.6000000000000001,
+					Highlights: map[string]string{
+						"disease": "viral <mark>fever</mark>",
+						"address": "<mark>Surat</mark>",
+					},
+				},
+			},
+		},
+		{
+			name:  "markup in a field is escaped :POS",
+			terms: []string{"anil"},
+			limit: 10,
+			wantResults: []SearchResult{
+				{
+					Patient:    existingPatients[3],
+					Rank:       1.0,
+					Highlights: map[string]string{"name": "&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; <mark>Anil</mark>"},
+				},
+			},
+		},
+		{
+			name:        "only the given fields are searched :POS",
+			terms:       []string{"fever"},
+			fields:      []string{"name", "address"},
+			limit:       10,
+			wantResults: []SearchResult{},
+		},
+		{
+			name:  "limit results :POS",
+			terms: []string{"fever"},
+			limit: 1,
+			wantResults: []SearchResult{
+				{
+					Patient:    existingPatients[0],
+					Rank:       0.4,
+					Highlights: map[string]string{"disease": "<mark>fever</mark>"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newInMemoryRepository()
+			repo.patients = existingPatients
+
+			fields := tt.fields
+			if fields == nil {
+				fields = allSearchFields()
+			}
+			gotResults, gotErr := repo.searchPatients(context.Background(), tt.terms, fields, tt.limit)
+
+			assert.NoError(t, gotErr, "no error expected")
+			assert.Equal(t, tt.wantResults, gotResults, "expect search results to match")
+		})
+	}
+}
+
+func TestRepo_patchPatient(t *testing.T) {
+	testTime := time.Date(2024, time.August, 20, 17, 0, 0, 0, time.UTC)
+	existingPatient := Patient{
+		Id:          1,
+		Name:        "priya",
+		Address:     "surat",
+		Disease:     "fever",
+		Phone:       "+919876543210",
+		DateOfBirth: newDate(2024, 2, 22),
+		CreatedAt:   testTime,
+		UpdatedAt:   testTime,
+		Version:     2,
+	}
+
+	tests := []struct {
+		name        string
+		patch       Patient
+		columns     []string
+		wantPatient Patient
+		wantErr     error
+	}{
+		{
+			name:        "patient not found :NEG",
+			patch:       Patient{Id: 2, Name: "abc", Version: 2},
+			columns:     []string{"name"},
+			wantPatient: existingPatient,
+			wantErr:     errPatientNotFound,
+		},
+		{
+			name:        "stale version :NEG",
+			patch:       Patient{Id: 1, Name: "abc", Version: 1},
+			columns:     []string{"name"},
+			wantPatient: existingPatient,
+			wantErr:     errVersionConflict,
+		},
+		{
+			name:    "only listed columns are written :POS",
+			patch:   Patient{Id: 1, Name: "abc", Address: "ignored", UpdatedAt: testTime.Add(time.Hour), Version: 2},
+			columns: []string{"name"},
+			wantPatient: Patient{
+				Id:          1,
+				Name:        "abc",
+				Address:     "surat",
+				Disease:     "fever",
+				Phone:       "+919876543210",
+				DateOfBirth: newDate(2024, 2, 22),
+				CreatedAt:   testTime,
+				UpdatedAt:   testTime.Add(time.Hour),
+				Version:     3,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newInMemoryRepository()
+			repo.patients = []Patient{existingPatient}
+
+			gotPatient, gotErr := repo.patchPatient(context.Background(), tt.patch, tt.columns)
 
 			assert.ErrorIs(t, gotErr, tt.wantErr, "expected error and got error are not same")
-			assert.Equal(t, tt.wantPatients, repo.patients, "expected and got patient are not same")
+			assert.Equal(t, []Patient{tt.wantPatient}, repo.patients, "expected and got patients are not same")
+			if tt.wantErr == nil {
+				assert.Equal(t, tt.wantPatient, gotPatient, "expected and got patient are not same")
+			}
 		})
 	}
 }
+
+func TestRepo_trash(t *testing.T) {
+	oldDelete := time.Date(2024, time.January, 1, 10, 0, 0, 0, time.UTC)
+	newDelete := time.Date(2024, time.August, 1, 10, 0, 0, 0, time.UTC)
+	restoredAt := time.Date(2024, time.August, 20, 17, 0, 0, 0, time.UTC)
+
+	newRepo := func() *InMemoryRepository {
+		repo := newInMemoryRepository()
+		repo.patients = []Patient{
+			{Id: 1, Name: "priya", Version: 1},
+			{Id: 2, Name: "abc", Version: 4, DeletedAt: &oldDelete},
+			{Id: 3, Name: "xyz", Version: 1, DeletedAt: &newDelete},
+		}
+		return repo
+	}
+
+	t.Run("deleted patients are hidden :POS", func(t *testing.T) {
+		repo := newRepo()
+
+		patients, err := repo.getPatients(context.Background())
+		assert.NoError(t, err, "no error expected")
+		assert.Equal(t, []Patient{{Id: 1, Name: "priya", Version: 1}}, patients, "expect only active patients")
+
+		_, err = repo.getPatient(context.Background(), 2)
+		assert.ErrorIs(t, err, errPatientNotFound, "expect deleted patient to be hidden")
+
+		_, err = repo.deletePatient(context.Background(), 3)
+		assert.ErrorIs(t, err, errPatientNotFound, "expect deleted patient to not be deleted twice")
+	})
+
+	t.Run("list trash newest first :POS", func(t *testing.T) {
+		repo := newRepo()
+
+		patients, err := repo.getDeletedPatients(context.Background())
+
+		assert.NoError(t, err, "no error expected")
+		assert.Equal(t, []Patient{repo.patients[2], repo.patients[1]}, patients, "expect deleted patients newest first")
+	})
+
+	t.Run("restore patient :POS", func(t *testing.T) {
+		repo := newRepo()
+
+		restored, err := repo.restorePatient(context.Background(), 2, restoredAt)
+
+		assert.NoError(t, err, "no error expected")
+		assert.Equal(t, Patient{Id: 2, Name: "abc", Version: 5, UpdatedAt: restoredAt}, restored, "expect restored patient")
+		got, err := repo.getPatient(context.Background(), 2)
+		assert.NoError(t, err, "expect restored patient to be visible")
+		assert.Equal(t, restored, got, "expect stored patient to match")
+	})
+
+	t.Run("restore active patient :NEG", func(t *testing.T) {
+		repo := newRepo()
+
+		_, err := repo.restorePatient(context.Background(), 1, restoredAt)
+
+		assert.ErrorIs(t, err, errPatientNotFound, "expect only deleted patients to be restored")
+	})
+
+	t.Run("purge patients past retention :POS", func(t *testing.T) {
+		repo := newRepo()
+
+		purged, err := repo.purgePatients(context.Background(), time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC))
+
+		assert.NoError(t, err, "no error expected")
+		assert.Equal(t, []int{2}, purged, "expect the patient deleted before retention to be purged")
+		assert.Equal(t, []int{1, 3}, []int{repo.patients[0].Id, repo.patients[1].Id}, "expect remaining patients to match")
+		assert.Len(t, repo.patients, 2, "expect two patients to remain")
+	})
+}
+
+// TestRepo_concurrentUse is meant to be run with -race: writers change
+// their own patients while readers list, search and page through all of
+// them.
+func TestRepo_concurrentUse(t *testing.T) {
+	const writers, updates = 8, 20
+	ctx := context.Background()
+	repo := newInMemoryRepository()
+
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				repo.getPatients(ctx)
+				repo.findPatients(ctx, newPatientQuery())
+				repo.searchPatients(ctx, []string{"priya"}, allSearchFields(), 10)
+				repo.getDeletedPatients(ctx)
+				repo.getAuditEntries(ctx, 1)
+			}
+		}()
+	}
+
+	stored := make([]Patient, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			p, err := repo.createPatient(ctx, Patient{Name: "priya", Address: "surat", Disease: "cold"})
+			if !assert.NoError(t, err, "expect patient to be created") {
+				return
+			}
+			for i := 0; i < updates; i++ {
+				p.Disease = "fever"
+				if i%2 == 0 {
+					p, err = repo.updatePatient(ctx, p)
+				} else {
+					p, err = repo.patchPatient(ctx, p, []string{"disease"})
+				}
+				assert.NoError(t, err, "expect own patient to be updated")
+			}
+			if w%2 == 0 {
+				_, err = repo.deletePatient(ctx, p.Id)
+				assert.NoError(t, err, "expect own patient to be deleted")
+				p, err = repo.restorePatient(ctx, p.Id, time.Now())
+				assert.NoError(t, err, "expect own patient to be restored")
+				repo.purgePatients(ctx, time.Now())
+			}
+			stored[w] = p
+		}(w)
+	}
+	wg.Wait()
+
+	patients, err := repo.getPatients(ctx)
+	assert.NoError(t, err, "no error expected")
+	assert.ElementsMatch(t, stored, patients, "expect every patient with every update")
+	updated := 0
+	for _, e := range repo.audit {
+		if e.Action == auditUpdate {
+			updated++
+		}
+	}
+	assert.Equal(t, writers*updates, updated, "expect every audit entry to be kept")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"html"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	highlightStart = "<mark>"
+	highlightStop  = "</mark>"
+)
+
+const (
+	mistakeEmptySearch = "search query cannot be empty"
+)
+
+// searchWeights mirror the setweight labels used for the search_vector
+// column: name is weighted A, disease B and address C, with the default
+// ts_rank weight for each label.
+var searchWeights = []struct {
+	field  string
+	label  string
+	weight float64
+	value  func(Patient) string
+}{
+	{field: "name", label: "A", weight: 1.0, value: func(p Patient) string { return p.Name }},
+	{field: "disease", label: "B", weight: 0.4, value: func(p Patient) string { return p.Disease }},
+	{field: "address", label: "C", weight: 0.2, value: func(p Patient) string { return p.Address }},
+}
+
+// allSearchFields are the fields searched unless fewer are asked for.
+func allSearchFields() []string {
+	fields := make([]string, len(searchWeights))
+	for i, sw := range searchWeights {
+		fields[i] = sw.field
+	}
+	return fields
+}
+
+// SearchResult is a single search hit. Highlights holds, for each field
+// that matched, the HTML-escaped field value with matched words wrapped in
+// <mark> tags.
+type SearchResult struct {
+	Patient    Patient           `json:"patient"`
+	Rank       float64           `json:"rank"`
+	Highlights map[string]string `json:"highlights"`
+}
+
+// splitSearchTerms lowercases s and splits it into distinct words.
+func splitSearchTerms(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var terms []string
+	seen := make(map[string]bool)
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+// prefixTsQuery builds a to_tsquery expression that requires every term to
+// match as a word prefix in one of fields, through their weight labels.
+// Terms only contain letters and digits so they are safe to pass to
+// to_tsquery as is.
+func prefixTsQuery(terms []string, fields []string) string {
+	labels := ""
+	for _, sw := range searchWeights {
+		if slices.Contains(fields, sw.field) {
+			labels += sw.label
+		}
+	}
+	parts := make([]string, len(terms))
+	for i, term := range terms {
+		parts[i] = term + ":*" + labels
+	}
+	return strings.Join(parts, " & ")
+}
+
+// searchInMemory is the fallback used when there is no database doing the
+// ranking: every term has to prefix-match a word in one of fields.
+func searchInMemory(patients []Patient, terms []string, fields []string, limit int) []SearchResult {
+	results := make([]SearchResult, 0)
+	for _, p := range patients {
+		result := SearchResult{Patient: p, Highlights: map[string]string{}}
+		matchedTerms := make(map[string]bool)
+
+		for _, sw := range searchWeights {
+			if !slices.Contains(fields, sw.field) {
+				continue
+			}
+			highlighted, matched := highlightTerms(sw.value(p), terms)
+			if len(matched) == 0 {
+				continue
+			}
+			result.Highlights[sw.field] = highlighted
+			for _, term := range matched {
+				matchedTerms[term] = true
+				result.Rank += sw.weight
+			}
+		}
+
+		if len(matchedTerms) == len(terms) {
+			results = append(results, result)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].Patient.Id < results[j].Patient.Id
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// highlightTerms HTML-escapes text, wraps every word that starts with one
+// of terms and reports which terms were found. Words are only letters and
+// digits, so only the text between them needs escaping.
+func highlightTerms(text string, terms []string) (string, []string) {
+	var b strings.Builder
+	var matched []string
+	seen := make(map[string]bool)
+
+	word := func(start, end int) {
+		w := text[start:end]
+		lower := strings.ToLower(w)
+		hit := false
+		for _, term := range terms {
+			if strings.HasPrefix(lower, term) {
+				hit = true
+				if !seen[term] {
+					seen[term] = true
+					matched = append(matched, term)
+				}
+			}
+		}
+		if hit {
+			b.WriteString(highlightStart + w + highlightStop)
+		} else {
+			b.WriteString(w)
+		}
+	}
+
+	start := -1
+	for i, r := range text {
+		isWordRune := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWordRune && start < 0 {
+			start = i
+		}
+		if !isWordRune {
+			if start >= 0 {
+				word(start, i)
+				start = -1
+			}
+			b.WriteString(html.EscapeString(string(r)))
+		}
+	}
+	if start >= 0 {
+		word(start, len(text))
+	}
+
+	return b.String(), matched
+}
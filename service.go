@@ -1,130 +1,670 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"slices"
+	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Service interface {
-	createPatient(p Patient) error
-	getPatients() ([]Patient, error)
-	getPatient(id int) (Patient, error)
-	deletePatient(id int) error
-	updatePatient(p Patient) error
-	addSubscriber(sub Subscriber) error
+	createPatient(ctx context.Context, p Patient) (Patient, error)
+	getPatients(ctx context.Context) ([]Patient, error)
+	findPatients(ctx context.Context, q PatientQuery) (PatientPage, error)
+	searchPatients(ctx context.Context, query string, fields []string, limit int) ([]SearchResult, error)
+	getPatient(ctx context.Context, id int) (Patient, error)
+	deletePatient(ctx context.Context, id int) error
+	updatePatient(ctx context.Context, p Patient) (Patient, error)
+	patchPatient(ctx context.Context, id int, version int, patch PatientPatch) (Patient, error)
+	getDeletedPatients(ctx context.Context) ([]Patient, error)
+	restorePatient(ctx context.Context, id int) (Patient, error)
+	purgeDeletedPatients(ctx context.Context) (int, error)
+	getPatientHistory(ctx context.Context, id int) ([]AuditEntry, error)
+	addSubscriber(ctx context.Context, sub Subscriber) error
+	resumeSubscriber(ctx context.Context, sub Subscriber, stream string, since int64) error
+	resyncSubscriber(ctx context.Context, sub Subscriber) error
 	removeSubscriber(sub Subscriber) error
+	closeSubscribers()
 }
 
 var errSubscriberNotFound = errors.New("Subscriber not found")
 var errEmptySubscriber = errors.New("Subscriber name cannot be empty")
 
 type patientsService struct {
-	repo        Repository
-	subscribers []Subscriber
+	repo Repository
+
+	// subscribersMu guards subscribers, which is replaced rather than
+	// changed in place, so a fan-out can keep ranging over the list it
+	// started with while clients come and go.
+	subscribersMu sync.Mutex
+	subscribers   []Subscriber
+
+	// notifyMu is held while a change is numbered and handed to the
+	// subscribers, and while a subscriber is handed a snapshot, so that
+	// every subscriber sees the changes after its snapshot in order.
+	// lastSeq is the number of the latest change, loading collects the
+	// changes made while snapshots load, and replay holds the latest
+	// changes for clients that reconnect.
+	notifyMu sync.Mutex
+	lastSeq  int64
+	loading  []*pendingChanges
+	replay   *replayBuffer
+
+	// stream tells this process's sequence numbers apart from those of an
+	// earlier one, which started again from zero.
+	stream string
+
+	// allowClientIds enables import mode, where createPatient keeps an id
+	// supplied by the caller instead of always letting the repository
+	// assign one.
+	allowClientIds bool
+
+	// trashRetention is how long a deleted patient stays restorable before
+	// purgeDeletedPatients removes it for good.
+	trashRetention time.Duration
+
+	// acceptLegacyDates lets clients keep sending the date of birth as
+	// separate year, month and date fields instead of dateOfBirth.
+	acceptLegacyDates bool
+
+	// phoneRegion is the region phone numbers without a country code are
+	// read in before they are stored in E.164 form.
+	phoneRegion string
+
+	// fanOuts records when each notification still being sent to
+	// subscribers started, so that readiness can spot a wedged one.
+	fanOuts fanOutTracker
+
+	// observeFanOut, when set, is told how long each notification took to
+	// reach every subscriber.
+	observeFanOut func(time.Duration)
+
+	logger *slog.Logger
+	tracer trace.Tracer
 }
 
+const defaultTrashRetention = 30 * 24 * time.Hour
+
 type Subscriber interface {
 	getName() string
 	update(Notification)
+
+	// close tells the subscriber that no more notifications will come
+	// because the server is shutting down.
+	close()
 }
 
+// Notification types. A snapshot carries every patient, the others the
+// one patient that changed.
+const (
+	notificationSnapshot = "snapshot"
+	notificationCreated  = "patient.created"
+	notificationUpdated  = "patient.updated"
+	notificationDeleted  = "patient.deleted"
+	notificationRestored = "patient.restored"
+
+	// notificationResyncRequired answers a client resuming from a change
+	// that is no longer held; it has to ask for a snapshot.
+	notificationResyncRequired = "resync.required"
+)
+
+// Notification tells subscribers about a change, or with type snapshot
+// about all patients. Seq goes up by one with every change, so a gap means
+// one was missed; a snapshot has the seq of the latest change it includes.
+// A change may also show up in a snapshot taken just before it is
+// numbered, so clients apply changes by id and skip older versions.
 type Notification struct {
-	Message     string    `json:"message"`
-	NewPatients []Patient `json:"newPatients"`
+	Type    string `json:"type"`
+	Seq     int64  `json:"seq"`
+	Message string `json:"message,omitempty"`
+
+	// Stream is sent with snapshots, for a client to resume from later.
+	Stream string `json:"stream,omitempty"`
+
+	// Patient is the patient as created, updated, deleted or restored,
+	// and Before how it was before an update.
+	Patient *Patient `json:"patient,omitempty"`
+	Before  *Patient `json:"before,omitempty"`
+
+	Patients []Patient `json:"patients,omitempty"`
 }
 
 func newPatientsService(repo Repository) *patientsService {
 	return &patientsService{
-		repo:        repo,
-		subscribers: []Subscriber{},
+		repo:              repo,
+		subscribers:       []Subscriber{},
+		trashRetention:    defaultTrashRetention,
+		acceptLegacyDates: true,
+		phoneRegion:       defaultPhoneRegion,
+		logger:            slog.Default(),
+		tracer:            defaultTracer(),
+		replay:            newReplayBuffer(defaultReplaySize),
+		stream:            newRequestId(),
 	}
 }
 
-func (s *patientsService) createPatient(p Patient) error {
-	if err := patientValidation(p); err != nil {
-		return err
+func (s *patientsService) createPatient(ctx context.Context, p Patient) (Patient, error) {
+	if err := s.legacyDateValidation(&p); err != nil {
+		return Patient{}, err
 	}
+	if err := s.newPatientValidation(p); err != nil {
+		return Patient{}, err
+	}
+	p.Phone, _ = parsePhone(p.Phone, s.phoneRegion)
 
 	timeNow := time.Now()
 	p.CreatedAt = timeNow
 	p.UpdatedAt = timeNow
-	if err := s.repo.createPatient(p); err != nil {
-		return err
+	p.DeletedAt = nil
+	p.Version = 1
+	created, err := s.repo.createPatient(ctx, p)
+	if err != nil {
+		return Patient{}, err
+	}
+
+	s.notifySubscriber(ctx, Notification{
+		Type:    notificationCreated,
+		Message: fmt.Sprintf("New patient added with id: %d", created.Id),
+		Patient: &created,
+	})
+	s.logger.InfoContext(ctx, "patient created", "patient_id", created.Id)
+	return created, nil
+}
+
+// newPatientValidation validates a patient that is about to be created. Its
+// id has to be left empty unless import mode is enabled.
+func (s *patientsService) newPatientValidation(p Patient) error {
+	var mistakes []string
+	if p.Id != 0 && !s.allowClientIds {
+		mistakes = append(mistakes, mistakeClientId)
+	} else if p.Id < 0 {
+		mistakes = append(mistakes, mistakeNegativeId)
 	}
 
-	fmt.Println("Patient created at", p.CreatedAt)
-	s.notifySubscriber(fmt.Sprintf("New patient added with id: %d", p.Id))
+	mistakes = append(mistakes, patientFieldMistakes(p, s.phoneRegion)...)
+	if len(mistakes) > 0 {
+		return &ValidationError{Mistakes: mistakes}
+	}
 	return nil
 }
 
-func (s *patientsService) getPatients() ([]Patient, error) {
-	return s.repo.getPatients()
+// legacyDateValidation moves a date of birth sent as year, month and date
+// into p.DateOfBirth, or rejects it when legacy input is turned off.
+func (s *patientsService) legacyDateValidation(p *Patient) error {
+	if p.legacyDateOfBirth == nil {
+		return nil
+	}
+
+	var mistakes []string
+	if s.acceptLegacyDates {
+		mistakes = applyLegacyDateOfBirth(p)
+	} else {
+		p.legacyDateOfBirth = nil
+		mistakes = []string{mistakeLegacyDateOfBirth}
+	}
+	if len(mistakes) > 0 {
+		return &ValidationError{Mistakes: mistakes}
+	}
+	return nil
+}
+
+func (s *patientsService) getPatients(ctx context.Context) ([]Patient, error) {
+	return s.repo.getPatients(ctx)
+}
+
+func (s *patientsService) findPatients(ctx context.Context, q PatientQuery) (PatientPage, error) {
+	if err := patientQueryValidation(q); err != nil {
+		return PatientPage{}, err
+	}
+	return s.repo.findPatients(ctx, q)
+}
+
+// searchPatients matches query against fields, or every searchable field
+// when fields is nil.
+func (s *patientsService) searchPatients(ctx context.Context, query string, fields []string, limit int) ([]SearchResult, error) {
+	var mistakes []string
+	terms := splitSearchTerms(query)
+	if len(terms) == 0 {
+		mistakes = append(mistakes, mistakeEmptySearch)
+	}
+
+	if limit <= 0 || limit > maxPageSize {
+		mistakes = append(mistakes, mistakeInvalidLimit)
+	}
+	if len(mistakes) > 0 {
+		return nil, &ValidationError{Mistakes: mistakes}
+	}
+	if fields == nil {
+		fields = allSearchFields()
+	}
+	return s.repo.searchPatients(ctx, terms, fields, limit)
 }
 
-func (s *patientsService) getPatient(id int) (Patient, error) {
-	return s.repo.getPatient(id)
+func (s *patientsService) getPatient(ctx context.Context, id int) (Patient, error) {
+	return s.repo.getPatient(ctx, id)
 }
 
-func (s *patientsService) deletePatient(id int) error {
-	if err := s.repo.deletePatient(id); err != nil {
+func (s *patientsService) deletePatient(ctx context.Context, id int) error {
+	stored, err := s.repo.deletePatient(ctx, id)
+	if err != nil {
 		return err
 	}
-	s.notifySubscriber(fmt.Sprintf("Patient removed with id: %d", id))
-	log.Printf("Patient removed with Id: %d", id)
+	s.notifySubscriber(ctx, Notification{
+		Type:    notificationDeleted,
+		Message: fmt.Sprintf("Patient removed with id: %d", id),
+		Patient: &stored,
+	})
+	s.logger.InfoContext(ctx, "patient deleted", "patient_id", id)
 	return nil
 }
 
-func (s *patientsService) updatePatient(p Patient) error {
-	if err := patientValidation(p); err != nil {
-		return err
+// anyVersion as the version of a change makes it apply to whatever
+// version is stored, as for If-Match: *.
+const anyVersion = -1
+
+// updatePatient saves p if the stored patient is still at p.Version, or
+// at any version for anyVersion, and returns it with its new version.
+func (s *patientsService) updatePatient(ctx context.Context, p Patient) (Patient, error) {
+	if err := s.legacyDateValidation(&p); err != nil {
+		return Patient{}, err
+	}
+	if err := patientValidation(p, s.phoneRegion); err != nil {
+		return Patient{}, err
 	}
+	p.Phone, _ = parsePhone(p.Phone, s.phoneRegion)
 
+	// the version check in the repository guarantees stored is what the
+	// update replaced, so diffing against it is exact
+	stored, err := s.repo.getPatient(ctx, p.Id)
+	if err != nil {
+		return Patient{}, err
+	}
+	if p.Version != anyVersion && stored.Version != p.Version {
+		return Patient{}, errVersionConflict
+	}
+	p.Version = stored.Version
+
+	// a PUT replaces what the client may change; when the patient was
+	// created and whether it is in the trash stay as stored
+	p.CreatedAt = stored.CreatedAt
+	p.DeletedAt = stored.DeletedAt
 	p.UpdatedAt = time.Now()
-	if err := s.repo.updatePatient(p); err != nil {
+	updated, err := s.repo.updatePatient(ctx, p)
+	if err != nil {
+		return Patient{}, err
+	}
+
+	s.notifySubscriber(ctx, Notification{
+		Type:    notificationUpdated,
+		Message: fmt.Sprintf("Patient updated with id: %d", updated.Id),
+		Patient: &updated,
+		Before:  &stored,
+	})
+	s.logger.InfoContext(ctx, "patient updated", "patient_id", updated.Id, "version", updated.Version)
+	return updated, nil
+}
+
+// patchPatient applies patch to the stored patient, which must still be at
+// version unless that is anyVersion, validates the result as a whole and
+// saves the fields that changed.
+func (s *patientsService) patchPatient(ctx context.Context, id int, version int, patch PatientPatch) (Patient, error) {
+	stored, err := s.repo.getPatient(ctx, id)
+	if err != nil {
+		return Patient{}, err
+	}
+	if version != anyVersion && stored.Version != version {
+		return Patient{}, errVersionConflict
+	}
+
+	doc, err := json.Marshal(stored)
+	if err != nil {
+		return Patient{}, err
+	}
+	doc, err = patch.apply(doc)
+	if err != nil {
+		return Patient{}, err
+	}
+
+	var patched Patient
+	if err := json.Unmarshal(doc, &patched); err != nil {
+		return Patient{}, fmt.Errorf("%w: %v", errInvalidPatch, err)
+	}
+	if err := s.legacyDateValidation(&patched); err != nil {
+		return Patient{}, err
+	}
+
+	var mistakes []string
+	if patched.Id != stored.Id {
+		mistakes = append(mistakes, mistakeIdChanged)
+	}
+	mistakes = append(mistakes, patientFieldMistakes(patched, s.phoneRegion)...)
+	if len(mistakes) > 0 {
+		return Patient{}, &ValidationError{Mistakes: mistakes}
+	}
+	patched.Phone, _ = parsePhone(patched.Phone, s.phoneRegion)
+
+	columns := changedPatientColumns(stored, patched)
+	if len(columns) == 0 {
+		return stored, nil
+	}
+
+	patched.Id = stored.Id
+	patched.CreatedAt = stored.CreatedAt
+	patched.UpdatedAt = time.Now()
+	patched.Version = stored.Version
+	updated, err := s.repo.patchPatient(ctx, patched, columns)
+	if err != nil {
+		return Patient{}, err
+	}
+
+	s.notifySubscriber(ctx, Notification{
+		Type:    notificationUpdated,
+		Message: fmt.Sprintf("Patient updated with id: %d", updated.Id),
+		Patient: &updated,
+		Before:  &stored,
+	})
+	s.logger.InfoContext(ctx, "patient patched", "patient_id", updated.Id, "version", updated.Version, "fields", columns)
+	return updated, nil
+}
+
+func (s *patientsService) getDeletedPatients(ctx context.Context) ([]Patient, error) {
+	return s.repo.getDeletedPatients(ctx)
+}
+
+func (s *patientsService) restorePatient(ctx context.Context, id int) (Patient, error) {
+	restored, err := s.repo.restorePatient(ctx, id, time.Now())
+	if err != nil {
+		return Patient{}, err
+	}
+
+	s.notifySubscriber(ctx, Notification{
+		Type:    notificationRestored,
+		Message: fmt.Sprintf("Patient restored with id: %d", id),
+		Patient: &restored,
+	})
+	s.logger.InfoContext(ctx, "patient restored", "patient_id", id)
+	return restored, nil
+}
+
+// purgeDeletedPatients permanently removes patients that have been in the
+// trash for longer than the retention period.
+func (s *patientsService) purgeDeletedPatients(ctx context.Context) (int, error) {
+	purged, err := s.repo.purgePatients(ctx, time.Now().Add(-s.trashRetention))
+	if err != nil {
+		return 0, err
+	}
+	if len(purged) > 0 {
+		s.logger.InfoContext(ctx, "deleted patients purged", "purged", len(purged), "retention", s.trashRetention)
+	}
+	return len(purged), nil
+}
+
+// getPatientHistory returns the audit entries of a patient, oldest first.
+// The history of a purged patient can still be read.
+func (s *patientsService) getPatientHistory(ctx context.Context, id int) ([]AuditEntry, error) {
+	entries, err := s.repo.getAuditEntries(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		// patients stored before the audit log existed have no entries
+		if _, err := s.repo.getPatient(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// addSubscriber sends subscriber a snapshot of the patients, followed by
+// every change from then on.
+func (s *patientsService) addSubscriber(ctx context.Context, subscriber Subscriber) error {
+	if subscriber.getName() == "" {
+		return errEmptySubscriber
+	}
+	return s.sendSnapshot(ctx, subscriber, true)
+}
+
+// resyncSubscriber sends subscriber a new snapshot, for a client that has
+// missed changes.
+func (s *patientsService) resyncSubscriber(ctx context.Context, subscriber Subscriber) error {
+	return s.sendSnapshot(ctx, subscriber, false)
+}
+
+// pendingChanges collects the changes made while a snapshot loads.
+type pendingChanges struct {
+	notifications []Notification
+}
+
+// sendSnapshot sends subscriber a snapshot, adding it to the subscribers
+// first when add is set. The patients are loaded without holding notifyMu,
+// so clients asking for snapshots do not hold up changes, and the changes
+// made meanwhile are sent after the snapshot.
+func (s *patientsService) sendSnapshot(ctx context.Context, subscriber Subscriber, add bool) error {
+	pending := &pendingChanges{}
+	s.notifyMu.Lock()
+	seq := s.lastSeq
+	s.loading = append(s.loading, pending)
+	s.notifyMu.Unlock()
+
+	snapshot, err := s.snapshot(ctx, seq)
+
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	s.loading = slices.DeleteFunc(s.loading, func(p *pendingChanges) bool { return p == pending })
+	if err != nil {
 		return err
 	}
+	if add {
+		s.subscribersMu.Lock()
+		s.subscribers = append(slices.Clip(s.subscribers), subscriber)
+		s.subscribersMu.Unlock()
+	}
 
-	fmt.Println("Patient updated at", p.UpdatedAt)
-	s.notifySubscriber(fmt.Sprintf("Patient updated with id: %d", p.Id))
-	log.Printf("Patient updated with Id: %d", p.Id)
+	subscriber.update(snapshot)
+	for _, notification := range pending.notifications {
+		subscriber.update(notification)
+	}
+	message := "subscriber resynced"
+	if add {
+		message = "subscriber added"
+	}
+	s.logger.InfoContext(ctx, message, "subscriber", subscriber.getName(), "seq", snapshot.Seq, "replayed", len(pending.notifications))
 	return nil
 }
 
-func (s *patientsService) addSubscriber(subscriber Subscriber) error {
+// resumeSubscriber sends subscriber the changes after since, followed by
+// every change from then on. When those changes are no longer held, or
+// since is from another stream, it is sent resync.required instead and
+// still gets the changes from then on.
+func (s *patientsService) resumeSubscriber(ctx context.Context, subscriber Subscriber, stream string, since int64) error {
 	if subscriber.getName() == "" {
 		return errEmptySubscriber
 	}
-	s.subscribers = append(s.subscribers, subscriber)
-	log.Printf("subscriber added: %s", subscriber.getName())
+
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	missed, ok := s.replay.after(since, s.lastSeq)
+	s.subscribersMu.Lock()
+	s.subscribers = append(slices.Clip(s.subscribers), subscriber)
+	s.subscribersMu.Unlock()
+
+	if !ok || stream != s.stream {
+		subscriber.update(Notification{
+			Type:    notificationResyncRequired,
+			Seq:     s.lastSeq,
+			Message: fmt.Sprintf("Changes after %d are no longer available", since),
+		})
+		s.logger.InfoContext(ctx, "subscriber needs resync", "subscriber", subscriber.getName(), "since", since, "seq", s.lastSeq)
+		return nil
+	}
+	for _, notification := range missed {
+		subscriber.update(notification)
+	}
+	s.logger.InfoContext(ctx, "subscriber resumed", "subscriber", subscriber.getName(), "since", since, "replayed", len(missed))
 	return nil
 }
 
+// snapshot loads every patient, which includes at least the changes up to
+// seq.
+func (s *patientsService) snapshot(ctx context.Context, seq int64) (Notification, error) {
+	patients, err := s.getPatients(ctx)
+	if err != nil {
+		return Notification{}, err
+	}
+	return Notification{Type: notificationSnapshot, Seq: seq, Stream: s.stream, Patients: patients}, nil
+}
+
 func (s *patientsService) removeSubscriber(subscriber Subscriber) error {
+	s.subscribersMu.Lock()
+	defer s.subscribersMu.Unlock()
 	for i, sub := range s.subscribers {
 		if sub.getName() == subscriber.getName() {
-			s.subscribers = append(s.subscribers[:i], s.subscribers[i+1:]...)
-			log.Printf("Subscriber removed: %s", subscriber.getName())
+			s.subscribers = slices.Delete(slices.Clone(s.subscribers), i, i+1)
+			s.logger.Info("subscriber removed", "subscriber", subscriber.getName())
 			return nil
 		}
 	}
 	return errSubscriberNotFound
 }
 
-func (s *patientsService) notifySubscriber(message string) {
-	patients, err := s.getPatients()
-	if err != nil {
-		log.Printf("Failed to get patients: %v", err)
-		return
+// currentSubscribers returns the subscribers at the time of the call. The
+// slice is never modified afterwards, so it can be ranged over unlocked.
+func (s *patientsService) currentSubscribers() []Subscriber {
+	s.subscribersMu.Lock()
+	defer s.subscribersMu.Unlock()
+	return s.subscribers
+}
+
+func (s *patientsService) subscriberCount() int {
+	return len(s.currentSubscribers())
+}
+
+// closeSubscribers is called on shutdown to let every subscriber know the
+// server is going away.
+func (s *patientsService) closeSubscribers() {
+	subscribers := s.currentSubscribers()
+	for _, sub := range subscribers {
+		sub.close()
 	}
+	s.logger.Info("subscribers closed", "subscribers", len(subscribers))
+}
+
+// notifySubscriber numbers a change and hands it to every subscriber.
+// Subscribers only queue it, so holding notifyMu meanwhile is cheap.
+func (s *patientsService) notifySubscriber(ctx context.Context, notification Notification) {
+	ctx, span := s.tracer.Start(ctx, "patientsService.notifySubscriber")
+	defer span.End()
 
-	notification := Notification{
-		Message:     message,
-		NewPatients: patients,
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	s.lastSeq++
+	notification.Seq = s.lastSeq
+	for _, pending := range s.loading {
+		pending.notifications = append(pending.notifications, notification)
 	}
+	s.replay.add(notification)
 
-	for _, sub := range s.subscribers {
+	subscribers := s.currentSubscribers()
+	start := time.Now()
+	span.SetAttributes(attribute.Int("subscribers", len(subscribers)), attribute.Int64("seq", notification.Seq))
+	done := s.fanOuts.begin()
+	defer done()
+	for _, sub := range subscribers {
 		sub.update(notification)
 	}
+	elapsed := time.Since(start)
+	if s.observeFanOut != nil {
+		s.observeFanOut(elapsed)
+	}
+	s.logger.DebugContext(ctx, "subscribers notified", "type", notification.Type, "seq", notification.Seq, "subscribers", len(subscribers), "duration", elapsed)
+}
+
+// fanOutDuration is how long the oldest notification still being sent to
+// subscribers has been running, or zero when none is.
+func (s *patientsService) fanOutDuration() time.Duration {
+	return s.fanOuts.oldest()
+}
+
+type fanOutTracker struct {
+	mu      sync.Mutex
+	next    int
+	started map[int]time.Time
+}
+
+// begin records a fan-out starting and returns the function that records
+// it finishing.
+func (f *fanOutTracker) begin() func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.started == nil {
+		f.started = map[int]time.Time{}
+	}
+	f.next++
+	id := f.next
+	f.started[id] = time.Now()
+
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.started, id)
+	}
+}
+
+func (f *fanOutTracker) oldest() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var oldest time.Duration
+	for _, started := range f.started {
+		oldest = max(oldest, time.Since(started))
+	}
+	return oldest
+}
+
+// defaultReplaySize is how many of the latest changes are kept for clients
+// that reconnect.
+const defaultReplaySize = 64
+
+// replayBuffer holds the latest changes, oldest first from start.
+type replayBuffer struct {
+	notifications []Notification
+	start         int
+	count         int
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{notifications: make([]Notification, size)}
+}
+
+func (b *replayBuffer) add(notification Notification) {
+	size := len(b.notifications)
+	if size == 0 {
+		return
+	}
+	b.notifications[(b.start+b.count)%size] = notification
+	if b.count < size {
+		b.count++
+	} else {
+		b.start = (b.start + 1) % size
+	}
+}
+
+// after returns the changes numbered after since, up to lastSeq, and
+// false when some of them are no longer held or since is in the future.
+func (b *replayBuffer) after(since, lastSeq int64) ([]Notification, bool) {
+	missed := lastSeq - since
+	if missed < 0 || missed > int64(b.count) {
+		return nil, false
+	}
+	notifications := make([]Notification, 0, missed)
+	for i := b.count - int(missed); i < b.count; i++ {
+		notifications = append(notifications, b.notifications[(b.start+i)%len(b.notifications)])
+	}
+	return notifications, true
 }
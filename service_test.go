@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -10,6 +14,7 @@ import (
 type testSubscriber struct {
 	name         string
 	notification []Notification
+	closed       bool
 }
 
 func (s *testSubscriber) update(notification Notification) {
@@ -20,23 +25,41 @@ func (s *testSubscriber) getName() string {
 	return s.name
 }
 
+func (s *testSubscriber) close() {
+	s.closed = true
+}
+
 func assertPatientEqual(t *testing.T, expectedPatient, actualPatient Patient) {
 	assert.Equal(t, expectedPatient.Id, actualPatient.Id, "Id should match")
 	assert.Equal(t, expectedPatient.Name, actualPatient.Name, "Name should match")
 	assert.Equal(t, expectedPatient.Address, actualPatient.Address, "Address should match")
 	assert.Equal(t, expectedPatient.Disease, actualPatient.Disease, "Disease should match")
 	assert.Equal(t, expectedPatient.Phone, actualPatient.Phone, "Phone should match")
-	assert.Equal(t, expectedPatient.Year, actualPatient.Year, "Year should match")
-	assert.Equal(t, expectedPatient.Month, actualPatient.Month, "Month should match")
-	assert.Equal(t, expectedPatient.Date, actualPatient.Date, "Date should match")
+	assert.Equal(t, expectedPatient.DateOfBirth, actualPatient.DateOfBirth, "DateOfBirth should match")
 }
 
-func notificationsEqual(t *testing.T, expectedPatients, actualPatients []Notification) {
-	for i := range expectedPatients {
-		assert.Equal(t, expectedPatients[i].Message, actualPatients[i].Message, "expect message to match")
+func assertOptionalPatientEqual(t *testing.T, expected, actual *Patient) {
+	if assert.Equal(t, expected == nil, actual == nil, "expect patient to be sent") && expected != nil {
+		assertPatientEqual(t, *expected, *actual)
+	}
+}
 
-		for j := range expectedPatients[i].NewPatients {
-			assertPatientEqual(t, expectedPatients[i].NewPatients[j], actualPatients[i].NewPatients[j])
+// notificationsEqual compares notifications without the timestamps and
+// versions of their patients.
+func notificationsEqual(t *testing.T, expected, actual []Notification) {
+	if !assert.Len(t, actual, len(expected), "expect number of notifications to match") {
+		return
+	}
+	for i := range expected {
+		assert.Equal(t, expected[i].Type, actual[i].Type, "expect type to match")
+		assert.Equal(t, expected[i].Seq, actual[i].Seq, "expect seq to match")
+		assert.Equal(t, expected[i].Message, actual[i].Message, "expect message to match")
+		assertOptionalPatientEqual(t, expected[i].Patient, actual[i].Patient)
+		assertOptionalPatientEqual(t, expected[i].Before, actual[i].Before)
+		if assert.Len(t, actual[i].Patients, len(expected[i].Patients), "expect snapshot size to match") {
+			for j := range expected[i].Patients {
+				assertPatientEqual(t, expected[i].Patients[j], actual[i].Patients[j])
+			}
 		}
 	}
 }
@@ -55,35 +78,31 @@ func TestService_createPatient(t *testing.T) {
 		wantErr          error
 		wantNotification []Notification
 		shouldSubscribe  bool
+		allowClientIds   bool
 	}{
 		{
-			name: "invalid id :NEG",
+			name: "client supplied id :NEG",
 			args: args{
 				patient: Patient{
-					Id:      0,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          5,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
-			wantMistakes: []string{mistakeNegativeId},
+			wantMistakes: []string{mistakeClientId},
 		},
 		{
 			name: "invalid name :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
-					Name:    "",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Name:        "",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			wantMistakes: []string{mistakeEmptyName},
@@ -92,14 +111,11 @@ func TestService_createPatient(t *testing.T) {
 			name: "invalid address :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
-					Name:    "wer",
-					Address: "",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Name:        "wer",
+					Address:     "",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			wantMistakes: []string{mistakeEmptyAddress},
@@ -108,14 +124,11 @@ func TestService_createPatient(t *testing.T) {
 			name: "invalid disease :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			wantMistakes: []string{mistakeEmptyDisease},
@@ -124,161 +137,122 @@ func TestService_createPatient(t *testing.T) {
 			name: "invalid phone :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   0,
-					Year:    2024,
-					Month:   10,
-					Date:    12,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "",
+					DateOfBirth: newDate(2024, 10, 12),
 				},
 			},
-			wantMistakes: []string{mistakeInvalidPhone},
+			wantMistakes: []string{mistakeEmptyPhone},
 		},
 		{
-			name: "invalid year :NEG",
+			name: "impossible date of birth :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    0,
-					Month:   12,
-					Date:    12,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2023, 2, 31),
 				},
 			},
-			wantMistakes: []string{mistakeInvalidyear},
+			wantMistakes: []string{mistakeInvalidDateOfBirth},
 		},
 		{
-			name: "invalid month :NEG",
+			name: "future date of birth :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   15,
-					Date:    12,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(today().Year+1, 1, 1),
 				},
 			},
-			wantMistakes: []string{mistakeInvalidMonth},
+			wantMistakes: []string{mistakeFutureDateOfBirth},
 		},
 		{
-			name: "invalid date :NEG",
+			name: "missing date of birth :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
 					Name:    "wer",
 					Address: "srt",
 					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   10,
-					Date:    -5,
+					Phone:   "+919876543210",
 				},
 			},
-			wantMistakes: []string{mistakeInvalidDate},
+			wantMistakes: []string{mistakeEmptyDateOfBirth},
 		},
 		{
 			name: "multiple validation errors :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
-					Name:    "",
-					Address: "",
-					Disease: "",
-					Phone:   0,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Name:        "",
+					Address:     "",
+					Disease:     "",
+					Phone:       "",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
-			wantMistakes: []string{mistakeEmptyName, mistakeEmptyDisease, mistakeInvalidPhone, mistakeEmptyAddress},
+			wantMistakes: []string{mistakeEmptyName, mistakeEmptyDisease, mistakeEmptyPhone, mistakeEmptyAddress},
 		},
 		{
 			name: "patient created with subscriber :POS",
 			args: args{
 				patient: Patient{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			existingPatients: []Patient{
 				{
-					Id:        1,
-					Name:      "wer",
-					Address:   "srt",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     12,
-					Date:      12,
-					CreatedAt: time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
-					UpdatedAt: time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+					CreatedAt:   time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
+					UpdatedAt:   time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:        1,
-					Name:      "wer",
-					Address:   "srt",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     12,
-					Date:      12,
-					CreatedAt: time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
-					UpdatedAt: time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+					CreatedAt:   time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
+					UpdatedAt:   time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
 				},
 				{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			wantMistakes: nil,
 			wantNotification: []Notification{
 				{
+					Type:    notificationCreated,
+					Seq:     1,
 					Message: "New patient added with id: 2",
-					NewPatients: []Patient{
-						{
-							Id:        1,
-							Name:      "wer",
-							Address:   "srt",
-							Disease:   "fever",
-							Phone:     12345,
-							Year:      2024,
-							Month:     12,
-							Date:      12,
-							CreatedAt: time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
-							UpdatedAt: time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
-						},
-						{
-							Id:      2,
-							Name:    "wer",
-							Address: "srt",
-							Disease: "fever",
-							Phone:   12345,
-							Year:    2024,
-							Month:   12,
-							Date:    12,
-						},
+					Patient: &Patient{
+						Id:          2,
+						Name:        "wer",
+						Address:     "srt",
+						Disease:     "fever",
+						Phone:       "+919876543210",
+						DateOfBirth: newDate(2024, 12, 12),
 					},
 				}},
 			shouldSubscribe: true,
@@ -287,52 +261,43 @@ func TestService_createPatient(t *testing.T) {
 			name: "patient created without subscriber :POS",
 			args: args{
 				patient: Patient{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			existingPatients: []Patient{
 				{
-					Id:        1,
-					Name:      "wer",
-					Address:   "srt",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     12,
-					Date:      12,
-					CreatedAt: time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
-					UpdatedAt: time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+					CreatedAt:   time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
+					UpdatedAt:   time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:        1,
-					Name:      "wer",
-					Address:   "srt",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     12,
-					Date:      12,
-					CreatedAt: time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
-					UpdatedAt: time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+					CreatedAt:   time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
+					UpdatedAt:   time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
 				},
 				{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			wantMistakes: nil,
@@ -341,41 +306,75 @@ func TestService_createPatient(t *testing.T) {
 			name: "duplicate id :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
-			wantErr: errDuplicateId,
+			wantErr:        errDuplicateId,
+			allowClientIds: true,
+		},
+		{
+			name: "negative id in import mode :NEG",
+			args: args{
+				patient: Patient{
+					Id:          -1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+				},
+			},
+			wantMistakes:   []string{mistakeNegativeId},
+			allowClientIds: true,
+		},
+		{
+			name: "patient imported with client id :POS",
+			args: args{
+				patient: Patient{
+					Id:          7,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+				},
+			},
+			wantPatients: []Patient{
+				{
+					Id:          7,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+				},
+			},
+			allowClientIds: true,
 		},
 	}
 	for _, tt := range tests {
@@ -383,13 +382,16 @@ func TestService_createPatient(t *testing.T) {
 			repo := newInMemoryRepository()
 			repo.patients = tt.existingPatients
 			service := newPatientsService(repo)
+			service.allowClientIds = tt.allowClientIds
 			subscriber := &testSubscriber{name: "foo"}
 			if tt.shouldSubscribe {
-				service.addSubscriber(subscriber)
+				service.addSubscriber(context.Background(), subscriber)
+				// the snapshot is checked by TestService_addSubscriber
+				subscriber.notification = nil
 			}
 
 			startTime := time.Now()
-			gotErr := service.createPatient(tt.args.patient)
+			createdPatient, gotErr := service.createPatient(context.Background(), tt.args.patient)
 			endTime := time.Now()
 
 			var validationErr *ValidationError
@@ -406,6 +408,8 @@ func TestService_createPatient(t *testing.T) {
 
 			notificationsEqual(t, tt.wantNotification, subscriber.notification)
 			if len(tt.wantPatients) > len(tt.existingPatients) {
+				assertPatientEqual(t, tt.wantPatients[len(tt.wantPatients)-1], createdPatient)
+
 				for i, gotPatient := range repo.patients {
 					if i < len(tt.existingPatients) {
 						wantPatient := tt.existingPatients[i]
@@ -438,46 +442,38 @@ func TestService_getPatients(t *testing.T) {
 			name: "multiple patients :POS",
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 				{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			wantPatient: []Patient{
 				{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 				{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 		},
@@ -489,7 +485,7 @@ func TestService_getPatients(t *testing.T) {
 			Service := newPatientsService(repo)
 			repo.patients = tt.existingPatients
 
-			gotPatient, gotErr := Service.getPatients()
+			gotPatient, gotErr := Service.getPatients(context.Background())
 
 			assert.NoError(t, gotErr, "no error expected")
 			assert.Equal(t, tt.wantPatient, gotPatient, "expexted and got patients are not same")
@@ -514,14 +510,12 @@ func TestService_getPatient(t *testing.T) {
 			args: args{id: 2},
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			wantPatient: Patient{},
@@ -532,35 +526,29 @@ func TestService_getPatient(t *testing.T) {
 			args: args{id: 1},
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 				{
-					Id:      2,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          2,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			wantPatient: Patient{
-				Id:      1,
-				Name:    "wer",
-				Address: "srt",
-				Disease: "fever",
-				Phone:   12345,
-				Year:    2024,
-				Month:   12,
-				Date:    12,
+				Id:          1,
+				Name:        "wer",
+				Address:     "srt",
+				Disease:     "fever",
+				Phone:       "+919876543210",
+				DateOfBirth: newDate(2024, 12, 12),
 			},
 			wantErr: nil,
 		},
@@ -572,7 +560,7 @@ func TestService_getPatient(t *testing.T) {
 			service := newPatientsService(repo)
 			repo.patients = tt.existingPatients
 
-			gotPatient, gotErr := service.getPatient(tt.args.id)
+			gotPatient, gotErr := service.getPatient(context.Background(), tt.args.id)
 
 			assert.ErrorIs(t, gotErr, tt.wantErr, "expected error and got error are not same")
 			assert.Equal(t, tt.wantPatient, gotPatient, "expected and got patients are not same")
@@ -580,6 +568,38 @@ func TestService_getPatient(t *testing.T) {
 	}
 }
 
+func TestService_serverManagedFields(t *testing.T) {
+	ctx := context.Background()
+	clientTime := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	repo := newInMemoryRepository()
+	service := newPatientsService(repo)
+
+	created, err := service.createPatient(ctx, Patient{Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12), CreatedAt: clientTime, DeletedAt: &clientTime})
+	if !assert.NoError(t, err, "expect patient to be created") {
+		return
+	}
+	assert.Nil(t, created.DeletedAt, "expect a new patient not to start in the trash")
+	assert.NotEqual(t, clientTime, created.CreatedAt, "expect the creation time to be set by the server")
+
+	put := created
+	put.Disease = "fever"
+	put.CreatedAt = clientTime
+	put.DeletedAt = &clientTime
+	updated, err := service.updatePatient(ctx, put)
+	if !assert.NoError(t, err, "expect patient to be updated") {
+		return
+	}
+	assert.Nil(t, updated.DeletedAt, "expect a PUT not to move the patient to the trash")
+	assert.Equal(t, created.CreatedAt, updated.CreatedAt, "expect a PUT to keep the creation time")
+
+	patients, err := service.getPatients(ctx)
+	assert.NoError(t, err, "expect patients to be listed")
+	assert.Len(t, patients, 1, "expect the patient to stay active")
+	purged, err := service.purgeDeletedPatients(ctx)
+	assert.NoError(t, err, "expect purge to run")
+	assert.Zero(t, purged, "expect nothing to be purged")
+}
+
 func TestService_updatePatient(t *testing.T) {
 	type args struct {
 		patient Patient
@@ -598,14 +618,12 @@ func TestService_updatePatient(t *testing.T) {
 			name: "invalid id :NEG",
 			args: args{
 				patient: Patient{
-					Id:      0,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          0,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			existingPatients: []Patient{},
@@ -619,14 +637,12 @@ func TestService_updatePatient(t *testing.T) {
 			name: "invalid name :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
-					Name:    "",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			existingPatients: []Patient{},
@@ -640,14 +656,12 @@ func TestService_updatePatient(t *testing.T) {
 			name: "invalid address :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
-					Name:    "wer",
-					Address: "",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			existingPatients: []Patient{},
@@ -661,14 +675,12 @@ func TestService_updatePatient(t *testing.T) {
 			name: "invalid disease :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "",
-					Phone:   12345,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			existingPatients: []Patient{},
@@ -682,155 +694,134 @@ func TestService_updatePatient(t *testing.T) {
 			name: "invalid phone :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   0,
-					Year:    2024,
-					Month:   12,
-					Date:    12,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "",
+					DateOfBirth: newDate(2024, 12, 12),
 				},
 			},
 			existingPatients: []Patient{},
 			wantPatients:     []Patient{},
-			wantMistakes:     []string{mistakeInvalidPhone},
+			wantMistakes:     []string{mistakeEmptyPhone},
 			wantErr: &ValidationError{
-				Mistakes: []string{mistakeInvalidPhone},
+				Mistakes: []string{mistakeEmptyPhone},
 			},
 		},
 		{
-			name: "invalid year :NEG",
+			name: "negative year :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    0,
-					Month:   12,
-					Date:    13,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(-5, 12, 13),
 				},
 			},
 			existingPatients: []Patient{},
 			wantPatients:     []Patient{},
-			wantMistakes:     []string{mistakeInvalidyear},
+			wantMistakes:     []string{mistakeInvalidDateOfBirth},
 			wantErr: &ValidationError{
-				Mistakes: []string{mistakeInvalidyear},
+				Mistakes: []string{mistakeInvalidDateOfBirth},
 			},
 		},
 		{
 			name: "invalid month :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   0,
-					Date:    13,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 0, 13),
 				},
 			},
 			existingPatients: []Patient{},
 			wantPatients:     []Patient{},
-			wantMistakes:     []string{mistakeInvalidMonth},
+			wantMistakes:     []string{mistakeInvalidDateOfBirth},
 			wantErr: &ValidationError{
-				Mistakes: []string{mistakeInvalidMonth},
+				Mistakes: []string{mistakeInvalidDateOfBirth},
 			},
 		},
 		{
-			name: "invalid date :NEG",
+			name: "leap day in a common year :NEG",
 			args: args{
 				patient: Patient{
-					Id:      1,
-					Name:    "wer",
-					Address: "srt",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   10,
-					Date:    -2,
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2023, 2, 29),
 				},
 			},
 			existingPatients: []Patient{},
 			wantPatients:     []Patient{},
-			wantMistakes:     []string{mistakeInvalidDate},
+			wantMistakes:     []string{mistakeInvalidDateOfBirth},
 			wantErr: &ValidationError{
-				Mistakes: []string{mistakeInvalidDate},
+				Mistakes: []string{mistakeInvalidDateOfBirth},
 			},
 		},
 		{
 			name: "patient updated with subscriber :POS",
 			args: args{
 				patient: Patient{
-					Id:        2,
-					Name:      "priya",
-					Address:   "srt",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     12,
-					Date:      12,
-					CreatedAt: time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
+					Id:          2,
+					Name:        "priya",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+					CreatedAt:   time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
 				},
 			},
 			existingPatients: []Patient{
 				{
-					Id:        1,
-					Name:      "wer",
-					Address:   "srt",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     12,
-					Date:      12,
-					CreatedAt: time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
-					UpdatedAt: time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+					CreatedAt:   time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
+					UpdatedAt:   time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
 				},
 				{
-					Id:        2,
-					Name:      "abc",
-					Address:   "srt",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     12,
-					Date:      12,
-					CreatedAt: time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
-					UpdatedAt: time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
+					Id:          2,
+					Name:        "abc",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+					CreatedAt:   time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
+					UpdatedAt:   time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
 				},
 			},
 
 			wantNotification: []Notification{
 				{
+					Type:    notificationUpdated,
+					Seq:     1,
 					Message: "Patient updated with id: 2",
-					NewPatients: []Patient{
-						{
-							Id:        1,
-							Name:      "wer",
-							Address:   "srt",
-							Disease:   "fever",
-							Phone:     12345,
-							Year:      2024,
-							Month:     12,
-							Date:      12,
-							CreatedAt: time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
-							UpdatedAt: time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
-						},
-						{
-							Id:        2,
-							Name:      "priya",
-							Address:   "srt",
-							Disease:   "fever",
-							Phone:     12345,
-							Year:      2024,
-							Month:     12,
-							Date:      12,
-							CreatedAt: time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
-						},
+					Patient: &Patient{
+						Id:          2,
+						Name:        "priya",
+						Address:     "srt",
+						Disease:     "fever",
+						Phone:       "+919876543210",
+						DateOfBirth: newDate(2024, 12, 12),
+					},
+					Before: &Patient{
+						Id:          2,
+						Name:        "abc",
+						Address:     "srt",
+						Disease:     "fever",
+						Phone:       "+919876543210",
+						DateOfBirth: newDate(2024, 12, 12),
 					},
 				}},
 			shouldSubscribe: true,
@@ -839,41 +830,35 @@ func TestService_updatePatient(t *testing.T) {
 			name: "patient updated without subscriber :POS",
 			args: args{
 				patient: Patient{
-					Id:        2,
-					Name:      "priya",
-					Address:   "srt",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     12,
-					Date:      12,
-					CreatedAt: time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
+					Id:          2,
+					Name:        "priya",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+					CreatedAt:   time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
 				},
 			},
 			existingPatients: []Patient{
 				{
-					Id:        1,
-					Name:      "wer",
-					Address:   "srt",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     12,
-					Date:      12,
-					CreatedAt: time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
-					UpdatedAt: time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
+					Id:          1,
+					Name:        "wer",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+					CreatedAt:   time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
+					UpdatedAt:   time.Date(2024, time.March, 24, 10, 0, 0, 0, time.UTC),
 				},
 				{
-					Id:        2,
-					Name:      "abc",
-					Address:   "srt",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     12,
-					Date:      12,
-					CreatedAt: time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
-					UpdatedAt: time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
+					Id:          2,
+					Name:        "abc",
+					Address:     "srt",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 12, 12),
+					CreatedAt:   time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
+					UpdatedAt:   time.Date(2024, time.August, 12, 10, 0, 0, 0, time.UTC),
 				},
 			},
 		},
@@ -886,11 +871,13 @@ func TestService_updatePatient(t *testing.T) {
 			subscriber := &testSubscriber{name: "foo"}
 
 			if tt.shouldSubscribe {
-				service.addSubscriber(subscriber)
+				service.addSubscriber(context.Background(), subscriber)
+				// the snapshot is checked by TestService_addSubscriber
+				subscriber.notification = nil
 			}
 
 			startTime := time.Now()
-			gotErr := service.updatePatient(tt.args.patient)
+			_, gotErr := service.updatePatient(context.Background(), tt.args.patient)
 			endTime := time.Now()
 
 			var validationErr *ValidationError
@@ -939,26 +926,22 @@ func TestService_deletePatient(t *testing.T) {
 			args: args{id: 2},
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			wantErr: errPatientNotFound,
@@ -968,36 +951,30 @@ func TestService_deletePatient(t *testing.T) {
 			args: args{id: 2},
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 				{
-					Id:      2,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          2,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			wantErr: nil,
@@ -1007,52 +984,44 @@ func TestService_deletePatient(t *testing.T) {
 			args: args{id: 2},
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 				{
-					Id:      2,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          2,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			wantPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "ert",
-					Address: "amd",
-					Disease: "fever",
-					Phone:   65432,
-					Year:    2024,
-					Month:   12,
-					Date:    2,
+					Id:          1,
+					Name:        "ert",
+					Address:     "amd",
+					Disease:     "fever",
+					Phone:       "+919900112233",
+					DateOfBirth: newDate(2024, 12, 2),
 				},
 			},
 			wantNotification: []Notification{
 				{
+					Type:    notificationDeleted,
+					Seq:     1,
 					Message: "Patient removed with id: 2",
-					NewPatients: []Patient{
-						{
-							Id:      1,
-							Name:    "ert",
-							Address: "amd",
-							Disease: "fever",
-							Phone:   65432,
-							Year:    2024,
-							Month:   12,
-							Date:    2,
-						},
+					Patient: &Patient{
+						Id:          2,
+						Name:        "ert",
+						Address:     "amd",
+						Disease:     "fever",
+						Phone:       "+919900112233",
+						DateOfBirth: newDate(2024, 12, 2),
 					},
 				}},
 			wantErr:         nil,
@@ -1068,14 +1037,16 @@ func TestService_deletePatient(t *testing.T) {
 			subscriber := &testSubscriber{name: "foo"}
 
 			if tt.shouldSubscribe {
-				service.addSubscriber(subscriber)
+				service.addSubscriber(context.Background(), subscriber)
+				// the snapshot is checked by TestService_addSubscriber
+				subscriber.notification = nil
 			}
 
-			gotErr := service.deletePatient(tt.args.id)
+			gotErr := service.deletePatient(context.Background(), tt.args.id)
 
 			assert.ErrorIs(t, gotErr, tt.wantErr, "expected error and got error are not same")
-			assert.Equal(t, tt.wantPatients, repo.patients, "expected and got patient mismatch")
-			assert.Equal(t, tt.wantNotification, subscriber.notification, "expected notification and got notification mismatched")
+			assert.Equal(t, tt.wantPatients, repo.activePatients(), "expected and got patient mismatch")
+			notificationsEqual(t, tt.wantNotification, subscriber.notification)
 
 		})
 	}
@@ -1086,6 +1057,9 @@ func TestService_addSubscriber(t *testing.T) {
 		sub Subscriber
 	}
 
+	patient := Patient{Id: 1, Name: "priya", Version: 2}
+	snapshot := []Notification{{Type: notificationSnapshot, Seq: 4, Stream: "stream-1", Patients: []Patient{patient}}}
+
 	tests := []struct {
 		name            string
 		existingSubs    []Subscriber
@@ -1099,7 +1073,7 @@ func TestService_addSubscriber(t *testing.T) {
 			args: []args{{
 				&testSubscriber{name: "abc"},
 			}},
-			wantSubscribers: []Subscriber{&testSubscriber{name: "abc"}},
+			wantSubscribers: []Subscriber{&testSubscriber{name: "abc", notification: snapshot}},
 		},
 		{
 			name:         "multiple subscribers :POS",
@@ -1114,8 +1088,8 @@ func TestService_addSubscriber(t *testing.T) {
 			},
 			wantSubscribers: []Subscriber{
 				&testSubscriber{name: "abc"},
-				&testSubscriber{name: "xyz"},
-				&testSubscriber{name: "mnp"},
+				&testSubscriber{name: "xyz", notification: snapshot},
+				&testSubscriber{name: "mnp", notification: snapshot},
 			},
 		},
 		{
@@ -1132,11 +1106,14 @@ func TestService_addSubscriber(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			repo := newInMemoryRepository()
+			repo.patients = []Patient{patient}
 			service := newPatientsService(repo)
 			service.subscribers = tt.existingSubs
+			service.lastSeq = 4
+			service.stream = "stream-1"
 
 			for _, s := range tt.args {
-				err := service.addSubscriber(s.sub)
+				err := service.addSubscriber(context.Background(), s.sub)
 				assert.ErrorIs(t, err, tt.wantErr, "expect error to match")
 			}
 
@@ -1145,6 +1122,191 @@ func TestService_addSubscriber(t *testing.T) {
 	}
 }
 
+func TestService_resyncSubscriber(t *testing.T) {
+	ctx := context.Background()
+	service := newPatientsService(newInMemoryRepository())
+	subscriber := &testSubscriber{name: "abc"}
+	assert.NoError(t, service.addSubscriber(ctx, subscriber), "expect subscriber to be added")
+
+	created, err := service.createPatient(ctx, Patient{Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)})
+	assert.NoError(t, err, "expect patient to be created")
+	assert.NoError(t, service.resyncSubscriber(ctx, subscriber), "expect subscriber to be resynced")
+
+	notificationsEqual(t, []Notification{
+		{Type: notificationSnapshot, Seq: 0},
+		{Type: notificationCreated, Seq: 1, Message: "New patient added with id: 1", Patient: &created},
+		{Type: notificationSnapshot, Seq: 1, Patients: []Patient{created}},
+	}, subscriber.notification)
+}
+
+// loadingRepository holds getPatients, as a large snapshot would, until
+// release is closed. loading is closed once it has started.
+type loadingRepository struct {
+	*InMemoryRepository
+	loading chan struct{}
+	release chan struct{}
+}
+
+func (r loadingRepository) getPatients(ctx context.Context) ([]Patient, error) {
+	close(r.loading)
+	<-r.release
+	return r.InMemoryRepository.getPatients(ctx)
+}
+
+// TestService_resyncWhileChanging checks that changes are not held up while
+// a snapshot loads, and are sent after it instead.
+func TestService_resyncWhileChanging(t *testing.T) {
+	ctx := context.Background()
+	repo := newInMemoryRepository()
+	service := newPatientsService(repo)
+	subscriber := &testSubscriber{name: "abc"}
+	assert.NoError(t, service.addSubscriber(ctx, subscriber), "expect subscriber to be added")
+
+	loading := loadingRepository{InMemoryRepository: repo, loading: make(chan struct{}), release: make(chan struct{})}
+	service.repo = loading
+	resynced := make(chan error)
+	go func() {
+		resynced <- service.resyncSubscriber(ctx, subscriber)
+	}()
+	<-loading.loading
+
+	type result struct {
+		patient Patient
+		err     error
+	}
+	createdCh := make(chan result)
+	go func() {
+		p, err := service.createPatient(ctx, Patient{Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)})
+		createdCh <- result{p, err}
+	}()
+	var created result
+	select {
+	case created = <-createdCh:
+		assert.NoError(t, created.err, "expect patient to be created")
+	case <-time.After(time.Second):
+		t.Fatal("expect change not to wait for the snapshot")
+	}
+
+	close(loading.release)
+	assert.NoError(t, <-resynced, "expect subscriber to be resynced")
+	notificationsEqual(t, []Notification{
+		{Type: notificationSnapshot, Seq: 0},
+		{Type: notificationCreated, Seq: 1, Message: "New patient added with id: 1", Patient: &created.patient},
+		{Type: notificationSnapshot, Seq: 0, Patients: []Patient{created.patient}},
+		{Type: notificationCreated, Seq: 1, Message: "New patient added with id: 1", Patient: &created.patient},
+	}, subscriber.notification)
+}
+
+func TestService_resumeSubscriber(t *testing.T) {
+	tests := []struct {
+		name     string
+		sub      *testSubscriber
+		stream   string
+		since    int64
+		wantSeqs []int64
+		wantType string
+		wantErr  error
+	}{
+		{
+			name:     "caught up :POS",
+			sub:      &testSubscriber{name: "abc"},
+			stream:   "stream-1",
+			since:    3,
+			wantSeqs: []int64{4},
+			wantType: notificationCreated,
+		},
+		{
+			name:     "missed changes are replayed :POS",
+			sub:      &testSubscriber{name: "abc"},
+			stream:   "stream-1",
+			since:    1,
+			wantSeqs: []int64{2, 3, 4},
+			wantType: notificationCreated,
+		},
+		{
+			name:     "changes no longer held :NEG",
+			sub:      &testSubscriber{name: "abc"},
+			stream:   "stream-1",
+			since:    0,
+			wantSeqs: []int64{3, 4},
+			wantType: notificationResyncRequired,
+		},
+		{
+			name:     "seq from an earlier process :NEG",
+			sub:      &testSubscriber{name: "abc"},
+			stream:   "stream-0",
+			since:    3,
+			wantSeqs: []int64{3, 4},
+			wantType: notificationResyncRequired,
+		},
+		{
+			name:     "seq not reached yet :NEG",
+			sub:      &testSubscriber{name: "abc"},
+			stream:   "stream-1",
+			since:    9,
+			wantSeqs: []int64{3, 4},
+			wantType: notificationResyncRequired,
+		},
+		{
+			name:    "empty subscriber name :NEG",
+			sub:     &testSubscriber{name: ""},
+			stream:  "stream-1",
+			since:   3,
+			wantErr: errEmptySubscriber,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			service := newPatientsService(newInMemoryRepository())
+			service.stream = "stream-1"
+			service.replay = newReplayBuffer(2)
+			p := Patient{Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)}
+			for i := 0; i < 3; i++ {
+				_, err := service.createPatient(ctx, p)
+				assert.NoError(t, err, "expect patient to be created")
+			}
+
+			err := service.resumeSubscriber(ctx, tt.sub, tt.stream, tt.since)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr, "expect error to match")
+				assert.Empty(t, service.currentSubscribers(), "expect subscriber not to be added")
+				return
+			}
+			assert.NoError(t, err, "expect subscriber to be resumed")
+			_, err = service.createPatient(ctx, p)
+			assert.NoError(t, err, "expect patient to be created")
+
+			var seqs []int64
+			for _, n := range tt.sub.notification {
+				seqs = append(seqs, n.Seq)
+			}
+			assert.Equal(t, tt.wantSeqs, seqs, "expect missed and later changes")
+			assert.Equal(t, tt.wantType, tt.sub.notification[0].Type, "expect first notification type to match")
+		})
+	}
+}
+
+func TestService_replayBuffer(t *testing.T) {
+	b := newReplayBuffer(3)
+	for seq := int64(1); seq <= 5; seq++ {
+		b.add(Notification{Seq: seq})
+	}
+
+	missed, ok := b.after(2, 5)
+	assert.True(t, ok, "expect the three latest changes to be held")
+	assert.Equal(t, []Notification{{Seq: 3}, {Seq: 4}, {Seq: 5}}, missed, "expect changes oldest first")
+	_, ok = b.after(1, 5)
+	assert.False(t, ok, "expect older changes to be dropped")
+
+	disabled := newReplayBuffer(0)
+	disabled.add(Notification{Seq: 1})
+	missed, ok = disabled.after(1, 1)
+	assert.True(t, ok, "expect a caught up client to resume without a buffer")
+	assert.Empty(t, missed, "expect nothing to replay")
+}
+
 func TestService_removeSubscriber(t *testing.T) {
 	type args struct {
 		sub Subscriber
@@ -1185,3 +1347,281 @@ func TestService_removeSubscriber(t *testing.T) {
 		})
 	}
 }
+
+func TestService_audit(t *testing.T) {
+	existing := Patient{Id: 1, Name: "priya", Address: "surat", Disease: "fever", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 22), Version: 1}
+
+	tests := []struct {
+		name        string
+		action      func(s *patientsService, ctx context.Context) error
+		wantErr     error
+		wantEntries []AuditEntry
+	}{
+		{
+			name: "create patient :POS",
+			action: func(s *patientsService, ctx context.Context) error {
+				_, err := s.createPatient(ctx, Patient{Name: "abc", Address: "srt", Disease: "cold", Phone: "+919811122233", DateOfBirth: newDate(2024, 3, 4)})
+				return err
+			},
+			wantEntries: []AuditEntry{
+				{Id: 1, PatientId: 2, Actor: "nurse", Action: auditCreate, Changes: []FieldChange{
+					{Field: "name", After: "abc"},
+					{Field: "address", After: "srt"},
+					{Field: "disease", After: "cold"},
+					{Field: "phone", After: "+919811122233"},
+					{Field: "date_of_birth", After: newDate(2024, 3, 4)},
+				}},
+			},
+		},
+		{
+			name: "update patient :POS",
+			action: func(s *patientsService, ctx context.Context) error {
+				p := existing
+				p.Disease = "cold"
+				p.Phone = "+919811122233"
+				_, err := s.updatePatient(ctx, p)
+				return err
+			},
+			wantEntries: []AuditEntry{
+				{Id: 1, PatientId: 1, Actor: "nurse", Action: auditUpdate, Changes: []FieldChange{
+					{Field: "disease", Before: "fever", After: "cold"},
+					{Field: "phone", Before: "+919876543210", After: "+919811122233"},
+				}},
+			},
+		},
+		{
+			name: "stale update is not recorded :NEG",
+			action: func(s *patientsService, ctx context.Context) error {
+				p := existing
+				p.Version = 7
+				_, err := s.updatePatient(ctx, p)
+				return err
+			},
+			wantErr:     errVersionConflict,
+			wantEntries: []AuditEntry{},
+		},
+		{
+			name: "patch patient :POS",
+			action: func(s *patientsService, ctx context.Context) error {
+				_, err := s.patchPatient(ctx, 1, 1, PatientPatch{ContentType: mergePatchContentType, Document: []byte(`{"name": "priya d"}`)})
+				return err
+			},
+			wantEntries: []AuditEntry{
+				{Id: 1, PatientId: 1, Actor: "nurse", Action: auditUpdate, Changes: []FieldChange{
+					{Field: "name", Before: "priya", After: "priya d"},
+				}},
+			},
+		},
+		{
+			name: "delete and restore patient :POS",
+			action: func(s *patientsService, ctx context.Context) error {
+				if err := s.deletePatient(ctx, 1); err != nil {
+					return err
+				}
+				_, err := s.restorePatient(ctx, 1)
+				return err
+			},
+			wantEntries: []AuditEntry{
+				{Id: 1, PatientId: 1, Actor: "nurse", Action: auditDelete, Changes: []FieldChange{
+					{Field: "name", Before: "priya"},
+					{Field: "address", Before: "surat"},
+					{Field: "disease", Before: "fever"},
+					{Field: "phone", Before: "+919876543210"},
+					{Field: "date_of_birth", Before: newDate(2024, 2, 22)},
+				}},
+				{Id: 2, PatientId: 1, Actor: "nurse", Action: auditRestore, Changes: []FieldChange{}},
+			},
+		},
+		{
+			name: "purge patient :POS",
+			action: func(s *patientsService, ctx context.Context) error {
+				if err := s.deletePatient(ctx, 1); err != nil {
+					return err
+				}
+				s.trashRetention = -time.Second
+				_, err := s.purgeDeletedPatients(withActor(ctx, systemActor))
+				return err
+			},
+			wantEntries: []AuditEntry{
+				{Id: 1, PatientId: 1, Actor: "nurse", Action: auditDelete, Changes: []FieldChange{
+					{Field: "name", Before: "priya"},
+					{Field: "address", Before: "surat"},
+					{Field: "disease", Before: "fever"},
+					{Field: "phone", Before: "+919876543210"},
+					{Field: "date_of_birth", Before: newDate(2024, 2, 22)},
+				}},
+				{Id: 2, PatientId: 1, Actor: systemActor, Action: auditPurge, Changes: []FieldChange{}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newInMemoryRepository()
+			repo.patients = []Patient{existing}
+			repo.lastId.Store(1)
+			service := newPatientsService(repo)
+
+			gotErr := tt.action(service, withActor(context.Background(), "nurse"))
+			assert.ErrorIs(t, gotErr, tt.wantErr, "expect error to match")
+
+			gotEntries := make([]AuditEntry, 0)
+			for _, e := range repo.audit {
+				assert.False(t, e.At.IsZero(), "expect entry to be timestamped")
+				e.At = time.Time{}
+				gotEntries = append(gotEntries, e)
+			}
+			assert.Equal(t, tt.wantEntries, gotEntries, "expect audit entries to match")
+		})
+	}
+}
+
+// failingAuditRepository cannot record audit entries, so, like the
+// Postgres repository, it refuses the changes they belong to.
+type failingAuditRepository struct {
+	*InMemoryRepository
+}
+
+var errAuditUnavailable = errors.New("audit table unavailable")
+
+func (r failingAuditRepository) createPatient(ctx context.Context, p Patient) (Patient, error) {
+	return Patient{}, errAuditUnavailable
+}
+
+// TestService_auditFailure checks that a change whose audit entry cannot be
+// written fails and is not sent to subscribers.
+func TestService_auditFailure(t *testing.T) {
+	repo := newInMemoryRepository()
+	service := newPatientsService(failingAuditRepository{repo})
+	subscriber := &testSubscriber{name: "a"}
+	if err := service.addSubscriber(context.Background(), subscriber); err != nil {
+		t.Fatalf("failed to add subscriber: %v", err)
+	}
+
+	_, err := service.createPatient(context.Background(), Patient{Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)})
+	assert.ErrorIs(t, err, errAuditUnavailable, "expect the change to fail without its audit entry")
+	assert.Empty(t, repo.patients, "expect the patient not to be stored")
+	assert.Len(t, subscriber.notification, 1, "expect only the snapshot to be sent")
+}
+
+// blockingSubscriber stands in for a client that has stopped reading, so
+// that sending it a change never returns until released.
+type blockingSubscriber struct {
+	name    string
+	release chan struct{}
+}
+
+func (s *blockingSubscriber) update(notification Notification) {
+	if notification.Type != notificationSnapshot {
+		<-s.release
+	}
+}
+
+func (s *blockingSubscriber) getName() string {
+	return s.name
+}
+
+func (s *blockingSubscriber) close() {}
+
+func TestService_subscribersCheck(t *testing.T) {
+	service := newPatientsService(newInMemoryRepository())
+	check := subscribersCheck(service, 50*time.Millisecond)
+	assert.NoError(t, check.check(context.Background()), "expect no fan-out to be ready")
+
+	subscriber := &blockingSubscriber{name: "stuck", release: make(chan struct{})}
+	service.addSubscriber(context.Background(), subscriber)
+
+	created := make(chan struct{})
+	go func() {
+		defer close(created)
+		service.createPatient(context.Background(), Patient{Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)})
+	}()
+
+	assert.Eventually(t, func() bool {
+		return check.check(context.Background()) != nil
+	}, time.Second, 10*time.Millisecond, "expect a wedged fan-out to fail the check")
+
+	close(subscriber.release)
+	<-created
+	assert.NoError(t, check.check(context.Background()), "expect a finished fan-out to be ready")
+	assert.Zero(t, service.fanOutDuration(), "expect no fan-out in flight")
+}
+
+// countingSubscriber can be notified from concurrent fan-outs.
+type countingSubscriber struct {
+	name string
+
+	mu   sync.Mutex
+	seqs []int64
+}
+
+func (s *countingSubscriber) update(notification Notification) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seqs = append(s.seqs, notification.Seq)
+}
+
+func (s *countingSubscriber) getName() string {
+	return s.name
+}
+
+func (s *countingSubscriber) close() {}
+
+func (s *countingSubscriber) received() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.seqs...)
+}
+
+// TestService_concurrentSubscribers is meant to be run with -race: clients
+// subscribe and unsubscribe while patients are created, updated and
+// deleted, and every change is fanned out to them.
+func TestService_concurrentSubscribers(t *testing.T) {
+	const writers, churners, rounds = 4, 4, 10
+	ctx := context.Background()
+	service := newPatientsService(newInMemoryRepository())
+	stayer := &countingSubscriber{name: "stayer"}
+	assert.NoError(t, service.addSubscriber(ctx, stayer), "expect subscriber to be added")
+
+	var wg sync.WaitGroup
+	for c := 0; c < churners; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				sub := &countingSubscriber{name: fmt.Sprintf("churner-%d-%d", c, i)}
+				assert.NoError(t, service.addSubscriber(ctx, sub), "expect subscriber to be added")
+				service.subscriberCount()
+				service.fanOutDuration()
+				assert.NoError(t, service.removeSubscriber(sub), "expect subscriber to be removed")
+			}
+		}(c)
+	}
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				p, err := service.createPatient(ctx, Patient{Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)})
+				if !assert.NoError(t, err, "expect patient to be created") {
+					return
+				}
+				p.Disease = "fever"
+				_, err = service.updatePatient(ctx, p)
+				assert.NoError(t, err, "expect patient to be updated")
+				assert.NoError(t, service.deletePatient(ctx, p.Id), "expect patient to be deleted")
+			}
+		}()
+	}
+	wg.Wait()
+
+	seqs := stayer.received()
+	if assert.Len(t, seqs, writers*rounds*3+1, "expect the snapshot and every change to be notified") {
+		for i, seq := range seqs {
+			assert.Equal(t, int64(i), seq, "expect sequence numbers without gaps")
+		}
+	}
+	assert.Equal(t, 1, service.subscriberCount(), "expect only the lasting subscriber to remain")
+	assert.Zero(t, service.fanOutDuration(), "expect no fan-out in flight")
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/uptrace/bun"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "bitbucket.org/midaas-telemetry/priyadebbrani"
+
+// newTracerProvider exports spans over OTLP/HTTP to endpoint, such as
+// http://localhost:4318 for a local collector, keeping sampleRatio of the
+// traces that do not already have a sampling decision from the caller.
+// With no endpoint tracing is disabled and nothing is exported.
+func newTracerProvider(ctx context.Context, endpoint string, sampleRatio float64) (trace.TracerProvider, func(context.Context) error, error) {
+	if endpoint == "" {
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, nil, fmt.Errorf("tracing exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "patients"))),
+	)
+	return provider, provider.Shutdown, nil
+}
+
+// tracePropagator reads and writes W3C trace context and baggage headers.
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// tracingMiddleware continues the trace in the caller's traceparent header,
+// or starts one, with a server span per request. The trace id is added to
+// the request's log lines.
+func tracingMiddleware(tracer trace.Tracer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			route := routeTemplate(req)
+			ctx := tracePropagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+			ctx, span := tracer.Start(ctx, req.Method+" "+route,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", req.Method),
+					attribute.String("http.route", route),
+					attribute.String("url.path", req.URL.Path),
+				),
+			)
+			defer span.End()
+			if sc := span.SpanContext(); sc.IsValid() {
+				ctx = withLogAttrs(ctx, slog.String("trace_id", sc.TraceID().String()))
+			}
+
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, req.WithContext(ctx))
+
+			span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+			if recorder.status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(recorder.status))
+			}
+		})
+	}
+}
+
+// callerError reports whether err is the caller's mistake rather than a
+// failure of the service, such as a missing patient or a validation error.
+// Those are recorded on spans without marking them as failed.
+func callerError(err error) bool {
+	var validation *ValidationError
+	return errors.As(err, &validation) ||
+		errors.Is(err, errPatientNotFound) ||
+		errors.Is(err, errDuplicateId) ||
+		errors.Is(err, errVersionConflict) ||
+		errors.Is(err, errInvalidPatch) ||
+		errors.Is(err, errPatchTestFailed) ||
+		errors.Is(err, errForbidden)
+}
+
+// endSpan records err, if any, and ends span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		if !callerError(err) {
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	span.End()
+}
+
+// queryTraceHook gives each bun query its own client span. As with
+// queryLogHook the statement is left out because bun inlines the patient
+// data into it.
+type queryTraceHook struct {
+	tracer trace.Tracer
+}
+
+func (h queryTraceHook) BeforeQuery(ctx context.Context, event *bun.QueryEvent) context.Context {
+	name := event.Operation()
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.operation.name", name),
+	}
+	if event.IQuery != nil {
+		if table := event.IQuery.GetTableName(); table != "" {
+			name += " " + table
+			attrs = append(attrs, attribute.String("db.collection.name", table))
+		}
+	}
+	ctx, _ = h.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	return ctx
+}
+
+func (h queryTraceHook) AfterQuery(ctx context.Context, event *bun.QueryEvent) {
+	span := trace.SpanFromContext(ctx)
+	if event.Err != nil && !expectedQueryError(event.Err) {
+		span.RecordError(event.Err)
+		span.SetStatus(codes.Error, event.Err.Error())
+	}
+	span.End()
+}
+
+// tracedRepository decorates a Repository with a span per call.
+type tracedRepository struct {
+	next   Repository
+	tracer trace.Tracer
+}
+
+func newTracedRepository(next Repository, tracer trace.Tracer) *tracedRepository {
+	return &tracedRepository{next: next, tracer: tracer}
+}
+
+func (r *tracedRepository) start(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return r.tracer.Start(ctx, "Repository."+method, trace.WithAttributes(attrs...))
+}
+
+func (r *tracedRepository) createPatient(ctx context.Context, p Patient) (created Patient, err error) {
+	ctx, span := r.start(ctx, "createPatient")
+	defer func() { endSpan(span, err) }()
+	return r.next.createPatient(ctx, p)
+}
+
+func (r *tracedRepository) getPatients(ctx context.Context) (patients []Patient, err error) {
+	ctx, span := r.start(ctx, "getPatients")
+	defer func() { endSpan(span, err) }()
+	return r.next.getPatients(ctx)
+}
+
+func (r *tracedRepository) findPatients(ctx context.Context, q PatientQuery) (page PatientPage, err error) {
+	ctx, span := r.start(ctx, "findPatients")
+	defer func() { endSpan(span, err) }()
+	return r.next.findPatients(ctx, q)
+}
+
+func (r *tracedRepository) searchPatients(ctx context.Context, terms []string, fields []string, limit int) (results []SearchResult, err error) {
+	ctx, span := r.start(ctx, "searchPatients")
+	defer func() { endSpan(span, err) }()
+	return r.next.searchPatients(ctx, terms, fields, limit)
+}
+
+func (r *tracedRepository) getPatient(ctx context.Context, id int) (patient Patient, err error) {
+	ctx, span := r.start(ctx, "getPatient", attribute.Int("patient.id", id))
+	defer func() { endSpan(span, err) }()
+	return r.next.getPatient(ctx, id)
+}
+
+func (r *tracedRepository) deletePatient(ctx context.Context, id int) (deleted Patient, err error) {
+	ctx, span := r.start(ctx, "deletePatient", attribute.Int("patient.id", id))
+	defer func() { endSpan(span, err) }()
+	return r.next.deletePatient(ctx, id)
+}
+
+func (r *tracedRepository) updatePatient(ctx context.Context, p Patient) (updated Patient, err error) {
+	ctx, span := r.start(ctx, "updatePatient", attribute.Int("patient.id", p.Id))
+	defer func() { endSpan(span, err) }()
+	return r.next.updatePatient(ctx, p)
+}
+
+func (r *tracedRepository) patchPatient(ctx context.Context, p Patient, columns []string) (patched Patient, err error) {
+	ctx, span := r.start(ctx, "patchPatient", attribute.Int("patient.id", p.Id), attribute.StringSlice("patient.fields", columns))
+	defer func() { endSpan(span, err) }()
+	return r.next.patchPatient(ctx, p, columns)
+}
+
+func (r *tracedRepository) getDeletedPatients(ctx context.Context) (patients []Patient, err error) {
+	ctx, span := r.start(ctx, "getDeletedPatients")
+	defer func() { endSpan(span, err) }()
+	return r.next.getDeletedPatients(ctx)
+}
+
+func (r *tracedRepository) restorePatient(ctx context.Context, id int, restoredAt time.Time) (restored Patient, err error) {
+	ctx, span := r.start(ctx, "restorePatient", attribute.Int("patient.id", id))
+	defer func() { endSpan(span, err) }()
+	return r.next.restorePatient(ctx, id, restoredAt)
+}
+
+func (r *tracedRepository) purgePatients(ctx context.Context, deletedBefore time.Time) (purged []int, err error) {
+	ctx, span := r.start(ctx, "purgePatients")
+	defer func() { endSpan(span, err) }()
+	return r.next.purgePatients(ctx, deletedBefore)
+}
+
+func (r *tracedRepository) getAuditEntries(ctx context.Context, patientId int) (entries []AuditEntry, err error) {
+	ctx, span := r.start(ctx, "getAuditEntries", attribute.Int("patient.id", patientId))
+	defer func() { endSpan(span, err) }()
+	return r.next.getAuditEntries(ctx, patientId)
+}
+
+// tracedService decorates a Service with a span per call. Removing and
+// closing subscribers is passed straight through.
+type tracedService struct {
+	next   Service
+	tracer trace.Tracer
+}
+
+func newTracedService(next Service, tracer trace.Tracer) *tracedService {
+	return &tracedService{next: next, tracer: tracer}
+}
+
+func (s *tracedService) start(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, "Service."+method, trace.WithAttributes(attrs...))
+}
+
+func (s *tracedService) createPatient(ctx context.Context, p Patient) (created Patient, err error) {
+	ctx, span := s.start(ctx, "createPatient")
+	defer func() {
+		span.SetAttributes(attribute.Int("patient.id", created.Id))
+		endSpan(span, err)
+	}()
+	return s.next.createPatient(ctx, p)
+}
+
+func (s *tracedService) getPatients(ctx context.Context) (patients []Patient, err error) {
+	ctx, span := s.start(ctx, "getPatients")
+	defer func() { endSpan(span, err) }()
+	return s.next.getPatients(ctx)
+}
+
+func (s *tracedService) findPatients(ctx context.Context, q PatientQuery) (page PatientPage, err error) {
+	ctx, span := s.start(ctx, "findPatients")
+	defer func() { endSpan(span, err) }()
+	return s.next.findPatients(ctx, q)
+}
+
+func (s *tracedService) searchPatients(ctx context.Context, query string, fields []string, limit int) (results []SearchResult, err error) {
+	ctx, span := s.start(ctx, "searchPatients")
+	defer func() { endSpan(span, err) }()
+	return s.next.searchPatients(ctx, query, fields, limit)
+}
+
+func (s *tracedService) getPatient(ctx context.Context, id int) (patient Patient, err error) {
+	ctx, span := s.start(ctx, "getPatient", attribute.Int("patient.id", id))
+	defer func() { endSpan(span, err) }()
+	return s.next.getPatient(ctx, id)
+}
+
+func (s *tracedService) deletePatient(ctx context.Context, id int) (err error) {
+	ctx, span := s.start(ctx, "deletePatient", attribute.Int("patient.id", id))
+	defer func() { endSpan(span, err) }()
+	return s.next.deletePatient(ctx, id)
+}
+
+func (s *tracedService) updatePatient(ctx context.Context, p Patient) (updated Patient, err error) {
+	ctx, span := s.start(ctx, "updatePatient", attribute.Int("patient.id", p.Id))
+	defer func() { endSpan(span, err) }()
+	return s.next.updatePatient(ctx, p)
+}
+
+func (s *tracedService) patchPatient(ctx context.Context, id int, version int, patch PatientPatch) (patched Patient, err error) {
+	ctx, span := s.start(ctx, "patchPatient", attribute.Int("patient.id", id), attribute.String("patch.content_type", patch.ContentType))
+	defer func() { endSpan(span, err) }()
+	return s.next.patchPatient(ctx, id, version, patch)
+}
+
+func (s *tracedService) getDeletedPatients(ctx context.Context) (patients []Patient, err error) {
+	ctx, span := s.start(ctx, "getDeletedPatients")
+	defer func() { endSpan(span, err) }()
+	return s.next.getDeletedPatients(ctx)
+}
+
+func (s *tracedService) restorePatient(ctx context.Context, id int) (restored Patient, err error) {
+	ctx, span := s.start(ctx, "restorePatient", attribute.Int("patient.id", id))
+	defer func() { endSpan(span, err) }()
+	return s.next.restorePatient(ctx, id)
+}
+
+func (s *tracedService) purgeDeletedPatients(ctx context.Context) (purged int, err error) {
+	ctx, span := s.start(ctx, "purgeDeletedPatients")
+	defer func() { endSpan(span, err) }()
+	return s.next.purgeDeletedPatients(ctx)
+}
+
+func (s *tracedService) getPatientHistory(ctx context.Context, id int) (entries []AuditEntry, err error) {
+	ctx, span := s.start(ctx, "getPatientHistory", attribute.Int("patient.id", id))
+	defer func() { endSpan(span, err) }()
+	return s.next.getPatientHistory(ctx, id)
+}
+
+func (s *tracedService) addSubscriber(ctx context.Context, sub Subscriber) (err error) {
+	ctx, span := s.start(ctx, "addSubscriber")
+	defer func() { endSpan(span, err) }()
+	return s.next.addSubscriber(ctx, sub)
+}
+
+func (s *tracedService) resumeSubscriber(ctx context.Context, sub Subscriber, stream string, since int64) (err error) {
+	ctx, span := s.start(ctx, "resumeSubscriber")
+	span.SetAttributes(attribute.Int64("since", since))
+	defer func() { endSpan(span, err) }()
+	return s.next.resumeSubscriber(ctx, sub, stream, since)
+}
+
+func (s *tracedService) resyncSubscriber(ctx context.Context, sub Subscriber) (err error) {
+	ctx, span := s.start(ctx, "resyncSubscriber")
+	defer func() { endSpan(span, err) }()
+	return s.next.resyncSubscriber(ctx, sub)
+}
+
+func (s *tracedService) removeSubscriber(sub Subscriber) error {
+	return s.next.removeSubscriber(sub)
+}
+
+func (s *tracedService) closeSubscribers() {
+	s.next.closeSubscribers()
+}
+
+// defaultTracer is used until a tracer is configured, and records nothing.
+func defaultTracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing_spans(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	tests := []struct {
+		name           string
+		body           string
+		wantStatusCode int
+		wantSpans      []string
+		wantStatus     codes.Code
+	}{
+		{
+			name:           "update patient :POS",
+			body:           `{"name": "priya d", "address": "surat", "disease": "cold", "phone": "+919876543210", "dateOfBirth": "2024-02-12"}`,
+			wantStatusCode: http.StatusOK,
+			wantSpans: []string{
+				"PUT /api/patients/{id}",
+				"Service.updatePatient",
+				"Repository.getPatient",
+				"Repository.updatePatient",
+				"patientsService.notifySubscriber",
+			},
+			wantStatus: codes.Unset,
+		},
+		{
+			name:           "invalid patient is not a failure :NEG",
+			body:           `{"name": "", "address": "surat", "disease": "cold", "phone": "+919876543210", "dateOfBirth": "2024-02-12"}`,
+			wantStatusCode: http.StatusBadRequest,
+			wantSpans: []string{
+				"PUT /api/patients/{id}",
+				"Service.updatePatient",
+			},
+			wantStatus: codes.Unset,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := tracetest.NewInMemoryExporter()
+			provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+			tracer := provider.Tracer(tracerName)
+
+			repo := newInMemoryRepository()
+			repo.patients = []Patient{{Id: 1, Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12), Version: 1}}
+			service := newPatientsService(newTracedRepository(repo, tracer))
+			service.tracer = tracer
+			httpTransport := newHttpTransport(newTracedService(service, tracer))
+			httpTransport.tracer = tracer
+			router := buildRoutes(httpTransport)
+
+			req := httptest.NewRequest("PUT", "/api/patients/1", strings.NewReader(tt.body))
+			req.Header.Set("If-Match", `"1"`)
+			req.Header.Set("traceparent", traceparent)
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			assert.Equal(t, tt.wantStatusCode, res.Code, "expect status code to match")
+
+			spans := exporter.GetSpans()
+			byName := map[string]tracetest.SpanStub{}
+			for _, span := range spans {
+				byName[span.Name] = span
+				assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext.TraceID().String(), "expect the caller's trace to be continued")
+			}
+			assert.Len(t, spans, len(tt.wantSpans), "expect one span per call")
+			for _, name := range tt.wantSpans {
+				assert.Contains(t, byName, name, "expect span to be recorded")
+			}
+
+			server := byName["PUT /api/patients/{id}"]
+			assert.Equal(t, "00f067aa0ba902b7", server.Parent.SpanID().String(), "expect server span to be a child of the caller's span")
+			assert.Equal(t, server.SpanContext.SpanID(), byName["Service.updatePatient"].Parent.SpanID(), "expect service span under the server span")
+			assert.Equal(t, tt.wantStatus, byName["Service.updatePatient"].Status.Code, "expect span status to match")
+		})
+	}
+}
@@ -1,41 +1,282 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type httpTransport struct {
 	service Service
+
+	// webSockets counts the connection handlers still running. The HTTP
+	// server stops tracking a connection once it is upgraded, so shutdown
+	// waits on this instead.
+	webSockets sync.WaitGroup
+
+	// readinessChecks are run by /readyz.
+	readinessChecks []readinessCheck
+
+	// metrics, when set, instruments every route and is served on
+	// /metrics.
+	metrics *metrics
+
+	logger *slog.Logger
+	tracer trace.Tracer
+
+	// auth, when set, is required on the patient API and the WebSocket.
+	auth *authenticator
+
+	subscriberConfig SubscriberConfig
 }
 
 func newHttpTransport(service Service) *httpTransport {
-	return &httpTransport{service: service}
+	return &httpTransport{service: service, logger: slog.Default(), tracer: defaultTracer(), subscriberConfig: defaultSubscriberConfig()}
+}
+
+const (
+	overflowDropOldest = "drop-oldest"
+	overflowDisconnect = "disconnect"
+)
+
+var overflowPolicies = []string{overflowDropOldest, overflowDisconnect}
+
+func defaultSubscriberConfig() SubscriberConfig {
+	return SubscriberConfig{
+		QueueSize:      64,
+		Overflow:       overflowDropOldest,
+		WriteTimeout:   10 * time.Second,
+		PingInterval:   30 * time.Second,
+		IdleTimeout:    75 * time.Second,
+		MaxMessageSize: 4096,
+		ReplaySize:     defaultReplaySize,
+	}
 }
 
+// Reasons a notification is not delivered or a slow client is
+// disconnected, as reported in metrics.
+const (
+	reasonQueueFull    = "queue_full"
+	reasonWriteTimeout = "write_timeout"
+	reasonDisconnected = "disconnected"
+)
+
+// webSocketSubscriber queues notifications for its own writer goroutine,
+// so that a fan-out never waits on the network.
 type webSocketSubscriber struct {
-	conn *websocket.Conn
-	name string
+	conn   *websocket.Conn
+	name   string
+	logger *slog.Logger
+	config SubscriberConfig
+
+	// metrics, when set, counts dropped notifications and slow clients.
+	metrics *metrics
+
+	queue chan Notification
+
+	// queueMu makes dropping the oldest notification and queueing a new
+	// one a single step for concurrent fan-outs.
+	queueMu sync.Mutex
+
+	// stopped is closed once no more notifications are to be sent, and
+	// slowReason says why when the client was too slow to keep up.
+	stopped    chan struct{}
+	stopOnce   sync.Once
+	slowReason string
+
+	// readDeadlineMu keeps the reader from moving the read deadline past
+	// the one close sets.
+	readDeadlineMu sync.Mutex
+
+	writerDone chan struct{}
+}
+
+func newWebSocketSubscriber(conn *websocket.Conn, name string, config SubscriberConfig) *webSocketSubscriber {
+	return &webSocketSubscriber{
+		conn:       conn,
+		name:       name,
+		logger:     slog.Default(),
+		config:     config,
+		queue:      make(chan Notification, config.QueueSize),
+		stopped:    make(chan struct{}),
+		writerDone: make(chan struct{}),
+	}
 }
 
+// update queues notification without waiting for the client. When the
+// queue is full the oldest notification is dropped, or the client is
+// disconnected, depending on the overflow policy.
 func (ws *webSocketSubscriber) update(notification Notification) {
-	err := ws.conn.WriteJSON(notification)
-	if err != nil {
-		log.Println("error sending message to websocket:", err)
+	ws.queueMu.Lock()
+	defer ws.queueMu.Unlock()
+	for {
+		select {
+		case <-ws.stopped:
+			return
+		case ws.queue <- notification:
+			return
+		default:
+		}
+
+		if ws.config.Overflow == overflowDisconnect {
+			ws.stop(reasonQueueFull)
+			ws.dropped(reasonDisconnected, 1)
+			return
+		}
+		select {
+		case <-ws.queue:
+			ws.dropped(reasonQueueFull, 1)
+		default:
+		}
 	}
 }
 
+// stop ends the writer. A non-empty slowReason has the writer disconnect
+// the client.
+func (ws *webSocketSubscriber) stop(slowReason string) {
+	ws.stopOnce.Do(func() {
+		ws.slowReason = slowReason
+		close(ws.stopped)
+	})
+}
+
+func (ws *webSocketSubscriber) dropped(reason string, count int) {
+	if ws.metrics != nil && count > 0 {
+		ws.metrics.notificationsDropped.WithLabelValues(reason).Add(float64(count))
+	}
+}
+
+// writeNotifications sends queued notifications, and pings the client
+// every PingInterval, until the subscriber is stopped or the client cannot
+// keep up.
+func (ws *webSocketSubscriber) writeNotifications() {
+	defer close(ws.writerDone)
+	ping := time.NewTicker(ws.config.PingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ws.stopped:
+			if ws.slowReason != "" {
+				ws.disconnectSlow()
+			}
+			return
+		case notification := <-ws.queue:
+			if err := ws.write(notification); err != nil {
+				ws.writeFailed(err, 1)
+				return
+			}
+		case <-ping.C:
+			deadline := time.Now().Add(ws.config.WriteTimeout)
+			if err := ws.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				ws.writeFailed(err, 0)
+				return
+			}
+		}
+	}
+}
+
+// writeFailed ends the writer after a failed write, which lost the given
+// number of notifications.
+func (ws *webSocketSubscriber) writeFailed(err error, lost int) {
+	select {
+	case <-ws.stopped:
+		// the connection was closed while writing
+		return
+	default:
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		ws.stop(reasonWriteTimeout)
+		ws.dropped(reasonDisconnected, lost)
+		ws.disconnectSlow()
+		return
+	}
+	ws.logger.Warn("error sending message to websocket", "error", err)
+	ws.stop("")
+	ws.conn.Close()
+}
+
+func (ws *webSocketSubscriber) write(notification Notification) error {
+	if err := ws.conn.SetWriteDeadline(time.Now().Add(ws.config.WriteTimeout)); err != nil {
+		return err
+	}
+	return ws.conn.WriteJSON(notification)
+}
+
+// disconnectSlow tells a client that fell behind why it is being dropped
+// and closes its connection, which ends the connection handler.
+func (ws *webSocketSubscriber) disconnectSlow() {
+	dropped := len(ws.queue)
+	ws.dropped(reasonDisconnected, dropped)
+	if ws.metrics != nil {
+		ws.metrics.slowSubscribers.WithLabelValues(ws.slowReason).Inc()
+	}
+	ws.logger.Warn("disconnecting slow websocket client", "reason", ws.slowReason, "dropped", dropped+1)
+
+	message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow to keep up with notifications")
+	ws.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	ws.conn.Close()
+}
+
 func (ws *webSocketSubscriber) getName() string {
 	return ws.name
 }
 
+// webSocketCloseTimeout is how long a client gets to answer the close
+// message before its connection is dropped.
+const webSocketCloseTimeout = 5 * time.Second
+
+// close starts the WebSocket closing handshake. The connection handler
+// returns once the client answers, or when the read deadline passes.
+// Notifications still queued are not sent.
+func (ws *webSocketSubscriber) close() {
+	ws.stop("")
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	deadline := time.Now().Add(webSocketCloseTimeout)
+	if err := ws.conn.WriteControl(websocket.CloseMessage, message, deadline); err != nil {
+		ws.logger.Error("error sending close message to websocket", "error", err)
+	}
+	ws.readDeadlineMu.Lock()
+	defer ws.readDeadlineMu.Unlock()
+	if err := ws.conn.SetReadDeadline(deadline); err != nil {
+		ws.logger.Error("error setting websocket read deadline", "error", err)
+	}
+}
+
+// extendReadDeadline gives the client another IdleTimeout to send
+// something, unless the subscriber is already stopped.
+func (ws *webSocketSubscriber) extendReadDeadline() error {
+	ws.readDeadlineMu.Lock()
+	defer ws.readDeadlineMu.Unlock()
+	if ws.isStopped() {
+		return nil
+	}
+	return ws.conn.SetReadDeadline(time.Now().Add(ws.config.IdleTimeout))
+}
+
+func (ws *webSocketSubscriber) isStopped() bool {
+	select {
+	case <-ws.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
 type errResponse struct {
 	Messages []string `json:"messages"`
 }
@@ -49,43 +290,202 @@ var upgrader = websocket.Upgrader{
 }
 
 func (t *httpTransport) ConnectionHandler(w http.ResponseWriter, req *http.Request) {
+	t.webSockets.Add(1)
+	defer t.webSockets.Done()
+
+	ctx := req.Context()
+
+	// a client that reconnects passes the stream and seq of the last
+	// notification it got, to be sent the changes it missed
+	stream := req.URL.Query().Get("stream")
+	since, resume := int64(0), req.URL.Query().Has("since")
+	if resume {
+		n, err := strconv.ParseInt(req.URL.Query().Get("since"), 10, 64)
+		if err != nil || n < 0 {
+			writeErrResponse(w, http.StatusBadRequest, errResponse{Messages: []string{mistakeInvalidSinceParam}})
+			return
+		}
+		since = n
+	}
+
 	conn, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
-		log.Println("error in connecting websocket:", err)
+		t.logger.WarnContext(ctx, "error connecting websocket", "error", err)
 		return
 	}
-	fmt.Println("websocket connected")
 
 	remoteAddr := conn.RemoteAddr().String()
-	wsSubscriber := &webSocketSubscriber{
-		conn: conn,
-		name: remoteAddr,
-	}
-
-	t.service.addSubscriber(wsSubscriber)
-
+	t.logger.InfoContext(ctx, "websocket connected", "subscriber", remoteAddr)
+	wsSubscriber := newWebSocketSubscriber(conn, remoteAddr, t.subscriberConfig)
+	wsSubscriber.logger = t.logger.With(append(logAttrs(ctx), slog.String("subscriber", remoteAddr))...)
+	wsSubscriber.metrics = t.metrics
+	conn.SetReadLimit(int64(t.subscriberConfig.MaxMessageSize))
+	conn.SetPongHandler(func(string) error {
+		return wsSubscriber.extendReadDeadline()
+	})
+	wsSubscriber.extendReadDeadline()
+	go wsSubscriber.writeNotifications()
 	defer func() {
-		t.service.removeSubscriber(wsSubscriber)
+		wsSubscriber.stop("")
 		conn.Close()
+		<-wsSubscriber.writerDone
 	}()
 
+	if resume {
+		err = t.service.resumeSubscriber(ctx, wsSubscriber, stream, since)
+	} else {
+		err = t.service.addSubscriber(ctx, wsSubscriber)
+	}
+	if errors.Is(err, errForbidden) {
+		t.logger.WarnContext(ctx, "websocket subscription forbidden", "subscriber", remoteAddr, "error", err)
+		message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+		conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		return
+	}
+	if err != nil {
+		t.logger.ErrorContext(ctx, "error subscribing websocket", "subscriber", remoteAddr, "error", err)
+		message := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "could not load patients")
+		conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		return
+	}
+	defer t.service.removeSubscriber(wsSubscriber)
+
 	for {
-		_, _, err := conn.ReadMessage()
+		_, message, err := conn.ReadMessage()
 		if err != nil {
-			log.Println("connection closed", err)
-			if websocket.IsCloseError(err) {
-				return
+			var netErr net.Error
+			switch {
+			case websocket.IsCloseError(err):
+				t.logger.InfoContext(ctx, "websocket closed", "subscriber", remoteAddr, "reason", err)
+			case errors.Is(err, websocket.ErrReadLimit):
+				t.logger.WarnContext(ctx, "websocket message too large", "subscriber", remoteAddr, "limit", t.subscriberConfig.MaxMessageSize)
+			case errors.As(err, &netErr) && netErr.Timeout() && !wsSubscriber.isStopped():
+				t.logger.InfoContext(ctx, "websocket idle, disconnecting", "subscriber", remoteAddr, "idle_timeout", t.subscriberConfig.IdleTimeout)
+				if t.metrics != nil {
+					t.metrics.idleSubscribers.Inc()
+				}
+			default:
+				t.logger.WarnContext(ctx, "error reading from websocket", "subscriber", remoteAddr, "error", err)
 			}
-			log.Println("error reading message:", err)
 			return
 		}
+		wsSubscriber.extendReadDeadline()
+
+		var request webSocketRequest
+		if err := json.Unmarshal(message, &request); err != nil {
+			t.logger.WarnContext(ctx, "ignoring malformed websocket message", "subscriber", remoteAddr, "error", err)
+			continue
+		}
+		switch request.Type {
+		case webSocketResync:
+			if err := t.service.resyncSubscriber(ctx, wsSubscriber); err != nil {
+				t.logger.ErrorContext(ctx, "error resyncing websocket", "subscriber", remoteAddr, "error", err)
+			}
+		default:
+			t.logger.WarnContext(ctx, "ignoring unknown websocket message", "subscriber", remoteAddr, "type", request.Type)
+		}
+	}
+}
+
+// webSocketRequest is a message from a WebSocket client. The only type is
+// resync, which asks for a new snapshot after missing changes.
+type webSocketRequest struct {
+	Type string `json:"type"`
+}
+
+const webSocketResync = "resync"
+
+// waitForWebSockets waits until every WebSocket connection handler has
+// returned, or ctx is done.
+func (t *httpTransport) waitForWebSockets(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.webSockets.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+const (
+	msgIfMatchRequired  = "If-Match header is required, use the ETag returned by GET /api/patients/{id}"
+	msgInvalidIfMatch   = "If-Match header should be an ETag returned by GET /api/patients/{id}"
+	msgUnsupportedPatch = "PATCH body should be application/merge-patch+json or application/json-patch+json"
+)
+
+var errInvalidIfMatch = errors.New(msgInvalidIfMatch)
+
+// patientETag is the strong entity tag for the stored version of p.
+func patientETag(p Patient) string {
+	return strconv.Quote(strconv.Itoa(p.Version))
+}
+
+// parseIfMatch returns the patient versions an If-Match header accepts:
+// anyVersion for *, or the versions of the strong ETags it lists. Weak
+// ETags and ones that are not a version never match, so they are left out.
+func parseIfMatch(header string) ([]int, error) {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return []int{anyVersion}, nil
+	}
+
+	versions := []int{}
+	for rest := header; ; {
+		rest = strings.TrimLeft(rest, " \t")
+		weak := strings.HasPrefix(rest, "W/")
+		rest = strings.TrimPrefix(rest, "W/")
+		if !strings.HasPrefix(rest, `"`) {
+			return nil, errInvalidIfMatch
+		}
+		end := strings.IndexByte(rest[1:], '"')
+		if end < 0 {
+			return nil, errInvalidIfMatch
+		}
+		version, err := strconv.Atoi(rest[1 : end+1])
+		if !weak && err == nil && version >= 0 {
+			versions = append(versions, version)
+		}
+
+		rest = strings.TrimLeft(rest[end+2:], " \t")
+		if rest == "" {
+			return versions, nil
+		}
+		if !strings.HasPrefix(rest, ",") {
+			return nil, errInvalidIfMatch
+		}
+		rest = rest[1:]
 	}
 }
 
+// matchingVersion picks the version a change is checked against from the
+// versions If-Match accepts. With more than one, the stored version is
+// read to find the one that matches.
+func (t *httpTransport) matchingVersion(ctx context.Context, id int, versions []int) (int, error) {
+	switch len(versions) {
+	case 0:
+		return 0, errVersionConflict
+	case 1:
+		return versions[0], nil
+	}
+	stored, err := t.service.getPatient(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if !slices.Contains(versions, stored.Version) {
+		return 0, errVersionConflict
+	}
+	return stored.Version, nil
+}
+
 func writeErrResponse(w http.ResponseWriter, statusCode int, res errResponse) {
 	w.WriteHeader(statusCode)
 	if jsonErr := json.NewEncoder(w).Encode(res); jsonErr != nil {
-		log.Println("error sending json response:", jsonErr)
+		slog.Error("error sending json response", "error", jsonErr)
 	}
 }
 
@@ -97,7 +497,12 @@ func (t *httpTransport) createPatientHandler(w http.ResponseWriter, req *http.Re
 		return
 	}
 
-	if err := t.service.createPatient(patient); err != nil {
+	created, err := t.service.createPatient(req.Context(), patient)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			writeErrResponse(w, http.StatusForbidden, errResponse{Messages: []string{err.Error()}})
+			return
+		}
 		if errors.Is(err, errDuplicateId) {
 			writeErrResponse(w, http.StatusConflict, errResponse{Messages: []string{errDuplicateId.Error()}})
 			return
@@ -112,7 +517,12 @@ func (t *httpTransport) createPatientHandler(w http.ResponseWriter, req *http.Re
 		return
 	}
 
+	w.Header().Set("Location", fmt.Sprintf("/api/patients/%d", created.Id))
+	w.Header().Set("ETag", patientETag(created))
 	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		t.logger.ErrorContext(req.Context(), "error sending response", "error", err)
+	}
 }
 
 func (t *httpTransport) getPatientHandler(w http.ResponseWriter, req *http.Request) {
@@ -124,8 +534,12 @@ func (t *httpTransport) getPatientHandler(w http.ResponseWriter, req *http.Reque
 		return
 	}
 
-	patient, err := t.service.getPatient(idint)
+	patient, err := t.service.getPatient(req.Context(), idint)
 	if err != nil {
+		if errors.Is(err, errForbidden) {
+			writeErrResponse(w, http.StatusForbidden, errResponse{Messages: []string{err.Error()}})
+			return
+		}
 		if errors.Is(err, errPatientNotFound) {
 			w.WriteHeader(http.StatusNotFound)
 			return
@@ -133,22 +547,158 @@ func (t *httpTransport) getPatientHandler(w http.ResponseWriter, req *http.Reque
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("ETag", patientETag(patient))
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(patient); err != nil {
-		log.Println("error sending response:", err)
+		t.logger.ErrorContext(req.Context(), "error sending response", "error", err)
 	}
 }
 
+const (
+	mistakeInvalidLimitParam  = "limit should be a number"
+	mistakeInvalidOffsetParam = "offset should be a number"
+	mistakeInvalidFromParam   = "admittedFrom should be a date (YYYY-MM-DD) or RFC 3339 timestamp"
+	mistakeInvalidToParam     = "admittedTo should be a date (YYYY-MM-DD) or RFC 3339 timestamp"
+	mistakeInvalidSinceParam  = "since should be the seq of the last notification received"
+)
+
+// parsePatientQuery reads the listing parameters from the query string,
+// falling back to newPatientQuery's defaults for anything not given.
+func parsePatientQuery(values url.Values) (PatientQuery, error) {
+	q := newPatientQuery()
+	var mistakes []string
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			mistakes = append(mistakes, mistakeInvalidLimitParam)
+		}
+		q.Limit = n
+	}
+
+	if offset := values.Get("offset"); offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil {
+			mistakes = append(mistakes, mistakeInvalidOffsetParam)
+		}
+		q.Offset = n
+	}
+
+	if sortBy := values.Get("sort"); sortBy != "" {
+		q.SortBy = sortBy
+	}
+
+	switch strings.ToLower(values.Get("order")) {
+	case "", "asc":
+	case "desc":
+		q.SortDesc = true
+	default:
+		mistakes = append(mistakes, mistakeInvalidOrder)
+	}
+
+	q.Name = values.Get("name")
+	q.Disease = values.Get("disease")
+	q.Address = values.Get("address")
+
+	if from := values.Get("admittedFrom"); from != "" {
+		t, _, err := parseQueryTime(from)
+		if err != nil {
+			mistakes = append(mistakes, mistakeInvalidFromParam)
+		}
+		q.AdmittedFrom = t
+	}
+
+	if to := values.Get("admittedTo"); to != "" {
+		t, dateOnly, err := parseQueryTime(to)
+		if err != nil {
+			mistakes = append(mistakes, mistakeInvalidToParam)
+		}
+		if dateOnly {
+			// a bare date means "up to the end of that day"
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		q.AdmittedTo = t
+	}
+
+	if len(mistakes) > 0 {
+		return PatientQuery{}, &ValidationError{Mistakes: mistakes}
+	}
+	return q, nil
+}
+
+func parseQueryTime(value string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, false, err
+}
+
 func (t *httpTransport) getPatientsHandler(w http.ResponseWriter, req *http.Request) {
-	patients, err := t.service.getPatients()
+	var page PatientPage
+	query, err := parsePatientQuery(req.URL.Query())
+	if err == nil {
+		page, err = t.service.findPatients(req.Context(), query)
+	}
 	if err != nil {
+		if errors.Is(err, errForbidden) {
+			writeErrResponse(w, http.StatusForbidden, errResponse{Messages: []string{err.Error()}})
+			return
+		}
+		var validation *ValidationError
+		if errors.As(err, &validation) {
+			writeErrResponse(w, http.StatusBadRequest, errResponse{Messages: validation.Mistakes})
+			return
+		}
 		http.Error(w, "error fetching patient", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if next := query.Offset + len(page.Patients); len(page.Patients) > 0 && next < page.Total {
+		nextURL := *req.URL
+		values := nextURL.Query()
+		values.Set("offset", strconv.Itoa(next))
+		values.Set("limit", strconv.Itoa(query.Limit))
+		nextURL.RawQuery = values.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, nextURL.RequestURI()))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(page.Patients); err != nil {
+		t.logger.ErrorContext(req.Context(), "error writing response", "error", err)
+	}
+}
+
+func (t *httpTransport) searchPatientsHandler(w http.ResponseWriter, req *http.Request) {
+	limit := defaultPageSize
+	if value := req.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			writeErrResponse(w, http.StatusBadRequest, errResponse{Messages: []string{mistakeInvalidLimitParam}})
+			return
+		}
+		limit = n
+	}
+
+	results, err := t.service.searchPatients(req.Context(), req.URL.Query().Get("q"), nil, limit)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			writeErrResponse(w, http.StatusForbidden, errResponse{Messages: []string{err.Error()}})
+			return
+		}
+		var validation *ValidationError
+		if errors.As(err, &validation) {
+			writeErrResponse(w, http.StatusBadRequest, errResponse{Messages: validation.Mistakes})
+			return
+		}
+		writeErrResponse(w, http.StatusInternalServerError, errResponse{Messages: []string{err.Error()}})
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(patients); err != nil {
-		log.Println("error writing response:", err)
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		t.logger.ErrorContext(req.Context(), "error writing response", "error", err)
 	}
 }
 
@@ -161,6 +711,17 @@ func (t *httpTransport) updatePatientHandler(w http.ResponseWriter, req *http.Re
 		return
 	}
 
+	ifMatch := req.Header.Get("If-Match")
+	if ifMatch == "" {
+		writeErrResponse(w, http.StatusPreconditionRequired, errResponse{Messages: []string{msgIfMatchRequired}})
+		return
+	}
+	versions, err := parseIfMatch(ifMatch)
+	if err != nil {
+		writeErrResponse(w, http.StatusBadRequest, errResponse{Messages: []string{msgInvalidIfMatch}})
+		return
+	}
+
 	var updatedPatient Patient
 	err = json.NewDecoder(req.Body).Decode(&updatedPatient)
 	if err != nil {
@@ -169,13 +730,107 @@ func (t *httpTransport) updatePatientHandler(w http.ResponseWriter, req *http.Re
 	}
 
 	updatedPatient.Id = idint
+	var updated Patient
+	updatedPatient.Version, err = t.matchingVersion(req.Context(), idint, versions)
+	if err == nil {
+		updated, err = t.service.updatePatient(req.Context(), updatedPatient)
+	}
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			writeErrResponse(w, http.StatusForbidden, errResponse{Messages: []string{err.Error()}})
+			return
+		}
+		if errors.Is(err, errPatientNotFound) {
+			writeErrResponse(w, http.StatusNotFound, errResponse{Messages: []string{"patient not found"}})
+			return
+		}
 
-	if err := t.service.updatePatient(updatedPatient); err != nil {
+		if errors.Is(err, errVersionConflict) {
+			writeErrResponse(w, http.StatusPreconditionFailed, errResponse{Messages: []string{errVersionConflict.Error()}})
+			return
+		}
+
+		var validation *ValidationError
+		if errors.As(err, &validation) {
+			writeErrResponse(w, http.StatusBadRequest, errResponse{Messages: validation.Mistakes})
+			return
+		}
+
+		writeErrResponse(w, http.StatusInternalServerError, errResponse{Messages: []string{err.Error()}})
+		return
+	}
+
+	w.Header().Set("ETag", patientETag(updated))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (t *httpTransport) patchPatientHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	id := vars["id"]
+	idint, err := strconv.Atoi(id)
+	if err != nil {
+		writeErrResponse(w, http.StatusBadRequest, errResponse{Messages: []string{err.Error()}})
+		return
+	}
+
+	contentType, _, _ := strings.Cut(req.Header.Get("Content-Type"), ";")
+	contentType = strings.TrimSpace(contentType)
+	if contentType == "" || contentType == "application/json" {
+		contentType = mergePatchContentType
+	}
+	if contentType != mergePatchContentType && contentType != jsonPatchContentType {
+		w.Header().Set("Accept-Patch", mergePatchContentType+", "+jsonPatchContentType)
+		writeErrResponse(w, http.StatusUnsupportedMediaType, errResponse{Messages: []string{msgUnsupportedPatch}})
+		return
+	}
+
+	ifMatch := req.Header.Get("If-Match")
+	if ifMatch == "" {
+		writeErrResponse(w, http.StatusPreconditionRequired, errResponse{Messages: []string{msgIfMatchRequired}})
+		return
+	}
+	versions, err := parseIfMatch(ifMatch)
+	if err != nil {
+		writeErrResponse(w, http.StatusBadRequest, errResponse{Messages: []string{msgInvalidIfMatch}})
+		return
+	}
+
+	var document json.RawMessage
+	if err := json.NewDecoder(req.Body).Decode(&document); err != nil {
+		writeErrResponse(w, http.StatusBadRequest, errResponse{Messages: []string{"error while decoding json"}})
+		return
+	}
+
+	var patched Patient
+	version, err := t.matchingVersion(req.Context(), idint, versions)
+	if err == nil {
+		patched, err = t.service.patchPatient(req.Context(), idint, version, PatientPatch{ContentType: contentType, Document: document})
+	}
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			writeErrResponse(w, http.StatusForbidden, errResponse{Messages: []string{err.Error()}})
+			return
+		}
 		if errors.Is(err, errPatientNotFound) {
 			writeErrResponse(w, http.StatusNotFound, errResponse{Messages: []string{"patient not found"}})
 			return
 		}
 
+		if errors.Is(err, errVersionConflict) {
+			writeErrResponse(w, http.StatusPreconditionFailed, errResponse{Messages: []string{errVersionConflict.Error()}})
+			return
+		}
+
+		if errors.Is(err, errPatchTestFailed) {
+			writeErrResponse(w, http.StatusConflict, errResponse{Messages: []string{err.Error()}})
+			return
+		}
+
+		if errors.Is(err, errInvalidPatch) {
+			writeErrResponse(w, http.StatusBadRequest, errResponse{Messages: []string{err.Error()}})
+			return
+		}
+
 		var validation *ValidationError
 		if errors.As(err, &validation) {
 			writeErrResponse(w, http.StatusBadRequest, errResponse{Messages: validation.Mistakes})
@@ -186,7 +841,11 @@ func (t *httpTransport) updatePatientHandler(w http.ResponseWriter, req *http.Re
 		return
 	}
 
+	w.Header().Set("ETag", patientETag(patched))
 	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(patched); err != nil {
+		t.logger.ErrorContext(req.Context(), "error sending response", "error", err)
+	}
 }
 
 func (t *httpTransport) deletePatientHandler(w http.ResponseWriter, req *http.Request) {
@@ -198,8 +857,12 @@ func (t *httpTransport) deletePatientHandler(w http.ResponseWriter, req *http.Re
 		return
 	}
 
-	err = t.service.deletePatient(idint)
+	err = t.service.deletePatient(req.Context(), idint)
 	if err != nil {
+		if errors.Is(err, errForbidden) {
+			writeErrResponse(w, http.StatusForbidden, errResponse{Messages: []string{err.Error()}})
+			return
+		}
 		if errors.Is(err, errPatientNotFound) {
 			w.WriteHeader(http.StatusNotFound)
 			return
@@ -211,15 +874,148 @@ func (t *httpTransport) deletePatientHandler(w http.ResponseWriter, req *http.Re
 	w.WriteHeader(http.StatusOK)
 }
 
+func (t *httpTransport) getDeletedPatientsHandler(w http.ResponseWriter, req *http.Request) {
+	patients, err := t.service.getDeletedPatients(req.Context())
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			writeErrResponse(w, http.StatusForbidden, errResponse{Messages: []string{err.Error()}})
+			return
+		}
+		writeErrResponse(w, http.StatusInternalServerError, errResponse{Messages: []string{err.Error()}})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(patients); err != nil {
+		t.logger.ErrorContext(req.Context(), "error writing response", "error", err)
+	}
+}
+
+func (t *httpTransport) restorePatientHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	id := vars["id"]
+	idint, err := strconv.Atoi(id)
+	if err != nil {
+		writeErrResponse(w, http.StatusBadRequest, errResponse{Messages: []string{err.Error()}})
+		return
+	}
+
+	restored, err := t.service.restorePatient(req.Context(), idint)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			writeErrResponse(w, http.StatusForbidden, errResponse{Messages: []string{err.Error()}})
+			return
+		}
+		if errors.Is(err, errPatientNotFound) {
+			writeErrResponse(w, http.StatusNotFound, errResponse{Messages: []string{"patient not found in trash"}})
+			return
+		}
+		writeErrResponse(w, http.StatusInternalServerError, errResponse{Messages: []string{err.Error()}})
+		return
+	}
+
+	w.Header().Set("ETag", patientETag(restored))
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(restored); err != nil {
+		t.logger.ErrorContext(req.Context(), "error sending response", "error", err)
+	}
+}
+
+func (t *httpTransport) getPatientHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	id := vars["id"]
+	idint, err := strconv.Atoi(id)
+	if err != nil {
+		writeErrResponse(w, http.StatusBadRequest, errResponse{Messages: []string{err.Error()}})
+		return
+	}
+
+	entries, err := t.service.getPatientHistory(req.Context(), idint)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			writeErrResponse(w, http.StatusForbidden, errResponse{Messages: []string{err.Error()}})
+			return
+		}
+		if errors.Is(err, errPatientNotFound) {
+			writeErrResponse(w, http.StatusNotFound, errResponse{Messages: []string{"patient not found"}})
+			return
+		}
+		writeErrResponse(w, http.StatusInternalServerError, errResponse{Messages: []string{err.Error()}})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		t.logger.ErrorContext(req.Context(), "error writing response", "error", err)
+	}
+}
+
+type purgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+func (t *httpTransport) purgeDeletedPatientsHandler(w http.ResponseWriter, req *http.Request) {
+	purged, err := t.service.purgeDeletedPatients(req.Context())
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			writeErrResponse(w, http.StatusForbidden, errResponse{Messages: []string{err.Error()}})
+			return
+		}
+		writeErrResponse(w, http.StatusInternalServerError, errResponse{Messages: []string{err.Error()}})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(purgeResponse{Purged: purged}); err != nil {
+		t.logger.ErrorContext(req.Context(), "error sending response", "error", err)
+	}
+}
+
+// actorMiddleware attributes the changes made by a request to the caller
+// named in the X-Actor header. It is only used when authentication is
+// disabled, as the header is taken on trust.
+func actorMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if actor := req.Header.Get("X-Actor"); actor != "" {
+			req = req.WithContext(withActor(req.Context(), actor))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
 func buildRoutes(t *httpTransport) *mux.Router {
 	router := mux.NewRouter()
+	router.Use(tracingMiddleware(t.tracer))
+	router.Use(loggingMiddleware(t.logger))
+	if t.metrics != nil {
+		router.Use(t.metrics.middleware)
+		router.Handle("/metrics", t.metrics.handler()).Methods("GET")
+	}
+	router.HandleFunc("/healthz", t.healthzHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/readyz", t.readyzHandler).Methods("GET", "HEAD")
+
+	// everything that touches patient data needs credentials
+	api := router.PathPrefix("/api").Subrouter()
+	webSocket := router.Path("/websocket").Subrouter()
+	if t.auth != nil {
+		api.Use(t.auth.middleware(false))
+		webSocket.Use(t.auth.middleware(true))
+	} else {
+		api.Use(actorMiddleware)
+	}
 
-	router.HandleFunc("/api/patients", t.createPatientHandler).Methods("POST")
-	router.HandleFunc("/api/patients", t.getPatientsHandler).Methods("GET")
-	router.HandleFunc("/api/patients/{id}", t.getPatientHandler).Methods("GET")
-	router.HandleFunc("/api/patients/{id}", t.updatePatientHandler).Methods("PUT")
-	router.HandleFunc("/api/patients/{id}", t.deletePatientHandler).Methods("DELETE")
-	router.HandleFunc("/websocket", t.ConnectionHandler)
+	api.HandleFunc("/patients", t.createPatientHandler).Methods("POST")
+	api.HandleFunc("/patients", t.getPatientsHandler).Methods("GET")
+	api.HandleFunc("/patients/search", t.searchPatientsHandler).Methods("GET")
+	api.HandleFunc("/patients/trash", t.getDeletedPatientsHandler).Methods("GET")
+	api.HandleFunc("/patients/trash", t.purgeDeletedPatientsHandler).Methods("DELETE")
+	api.HandleFunc("/patients/trash/{id}/restore", t.restorePatientHandler).Methods("POST")
+	api.HandleFunc("/patients/{id}", t.getPatientHandler).Methods("GET")
+	api.HandleFunc("/patients/{id}", t.updatePatientHandler).Methods("PUT")
+	api.HandleFunc("/patients/{id}", t.patchPatientHandler).Methods("PATCH")
+	api.HandleFunc("/patients/{id}", t.deletePatientHandler).Methods("DELETE")
+	api.HandleFunc("/patients/{id}/history", t.getPatientHistoryHandler).Methods("GET")
+	webSocket.HandleFunc("", t.ConnectionHandler)
 
 	return router
 }
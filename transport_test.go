@@ -2,14 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -21,7 +29,9 @@ func TestTransport_createPatient(t *testing.T) {
 		existingBody   []Patient
 		wantResponse   string
 		wantErr        error
+		wantLocation   string
 		wantStatusCode int
+		allowClientIds bool
 	}{
 		{
 			name: "invalid json syntax for name :NEG",
@@ -31,11 +41,9 @@ func TestTransport_createPatient(t *testing.T) {
 				"id": 98,
 				"name": abc,
 				"address": "SRT",
-				"phone": 123,
+				"phone": "+919845012345",
 				"disease": "fever",
-				"year": 2012,
-				"month": 10,
-				"date" :12,
+				"dateOfBirth": "2012-10-12",
 			}
 			`,
 			wantResponse: `{
@@ -52,40 +60,34 @@ func TestTransport_createPatient(t *testing.T) {
 				"name": "abc",
 				"address": "SRT",
 				"disease": "fever",
-				"phone": 123,
-				"year": 2012,
-				"month": 10,
-				"date" :12
+				"phone": "+919845012345",
+				"dateOfBirth": "2012-10-12"
 			}
 			`,
 			existingBody: []Patient{
 				{
-					Id:      1,
-					Name:    "abc",
-					Address: "SRT",
-					Disease: "fever",
-					Phone:   123,
-					Year:    2024,
-					Month:   10,
-					Date:    12,
+					Id:          1,
+					Name:        "abc",
+					Address:     "SRT",
+					Disease:     "fever",
+					Phone:       "+919845012345",
+					DateOfBirth: newDate(2024, 10, 12),
 				},
 			},
 			wantErr:        errDuplicateId,
 			wantStatusCode: http.StatusConflict,
+			allowClientIds: true,
 		},
 		{
 			name: "empty name :NEG",
 			url:  "/api/patients",
 			requestBody: `
 			{
-				"id": 1,
 				"name": "",
 				"address": "surat",
-				"phone": 12345,
+				"phone": "+919876543210",
 				"disease": "fever",
-				"year": 2024,
-				"month": 2,
-				"date" :12
+				"dateOfBirth": "2024-02-12"
 			}
 			`,
 			wantResponse: `{
@@ -99,14 +101,11 @@ func TestTransport_createPatient(t *testing.T) {
 			url:  "/api/patients",
 			requestBody: `
 			{
-				"id": 1,
 				"name": "dfrf",
 				"address": "",
-				"phone": 12345,
+				"phone": "+919876543210",
 				"disease": "fever",
-				"year": 2024,
-				"month": 2,
-				"date" :12
+				"dateOfBirth": "2024-02-12"
 			}
 			`,
 			wantResponse: `{
@@ -119,18 +118,15 @@ func TestTransport_createPatient(t *testing.T) {
 			url:  "/api/patients",
 			requestBody: `
 			{
-				"id": 1,
 				"name": "fwer",
 				"address": "ewre",
-				"phone": 0,
+				"phone": "",
 				"disease": "fever",
-				"year": 2024,
-				"month": 2,
-				"date" :12
+				"dateOfBirth": "2024-02-12"
 			}
 			`,
 			wantResponse: `{
-				"messages": ["contact Number should be postive"]
+				"messages": ["phone cannot be empty"]
 				}`,
 			wantStatusCode: http.StatusBadRequest,
 		},
@@ -139,22 +135,18 @@ func TestTransport_createPatient(t *testing.T) {
 			url:  "/api/patients",
 			requestBody: `
 			{
-				"id": 1,
 				"name": "",
 				"address": "ewre",
-				"phone": 0,
+				"phone": "",
 				"disease": "",
-				"year": 0,
-				"month": 2,
-				"date" :0
+				"dateOfBirth": null
 			}
 			`,
 			wantResponse: `{
 				"messages": ["name cannot be empty",
 							"disease cannot be empty",
-							"contact Number should be postive",
-							"year should be positive or negative",
-							"date should be positive or less than 32"]
+							"phone cannot be empty",
+							"dateOfBirth cannot be empty"]
 				}`,
 			wantStatusCode: http.StatusBadRequest,
 		},
@@ -163,17 +155,76 @@ func TestTransport_createPatient(t *testing.T) {
 			url:  "/api/patients",
 			requestBody: `
 			{
-				"id": 1,
 				"name": "priya",
 				"address": "surat",
-				"phone": 12345,
+				"phone": "+919876543210",
+				"disease": "fever",
+				"dateOfBirth": "2024-02-12"
+			}
+			`,
+			existingBody: []Patient{
+				{
+					Id:          1,
+					Name:        "abc",
+					Address:     "SRT",
+					Disease:     "fever",
+					Phone:       "+919845012345",
+					DateOfBirth: newDate(2024, 10, 12),
+				},
+			},
+			wantResponse: `{
+				"id": 2,
+				"name": "priya",
+				"address": "surat",
+				"phone": "+919876543210",
+				"disease": "fever",
+				"dateOfBirth": "2024-02-12"
+			}`,
+			wantLocation:   "/api/patients/2",
+			wantStatusCode: http.StatusCreated,
+		},
+		{
+			name: "client supplied id :NEG",
+			url:  "/api/patients",
+			requestBody: `
+			{
+				"id": 5,
+				"name": "priya",
+				"address": "surat",
+				"phone": "+919876543210",
+				"disease": "fever",
+				"dateOfBirth": "2024-02-12"
+			}
+			`,
+			wantResponse: `{
+				"messages": ["id is assigned by the server"]
+				}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "patient imported with client id :POS",
+			url:  "/api/patients",
+			requestBody: `
+			{
+				"id": 5,
+				"name": "priya",
+				"address": "surat",
+				"phone": "+919876543210",
 				"disease": "fever",
-				"year": 2024,
-				"month": 2,
-				"date" :12
+				"dateOfBirth": "2024-02-12"
 			}
 			`,
+			wantResponse: `{
+				"id": 5,
+				"name": "priya",
+				"address": "surat",
+				"phone": "+919876543210",
+				"disease": "fever",
+				"dateOfBirth": "2024-02-12"
+			}`,
+			wantLocation:   "/api/patients/5",
 			wantStatusCode: http.StatusCreated,
+			allowClientIds: true,
 		},
 	}
 
@@ -181,6 +232,7 @@ func TestTransport_createPatient(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			repo := newInMemoryRepository()
 			service := newPatientsService(repo)
+			service.allowClientIds = tt.allowClientIds
 			transport := newHttpTransport(service)
 			repo.patients = tt.existingBody
 
@@ -193,7 +245,19 @@ func TestTransport_createPatient(t *testing.T) {
 
 			gotResponse := res.Body.String()
 			assert.Equal(t, tt.wantStatusCode, res.Code, "expect status code to match")
-			if tt.wantResponse != "" {
+			assert.Equal(t, tt.wantLocation, res.Header().Get("Location"), "expect location to match")
+			if tt.wantStatusCode == http.StatusCreated {
+				var created Patient
+				if err := json.Unmarshal([]byte(gotResponse), &created); err != nil {
+					t.Fatalf("failed to decode response: %v", err)
+				}
+				var want Patient
+				if err := json.Unmarshal([]byte(tt.wantResponse), &want); err != nil {
+					t.Fatalf("failed to decode expected response: %v", err)
+				}
+				assertPatientEqual(t, want, created)
+				assert.False(t, created.CreatedAt.IsZero(), "expect createdAt to be set")
+			} else if tt.wantResponse != "" {
 				assert.JSONEq(t, tt.wantResponse, gotResponse, "expect response body to match")
 			}
 		})
@@ -221,28 +285,24 @@ func TestTransport_getPatients(t *testing.T) {
 			url:  "/api/patients",
 			existingPatients: []Patient{
 				{
-					Id:        1,
-					Name:      "priya",
-					Address:   "surat",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     2,
-					Date:      12,
-					CreatedAt: testTime,
-					UpdatedAt: testTime,
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 12),
+					CreatedAt:   testTime,
+					UpdatedAt:   testTime,
 				},
 				{
-					Id:        2,
-					Name:      "priya",
-					Address:   "surat",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     2,
-					Date:      12,
-					CreatedAt: testTime,
-					UpdatedAt: testTime,
+					Id:          2,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 12),
+					CreatedAt:   testTime,
+					UpdatedAt:   testTime,
 				},
 			},
 			wantResponse: `
@@ -251,25 +311,23 @@ func TestTransport_getPatients(t *testing.T) {
 					"id": 1,
 					"name": "priya",
 					"address": "surat",
-					"phone": 12345,
+					"phone": "+919876543210",
 					"disease": "fever",
-					"year": 2024,
-					"month": 2,
-					"date": 12,
+					"dateOfBirth": "2024-02-12",
 					"createdAt" : "2024-08-20T17:00:00Z",
-					"updatedAt" : "2024-08-20T17:00:00Z"
+					"updatedAt" : "2024-08-20T17:00:00Z",
+					"version": 0
 				},
 				{
 					"id": 2,
 					"name": "priya",
 					"address": "surat",
-					"phone": 12345,
+					"phone": "+919876543210",
 					"disease": "fever",
-					"year": 2024,
-					"month": 2,
-					"date": 12,
+					"dateOfBirth": "2024-02-12",
 					"createdAt" : "2024-08-20T17:00:00Z",
-					"updatedAt" : "2024-08-20T17:00:00Z"
+					"updatedAt" : "2024-08-20T17:00:00Z",
+					"version": 0
 				}
 			]
 			`,
@@ -298,6 +356,181 @@ func TestTransport_getPatients(t *testing.T) {
 	}
 }
 
+func TestTransport_getPatientsQuery(t *testing.T) {
+	existingPatients := []Patient{
+		{Id: 1, Name: "priya", Address: "surat", Disease: "fever", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)},
+		{Id: 2, Name: "abc", Address: "amd", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)},
+		{Id: 3, Name: "xyz", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)},
+	}
+
+	tests := []struct {
+		name           string
+		url            string
+		wantIds        []int
+		wantResponse   string
+		wantTotal      string
+		wantLink       string
+		wantStatusCode int
+	}{
+		{
+			name:           "first page with next link :POS",
+			url:            "/api/patients?limit=2&sort=name",
+			wantIds:        []int{2, 1},
+			wantTotal:      "3",
+			wantLink:       `</api/patients?limit=2&offset=2&sort=name>; rel="next"`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "last page has no next link :POS",
+			url:            "/api/patients?limit=2&offset=2&sort=name",
+			wantIds:        []int{3},
+			wantTotal:      "3",
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "filter and descending order :POS",
+			url:            "/api/patients?address=surat&order=desc",
+			wantIds:        []int{3, 1},
+			wantTotal:      "2",
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name: "invalid parameters :NEG",
+			url:  "/api/patients?limit=abc&order=up&sort=phone",
+			wantResponse: `{
+				"messages": ["limit should be a number", "order should be asc or desc"]
+			}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "invalid sort field :NEG",
+			url:  "/api/patients?sort=phone&limit=1000",
+			wantResponse: `{
+				"messages": ["limit should be between 1 and 500", "sort should be one of id, name, address, disease, createdAt, updatedAt"]
+			}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "invalid admission date :NEG",
+			url:  "/api/patients?admittedFrom=yesterday",
+			wantResponse: `{
+				"messages": ["admittedFrom should be a date (YYYY-MM-DD) or RFC 3339 timestamp"]
+			}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newInMemoryRepository()
+			repo.patients = existingPatients
+			service := newPatientsService(repo)
+			transport := newHttpTransport(service)
+
+			router := buildRoutes(transport)
+
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", tt.url, nil)
+			router.ServeHTTP(res, req)
+
+			assert.Equal(t, tt.wantStatusCode, res.Code, "expect status code to match")
+			if tt.wantResponse != "" {
+				assert.JSONEq(t, tt.wantResponse, res.Body.String(), "expect response body to match")
+				return
+			}
+
+			var gotPatients []Patient
+			if err := json.NewDecoder(res.Body).Decode(&gotPatients); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			gotIds := []int{}
+			for _, p := range gotPatients {
+				gotIds = append(gotIds, p.Id)
+			}
+			assert.Equal(t, tt.wantIds, gotIds, "expect patient ids to match")
+			assert.Equal(t, tt.wantTotal, res.Header().Get("X-Total-Count"), "expect total count to match")
+			assert.Equal(t, tt.wantLink, res.Header().Get("Link"), "expect next link to match")
+		})
+	}
+}
+
+func TestTransport_searchPatients(t *testing.T) {
+	existingPatients := []Patient{
+		{Id: 1, Name: "priya", Address: "surat", Disease: "fever", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)},
+		{Id: 2, Name: "abc", Address: "amd", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)},
+	}
+
+	tests := []struct {
+		name           string
+		url            string
+		wantResponse   string
+		wantStatusCode int
+	}{
+		{
+			name: "ranked results with highlights :POS",
+			url:  "/api/patients/search?q=pri",
+			wantResponse: `[
+				{
+					"patient": {
+						"id": 1,
+						"name": "priya",
+						"address": "surat",
+						"disease": "fever",
+						"phone": "+919876543210",
+						"dateOfBirth": "2024-02-12",
+						"createdAt": "0001-01-01T00:00:00Z",
+						"updatedAt": "0001-01-01T00:00:00Z",
+						"version": 0
+					},
+					"rank": 1,
+					"highlights": {"name": "<mark>priya</mark>"}
+				}
+			]`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "no results :POS",
+			url:            "/api/patients/search?q=malaria",
+			wantResponse:   `[]`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name: "empty query :NEG",
+			url:  "/api/patients/search?q=%20-",
+			wantResponse: `{
+				"messages": ["search query cannot be empty"]
+			}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "invalid limit :NEG",
+			url:  "/api/patients/search?q=priya&limit=x",
+			wantResponse: `{
+				"messages": ["limit should be a number"]
+			}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newInMemoryRepository()
+			repo.patients = existingPatients
+			service := newPatientsService(repo)
+			transport := newHttpTransport(service)
+
+			router := buildRoutes(transport)
+
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", tt.url, nil)
+			router.ServeHTTP(res, req)
+
+			assert.Equal(t, tt.wantStatusCode, res.Code, "expect status code to match")
+			assert.JSONEq(t, tt.wantResponse, res.Body.String(), "expect response body to match")
+		})
+	}
+}
+
 func TestTransport_getPatient(t *testing.T) {
 	testTime := time.Date(2024, time.August, 20, 17, 0, 0, 0, time.UTC)
 	tests := []struct {
@@ -305,6 +538,7 @@ func TestTransport_getPatient(t *testing.T) {
 		url                string
 		existingPatients   []Patient
 		expectedResponse   string
+		expectedETag       string
 		expectedStatusCode int
 	}{
 		{
@@ -318,30 +552,29 @@ func TestTransport_getPatient(t *testing.T) {
 			url:  "/api/patients/1",
 			existingPatients: []Patient{
 				{
-					Id:        1,
-					Name:      "priya",
-					Address:   "surat",
-					Disease:   "fever",
-					Phone:     12345,
-					Year:      2024,
-					Month:     2,
-					Date:      12,
-					CreatedAt: testTime,
-					UpdatedAt: testTime,
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 12),
+					CreatedAt:   testTime,
+					UpdatedAt:   testTime,
+					Version:     3,
 				},
 			},
 			expectedResponse: `{
 				"id": 1,
 				"name": "priya",
 				"address": "surat",
-				"phone": 12345,
+				"phone": "+919876543210",
 				"disease": "fever",
-				"year": 2024,
-				"month": 2,
-				"date" :12,
+				"dateOfBirth": "2024-02-12",
 				"createdAt" : "2024-08-20T17:00:00Z",
-				"updatedAt" : "2024-08-20T17:00:00Z"
+				"updatedAt" : "2024-08-20T17:00:00Z",
+				"version": 3
 			}`,
+			expectedETag:       `"3"`,
 			expectedStatusCode: http.StatusOK,
 		},
 	}
@@ -361,6 +594,7 @@ func TestTransport_getPatient(t *testing.T) {
 
 			gotResponse := res.Body.String()
 			assert.Equal(t, tt.expectedStatusCode, res.Code, "status code mismatched")
+			assert.Equal(t, tt.expectedETag, res.Header().Get("ETag"), "ETag mismatched")
 			if tt.expectedStatusCode == http.StatusOK {
 				assert.JSONEq(t, tt.expectedResponse, gotResponse, "expected response mismatched")
 			}
@@ -372,24 +606,25 @@ func TestTransport_updatePatient(t *testing.T) {
 	tests := []struct {
 		name             string
 		url              string
+		ifMatch          string
 		requestBody      string
 		existingPatients []Patient
 		wantResponse     string
+		wantETag         string
 		wantStatusCode   int
 	}{
 		{
-			name: "patient not found :NEG",
-			url:  "/api/patients/1",
+			name:    "patient not found :NEG",
+			url:     "/api/patients/1",
+			ifMatch: `"0"`,
 			requestBody: `
 			{
 				"id": 1,
 				"name": "abc",
 				"address": "surat",
-				"phone": 12345,
+				"phone": "+919876543210",
 				"disease": "fever",
-				"year": 2024,
-				"month": 2,
-				"date" :12
+				"dateOfBirth": "2024-02-12"
 			}
 			`,
 			existingPatients: []Patient{},
@@ -399,30 +634,27 @@ func TestTransport_updatePatient(t *testing.T) {
 			wantStatusCode: http.StatusNotFound,
 		},
 		{
-			name: "empty name :NEG",
-			url:  "/api/patients/1",
+			name:    "empty name :NEG",
+			url:     "/api/patients/1",
+			ifMatch: `"0"`,
 			requestBody: `
 			{
 				"id": 1,
 				"name": "",
 				"address": "surat",
-				"phone": 12345,
+				"phone": "+919876543210",
 				"disease": "fever",
-				"year": 2024,
-				"month": 2,
-				"date" :12
+				"dateOfBirth": "2024-02-12"
 			}
 			`,
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "priya",
-					Address: "surat",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   2,
-					Date:    12,
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 12),
 				},
 			},
 			wantResponse: `{
@@ -431,30 +663,27 @@ func TestTransport_updatePatient(t *testing.T) {
 			wantStatusCode: http.StatusBadRequest,
 		},
 		{
-			name: "empty address :NEG",
-			url:  "/api/patients/1",
+			name:    "empty address :NEG",
+			url:     "/api/patients/1",
+			ifMatch: `"0"`,
 			requestBody: `
 			{
 				"id": 1,
 				"name": "gdfgh",
 				"address": "",
-				"phone": 12345,
+				"phone": "+919876543210",
 				"disease": "fever",
-				"year": 2024,
-				"month": 2,
-				"date" :12
+				"dateOfBirth": "2024-02-12"
 			}
 			`,
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "priya",
-					Address: "surat",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   2,
-					Date:    12,
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 12),
 				},
 			},
 			wantResponse: `{
@@ -463,171 +692,569 @@ func TestTransport_updatePatient(t *testing.T) {
 			wantStatusCode: http.StatusBadRequest,
 		},
 		{
-			name: "empty phone :NEG",
-			url:  "/api/patients/1",
+			name:    "empty phone :NEG",
+			url:     "/api/patients/1",
+			ifMatch: `"0"`,
 			requestBody: `
 			{
 				"id": 1,
 				"name": "fwer",
 				"address": "ewre",
-				"phone": 0,
+				"phone": "",
 				"disease": "fever",
-				"year": 2024,
-				"month": 2,
-				"date" :12
+				"dateOfBirth": "2024-02-12"
 			}
 			`,
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "priya",
-					Address: "surat",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   2,
-					Date:    12,
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 12),
 				},
 			},
 			wantResponse: `{
-				"messages": ["contact Number should be postive"]
+				"messages": ["phone cannot be empty"]
 				}`,
 			wantStatusCode: http.StatusBadRequest,
 		},
 		{
-			name: "patient found :POS",
-			url:  "/api/patients/1",
+			name:    "patient found :POS",
+			url:     "/api/patients/1",
+			ifMatch: `"1"`,
 			requestBody: `
 			{
 				"id": 1,
 				"name": "priya",
 				"address": "SRT",
-				"phone": 12345,
+				"phone": "+919876543210",
 				"disease": "fever",
-				"year": 2024,
-				"month": 2,
-				"date" :12
+				"dateOfBirth": "2024-02-12"
 			}
 			`,
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "priya",
-					Address: "surat",
-					Disease: "fever",
-					Phone:   12345,
-					Year:    2024,
-					Month:   2,
-					Date:    12,
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 12),
+					Version:     1,
 				},
 			},
+			wantETag:       `"2"`,
 			wantStatusCode: http.StatusOK,
 		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			repo := newInMemoryRepository()
-			repo.patients = tt.existingPatients
-			service := newPatientsService(repo)
-			transport := newHttpTransport(service)
-
-			router := buildRoutes(transport)
-			body := strings.NewReader(tt.requestBody)
-
-			res := httptest.NewRecorder()
-			req := httptest.NewRequest("PUT", tt.url, body)
-			router.ServeHTTP(res, req)
-
-			gotResponse := res.Body.String()
-
-			assert.Equal(t, tt.wantStatusCode, res.Code, "expect status code to match")
-			if tt.wantResponse != "" {
-				assert.JSONEq(t, tt.wantResponse, gotResponse, "expect response body to match")
-			}
-		})
-	}
-}
-
-func TestTransport_deletePatient(t *testing.T) {
-	tests := []struct {
-		name             string
-		url              string
-		existingPatients []Patient
-		wantPatients     []Patient
-		wantStatusCode   int
-	}{
-
 		{
-			name: "patient not found :NEG",
-			url:  "/api/patients/2",
+			name: "missing If-Match :NEG",
+			url:  "/api/patients/1",
+			requestBody: `
+			{
+				"name": "priya",
+				"address": "SRT",
+				"phone": "+919876543210",
+				"disease": "fever",
+				"dateOfBirth": "2024-02-12"
+			}
+			`,
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "abc",
-					Address: "srt",
-					Phone:   12345,
-					Disease: "Cold",
-					Year:    2024,
-					Month:   2,
-					Date:    12,
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 12),
+					Version:     1,
 				},
 			},
-			wantPatients: []Patient{
+			wantResponse: `{
+				"messages": ["If-Match header is required, use the ETag returned by GET /api/patients/{id}"]
+				}`,
+			wantStatusCode: http.StatusPreconditionRequired,
+		},
+		{
+			name:    "malformed If-Match :NEG",
+			url:     "/api/patients/1",
+			ifMatch: "1",
+			requestBody: `
+			{
+				"name": "priya",
+				"address": "SRT",
+				"phone": "+919876543210",
+				"disease": "fever",
+				"dateOfBirth": "2024-02-12"
+			}
+			`,
+			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "abc",
-					Address: "srt",
-					Phone:   12345,
-					Disease: "Cold",
-					Year:    2024,
-					Month:   2,
-					Date:    12,
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 12),
+					Version:     1,
 				},
 			},
-			wantStatusCode: http.StatusNotFound,
+			wantResponse: `{
+				"messages": ["If-Match header should be an ETag returned by GET /api/patients/{id}"]
+				}`,
+			wantStatusCode: http.StatusBadRequest,
 		},
 		{
-			name: "patient deleted :POS",
-			url:  "/api/patients/2",
+			name:    "If-Match any version :POS",
+			url:     "/api/patients/1",
+			ifMatch: "*",
+			requestBody: `
+			{
+				"name": "priya",
+				"address": "SRT",
+				"phone": "+919876543210",
+				"disease": "fever",
+				"dateOfBirth": "2024-02-12"
+			}
+			`,
 			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "abc",
-					Address: "srt",
-					Phone:   12345,
-					Disease: "cold",
-					Year:    2024,
-					Month:   2,
-					Date:    12,
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 12),
+					Version:     1,
 				},
+			},
+			wantETag:       `"2"`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:    "If-Match list with the stored version :POS",
+			url:     "/api/patients/1",
+			ifMatch: `"3", W/"2", "1"`,
+			requestBody: `
+			{
+				"name": "priya",
+				"address": "SRT",
+				"phone": "+919876543210",
+				"disease": "fever",
+				"dateOfBirth": "2024-02-12"
+			}
+			`,
+			existingPatients: []Patient{
 				{
-					Id:      2,
-					Name:    "abc",
-					Address: "srt",
-					Phone:   12345,
-					Disease: "cold",
-					Year:    2024,
-					Month:   2,
-					Date:    12,
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 12),
+					Version:     1,
 				},
 			},
-			wantPatients: []Patient{
+			wantETag:       `"2"`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:    "If-Match list without the stored version :NEG",
+			url:     "/api/patients/1",
+			ifMatch: `"2", "3"`,
+			requestBody: `
+			{
+				"name": "priya",
+				"address": "SRT",
+				"phone": "+919876543210",
+				"disease": "fever",
+				"dateOfBirth": "2024-02-12"
+			}
+			`,
+			existingPatients: []Patient{
 				{
-					Id:      1,
-					Name:    "abc",
-					Address: "srt",
-					Phone:   12345,
-					Disease: "cold",
-					Year:    2024,
-					Month:   2,
-					Date:    12,
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 12),
+					Version:     1,
 				},
 			},
-			wantStatusCode: http.StatusOK,
+			wantResponse: `{
+				"messages": ["patient was modified since it was read"]
+				}`,
+			wantStatusCode: http.StatusPreconditionFailed,
 		},
-	}
-	for _, tt := range tests {
+		{
+			name:    "weak If-Match never matches :NEG",
+			url:     "/api/patients/1",
+			ifMatch: `W/"1"`,
+			requestBody: `
+			{
+				"name": "priya",
+				"address": "SRT",
+				"phone": "+919876543210",
+				"disease": "fever",
+				"dateOfBirth": "2024-02-12"
+			}
+			`,
+			existingPatients: []Patient{
+				{
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 12),
+					Version:     1,
+				},
+			},
+			wantResponse: `{
+				"messages": ["patient was modified since it was read"]
+				}`,
+			wantStatusCode: http.StatusPreconditionFailed,
+		},
+		{
+			name:    "stale version :NEG",
+			url:     "/api/patients/1",
+			ifMatch: `"1"`,
+			requestBody: `
+			{
+				"name": "priya",
+				"address": "SRT",
+				"phone": "+919876543210",
+				"disease": "fever",
+				"dateOfBirth": "2024-02-12"
+			}
+			`,
+			existingPatients: []Patient{
+				{
+					Id:          1,
+					Name:        "priya",
+					Address:     "surat",
+					Disease:     "fever",
+					Phone:       "+919876543210",
+					DateOfBirth: newDate(2024, 2, 12),
+					Version:     2,
+				},
+			},
+			wantResponse: `{
+				"messages": ["patient was modified since it was read"]
+				}`,
+			wantStatusCode: http.StatusPreconditionFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newInMemoryRepository()
+			repo.patients = tt.existingPatients
+			service := newPatientsService(repo)
+			transport := newHttpTransport(service)
+
+			router := buildRoutes(transport)
+			body := strings.NewReader(tt.requestBody)
+
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest("PUT", tt.url, body)
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			router.ServeHTTP(res, req)
+
+			gotResponse := res.Body.String()
+
+			assert.Equal(t, tt.wantStatusCode, res.Code, "expect status code to match")
+			assert.Equal(t, tt.wantETag, res.Header().Get("ETag"), "expect ETag to match")
+			if tt.wantResponse != "" {
+				assert.JSONEq(t, tt.wantResponse, gotResponse, "expect response body to match")
+			}
+		})
+	}
+}
+
+func TestTransport_patchPatient(t *testing.T) {
+	existingPatient := Patient{
+		Id:          1,
+		Name:        "priya",
+		Address:     "surat",
+		Disease:     "fever",
+		Phone:       "+919876543210",
+		DateOfBirth: newDate(2024, 2, 12),
+		Version:     1,
+	}
+
+	tests := []struct {
+		name           string
+		url            string
+		contentType    string
+		ifMatch        string
+		requestBody    string
+		wantResponse   string
+		wantPatient    Patient
+		wantETag       string
+		wantStatusCode int
+	}{
+		{
+			name:           "merge patch :POS",
+			url:            "/api/patients/1",
+			contentType:    "application/merge-patch+json",
+			ifMatch:        `"1"`,
+			requestBody:    `{"address": "ahmedabad", "phone": "+919812345678"}`,
+			wantPatient:    Patient{Id: 1, Name: "priya", Address: "ahmedabad", Disease: "fever", Phone: "+919812345678", DateOfBirth: newDate(2024, 2, 12), Version: 2},
+			wantETag:       `"2"`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "plain json is treated as merge patch :POS",
+			url:            "/api/patients/1",
+			contentType:    "application/json",
+			ifMatch:        `"1"`,
+			requestBody:    `{"disease": "cold"}`,
+			wantPatient:    Patient{Id: 1, Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12), Version: 2},
+			wantETag:       `"2"`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:        "json patch :POS",
+			url:         "/api/patients/1",
+			contentType: "application/json-patch+json",
+			ifMatch:     `"1"`,
+			requestBody: `[
+				{"op": "test", "path": "/name", "value": "priya"},
+				{"op": "replace", "path": "/name", "value": "priyanka"},
+				{"op": "copy", "from": "/address", "path": "/disease"}
+			]`,
+			wantPatient:    Patient{Id: 1, Name: "priyanka", Address: "surat", Disease: "surat", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12), Version: 2},
+			wantETag:       `"2"`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "unchanged patch keeps version :POS",
+			url:            "/api/patients/1",
+			contentType:    "application/merge-patch+json",
+			ifMatch:        `"1"`,
+			requestBody:    `{"name": "priya"}`,
+			wantPatient:    existingPatient,
+			wantETag:       `"1"`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:        "json patch test fails :NEG",
+			url:         "/api/patients/1",
+			contentType: "application/json-patch+json",
+			ifMatch:     `"1"`,
+			requestBody: `[
+				{"op": "test", "path": "/name", "value": "abc"},
+				{"op": "replace", "path": "/name", "value": "priyanka"}
+			]`,
+			wantResponse:   `{"messages": ["operation 0: patch test operation failed: /name"]}`,
+			wantPatient:    existingPatient,
+			wantStatusCode: http.StatusConflict,
+		},
+		{
+			name:           "json patch nested path :NEG",
+			url:            "/api/patients/1",
+			contentType:    "application/json-patch+json",
+			ifMatch:        `"1"`,
+			requestBody:    `[{"op": "remove", "path": "/name/first"}]`,
+			wantResponse:   `{"messages": ["operation 0: invalid patch: path \"/name/first\" should point to a patient field"]}`,
+			wantPatient:    existingPatient,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "null removes a required field :NEG",
+			url:            "/api/patients/1",
+			contentType:    "application/merge-patch+json",
+			ifMatch:        `"1"`,
+			requestBody:    `{"name": null, "id": 7}`,
+			wantResponse:   `{"messages": ["id cannot be changed", "name cannot be empty"]}`,
+			wantPatient:    existingPatient,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "stale version :NEG",
+			url:            "/api/patients/1",
+			contentType:    "application/merge-patch+json",
+			ifMatch:        `"0"`,
+			requestBody:    `{"name": "abc"}`,
+			wantResponse:   `{"messages": ["patient was modified since it was read"]}`,
+			wantPatient:    existingPatient,
+			wantStatusCode: http.StatusPreconditionFailed,
+		},
+		{
+			name:           "If-Match any version :POS",
+			url:            "/api/patients/1",
+			contentType:    "application/merge-patch+json",
+			ifMatch:        "*",
+			requestBody:    `{"disease": "cold"}`,
+			wantPatient:    Patient{Id: 1, Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12), Version: 2},
+			wantETag:       `"2"`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "If-Match list with the stored version :POS",
+			url:            "/api/patients/1",
+			contentType:    "application/merge-patch+json",
+			ifMatch:        `"0", "1"`,
+			requestBody:    `{"disease": "cold"}`,
+			wantPatient:    Patient{Id: 1, Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12), Version: 2},
+			wantETag:       `"2"`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "weak If-Match never matches :NEG",
+			url:            "/api/patients/1",
+			contentType:    "application/merge-patch+json",
+			ifMatch:        `W/"1"`,
+			requestBody:    `{"name": "abc"}`,
+			wantResponse:   `{"messages": ["patient was modified since it was read"]}`,
+			wantPatient:    existingPatient,
+			wantStatusCode: http.StatusPreconditionFailed,
+		},
+		{
+			name:           "malformed If-Match :NEG",
+			url:            "/api/patients/1",
+			contentType:    "application/merge-patch+json",
+			ifMatch:        `"1`,
+			requestBody:    `{"name": "abc"}`,
+			wantResponse:   `{"messages": ["If-Match header should be an ETag returned by GET /api/patients/{id}"]}`,
+			wantPatient:    existingPatient,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "missing If-Match :NEG",
+			url:            "/api/patients/1",
+			contentType:    "application/merge-patch+json",
+			requestBody:    `{"name": "abc"}`,
+			wantResponse:   `{"messages": ["If-Match header is required, use the ETag returned by GET /api/patients/{id}"]}`,
+			wantPatient:    existingPatient,
+			wantStatusCode: http.StatusPreconditionRequired,
+		},
+		{
+			name:           "patient not found :NEG",
+			url:            "/api/patients/2",
+			contentType:    "application/merge-patch+json",
+			ifMatch:        `"1"`,
+			requestBody:    `{"name": "abc"}`,
+			wantResponse:   `{"messages": ["patient not found"]}`,
+			wantPatient:    existingPatient,
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name:           "unsupported content type :NEG",
+			url:            "/api/patients/1",
+			contentType:    "text/plain",
+			ifMatch:        `"1"`,
+			requestBody:    `name=abc`,
+			wantResponse:   `{"messages": ["PATCH body should be application/merge-patch+json or application/json-patch+json"]}`,
+			wantPatient:    existingPatient,
+			wantStatusCode: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newInMemoryRepository()
+			repo.patients = []Patient{existingPatient}
+			service := newPatientsService(repo)
+			transport := newHttpTransport(service)
+
+			router := buildRoutes(transport)
+
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest("PATCH", tt.url, strings.NewReader(tt.requestBody))
+			req.Header.Set("Content-Type", tt.contentType)
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			router.ServeHTTP(res, req)
+
+			assert.Equal(t, tt.wantStatusCode, res.Code, "expect status code to match")
+			assert.Equal(t, tt.wantETag, res.Header().Get("ETag"), "expect ETag to match")
+			if tt.wantResponse != "" {
+				assert.JSONEq(t, tt.wantResponse, res.Body.String(), "expect response body to match")
+			}
+
+			gotPatient := repo.patients[0]
+			assertPatientEqual(t, tt.wantPatient, gotPatient)
+			assert.Equal(t, tt.wantPatient.Version, gotPatient.Version, "expect version to match")
+		})
+	}
+}
+
+func TestTransport_deletePatient(t *testing.T) {
+	tests := []struct {
+		name             string
+		url              string
+		existingPatients []Patient
+		wantPatients     []Patient
+		wantStatusCode   int
+	}{
+
+		{
+			name: "patient not found :NEG",
+			url:  "/api/patients/2",
+			existingPatients: []Patient{
+				{
+					Id:          1,
+					Name:        "abc",
+					Address:     "srt",
+					Phone:       "+919876543210",
+					Disease:     "Cold",
+					DateOfBirth: newDate(2024, 2, 12),
+				},
+			},
+			wantPatients: []Patient{
+				{
+					Id:          1,
+					Name:        "abc",
+					Address:     "srt",
+					Phone:       "+919876543210",
+					Disease:     "Cold",
+					DateOfBirth: newDate(2024, 2, 12),
+				},
+			},
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name: "patient deleted :POS",
+			url:  "/api/patients/2",
+			existingPatients: []Patient{
+				{
+					Id:          1,
+					Name:        "abc",
+					Address:     "srt",
+					Phone:       "+919876543210",
+					Disease:     "cold",
+					DateOfBirth: newDate(2024, 2, 12),
+				},
+				{
+					Id:          2,
+					Name:        "abc",
+					Address:     "srt",
+					Phone:       "+919876543210",
+					Disease:     "cold",
+					DateOfBirth: newDate(2024, 2, 12),
+				},
+			},
+			wantPatients: []Patient{
+				{
+					Id:          1,
+					Name:        "abc",
+					Address:     "srt",
+					Phone:       "+919876543210",
+					Disease:     "cold",
+					DateOfBirth: newDate(2024, 2, 12),
+				},
+			},
+			wantStatusCode: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			repo := newInMemoryRepository()
 			repo.patients = tt.existingPatients
@@ -641,7 +1268,103 @@ func TestTransport_deletePatient(t *testing.T) {
 			router.ServeHTTP(res, req)
 
 			assert.Equal(t, tt.wantStatusCode, res.Code, "expect status code to match")
-			assert.Equal(t, tt.wantPatients, repo.patients, "expect patients to match")
+			assert.Equal(t, tt.wantPatients, repo.activePatients(), "expect patients to match")
+		})
+	}
+}
+
+func TestTransport_trash(t *testing.T) {
+	oldDelete := time.Date(2024, time.January, 1, 10, 0, 0, 0, time.UTC)
+	newDelete := time.Now()
+
+	tests := []struct {
+		name           string
+		method         string
+		url            string
+		wantResponse   string
+		wantActiveIds  []int
+		wantStatusCode int
+	}{
+		{
+			name:   "list trash :POS",
+			method: "GET",
+			url:    "/api/patients/trash",
+			wantResponse: `[
+				{
+					"id": 3, "name": "xyz", "address": "surat", "disease": "cold", "phone": "+919876543210",
+					"dateOfBirth": "2024-02-12",
+					"createdAt": "0001-01-01T00:00:00Z", "updatedAt": "0001-01-01T00:00:00Z", "version": 0,
+					"deletedAt": "` + newDelete.Format(time.RFC3339Nano) + `"
+				},
+				{
+					"id": 2, "name": "abc", "address": "surat", "disease": "cold", "phone": "+919876543210",
+					"dateOfBirth": "2024-02-12",
+					"createdAt": "0001-01-01T00:00:00Z", "updatedAt": "0001-01-01T00:00:00Z", "version": 0,
+					"deletedAt": "2024-01-01T10:00:00Z"
+				}
+			]`,
+			wantActiveIds:  []int{1},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "restore patient :POS",
+			method:         "POST",
+			url:            "/api/patients/trash/2/restore",
+			wantActiveIds:  []int{1, 2},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "restore active patient :NEG",
+			method:         "POST",
+			url:            "/api/patients/trash/1/restore",
+			wantResponse:   `{"messages": ["patient not found in trash"]}`,
+			wantActiveIds:  []int{1},
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name:           "deleted patient is hidden :NEG",
+			method:         "GET",
+			url:            "/api/patients/2",
+			wantActiveIds:  []int{1},
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name:           "purge patients past retention :POS",
+			method:         "DELETE",
+			url:            "/api/patients/trash",
+			wantResponse:   `{"purged": 1}`,
+			wantActiveIds:  []int{1},
+			wantStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newInMemoryRepository()
+			repo.patients = []Patient{
+				{Id: 1, Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)},
+				{Id: 2, Name: "abc", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12), DeletedAt: &oldDelete},
+				{Id: 3, Name: "xyz", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12), DeletedAt: &newDelete},
+			}
+			service := newPatientsService(repo)
+			transport := newHttpTransport(service)
+
+			router := buildRoutes(transport)
+
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			router.ServeHTTP(res, req)
+
+			assert.Equal(t, tt.wantStatusCode, res.Code, "expect status code to match")
+			if tt.wantResponse != "" {
+				assert.JSONEq(t, tt.wantResponse, res.Body.String(), "expect response body to match")
+			}
+
+			gotActiveIds := []int{}
+			for _, p := range repo.activePatients() {
+				gotActiveIds = append(gotActiveIds, p.Id)
+			}
+			assert.Equal(t, tt.wantActiveIds, gotActiveIds, "expect active patients to match")
 		})
 	}
 }
@@ -667,14 +1390,11 @@ func TestWebSocket_createPatient(t *testing.T) {
 
 	requestBody := `
 		{
-			"id": 1,
 			"name": "abc",
 			"address": "surat",
 			"disease": "fever",
-			"phone": 123,
-			"year": 2012,
-			"month": 10,
-			"date" :12
+			"phone": "+919845012345",
+			"dateOfBirth": "2012-10-12"
 		}
 	`
 
@@ -685,55 +1405,71 @@ func TestWebSocket_createPatient(t *testing.T) {
 	}
 	defer resp.Body.Close()
 
-	wantNotification := Notification{
-		Message: "New patient added with id: 1",
-		NewPatients: []Patient{
-			{
-				Id:      1,
-				Name:    "abc",
-				Address: "surat",
-				Disease: "fever",
-				Phone:   123,
-				Year:    2012,
-				Month:   10,
-				Date:    12,
+	wantNotifications := []Notification{
+		{Type: notificationSnapshot, Seq: 0},
+		{
+			Type:    notificationCreated,
+			Seq:     1,
+			Message: "New patient added with id: 1",
+			Patient: &Patient{
+				Id:          1,
+				Name:        "abc",
+				Address:     "surat",
+				Disease:     "fever",
+				Phone:       "+919845012345",
+				DateOfBirth: newDate(2012, 10, 12),
 			},
 		},
 	}
 
-	var notification Notification
-	if err := conn.ReadJSON(&notification); err != nil {
-		t.Errorf("Failed to read message from WebSocket: %v", err)
-	}
+	notificationsEqual(t, wantNotifications, readNotifications(t, conn, len(wantNotifications)))
+}
 
-	assert.Equal(t, wantNotification.Message, notification.Message, "expect message to match")
-	for i := range notification.NewPatients {
-		assertPatientEqual(t, wantNotification.NewPatients[i], notification.NewPatients[i])
+// readNotifications reads the next count notifications from conn.
+func readNotifications(t *testing.T, conn *websocket.Conn, count int) []Notification {
+	notifications := make([]Notification, count)
+	for i := range notifications {
+		if err := conn.ReadJSON(&notifications[i]); err != nil {
+			t.Fatalf("Failed to read message from WebSocket: %v", err)
+		}
 	}
+	return notifications
 }
 
 func TestWebSocket_deletePatient(t *testing.T) {
+	wantSnapshot := `
+		{
+			"type": "snapshot",
+			"seq": 0,
+			"stream": "stream-1",
+			"patients": [
+				{"id": 1, "name": "abc", "address": "srt", "disease": "cold", "phone": "+919876543210", "dateOfBirth": "2024-02-12", "createdAt": "0001-01-01T00:00:00Z", "updatedAt": "0001-01-01T00:00:00Z", "version": 2}
+			]
+		}
+	`
 	wantNotification := `
 		{
+			"type": "patient.deleted",
+			"seq": 1,
 			"message": "Patient removed with id: 1",
-			"newPatients": []
+			"patient": {"id": 1, "name": "abc", "address": "srt", "disease": "cold", "phone": "+919876543210", "dateOfBirth": "2024-02-12", "createdAt": "0001-01-01T00:00:00Z", "updatedAt": "0001-01-01T00:00:00Z", "version": 2}
 		}
 	`
 
 	repo := newInMemoryRepository()
 	repo.patients = []Patient{
 		{
-			Id:      1,
-			Name:    "abc",
-			Address: "srt",
-			Phone:   12345,
-			Disease: "cold",
-			Year:    2024,
-			Month:   2,
-			Date:    12,
+			Id:          1,
+			Name:        "abc",
+			Address:     "srt",
+			Phone:       "+919876543210",
+			Disease:     "cold",
+			DateOfBirth: newDate(2024, 2, 12),
+			Version:     2,
 		},
 	}
 	service := newPatientsService(repo)
+	service.stream = "stream-1"
 	transport := newHttpTransport(service)
 	router := buildRoutes(transport)
 	ts := httptest.NewServer(router)
@@ -749,6 +1485,12 @@ func TestWebSocket_deletePatient(t *testing.T) {
 
 	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode, "status code mismatched")
 
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read snapshot from websocket: %v", err)
+	}
+	assert.JSONEq(t, wantSnapshot, string(msg), "expect snapshot on connect")
+
 	req, err := http.NewRequest("DELETE", ts.URL+"/api/patients/1", nil)
 	if err != nil {
 		t.Fatalf("Failed to create HTTP request: %v", err)
@@ -763,7 +1505,7 @@ func TestWebSocket_deletePatient(t *testing.T) {
 
 	messageType, msg, err := conn.ReadMessage()
 	if err != nil {
-		t.Errorf("failed to read message from websocket: %v", err)
+		t.Fatalf("failed to read message from websocket: %v", err)
 	}
 
 	assert.Equal(t, websocket.TextMessage, messageType, "message type should be text")
@@ -775,14 +1517,12 @@ func TestWebSocket_updatePatient(t *testing.T) {
 	repo := newInMemoryRepository()
 	repo.patients = []Patient{
 		{
-			Id:      1,
-			Name:    "abc",
-			Address: "srt",
-			Disease: "cold",
-			Phone:   12345,
-			Year:    2024,
-			Month:   2,
-			Date:    12,
+			Id:          1,
+			Name:        "abc",
+			Address:     "srt",
+			Disease:     "cold",
+			Phone:       "+919876543210",
+			DateOfBirth: newDate(2024, 2, 12),
 		},
 	}
 	service := newPatientsService(repo)
@@ -807,26 +1547,27 @@ func TestWebSocket_updatePatient(t *testing.T) {
 		"id": 1,
 		"name": "priya",
 		"address": "surat",
-		"phone": 54321,
+		"phone": "+919812345678",
 		"disease": "cold",
-		"year": 2025,
-		"month": 3,
-		"date": 15
+		"dateOfBirth": "2025-03-15"
 	}
 	`
-	wantNotification := Notification{
-		Message: "Patient updated with id: 1",
-		NewPatients: []Patient{
-			{
-				Id:      1,
-				Name:    "priya",
-				Address: "surat",
-				Disease: "cold",
-				Phone:   54321,
-				Year:    2025,
-				Month:   3,
-				Date:    15,
+	original := repo.patients[0]
+	wantNotifications := []Notification{
+		{Type: notificationSnapshot, Seq: 0, Patients: []Patient{original}},
+		{
+			Type:    notificationUpdated,
+			Seq:     1,
+			Message: "Patient updated with id: 1",
+			Patient: &Patient{
+				Id:          1,
+				Name:        "priya",
+				Address:     "surat",
+				Disease:     "cold",
+				Phone:       "+919812345678",
+				DateOfBirth: newDate(2025, 3, 15),
 			},
+			Before: &original,
 		},
 	}
 
@@ -834,6 +1575,7 @@ func TestWebSocket_updatePatient(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create HTTP request: %v", err)
 	}
+	req.Header.Set("If-Match", `"0"`)
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -842,13 +1584,768 @@ func TestWebSocket_updatePatient(t *testing.T) {
 	}
 	defer resp.Body.Close()
 
-	var notification Notification
-	if err := conn.ReadJSON(&notification); err != nil {
-		t.Errorf("Failed to read message from WebSocket: %v", err)
+	gotNotifications := readNotifications(t, conn, len(wantNotifications))
+	notificationsEqual(t, wantNotifications, gotNotifications)
+	// clients skip changes older than the version they hold
+	assert.Equal(t, 1, gotNotifications[1].Patient.Version, "expect the updated version to be sent")
+	assert.Equal(t, 0, gotNotifications[1].Before.Version, "expect the previous version to be sent")
+}
+
+func TestTransport_patientHistory(t *testing.T) {
+	at := time.Date(2024, time.August, 20, 17, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name           string
+		url            string
+		wantResponse   string
+		wantStatusCode int
+	}{
+		{
+			name: "patient history :POS",
+			url:  "/api/patients/1/history",
+			wantResponse: `[
+				{"id": 1, "patientId": 1, "actor": "nurse", "action": "create", "at": "2024-08-20T17:00:00Z", "changes": [{"field": "name", "after": "priya"}]},
+				{"id": 3, "patientId": 1, "actor": "doctor", "action": "update", "at": "2024-08-20T17:00:00Z", "changes": [{"field": "name", "before": "priya", "after": "priya d"}]}
+			]`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "history of purged patient :POS",
+			url:            "/api/patients/2/history",
+			wantResponse:   `[{"id": 2, "patientId": 2, "actor": "nurse", "action": "delete", "at": "2024-08-20T17:00:00Z", "changes": []}]`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "patient without history :POS",
+			url:            "/api/patients/4/history",
+			wantResponse:   `[]`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "unknown patient :NEG",
+			url:            "/api/patients/9/history",
+			wantResponse:   `{"messages": ["patient not found"]}`,
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name:           "invalid id :NEG",
+			url:            "/api/patients/abc/history",
+			wantStatusCode: http.StatusBadRequest,
+		},
 	}
 
-	assert.Equal(t, notification.Message, wantNotification.Message, "message type should be text")
-	for i := range notification.NewPatients {
-		assertPatientEqual(t, wantNotification.NewPatients[i], notification.NewPatients[i])
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newInMemoryRepository()
+			repo.patients = []Patient{
+				{Id: 1, Name: "priya d", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)},
+				{Id: 4, Name: "xyz", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)},
+			}
+			repo.audit = []AuditEntry{
+				{Id: 1, PatientId: 1, Actor: "nurse", Action: auditCreate, At: at, Changes: []FieldChange{{Field: "name", After: "priya"}}},
+				{Id: 2, PatientId: 2, Actor: "nurse", Action: auditDelete, At: at, Changes: []FieldChange{}},
+				{Id: 3, PatientId: 1, Actor: "doctor", Action: auditUpdate, At: at, Changes: []FieldChange{{Field: "name", Before: "priya", After: "priya d"}}},
+			}
+			service := newPatientsService(repo)
+			transport := newHttpTransport(service)
+
+			router := buildRoutes(transport)
+
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", tt.url, nil)
+			router.ServeHTTP(res, req)
+
+			assert.Equal(t, tt.wantStatusCode, res.Code, "expect status code to match")
+			if tt.wantResponse != "" {
+				assert.JSONEq(t, tt.wantResponse, res.Body.String(), "expect response body to match")
+			}
+		})
+	}
+}
+
+func TestTransport_auditActor(t *testing.T) {
+	repo := newInMemoryRepository()
+	service := newPatientsService(repo)
+	router := buildRoutes(newHttpTransport(service))
+
+	for _, actor := range []string{"dr who", ""} {
+		body := `{"name": "priya", "address": "surat", "disease": "cold", "phone": "+919876543210", "dateOfBirth": "2024-02-12"}`
+		req := httptest.NewRequest("POST", "/api/patients", strings.NewReader(body))
+		if actor != "" {
+			req.Header.Set("X-Actor", actor)
+		}
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusCreated, res.Code, "expect status code to match")
+	}
+
+	if assert.Len(t, repo.audit, 2, "expect one audit entry per create") {
+		assert.Equal(t, "dr who", repo.audit[0].Actor, "expect actor from X-Actor header")
+		assert.Equal(t, anonymousActor, repo.audit[1].Actor, "expect anonymous actor without header")
+	}
+}
+
+func TestTransport_encryptedPrefix(t *testing.T) {
+	repo := newInMemoryRepository()
+	router := buildRoutes(newHttpTransport(newPatientsService(repo)))
+
+	for _, field := range []string{"name", "address", "disease"} {
+		patient := map[string]string{"name": "priya", "address": "surat", "disease": "cold", "phone": "+919876543210", "dateOfBirth": "2024-02-12"}
+		patient[field] = encryptedPrefix + "k1:AAAA:AAAA"
+		body, _ := json.Marshal(patient)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, httptest.NewRequest("POST", "/api/patients", bytes.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, res.Code, "expect %s with the encrypted prefix to be rejected", field)
+		assert.JSONEq(t, `{"messages": ["values cannot start with enc:v1:"]}`, res.Body.String(), "expect response body to match")
+	}
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, httptest.NewRequest("GET", "/api/patients", nil))
+	assert.Equal(t, http.StatusOK, res.Code, "expect patients to still be listed")
+	assert.JSONEq(t, `[]`, res.Body.String(), "expect nothing to be stored")
+}
+
+func TestTransport_legacyDateOfBirth(t *testing.T) {
+	tests := []struct {
+		name              string
+		method            string
+		url               string
+		requestBody       string
+		rejectLegacyDates bool
+		wantResponse      string
+		wantStatusCode    int
+		wantDateOfBirth   Date
+	}{
+		{
+			name:            "create with legacy fields :POS",
+			method:          "POST",
+			url:             "/api/patients",
+			requestBody:     `{"name": "abc", "address": "surat", "disease": "cold", "phone": "+919876543210", "year": 1990, "month": 7, "date": 14}`,
+			wantStatusCode:  http.StatusCreated,
+			wantDateOfBirth: newDate(1990, 7, 14),
+		},
+		{
+			name:           "create with impossible legacy date :NEG",
+			method:         "POST",
+			url:            "/api/patients",
+			requestBody:    `{"name": "abc", "address": "surat", "disease": "cold", "phone": "+919876543210", "year": 1990, "month": 2, "date": 31}`,
+			wantResponse:   `{"messages": ["dateOfBirth should be a real calendar date"]}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:              "create with legacy fields turned off :NEG",
+			method:            "POST",
+			url:               "/api/patients",
+			requestBody:       `{"name": "abc", "address": "surat", "disease": "cold", "phone": "+919876543210", "year": 1990, "month": 7, "date": 14}`,
+			rejectLegacyDates: true,
+			wantResponse:      `{"messages": ["year, month and date are no longer accepted, send dateOfBirth as YYYY-MM-DD"]}`,
+			wantStatusCode:    http.StatusBadRequest,
+		},
+		{
+			name:           "create with malformed date :NEG",
+			method:         "POST",
+			url:            "/api/patients",
+			requestBody:    `{"name": "abc", "address": "surat", "disease": "cold", "phone": "+919876543210", "dateOfBirth": "14/07/1990"}`,
+			wantResponse:   `{"messages": ["error while decoding json"]}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:            "patch only the legacy year :POS",
+			method:          "PATCH",
+			url:             "/api/patients/1",
+			requestBody:     `{"year": 1985}`,
+			wantStatusCode:  http.StatusOK,
+			wantDateOfBirth: newDate(1985, 2, 12),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newInMemoryRepository()
+			repo.patients = []Patient{
+				{Id: 1, Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(1994, 2, 12), Version: 1},
+			}
+			repo.lastId.Store(1)
+			service := newPatientsService(repo)
+			service.acceptLegacyDates = !tt.rejectLegacyDates
+			router := buildRoutes(newHttpTransport(service))
+
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.requestBody))
+			req.Header.Set("If-Match", `"1"`)
+			router.ServeHTTP(res, req)
+
+			assert.Equal(t, tt.wantStatusCode, res.Code, "expect status code to match")
+			if tt.wantResponse != "" {
+				assert.JSONEq(t, tt.wantResponse, res.Body.String(), "expect response body to match")
+			}
+			if !tt.wantDateOfBirth.IsZero() {
+				var got Patient
+				if err := json.Unmarshal(res.Body.Bytes(), &got); err != nil {
+					t.Fatalf("failed to decode response: %v", err)
+				}
+				assert.Equal(t, tt.wantDateOfBirth, got.DateOfBirth, "expect date of birth to match")
+				assert.Contains(t, res.Body.String(), `"dateOfBirth":"`+tt.wantDateOfBirth.String()+`"`, "expect ISO 8601 date")
+			}
+		})
+	}
+}
+
+func TestTransport_phoneNumbers(t *testing.T) {
+	tests := []struct {
+		name           string
+		phone          string
+		phoneRegion    string
+		wantPhone      string
+		wantResponse   string
+		wantStatusCode int
+	}{
+		{
+			name:           "national number in default region :POS",
+			phone:          `"098765 43210"`,
+			wantPhone:      "+919876543210",
+			wantStatusCode: http.StatusCreated,
+		},
+		{
+			name:           "legacy numeric phone :POS",
+			phone:          `9876543210`,
+			wantPhone:      "+919876543210",
+			wantStatusCode: http.StatusCreated,
+		},
+		{
+			name:           "international number :POS",
+			phone:          `"+1 (415) 555-2671"`,
+			wantPhone:      "+14155552671",
+			wantStatusCode: http.StatusCreated,
+		},
+		{
+			name:           "national number in configured region :POS",
+			phone:          `"415-555-2671"`,
+			phoneRegion:    "US",
+			wantPhone:      "+14155552671",
+			wantStatusCode: http.StatusCreated,
+		},
+		{
+			name:           "letters in phone :NEG",
+			phone:          `"call me"`,
+			wantResponse:   `{"messages": ["phone should only contain digits, spaces, dashes, brackets and a leading +"]}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "unknown country code :NEG",
+			phone:          `"+999 12345678"`,
+			wantResponse:   `{"messages": ["phone has an unknown country code, write it as +<country code> <number>"]}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "too few digits :NEG",
+			phone:          `"12345"`,
+			wantResponse:   `{"messages": ["phone has too few digits"]}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "too many digits :NEG",
+			phone:          `"+91 98765 43210 98765"`,
+			wantResponse:   `{"messages": ["phone has too many digits"]}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "number not in use :NEG",
+			phone:          `"+1 123 555 2671"`,
+			wantResponse:   `{"messages": ["phone is not a number that can be dialled in its region"]}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newInMemoryRepository()
+			service := newPatientsService(repo)
+			if tt.phoneRegion != "" {
+				service.phoneRegion = tt.phoneRegion
+			}
+			router := buildRoutes(newHttpTransport(service))
+
+			body := `{"name": "abc", "address": "surat", "disease": "cold", "dateOfBirth": "1990-07-14", "phone": ` + tt.phone + `}`
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/api/patients", strings.NewReader(body))
+			router.ServeHTTP(res, req)
+
+			assert.Equal(t, tt.wantStatusCode, res.Code, "expect status code to match")
+			if tt.wantResponse != "" {
+				assert.JSONEq(t, tt.wantResponse, res.Body.String(), "expect response body to match")
+			}
+			if tt.wantPhone != "" && assert.Len(t, repo.patients, 1, "expect patient to be stored") {
+				assert.Equal(t, tt.wantPhone, repo.patients[0].Phone, "expect phone in E.164 form")
+			}
+		})
+	}
+}
+
+func TestWebSocket_resync(t *testing.T) {
+	repo := newInMemoryRepository()
+	service := newPatientsService(repo)
+	router := buildRoutes(newHttpTransport(service))
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	wsURL := "ws" + ts.URL[len("http"):] + "/websocket"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	snapshot := readNotifications(t, conn, 1)[0]
+	assert.Equal(t, notificationSnapshot, snapshot.Type, "expect a snapshot on connect")
+	assert.Empty(t, snapshot.Patients, "expect no patients yet")
+
+	_, err = service.createPatient(context.Background(), Patient{Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)})
+	if !assert.NoError(t, err, "expect patient to be created") {
+		return
+	}
+	created := readNotifications(t, conn, 1)[0]
+	assert.Equal(t, notificationCreated, created.Type, "expect the change")
+
+	for _, message := range []string{`not json`, `{"type": "rewind"}`, `{"type": "resync"}`} {
+		assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(message)), "expect message to be sent")
+	}
+	resynced := readNotifications(t, conn, 1)[0]
+	assert.Equal(t, notificationSnapshot, resynced.Type, "expect unknown messages to be skipped and a new snapshot sent")
+	assert.Equal(t, created.Seq, resynced.Seq, "expect the snapshot to carry the last change")
+	if assert.Len(t, resynced.Patients, 1, "expect the created patient") {
+		assert.Equal(t, "priya", resynced.Patients[0].Name, "expect the created patient")
+	}
+}
+
+func TestWebSocket_resume(t *testing.T) {
+	service := newPatientsService(newInMemoryRepository())
+	ts := httptest.NewServer(buildRoutes(newHttpTransport(service)))
+	defer ts.Close()
+
+	wsURL := "ws" + ts.URL[len("http"):] + "/websocket"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	snapshot := readNotifications(t, conn, 1)[0]
+	conn.Close()
+	assert.NotEmpty(t, snapshot.Stream, "expect the snapshot to name the stream")
+	assert.Eventually(t, func() bool {
+		return service.subscriberCount() == 0
+	}, time.Second, 10*time.Millisecond, "expect client to be removed")
+
+	for i := 0; i < 2; i++ {
+		_, err := service.createPatient(context.Background(), Patient{Name: "priya", Address: "surat", Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)})
+		assert.NoError(t, err, "expect patient to be created")
+	}
+
+	query := url.Values{"stream": {snapshot.Stream}, "since": {strconv.FormatInt(snapshot.Seq, 10)}}
+	conn, _, err = websocket.DefaultDialer.Dial(wsURL+"?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatalf("Failed to reconnect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i, notification := range readNotifications(t, conn, 2) {
+		assert.Equal(t, notificationCreated, notification.Type, "expect missed change instead of a snapshot")
+		assert.Equal(t, snapshot.Seq+int64(i)+1, notification.Seq, "expect missed changes in order")
+	}
+
+	_, res, err := websocket.DefaultDialer.Dial(wsURL+"?since=last", nil)
+	assert.Error(t, err, "expect invalid since to be rejected")
+	if assert.NotNil(t, res, "expect a response") {
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, "expect bad request")
+	}
+}
+
+func TestWebSocket_keepalive(t *testing.T) {
+	tests := []struct {
+		name           string
+		answerPings    bool
+		wantSubscribed bool
+	}{
+		{
+			name:           "client answering pings stays subscribed :POS",
+			answerPings:    true,
+			wantSubscribed: true,
+		},
+		{
+			name:           "client not answering pings is disconnected :NEG",
+			answerPings:    false,
+			wantSubscribed: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newPatientsService(newInMemoryRepository())
+			transport := newHttpTransport(service)
+			transport.metrics = newMetrics()
+			transport.subscriberConfig.PingInterval = 20 * time.Millisecond
+			transport.subscriberConfig.IdleTimeout = 100 * time.Millisecond
+			ts := httptest.NewServer(buildRoutes(transport))
+			defer ts.Close()
+
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+ts.URL[len("http"):]+"/websocket", nil)
+			if err != nil {
+				t.Fatalf("Failed to connect to WebSocket: %v", err)
+			}
+			defer conn.Close()
+			var pings atomic.Int32
+			conn.SetPingHandler(func(data string) error {
+				pings.Add(1)
+				return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+			})
+			if tt.answerPings {
+				// pings are only answered while reading
+				go func() {
+					for {
+						if _, _, err := conn.ReadMessage(); err != nil {
+							return
+						}
+					}
+				}()
+			}
+
+			if tt.wantSubscribed {
+				time.Sleep(5 * transport.subscriberConfig.IdleTimeout)
+				assert.Equal(t, 1, service.subscriberCount(), "expect client to stay subscribed")
+				assert.GreaterOrEqual(t, pings.Load(), int32(2), "expect client to be pinged")
+				assert.Zero(t, testutil.ToFloat64(transport.metrics.idleSubscribers), "expect no idle disconnects")
+				return
+			}
+			assert.Eventually(t, func() bool {
+				return service.subscriberCount() == 0
+			}, 5*time.Second, 10*time.Millisecond, "expect idle client to be removed")
+			assert.Equal(t, 1.0, testutil.ToFloat64(transport.metrics.idleSubscribers), "expect idle disconnect to be counted")
+		})
+	}
+}
+
+func TestWebSocket_messageTooLarge(t *testing.T) {
+	service := newPatientsService(newInMemoryRepository())
+	transport := newHttpTransport(service)
+	transport.subscriberConfig.MaxMessageSize = 64
+	ts := httptest.NewServer(buildRoutes(transport))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+ts.URL[len("http"):]+"/websocket", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	readNotifications(t, conn, 1)
+
+	message := `{"type": "resync", "padding": "` + strings.Repeat("x", 64) + `"}`
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(message)), "expect message to be sent")
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), "expect message too big close message, got %v", err)
+	assert.Eventually(t, func() bool {
+		return service.subscriberCount() == 0
+	}, time.Second, 10*time.Millisecond, "expect client to be removed")
+}
+
+func TestWebSocket_shutdown(t *testing.T) {
+	repo := newInMemoryRepository()
+	service := newPatientsService(repo)
+	transport := newHttpTransport(service)
+	router := buildRoutes(transport)
+	ts := httptest.NewUnstartedServer(router)
+	ts.Config.RegisterOnShutdown(service.closeSubscribers)
+	ts.Start()
+	defer ts.Close()
+
+	wsURL := "ws" + ts.URL[len("http"):] + "/websocket"
+	conns := make([]*websocket.Conn, 2)
+	for i := range conns {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect to WebSocket: %v", err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+
+	// subscribers are added by the connection handlers, so wait for both
+	for i := 0; i < 100 && service.subscriberCount() < len(conns); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, len(conns), service.subscriberCount(), "expect every connection to subscribe")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ts.Config.Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to shut down server: %v", err)
+	}
+
+	for _, conn := range conns {
+		_, _, err := conn.ReadMessage()
+		assert.NoError(t, err, "expect the snapshot")
+		_, _, err = conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "expect going away close message, got %v", err)
+	}
+
+	assert.NoError(t, transport.waitForWebSockets(ctx), "expect connection handlers to return")
+	assert.Zero(t, service.subscriberCount(), "expect subscribers to be removed")
+}
+
+// TestWebSocket_concurrentUse is meant to be run with -race: patients are
+// created in parallel, so notifications to the same connection race each
+// other, while other clients connect and disconnect.
+func TestWebSocket_concurrentUse(t *testing.T) {
+	const creates, churners = 20, 4
+	service := newPatientsService(newInMemoryRepository())
+	ts := httptest.NewServer(buildRoutes(newHttpTransport(service)))
+	defer ts.Close()
+
+	wsURL := "ws" + ts.URL[len("http"):] + "/websocket"
+	conns := make([]*websocket.Conn, 2)
+	for i := range conns {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect to WebSocket: %v", err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	assert.Eventually(t, func() bool {
+		return service.subscriberCount() == len(conns)
+	}, time.Second, 10*time.Millisecond, "expect every connection to subscribe")
+
+	var wg sync.WaitGroup
+	for c := 0; c < churners; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < creates/churners; i++ {
+				conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+				if !assert.NoError(t, err, "expect connection to open") {
+					return
+				}
+				conn.Close()
+			}
+		}()
+	}
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := `{"name": "abc", "address": "surat", "disease": "fever", "phone": "+919845012345", "dateOfBirth": "2012-10-12"}`
+			resp, err := http.Post(ts.URL+"/api/patients", "application/json", strings.NewReader(body))
+			if !assert.NoError(t, err, "expect request to be sent") {
+				return
+			}
+			resp.Body.Close()
+			assert.Equal(t, http.StatusCreated, resp.StatusCode, "expect patient to be created")
+		}()
+	}
+	wg.Wait()
+
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var snapshot Notification
+		if err := conn.ReadJSON(&snapshot); err != nil {
+			t.Fatalf("Failed to read snapshot: %v", err)
+		}
+		assert.Equal(t, notificationSnapshot, snapshot.Type, "expect the snapshot first")
+		for i := 0; i < creates; i++ {
+			var notification Notification
+			if err := conn.ReadJSON(&notification); err != nil {
+				t.Fatalf("Failed to read notification %d: %v", i+1, err)
+			}
+			assert.True(t, strings.HasPrefix(notification.Message, "New patient added"), "expect intact notification, got %q", notification.Message)
+			assert.Equal(t, snapshot.Seq+int64(i)+1, notification.Seq, "expect notifications in sequence")
+		}
+	}
+	assert.Eventually(t, func() bool {
+		return service.subscriberCount() == len(conns)
+	}, time.Second, 10*time.Millisecond, "expect disconnected clients to unsubscribe")
+}
+
+func TestWebSocket_subscriberQueue(t *testing.T) {
+	tests := []struct {
+		name         string
+		overflow     string
+		updates      []string
+		wantQueued   []string
+		wantStopped  bool
+		wantDropped  map[string]float64
+		wantSlowness string
+	}{
+		{
+			name:       "room in the queue :POS",
+			overflow:   overflowDisconnect,
+			updates:    []string{"1", "2"},
+			wantQueued: []string{"1", "2"},
+		},
+		{
+			name:        "drop oldest :POS",
+			overflow:    overflowDropOldest,
+			updates:     []string{"1", "2", "3", "4"},
+			wantQueued:  []string{"3", "4"},
+			wantDropped: map[string]float64{reasonQueueFull: 2},
+		},
+		{
+			name:         "disconnect slow client :NEG",
+			overflow:     overflowDisconnect,
+			updates:      []string{"1", "2", "3", "4"},
+			wantQueued:   []string{"1", "2"},
+			wantStopped:  true,
+			wantDropped:  map[string]float64{reasonDisconnected: 1},
+			wantSlowness: reasonQueueFull,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMetrics()
+			ws := newWebSocketSubscriber(nil, "client", SubscriberConfig{QueueSize: 2, Overflow: tt.overflow, WriteTimeout: time.Second})
+			ws.metrics = m
+
+			for _, message := range tt.updates {
+				ws.update(Notification{Message: message})
+			}
+
+			var queued []string
+			for len(ws.queue) > 0 {
+				queued = append(queued, (<-ws.queue).Message)
+			}
+			assert.Equal(t, tt.wantQueued, queued, "expect queued notifications to match")
+			select {
+			case <-ws.stopped:
+				assert.True(t, tt.wantStopped, "expect subscriber to keep going")
+			default:
+				assert.False(t, tt.wantStopped, "expect subscriber to be stopped")
+			}
+			assert.Equal(t, tt.wantSlowness, ws.slowReason, "expect reason to match")
+			for _, reason := range []string{reasonQueueFull, reasonDisconnected} {
+				assert.Equal(t, tt.wantDropped[reason], testutil.ToFloat64(m.notificationsDropped.WithLabelValues(reason)), "expect %s drops to match", reason)
+			}
+		})
+	}
+}
+
+// TestWebSocket_slowClient has a client that stops reading: changes are
+// still made at full speed, and the client is dropped once a notification
+// cannot be written in time.
+func TestWebSocket_slowClient(t *testing.T) {
+	repo := newInMemoryRepository()
+	service := newPatientsService(repo)
+	transport := newHttpTransport(service)
+	transport.metrics = newMetrics()
+	transport.subscriberConfig.QueueSize = 4
+	transport.subscriberConfig.WriteTimeout = 200 * time.Millisecond
+	ts := httptest.NewServer(buildRoutes(transport))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+ts.URL[len("http"):]+"/websocket", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+	assert.Eventually(t, func() bool {
+		return service.subscriberCount() == 1
+	}, time.Second, 10*time.Millisecond, "expect connection to subscribe")
+
+	// big enough that a few notifications fill the socket buffers
+	address := strings.Repeat("surat ", 200000)
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		_, err := service.createPatient(context.Background(), Patient{Name: "priya", Address: address, Disease: "cold", Phone: "+919876543210", DateOfBirth: newDate(2024, 2, 12)})
+		assert.NoError(t, err, "expect patient to be created")
+	}
+	assert.Less(t, time.Since(start), 20*transport.subscriberConfig.WriteTimeout, "expect changes not to wait on the client")
+
+	assert.Eventually(t, func() bool {
+		return service.subscriberCount() == 0
+	}, 5*time.Second, 10*time.Millisecond, "expect slow client to be disconnected")
+	assert.Equal(t, 1.0, testutil.ToFloat64(transport.metrics.slowSubscribers.WithLabelValues(reasonWriteTimeout)), "expect disconnect to be counted")
+	assert.Positive(t, testutil.ToFloat64(transport.metrics.notificationsDropped.WithLabelValues(reasonDisconnected)), "expect lost notifications to be counted")
+}
+
+func TestTransport_health(t *testing.T) {
+	failing := readinessCheck{name: "database", check: func(ctx context.Context) error {
+		return errors.New("connection refused")
+	}}
+	passing := readinessCheck{name: "migrations", check: func(ctx context.Context) error {
+		return nil
+	}}
+	hanging := readinessCheck{name: "database", check: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+
+	tests := []struct {
+		name           string
+		url            string
+		checks         []readinessCheck
+		wantStatusCode int
+		wantStatus     string
+		wantChecks     map[string]string
+	}{
+		{
+			name:           "alive without checking dependencies :POS",
+			url:            "/healthz",
+			checks:         []readinessCheck{failing},
+			wantStatusCode: http.StatusOK,
+			wantStatus:     healthOK,
+			wantChecks:     map[string]string{},
+		},
+		{
+			name:           "ready :POS",
+			url:            "/readyz",
+			checks:         []readinessCheck{passing},
+			wantStatusCode: http.StatusOK,
+			wantStatus:     healthOK,
+			wantChecks:     map[string]string{"migrations": ""},
+		},
+		{
+			name:           "failing check :NEG",
+			url:            "/readyz",
+			checks:         []readinessCheck{passing, failing},
+			wantStatusCode: http.StatusServiceUnavailable,
+			wantStatus:     healthUnavailable,
+			wantChecks:     map[string]string{"migrations": "", "database": "connection refused"},
+		},
+		{
+			name:           "hanging check times out :NEG",
+			url:            "/readyz",
+			checks:         []readinessCheck{hanging},
+			wantStatusCode: http.StatusServiceUnavailable,
+			wantStatus:     healthUnavailable,
+			wantChecks:     map[string]string{"database": context.DeadlineExceeded.Error()},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpTransport := newHttpTransport(newPatientsService(newInMemoryRepository()))
+			httpTransport.readinessChecks = tt.checks
+			router := buildRoutes(httpTransport)
+
+			req := httptest.NewRequest("GET", tt.url, nil)
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+
+			assert.Equal(t, tt.wantStatusCode, res.Code, "expect status code to match")
+			assert.Equal(t, "application/json", res.Header().Get("Content-Type"), "expect json response")
+
+			var got healthResponse
+			if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			assert.Equal(t, tt.wantStatus, got.Status, "expect overall status to match")
+
+			gotChecks := map[string]string{}
+			for name, result := range got.Checks {
+				assert.GreaterOrEqual(t, result.LatencyMs, 0.0, "expect latency to be reported")
+				gotChecks[name] = result.Error
+			}
+			assert.Equal(t, tt.wantChecks, gotChecks, "expect checks to match")
+		})
 	}
 }
@@ -1,14 +1,66 @@
 import axios from "axios";
 import { Patient } from "@/types/patient";
 
+// apiToken is a bearer token for the API, such as a long-lived token for a
+// kiosk deployment; without it the API has to run with -auth-disabled.
+const apiToken = process.env.NEXT_PUBLIC_API_TOKEN;
+if (apiToken) {
+  axios.defaults.headers.common["Authorization"] = `Bearer ${apiToken}`;
+}
+
+// browsers cannot set headers on a WebSocket, so the token goes in the URL
+export const webSocketUrl = apiToken
+  ? `ws://localhost:8000/websocket?access_token=${encodeURIComponent(apiToken)}`
+  : "ws://localhost:8000/websocket";
+
+// getAllPatients reads every page of GET /api/patients, following the
+// rel="next" Link header the server sends while more patients remain.
+export const getAllPatients = async (): Promise<Patient[]> => {
+  const patients: Patient[] = [];
+  let url: string | undefined = "/api/patients";
+  while (url) {
+    const response = await axios.get(url);
+    patients.push(...response.data);
+    url = nextPageUrl(response.headers["link"]);
+  }
+  return patients;
+};
+
+const nextPageUrl = (link: string | undefined): string | undefined =>
+  link?.match(/<([^>]*)>;\s*rel="next"/)?.[1];
+
+// createPatient adds patient and returns it as stored, with the id the
+// server assigned to it.
+export const createPatient = async ({
+  id: _,
+  ...patient
+}: Patient): Promise<Patient> => {
+  const response = await axios.post("/api/patients", patient);
+  return response.data;
+};
+
+// ETags of the patients last read, sent back as If-Match on update.
+const patientETags = new Map<string, string>();
+
 export const getPatientById = async (id: string): Promise<Patient> => {
   const response = await axios.get(`/api/patients/${id}`);
-  return response.data;
+  patientETags.set(id, response.headers["etag"]);
+  return withDateParts(response.data);
+};
+
+// withDateParts splits dateOfBirth into the year, month and date fields the
+// forms edit, and drops it so an edited triple is not overridden on save.
+const withDateParts = ({ dateOfBirth, ...patient }: Patient): Patient => {
+  const [year, month, date] = (dateOfBirth ?? "").split("-").map(Number);
+  return { ...patient, year: year || 0, month: month || 0, date: date || 0 };
 };
 
 export const updatePatient = async (
   id: string,
   patient: Patient
 ): Promise<void> => {
-  await axios.put(`/api/patients/${id}`, patient);
+  const response = await axios.put(`/api/patients/${id}`, patient, {
+    headers: { "If-Match": patientETags.get(id) },
+  });
+  patientETags.set(id, response.headers["etag"]);
 };
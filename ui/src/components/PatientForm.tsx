@@ -19,16 +19,12 @@ import { Patient } from "../types/patient";
 function validate(patient: Patient): [boolean, { [key: string]: string }] {
   let valid = true;
   const newValidationErrors: { [key: string]: string } = {};
-  if (patient.id == 0 || isNaN(patient.id)) {
-    newValidationErrors["id"] = "ID is required";
-    valid = false;
-  }
   if (patient.name == "") {
     newValidationErrors["name"] = "Name is required";
     valid = false;
   }
-  if (patient.phone == 0 || isNaN(patient.phone)) {
-    newValidationErrors["phone"] = "Contact No must be a valid 10-digit number";
+  if (patient.phone.trim() == "") {
+    newValidationErrors["phone"] = "Contact No is required";
     valid = false;
   }
   if (patient.disease == "") {
@@ -73,13 +69,7 @@ const PatientForm: FunctionComponent<PatientFormProps> = ({
 
   const handleChange = (event: ChangeEvent<HTMLInputElement>) => {
     const { name, value, valueAsNumber } = event.target;
-    if (
-      name === "id" ||
-      name === "phone" ||
-      name === "year" ||
-      name === "month" ||
-      name === "date"
-    ) {
+    if (name === "year" || name === "month" || name === "date") {
       setPatient({
         ...patient,
         [name]: valueAsNumber,
@@ -148,20 +138,6 @@ const PatientForm: FunctionComponent<PatientFormProps> = ({
         )}
 
         <form method="post" onSubmit={onSubmit}>
-          <FormControl id="id">
-            <FormLabel>ID</FormLabel>
-            <Input
-              type="number"
-              placeholder="ID"
-              name="id"
-              value={patient.id}
-              onChange={handleChange}
-            />
-            {validationErrors["id"] && (
-              <div style={{ color: "red" }}>{validationErrors["id"]}</div>
-            )}
-          </FormControl>
-
           <FormControl id="name">
             <FormLabel>Name</FormLabel>
             <Input
@@ -179,7 +155,7 @@ const PatientForm: FunctionComponent<PatientFormProps> = ({
           <FormControl id="phone">
             <FormLabel>Contact No</FormLabel>
             <Input
-              type="number"
+              type="tel"
               placeholder="Contact Number"
               name="phone"
               value={patient.phone}
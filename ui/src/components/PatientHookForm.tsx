@@ -66,20 +66,12 @@ const PatientHookForm: FunctionComponent<PatientFormProps> = ({
         )}
 
         <form onSubmit={handleSubmit(handleFormSubmit)}>
-          <FormControl id="id">
-            <FormLabel>ID</FormLabel>
-            <Input
-              type="number"
-              placeholder="ID"
-              {...register("id", {
-                valueAsNumber: true,
-              })}
-              isDisabled={isUpdate}
-            />
-            <span style={{ color: "red", marginTop: "8px" }}>
-              {errors.id && errors.id.message}
-            </span>
-          </FormControl>
+          {isUpdate && (
+            <FormControl id="id">
+              <FormLabel>ID</FormLabel>
+              <Input type="number" value={initialPatient.id} isDisabled />
+            </FormControl>
+          )}
 
           <FormControl id="name">
             <FormLabel>Name</FormLabel>
@@ -100,9 +92,9 @@ const PatientHookForm: FunctionComponent<PatientFormProps> = ({
           <FormControl id="phone">
             <FormLabel>Phone</FormLabel>
             <Input
-              type="number"
+              type="tel"
               placeholder="Your Phone No."
-              {...register("phone", { valueAsNumber: true })}
+              {...register("phone")}
             />
             <span style={{ color: "red", marginTop: "8px" }}>
               {errors.phone && errors.phone.message}
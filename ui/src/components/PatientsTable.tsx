@@ -70,9 +70,7 @@ const PatientsTable: FunctionComponent<PatientsTableProps> = ({
                 <Td>{patient.address}</Td>
                 <Td>{patient.disease}</Td>
                 <Td>{patient.phone}</Td>
-                <Td>
-                  {patient.date}/{patient.month}/{patient.year}
-                </Td>
+                <Td>{patient.dateOfBirth}</Td>
                 <Td>
                   <HStack>
                     <IconButton
@@ -1,3 +1,4 @@
+import { getAllPatients, webSocketUrl } from "@/api";
 import { Patient } from "@/types/patient";
 import { Alert, AlertIcon, AlertTitle, Button } from "@chakra-ui/react";
 import axios from "axios";
@@ -6,6 +7,40 @@ import Loading from "../components/Loading";
 import PatientsTable from "../components/PatientsTable";
 import router from "next/router";
 
+interface Notification {
+  type: string;
+  seq: number;
+  message?: string;
+  stream?: string;
+  patient?: Patient;
+  before?: Patient;
+  patients?: Patient[];
+}
+
+// applyNotification returns the patients after a change notification. A
+// change can arrive after a snapshot that already has it, so versions older
+// than the one held are skipped.
+const applyNotification = (
+  patients: Patient[],
+  notification: Notification
+): Patient[] => {
+  const patient = notification.patient;
+  if (!patient) {
+    return patients;
+  }
+  if (notification.type === "patient.deleted") {
+    return patients.filter((p) => p.id !== patient.id);
+  }
+  const held = patients.find((p) => p.id === patient.id);
+  if (!held) {
+    return [...patients, patient];
+  }
+  if ((held.version ?? 0) > (patient.version ?? 0)) {
+    return patients;
+  }
+  return patients.map((p) => (p.id === patient.id ? patient : p));
+};
+
 interface PatientsState {
   patients: Patient[];
   isLoading: boolean;
@@ -21,31 +56,74 @@ const PatientsPage: FunctionComponent = () => {
   const [messages, setMessages] = useState<string[]>([]);
 
   useEffect(() => {
-    const socket = new WebSocket("ws://localhost:8000/websocket");
-
-    socket.onopen = () => {
-      console.log("WebSocket connection opened");
-    };
-
-    socket.onmessage = (event) => {
-      const notification = JSON.parse(event.data);
-      console.log("WebSocket message received:", notification);
-      setMessages((prev) => [...prev, notification]);
-      setPatientsState({
-        ...patientsState,
-        patients: notification.newPatients,
-      });
-    };
-
-    socket.onerror = (error) => {
-      console.error("WebSocket error:", error);
-    };
+    let socket: WebSocket;
+    let stream: string | undefined;
+    let lastSeq: number | undefined;
+    let unmounted = false;
+    let reconnect: ReturnType<typeof setTimeout> | undefined;
+
+    const connect = () => {
+      // after a drop, ask for the changes missed instead of a new snapshot
+      let url = webSocketUrl;
+      if (stream !== undefined && lastSeq !== undefined) {
+        const separator = url.includes("?") ? "&" : "?";
+        url += `${separator}stream=${encodeURIComponent(stream)}&since=${lastSeq}`;
+      }
+      socket = new WebSocket(url);
+
+      socket.onopen = () => {
+        console.log("WebSocket connection opened");
+      };
+
+      socket.onmessage = (event) => {
+        const notification: Notification = JSON.parse(event.data);
+        console.log("WebSocket message received:", notification);
+        if (notification.type === "snapshot") {
+          stream = notification.stream;
+          lastSeq = notification.seq;
+          setPatientsState((prev) => ({
+            ...prev,
+            patients: notification.patients ?? [],
+          }));
+          return;
+        }
+        if (notification.type === "resync.required") {
+          // the changes missed are gone, so ask for the whole list again
+          lastSeq = notification.seq;
+          socket.send(JSON.stringify({ type: "resync" }));
+          return;
+        }
 
-    socket.onclose = () => {
-      console.log("WebSocket connection closed");
+        if (lastSeq !== undefined && notification.seq > lastSeq + 1) {
+          // some changes were dropped, so ask for the whole list again
+          socket.send(JSON.stringify({ type: "resync" }));
+        }
+        lastSeq = Math.max(lastSeq ?? 0, notification.seq);
+        if (notification.message) {
+          setMessages((prev) => [...prev, notification.message as string]);
+        }
+        setPatientsState((prev) => ({
+          ...prev,
+          patients: applyNotification(prev.patients, notification),
+        }));
+      };
+
+      socket.onerror = (error) => {
+        console.error("WebSocket error:", error);
+      };
+
+      socket.onclose = () => {
+        console.log("WebSocket connection closed");
+        if (!unmounted) {
+          reconnect = setTimeout(connect, 1000);
+        }
+      };
     };
+    connect();
 
     return () => {
+      unmounted = true;
+      clearTimeout(reconnect);
       socket.close();
     };
   }, []);
@@ -60,11 +138,10 @@ const PatientsPage: FunctionComponent = () => {
       isLoading: true,
     });
 
-    axios
-      .get("/api/patients")
-      .then((response) => {
+    getAllPatients()
+      .then((patients) => {
         setPatientsState({
-          patients: response.data,
+          patients: patients,
           isLoading: false,
           error: undefined,
         });
@@ -1,6 +1,6 @@
 import PatientHookForm from "@/components/PatientHookForm";
+import { createPatient } from "@/api";
 import { Patient } from "@/types/patient";
-import axios from "axios";
 import router from "next/router";
 import { FunctionComponent } from "react";
 
@@ -9,7 +9,7 @@ const defaultPatient: Patient = {
   name: "",
   address: "",
   disease: "",
-  phone: 0,
+  phone: "",
   year: 0,
   month: 0,
   date: 0,
@@ -17,7 +17,7 @@ const defaultPatient: Patient = {
 
 const Add: FunctionComponent = () => {
   const handleSubmit = async (patient: Patient) => {
-    await axios.post("/api/patients", patient);
+    await createPatient(patient);
     await router.push("/");
   };
 
@@ -11,7 +11,7 @@ const initialPatient: Patient = {
   name: "",
   address: "",
   disease: "",
-  phone: 0,
+  phone: "",
   year: 0,
   month: 0,
   date: 0,
@@ -1,25 +1,34 @@
-import { min, number, object, refine, size, string } from "superstruct";
+import { min, number, refine, size, string, type } from "superstruct";
 
 export interface Patient {
   id: number;
   name: string;
   address: string;
   disease: string;
-  phone: number;
+  // E.164 as returned by the server; a national number is read in the
+  // server's default region
+  phone: string;
   year: number;
   month: number;
   date: number;
+  // ISO 8601 (YYYY-MM-DD) as returned by the server; the forms still edit
+  // year, month and date, which the server accepts in its place.
+  dateOfBirth?: string | null;
+  // bumped on every change; used to skip stale WebSocket notifications
+  version?: number;
 }
 
-const phoneSchema = refine(number(), "phone", (value) => {
-  if (/^\d{10}$/.test(String(value))) {
+const phoneSchema = refine(string(), "phone", (value) => {
+  if (/^\+?[\d\s()-]{5,}$/.test(value)) {
     return true;
   }
-  return "phone number length should be 10 digits";
+  return "phone should be digits, optionally starting with +";
 });
 
-export const patientSchema = object({
-  id: min(number(), 1),
+// patientSchema validates what a client may send. The id is assigned by the
+// server, so it is not checked, and other fields the server returns are
+// ignored.
+export const patientSchema = type({
   name: string(),
   address: string(),
   disease: string(),